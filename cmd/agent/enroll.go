@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/evergreen-os/device-agent/internal/agent"
+	"github.com/evergreen-os/device-agent/internal/enroll"
+)
+
+// runEnroll implements `agent enroll`, which enrolls the device with a
+// one-time code instead of a pre-shared key baked into the image.
+func runEnroll(args []string) int {
+	fs := flag.NewFlagSet("enroll", flag.ContinueOnError)
+	configPath := fs.String("config", defaultConfigPath, "Path to agent configuration")
+	code := fs.String("code", "", "One-time enrollment code, e.g. ABCD-EFGH")
+	deviceCode := fs.Bool("device-code", false, "Print a URL and code to approve this device from another machine")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if (*code == "") == !*deviceCode {
+		fmt.Fprintln(os.Stderr, "agent enroll: exactly one of --code or --device-code is required")
+		fs.Usage()
+		return 2
+	}
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	manager, err := agent.NewEnrollManager(cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	var cred enroll.Credentials
+	if *deviceCode {
+		cred, err = enrollWithDeviceCode(ctx, manager)
+	} else {
+		cred, _, err = manager.EnrollWithCode(ctx, *code)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "enrollment failed: %v\n", err)
+		return 1
+	}
+	fmt.Printf("enrolled as %s\n", cred.DeviceID)
+	return 0
+}
+
+func enrollWithDeviceCode(ctx context.Context, manager *enroll.Manager) (enroll.Credentials, error) {
+	code, err := manager.RequestDeviceCode(ctx)
+	if err != nil {
+		return enroll.Credentials{}, err
+	}
+	fmt.Printf("To approve this device, visit %s and enter the code %s\n", code.VerificationURI, code.UserCode)
+	if code.VerificationURIComplete != "" {
+		fmt.Printf("or open %s\n", code.VerificationURIComplete)
+	}
+	fmt.Println("Waiting for approval...")
+	cred, _, err := manager.EnrollWithDeviceCode(ctx, code)
+	return cred, err
+}
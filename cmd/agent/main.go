@@ -13,17 +13,23 @@ import (
 	"github.com/evergreen-os/device-agent/internal/config"
 )
 
+const defaultConfigPath = "config/agent.yaml"
+
 func main() {
-	configPath := flag.String("config", "config/agent.yaml", "Path to agent configuration")
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "enroll":
+			os.Exit(runEnroll(os.Args[2:]))
+		case "unenroll":
+			os.Exit(runUnenroll(os.Args[2:]))
+		}
+	}
+	configPath := flag.String("config", defaultConfigPath, "Path to agent configuration")
 	flag.Parse()
 
-	cfg, err := config.Load(*configPath)
+	cfg, err := loadConfig(*configPath)
 	if err != nil {
-		slog.Error("failed to load config", slog.String("error", err.Error()))
-		os.Exit(1)
-	}
-	if err := cfg.Validate(); err != nil {
-		slog.Error("invalid config", slog.String("error", err.Error()))
+		slog.Error("failed to start", slog.String("error", err.Error()))
 		os.Exit(1)
 	}
 	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
@@ -43,3 +49,14 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+func loadConfig(path string) (config.Config, error) {
+	cfg, err := config.Load(path)
+	if err != nil {
+		return config.Config{}, fmt.Errorf("failed to load config: %w", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return config.Config{}, fmt.Errorf("invalid config: %w", err)
+	}
+	return cfg, nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/evergreen-os/device-agent/internal/agent"
+)
+
+// runUnenroll implements `agent unenroll`, which releases the device and
+// removes everything the agent manages. Stop the service before running it.
+func runUnenroll(args []string) int {
+	fs := flag.NewFlagSet("unenroll", flag.ContinueOnError)
+	configPath := fs.String("config", defaultConfigPath, "Path to agent configuration")
+	removeApps := fs.Bool("remove-apps", false, "Uninstall the Flatpaks required by policy")
+	force := fs.Bool("force", false, "Wipe local state even if the backend cannot be notified")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	agentInstance, err := agent.New(ctx, cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to initialise agent: %v\n", err)
+		return 1
+	}
+	report, err := agentInstance.Unenroll(ctx, agent.DecommissionOptions{RemoveApps: *removeApps, Force: *force})
+	for _, event := range report.Events {
+		fmt.Printf("%s %v\n", event.Type, event.Payload)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unenroll failed: %v\n", err)
+		if !report.Notified && !*force {
+			fmt.Fprintln(os.Stderr, "credentials were kept; retry, or pass --force to wipe them anyway")
+		}
+		return 1
+	}
+	if !report.Notified {
+		fmt.Println("warning: the backend was not notified")
+	}
+	fmt.Printf("device %s unenrolled\n", report.DeviceID)
+	return 0
+}
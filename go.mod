@@ -2,11 +2,14 @@ module github.com/evergreen-os/device-agent
 
 go 1.24
 
-require github.com/google/go-attestation v0.5.1
+require (
+	github.com/google/go-attestation v0.5.1
+	github.com/google/go-tpm v0.9.0
+	github.com/google/go-tpm-tools v0.4.2
+)
 
 require (
 	github.com/google/certificate-transparency-go v1.1.2 // indirect
-	github.com/google/go-tpm v0.9.0 // indirect
 	github.com/google/go-tspi v0.3.0 // indirect
 	golang.org/x/crypto v0.13.0 // indirect
 	golang.org/x/sys v0.14.0 // indirect
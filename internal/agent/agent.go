@@ -5,18 +5,26 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/evergreen-os/device-agent/internal/apps"
 	"github.com/evergreen-os/device-agent/internal/attestation"
 	"github.com/evergreen-os/device-agent/internal/browser"
+	"github.com/evergreen-os/device-agent/internal/buildinfo"
 	"github.com/evergreen-os/device-agent/internal/config"
+	"github.com/evergreen-os/device-agent/internal/control"
 	"github.com/evergreen-os/device-agent/internal/enroll"
 	"github.com/evergreen-os/device-agent/internal/events"
+	"github.com/evergreen-os/device-agent/internal/hardware"
 	"github.com/evergreen-os/device-agent/internal/logins"
 	"github.com/evergreen-os/device-agent/internal/network"
 	"github.com/evergreen-os/device-agent/internal/policy"
+	"github.com/evergreen-os/device-agent/internal/secrets"
 	"github.com/evergreen-os/device-agent/internal/security"
 	"github.com/evergreen-os/device-agent/internal/state"
 	"github.com/evergreen-os/device-agent/internal/updates"
@@ -24,6 +32,25 @@ import (
 	"github.com/evergreen-os/device-agent/pkg/api"
 )
 
+// certificateCheckInterval controls how often the device certificate is checked for renewal.
+const certificateCheckInterval = time.Hour
+
+// policyApplyTimeout bounds enforcement of a pulled policy, including app
+// installs that retry over a slow connection.
+const policyApplyTimeout = 4 * time.Hour
+
+// Upload limits applied when the configuration leaves them unset.
+const (
+	defaultMaxBatchSize  = 100
+	defaultMaxBatchBytes = 1 << 20
+)
+
+// Bounds applied to backend-suggested policy poll intervals.
+const (
+	minPolicyPollInterval = 10 * time.Second
+	maxPolicyPollInterval = 24 * time.Hour
+)
+
 // Agent runs the Evergreen device agent lifecycle.
 type Agent struct {
 	cfg    config.Config
@@ -38,8 +65,18 @@ type Agent struct {
 	updatesManager *updates.Manager
 	loginWatcher   *logins.Watcher
 	attestManager  *attestation.Manager
+	hardwareMon    *hardware.Monitor
+	controlServer  *control.Server
+
+	appsManager     *apps.Manager
+	browserManager  *browser.Manager
+	networkManager  *network.Manager
+	securityManager *security.Manager
 
-	credentials enroll.Credentials
+	credMu         sync.RWMutex
+	credentials    enroll.Credentials
+	credGeneration uint64
+	reenrollMu     sync.Mutex
 
 	policyInterval time.Duration
 	stateInterval  time.Duration
@@ -49,32 +86,123 @@ type Agent struct {
 
 	retryBackoff  time.Duration
 	retryMaxDelay time.Duration
+
+	maxBatchSize  int
+	maxBatchBytes int
+
+	suggestedPoll atomic.Int64
+
+	maxClockSkew time.Duration
+	clockSkewed  atomic.Bool
+}
+
+// NewEnrollManager wires an enrollment manager the same way New does, for
+// one-shot commands such as `agent enroll` that run without the full agent.
+func NewEnrollManager(cfg config.Config) (*enroll.Manager, error) {
+	logger := util.ConfigureLogger(cfg.Logging.Level)
+	if err := configureSecrets(cfg); err != nil {
+		return nil, err
+	}
+	client, err := newClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return enroll.NewManager(cfg, client,
+		enroll.WithTPM(newAttestationManager(logger, cfg)),
+		enroll.WithHardwareBaseline(newHardwareMonitor(logger, cfg)),
+	), nil
+}
+
+func newClient(cfg config.Config) (*api.Client, error) {
+	transport, err := transportOptions(cfg.Transport)
+	if err != nil {
+		return nil, fmt.Errorf("configure transport: %w", err)
+	}
+	info := api.AgentInfo{
+		Version:      buildinfo.Version,
+		Commit:       buildinfo.Revision(),
+		BuildDate:    buildinfo.Date,
+		Capabilities: capabilities(cfg.Uploads),
+	}
+	client, err := api.New(cfg.BackendURL,
+		api.WithCompression(cfg.Uploads.Compress),
+		api.WithTransportOptions(transport),
+		api.WithAgentInfo(info),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("init api client: %w", err)
+	}
+	return client, nil
+}
+
+// configureSecrets selects the encryption backend for credential files. It must
+// run before anything reads or writes them.
+func configureSecrets(cfg config.Config) error {
+	store, err := secrets.New(cfg)
+	if err != nil {
+		return fmt.Errorf("configure secrets backend: %w", err)
+	}
+	util.SetSecretStore(store)
+	return nil
+}
+
+func newAttestationManager(logger *slog.Logger, cfg config.Config) *attestation.Manager {
+	akPath := cfg.Enrollment.AttestationKeyPath
+	if akPath == "" {
+		akPath = filepath.Join(filepath.Dir(cfg.DeviceTokenPath), "attestation-key.blob")
+	}
+	return attestation.NewManager(logger, attestation.WithAKPath(akPath))
+}
+
+func newHardwareMonitor(logger *slog.Logger, cfg config.Config) *hardware.Monitor {
+	path := cfg.Enrollment.HardwareFingerprintPath
+	if path == "" {
+		path = filepath.Join(filepath.Dir(cfg.DeviceTokenPath), "hardware-fingerprint.json")
+	}
+	return hardware.NewMonitor(logger, path)
 }
 
 // New constructs a fully wired Agent.
 func New(ctx context.Context, cfg config.Config) (*Agent, error) {
 	logger := util.ConfigureLogger(cfg.Logging.Level)
-	client, err := api.New(cfg.BackendURL)
+	if err := configureSecrets(cfg); err != nil {
+		return nil, err
+	}
+	client, err := newClient(cfg)
 	if err != nil {
-		return nil, fmt.Errorf("init api client: %w", err)
+		return nil, err
 	}
-	enrollManager := enroll.NewManager(cfg, client)
-	appsManager := apps.NewManager(logger)
+	attestManager := newAttestationManager(logger, cfg)
+	hardwareMonitor := newHardwareMonitor(logger, cfg)
+	enrollManager := enroll.NewManager(cfg, client, enroll.WithTPM(attestManager), enroll.WithHardwareBaseline(hardwareMonitor))
+	appsManager := apps.NewManager(logger, filepath.Join(filepath.Dir(cfg.PolicyCachePath), "managed-apps.json"))
 	browserManager := browser.NewManager(logger, "")
-	updatesManager := updates.NewManager(logger)
+	maxClockSkew := cfg.Clock.MaxSkew.Duration
+	if maxClockSkew == 0 {
+		maxClockSkew = updates.DefaultMaxClockSkew
+	}
+	updatesManager := updates.NewManager(logger, updates.WithMaxClockSkew(maxClockSkew))
 	networkManager := network.NewManager(logger, "")
 	securityManager := security.NewManager(logger)
 	verifier, err := policy.NewVerifier(cfg.PolicyPublicKey)
 	if err != nil {
 		return nil, fmt.Errorf("load policy key: %w", err)
 	}
-	policyManager := policy.NewManager(logger, cfg, verifier, appsManager, browserManager, updatesManager, networkManager, securityManager)
+	policyManager := policy.NewManager(logger, cfg, verifier, appsManager, browserManager, updatesManager, networkManager, securityManager,
+		policy.WithHardwareChanges(hardwareMonitor))
 	collector := state.NewCollector(logger, appsManager, updatesManager)
 	queue := events.NewQueue(cfg.EventQueuePath)
 	stateQueue := state.NewQueue(cfg.StateQueuePath)
 	loginWatcher := logins.NewWatcher(logger)
-	attestManager := attestation.NewManager(logger)
-	return &Agent{
+	maxBatchSize := cfg.Uploads.MaxBatchSize
+	if maxBatchSize == 0 {
+		maxBatchSize = defaultMaxBatchSize
+	}
+	maxBatchBytes := cfg.Uploads.MaxBatchBytes
+	if maxBatchBytes == 0 {
+		maxBatchBytes = defaultMaxBatchBytes
+	}
+	a := &Agent{
 		cfg:            cfg,
 		logger:         logger,
 		client:         client,
@@ -86,6 +214,7 @@ func New(ctx context.Context, cfg config.Config) (*Agent, error) {
 		updatesManager: updatesManager,
 		loginWatcher:   loginWatcher,
 		attestManager:  attestManager,
+		hardwareMon:    hardwareMonitor,
 		policyInterval: cfg.Intervals.PolicyPoll.Duration,
 		stateInterval:  cfg.Intervals.StateReport.Duration,
 		eventInterval:  cfg.Intervals.EventFlush.Duration,
@@ -93,36 +222,76 @@ func New(ctx context.Context, cfg config.Config) (*Agent, error) {
 		attestInterval: cfg.Intervals.StateReport.Duration,
 		retryBackoff:   cfg.Intervals.RetryBackoff.Duration,
 		retryMaxDelay:  cfg.Intervals.RetryMaxDelay.Duration,
-	}, nil
+		maxBatchSize:   maxBatchSize,
+		maxBatchBytes:  maxBatchBytes,
+		maxClockSkew:   maxClockSkew,
+
+		appsManager:     appsManager,
+		browserManager:  browserManager,
+		networkManager:  networkManager,
+		securityManager: securityManager,
+	}
+	if cfg.ControlSocket != "" {
+		a.controlServer = control.NewServer(logger, cfg.ControlSocket, a.status)
+	}
+	return a, nil
+}
+
+// status is the document served on the local control socket.
+func (a *Agent) status() any {
+	return struct {
+		Version    string        `json:"version"`
+		Enrollment enroll.Status `json:"enrollment"`
+	}{
+		Version:    buildinfo.Version,
+		Enrollment: a.enrollManager.Status(),
+	}
 }
 
 // Run executes the agent until the context is cancelled.
 func (a *Agent) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if a.controlServer != nil {
+		go func() {
+			if err := a.controlServer.Run(ctx); err != nil {
+				a.logger.Warn("control socket unavailable", slog.String("error", err.Error()))
+			}
+		}()
+	}
+
 	cred, initialPolicy, err := a.enrollManager.EnsureEnrollment(ctx)
+	if errors.Is(err, enroll.ErrDecommissioned) {
+		a.logger.Warn("device was decommissioned; run agent enroll to enroll it again")
+		return nil
+	}
 	if err != nil {
 		return err
 	}
-	a.credentials = cred
-	if initialPolicy.Version != "" {
-		a.logger.Info("applying initial policy", slog.String("version", initialPolicy.Version))
-		if events, err := a.policyManager.Apply(ctx, initialPolicy); err != nil {
-			a.stateCollector.SetLastError(err)
-			a.appendEvents(events)
-			return fmt.Errorf("apply initial policy: %w", err)
-		} else {
-			a.appendEvents(events)
+	if status := a.enrollManager.Status(); !status.ApprovedAt.IsZero() {
+		a.appendEvents([]api.Event{events.NewEvent("enroll.approved", map[string]string{
+			"device_id":     cred.DeviceID,
+			"pending_since": status.PendingSince.UTC().Format(time.RFC3339),
+			"approved_at":   status.ApprovedAt.UTC().Format(time.RFC3339),
+		})})
+	}
+	a.setCredentials(cred)
+	a.installTokenSource(cred)
+	a.installClientCertificate()
+	reenrolled := a.checkHardware(ctx, initialPolicy.Policy.Hardware)
+	if initialPolicy.Version != "" && !reenrolled {
+		if err := a.applyInitialPolicy(ctx, initialPolicy); err != nil {
+			return err
 		}
 	}
+	cred = a.currentCredentials()
 	if err := a.resumeQueuedEvents(); err != nil {
 		a.logger.Warn("failed to load queued events", slog.String("error", err.Error()))
 	}
-	a.logger.Info("agent ready", slog.String("device_id", cred.DeviceID))
-
-	ctx, cancel := context.WithCancel(ctx)
-	defer cancel()
+	a.logger.Info("agent ready", slog.String("device_id", cred.DeviceID), slog.String("version", buildinfo.Version))
 
 	var wg sync.WaitGroup
-	loops := 5
+	loops := 6
 	errCh := make(chan error, loops)
 
 	wg.Add(1)
@@ -155,24 +324,67 @@ func (a *Agent) Run(ctx context.Context) error {
 		errCh <- a.attestationLoop(ctx)
 	}()
 
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		errCh <- a.certificateLoop(ctx)
+	}()
+
 	var runErr error
 	for i := 0; i < loops; i++ {
 		select {
 		case <-ctx.Done():
-			runErr = ctx.Err()
+			if runErr == nil {
+				runErr = ctx.Err()
+			}
 		case err := <-errCh:
-			if err != nil && !errors.Is(err, context.Canceled) {
+			if err != nil && !errors.Is(err, context.Canceled) && (runErr == nil || errors.Is(runErr, context.Canceled)) {
 				runErr = err
 				cancel()
 			}
 		}
 	}
 	wg.Wait()
+	if errors.Is(runErr, api.ErrDecommissioned) {
+		// The loops were stopped by ctx; clean up with a fresh deadline.
+		decommissionCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), decommissionTimeout)
+		defer cancel()
+		if _, err := a.decommission(decommissionCtx, decommissionReasonBackend, DecommissionOptions{Force: true}); err != nil {
+			return fmt.Errorf("decommission: %w", err)
+		}
+		return nil
+	}
 	return runErr
 }
 
+// applyInitialPolicy enforces the enrollment or cached policy at startup.
+// Policies that are blocked or not understood are reported while the agent
+// keeps running, so the backend can see why enforcement stopped and send a
+// policy this build supports.
+func (a *Agent) applyInitialPolicy(ctx context.Context, envelope api.PolicyEnvelope) error {
+	// Enrollment may have measured the clock already; with cached
+	// credentials the backend has not been reached yet, and reboots wait
+	// until it has.
+	a.checkClockSkew()
+	if _, measured := a.client.ClockSkew(); !measured {
+		a.updatesManager.SetClockSkewUnknown()
+	}
+	a.logger.Info("applying initial policy", slog.String("version", envelope.Version))
+	events, err := a.policyManager.Apply(ctx, envelope)
+	a.appendEvents(events)
+	switch {
+	case errors.Is(err, policy.ErrHardwareChanged), errors.Is(err, policy.ErrUnsupportedPolicy):
+		a.logger.Warn("policy enforcement blocked", slog.String("error", err.Error()))
+		a.stateCollector.SetLastError(err)
+	case err != nil:
+		a.stateCollector.SetLastError(err)
+		return fmt.Errorf("apply initial policy: %w", err)
+	}
+	return nil
+}
+
 func (a *Agent) policyLoop(ctx context.Context) error {
-	return a.backoffLoop(ctx, a.policyInterval, func(loopCtx context.Context) error {
+	return a.backoffLoopFunc(ctx, a.currentPolicyInterval, func(loopCtx context.Context) error {
 		if err := a.pullAndApplyPolicy(loopCtx); err != nil {
 			a.logger.Warn("policy sync failed", slog.String("error", err.Error()))
 			a.stateCollector.SetLastError(err)
@@ -190,32 +402,100 @@ func (a *Agent) pullAndApplyPolicy(ctx context.Context) error {
 			version = cached.Version
 		}
 	}
-	ctx, cancel := context.WithTimeout(ctx, a.policyInterval)
+	pullCtx, cancel := context.WithTimeout(ctx, a.policyInterval)
 	defer cancel()
-	envelope, err := a.client.PullPolicy(ctx, a.credentials.DeviceToken, version)
+	cred := a.currentCredentials()
+	generation := a.credentialGeneration()
+	req := api.PullPolicyRequest{CurrentVersion: version, ETag: a.policyManager.ETag()}
+	resp, err := a.client.PullPolicy(pullCtx, cred.DeviceToken, req)
+	a.checkClockSkew()
+	a.setSuggestedPollInterval(resp.PollInterval)
 	if err != nil {
 		if errors.Is(err, api.ErrNotModified) {
 			return nil
 		}
 		return err
 	}
+	envelope := resp.Envelope
+	// Installing a long list of required apps can take far longer than a
+	// poll, so enforcement gets its own budget.
+	applyCtx, cancelApply := context.WithTimeout(ctx, policyApplyTimeout)
+	defer cancelApply()
+	if len(a.hardwareMon.Changes()) > 0 && envelope.Policy.Hardware.Action() == api.HardwareOnChangeReenroll {
+		return a.reenrollForHardware(applyCtx)
+	}
 	a.logger.Info("applying policy", slog.String("version", envelope.Version))
-	events, err := a.policyManager.Apply(ctx, envelope)
+	events, err := a.policyManager.Apply(applyCtx, envelope)
 	a.appendEvents(events)
 	if err != nil {
 		return err
 	}
-	if envelope.DeviceToken != "" && envelope.DeviceToken != a.credentials.DeviceToken {
+	if envelope.DeviceToken != "" && envelope.DeviceToken != cred.DeviceToken {
 		a.logger.Info("rotating device token")
-		a.credentials.DeviceToken = envelope.DeviceToken
+		cred.DeviceToken = envelope.DeviceToken
 	}
-	a.credentials.Version = envelope.Version
-	if err := a.enrollManager.Persist(a.credentials, envelope); err != nil {
+	cred.Version = envelope.Version
+	a.reenrollMu.Lock()
+	defer a.reenrollMu.Unlock()
+	if a.credentialGeneration() != generation {
+		// The device re-enrolled while the policy was applied; its new
+		// credentials must not be overwritten with the old identity.
+		a.logger.Info("credentials replaced during policy application, not persisting")
+		return nil
+	}
+	// The refresh credential may have rotated while the policy was applied.
+	cred.RefreshToken = a.currentCredentials().RefreshToken
+	if err := a.enrollManager.Persist(cred, envelope); err != nil {
 		return fmt.Errorf("persist credentials: %w", err)
 	}
+	a.setCredentials(cred)
+	if err := a.policyManager.SaveETag(resp.ETag); err != nil {
+		a.logger.Warn("failed to persist policy etag", slog.String("error", err.Error()))
+	}
 	return nil
 }
 
+// setSuggestedPollInterval records the backend's preferred policy poll
+// interval, clamped to sane bounds. Zero restores the configured interval.
+func (a *Agent) setSuggestedPollInterval(interval time.Duration) {
+	if interval > 0 {
+		interval = max(interval, minPolicyPollInterval)
+		interval = min(interval, maxPolicyPollInterval)
+	}
+	a.suggestedPoll.Store(int64(interval))
+}
+
+func (a *Agent) currentPolicyInterval() time.Duration {
+	if suggested := time.Duration(a.suggestedPoll.Load()); suggested > 0 {
+		return suggested
+	}
+	return a.policyInterval
+}
+
+// checkClockSkew propagates the clock offset measured by the API client and
+// records a time.skew event whenever it crosses the configured limit.
+func (a *Agent) checkClockSkew() {
+	skew, ok := a.client.ClockSkew()
+	if !ok {
+		return
+	}
+	a.stateCollector.SetClockSkew(skew)
+	a.updatesManager.SetClockSkew(skew)
+	skewed := skew.Abs() > a.maxClockSkew
+	if a.clockSkewed.Swap(skewed) == skewed {
+		return
+	}
+	status := "resolved"
+	if skewed {
+		status = "detected"
+		a.logger.Warn("local clock disagrees with backend", slog.Duration("skew", skew))
+	}
+	a.appendEvents([]api.Event{events.NewEvent("time.skew", map[string]string{
+		"status":       status,
+		"skew_seconds": strconv.FormatFloat(skew.Seconds(), 'f', 0, 64),
+	})})
+}
+
 func (a *Agent) stateLoop(ctx context.Context) error {
 	return a.backoffLoop(ctx, a.stateInterval, func(loopCtx context.Context) error {
 		if events, err := a.updatesManager.EnsureRollback(loopCtx); err != nil {
@@ -226,6 +506,7 @@ func (a *Agent) stateLoop(ctx context.Context) error {
 		} else {
 			a.appendEvents(events)
 		}
+		a.updateApps(loopCtx)
 		if err := a.reportState(loopCtx); err != nil {
 			a.logger.Warn("state report failed", slog.String("error", err.Error()))
 			a.stateCollector.SetLastError(err)
@@ -236,46 +517,92 @@ func (a *Agent) stateLoop(ctx context.Context) error {
 	})
 }
 
+// updateApps installs the app updates the apps policy allows and records
+// the outstanding ones for the next state report. Failures are reported as
+// events rather than holding back the state report.
+func (a *Agent) updateApps(ctx context.Context) {
+	result, err := a.appsManager.Update(ctx)
+	a.appendEvents(result.Events)
+	if err != nil {
+		a.logger.Warn("app update check failed", slog.String("error", err.Error()))
+		return
+	}
+	a.stateCollector.SetAppUpdates(result.Available)
+}
+
 func (a *Agent) reportState(ctx context.Context) error {
+	a.checkClockSkew()
 	snapshot, err := a.stateCollector.Snapshot(ctx)
 	if err != nil {
 		return err
 	}
+	cred := a.currentCredentials()
 	if a.stateQueue != nil {
 		if err := a.stateQueue.Append(snapshot); err != nil {
 			return fmt.Errorf("persist state snapshot: %w", err)
 		}
-		for {
-			pending, err := a.stateQueue.Load()
-			if err != nil {
-				return err
-			}
-			if len(pending) == 0 {
-				break
-			}
-			current := pending[0]
-			req := api.ReportStateRequest{DeviceID: a.credentials.DeviceID, State: current}
+		pending, err := a.stateQueue.Load()
+		if err != nil {
+			return err
+		}
+		if features, ok := a.client.ServerFeatures(); ok && !features.Has(api.FeatureStateBatch) {
+			return a.reportStateIndividually(ctx, cred, pending)
+		}
+		for _, batch := range api.SplitBatches(pending, a.maxBatchSize, a.maxBatchBytes) {
+			req := api.ReportStateBatchRequest{DeviceID: cred.DeviceID, States: batch}
 			loopCtx, cancel := context.WithTimeout(ctx, a.stateInterval)
-			err = a.client.ReportState(loopCtx, a.credentials.DeviceToken, req)
+			err = a.client.ReportStateBatch(loopCtx, cred.DeviceToken, req)
 			cancel()
 			if err != nil {
 				return err
 			}
-			if err := a.stateQueue.Replace(pending[1:]); err != nil {
+			if err := a.stateQueue.Discard(len(batch)); err != nil {
 				return err
 			}
 		}
 		return nil
 	}
-	req := api.ReportStateRequest{DeviceID: a.credentials.DeviceID, State: snapshot}
+	req := api.ReportStateRequest{DeviceID: cred.DeviceID, State: snapshot}
 	loopCtx, cancel := context.WithTimeout(ctx, a.stateInterval)
 	defer cancel()
-	if err := a.client.ReportState(loopCtx, a.credentials.DeviceToken, req); err != nil {
+	if err := a.client.ReportState(loopCtx, cred.DeviceToken, req); err != nil {
 		return err
 	}
 	return nil
 }
 
+// reportStateIndividually drains queued snapshots one request at a time for
+// backends without the batched state endpoint.
+func (a *Agent) reportStateIndividually(ctx context.Context, cred enroll.Credentials, pending []api.DeviceState) error {
+	for _, snapshot := range pending {
+		req := api.ReportStateRequest{DeviceID: cred.DeviceID, State: snapshot}
+		loopCtx, cancel := context.WithTimeout(ctx, a.stateInterval)
+		err := a.client.ReportState(loopCtx, cred.DeviceToken, req)
+		cancel()
+		if err != nil {
+			return err
+		}
+		if err := a.stateQueue.Discard(1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// capabilities lists the policy sections and protocol features this agent
+// supports, announced to the backend on enrollment and every request. Gzip is
+// only announced when uploads are configured to be compressed.
+func capabilities(uploads config.Uploads) []string {
+	caps := []string{api.FeatureStateBatch, "conditional_policy", "token_refresh", "client_certificate"}
+	if uploads.Compress {
+		caps = append(caps, api.FeatureGzip)
+	}
+	for _, section := range api.PolicySections {
+		caps = append(caps, "policy."+section)
+	}
+	return caps
+}
+
 func (a *Agent) eventLoop(ctx context.Context) error {
 	return a.backoffLoop(ctx, a.eventInterval, func(loopCtx context.Context) error {
 		if err := a.flushEvents(loopCtx); err != nil {
@@ -303,7 +630,8 @@ func (a *Agent) attestationLoop(ctx context.Context) error {
 		if a.attestManager == nil {
 			return nil
 		}
-		events, err := a.attestManager.Attest(loopCtx, a.client, a.credentials.DeviceToken, a.credentials.DeviceID)
+		cred := a.currentCredentials()
+		events, err := a.attestManager.Attest(loopCtx, a.client, cred.DeviceToken, cred.DeviceID)
 		if err != nil {
 			a.logger.Warn("attestation failed", slog.String("error", err.Error()))
 			a.appendEvents(events)
@@ -314,6 +642,179 @@ func (a *Agent) attestationLoop(ctx context.Context) error {
 	})
 }
 
+func (a *Agent) certificateLoop(ctx context.Context) error {
+	return a.backoffLoop(ctx, certificateCheckInterval, a.renewCertificate)
+}
+
+// renewCertificate renews the device certificate when it is close to expiry.
+// Devices whose backend never issued a certificate are left without one.
+func (a *Agent) renewCertificate(ctx context.Context) error {
+	cert, err := a.enrollManager.ClientCertificate()
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		a.logger.Warn("failed to load device certificate", slog.String("error", err.Error()))
+	}
+	if !enroll.NeedsRenewal(cert, time.Now()) {
+		return nil
+	}
+	renewCtx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	renewed, err := a.enrollManager.RenewCertificate(renewCtx, a.currentCredentials())
+	if err != nil {
+		a.logger.Warn("certificate renewal failed", slog.String("error", err.Error()))
+		a.appendEvents([]api.Event{events.NewEvent("identity.certificate.failure", map[string]string{"error": err.Error()})})
+		return err
+	}
+	a.client.SetClientCertificate(renewed)
+	a.logger.Info("renewed device certificate", slog.Time("not_after", renewed.Leaf.NotAfter))
+	a.appendEvents([]api.Event{events.NewEvent("identity.certificate.renewed", map[string]string{"not_after": renewed.Leaf.NotAfter.UTC().Format(time.RFC3339)})})
+	return nil
+}
+
+func (a *Agent) installClientCertificate() {
+	cert, err := a.enrollManager.ClientCertificate()
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			a.logger.Warn("failed to load device certificate", slog.String("error", err.Error()))
+		}
+		return
+	}
+	a.client.SetClientCertificate(cert)
+}
+
+// installTokenSource switches the client to short-lived access tokens when the
+// backend issued a refresh credential.
+func (a *Agent) installTokenSource(cred enroll.Credentials) {
+	if cred.RefreshToken == "" {
+		a.client.SetTokenSource(nil)
+		return
+	}
+	a.client.SetTokenSource(api.NewRefreshTokenSource(a.client, cred.DeviceID, cred.RefreshToken, a.rotateRefreshToken))
+}
+
+// rotateRefreshToken records a refresh credential rotated by the backend. It
+// does not bump the credential generation because the device identity is
+// unchanged. A failed write is retried on the next token request.
+func (a *Agent) rotateRefreshToken(refreshToken string) error {
+	a.credMu.Lock()
+	a.credentials.RefreshToken = refreshToken
+	a.credMu.Unlock()
+	if err := a.enrollManager.UpdateRefreshToken(refreshToken); err != nil {
+		a.logger.Warn("failed to persist rotated refresh token", slog.String("error", err.Error()))
+		a.stateCollector.SetLastError(fmt.Errorf("persist rotated refresh token: %w", err))
+		return err
+	}
+	a.logger.Info("rotated refresh token")
+	return nil
+}
+
+func (a *Agent) currentCredentials() enroll.Credentials {
+	a.credMu.RLock()
+	defer a.credMu.RUnlock()
+	return a.credentials
+}
+
+func (a *Agent) credentialGeneration() uint64 {
+	a.credMu.RLock()
+	defer a.credMu.RUnlock()
+	return a.credGeneration
+}
+
+// setCredentials installs cred. The generation only advances when the
+// identity changes, so calls made with unchanged credentials can still
+// trigger recovery.
+func (a *Agent) setCredentials(cred enroll.Credentials) {
+	a.credMu.Lock()
+	defer a.credMu.Unlock()
+	if cred.DeviceID != a.credentials.DeviceID || cred.DeviceToken != a.credentials.DeviceToken {
+		a.credGeneration++
+	}
+	a.credentials = cred
+}
+
+// recoverCredentials re-enrolls the device after the backend rejected its
+// credentials. generation identifies the credentials used by the failed call
+// so concurrent loops only trigger a single re-enrollment.
+func (a *Agent) recoverCredentials(ctx context.Context, generation uint64) error {
+	a.reenrollMu.Lock()
+	defer a.reenrollMu.Unlock()
+	if a.credentialGeneration() != generation {
+		return nil
+	}
+	a.logger.Warn("backend rejected device credentials, re-enrolling", slog.String("device_id", a.currentCredentials().DeviceID))
+	return a.reenrollLocked(ctx, "credentials_rejected")
+}
+
+// checkHardware compares the hardware with the fingerprint recorded at
+// enrollment and reports changes. It re-enrolls when the policy asks for it
+// and reports whether it did.
+func (a *Agent) checkHardware(ctx context.Context, hardwarePolicy *api.HardwarePolicy) bool {
+	events, err := a.hardwareMon.Check()
+	a.appendEvents(events)
+	if err != nil {
+		a.logger.Warn("hardware check failed", slog.String("error", err.Error()))
+		return false
+	}
+	changes := a.hardwareMon.Changes()
+	a.stateCollector.SetHardwareChanges(changes)
+	if len(changes) == 0 || hardwarePolicy.Action() != api.HardwareOnChangeReenroll {
+		return false
+	}
+	if err := a.reenrollForHardware(ctx); err != nil {
+		a.logger.Warn("re-enrollment after hardware change failed", slog.String("error", err.Error()))
+		return false
+	}
+	return true
+}
+
+func (a *Agent) reenrollForHardware(ctx context.Context) error {
+	a.reenrollMu.Lock()
+	defer a.reenrollMu.Unlock()
+	a.logger.Warn("hardware changed since enrollment, re-enrolling", slog.String("device_id", a.currentCredentials().DeviceID))
+	if err := a.reenrollLocked(ctx, "hardware_changed"); err != nil {
+		return err
+	}
+	// Enrollment recorded the new hardware as the baseline.
+	a.stateCollector.SetHardwareChanges(a.hardwareMon.Changes())
+	return nil
+}
+
+// reenrollLocked archives the current credentials, enrolls again and applies
+// the policy issued with the new identity. reenrollMu must be held.
+func (a *Agent) reenrollLocked(ctx context.Context, reason string) error {
+	previous := a.currentCredentials()
+	// The old refresh credential is useless now; dropping it lets
+	// enrollment calls authenticate with the newly issued device token.
+	a.client.SetTokenSource(nil)
+	cred, policy, err := a.enrollManager.Reenroll(ctx)
+	if err != nil {
+		// The previous credentials are kept until enrollment succeeds.
+		a.installTokenSource(a.currentCredentials())
+		if !errors.Is(err, enroll.ErrReenrollThrottled) {
+			a.appendEvents([]api.Event{events.NewEvent("enroll.reenroll.failure", map[string]string{"error": err.Error()})})
+		}
+		return fmt.Errorf("re-enroll: %w", err)
+	}
+	a.setCredentials(cred)
+	a.installTokenSource(cred)
+	a.installClientCertificate()
+	a.appendEvents([]api.Event{events.NewEvent("enroll.reenrolled", map[string]string{
+		"device_id":          cred.DeviceID,
+		"previous_device_id": previous.DeviceID,
+		"reason":             reason,
+	})})
+	if policy.Version != "" {
+		applied, err := a.policyManager.Apply(ctx, policy)
+		a.appendEvents(applied)
+		if err != nil {
+			return fmt.Errorf("apply policy after re-enrollment: %w", err)
+		}
+	}
+	return nil
+}
+
 func (a *Agent) appendEvents(events []api.Event) {
 	if len(events) == 0 {
 		return
@@ -336,22 +837,32 @@ func (a *Agent) flushEvents(ctx context.Context) error {
 	if len(pending) == 0 {
 		return nil
 	}
-	req := api.ReportEventsRequest{
-		DeviceID: a.credentials.DeviceID,
-		Events:   pending,
-	}
-	ctx, cancel := context.WithTimeout(ctx, a.eventInterval)
-	defer cancel()
-	if err := a.client.ReportEvents(ctx, a.credentials.DeviceToken, req); err != nil {
-		return err
+	cred := a.currentCredentials()
+	for _, batch := range api.SplitBatches(pending, a.maxBatchSize, a.maxBatchBytes) {
+		req := api.ReportEventsRequest{
+			DeviceID: cred.DeviceID,
+			Events:   batch,
+		}
+		batchCtx, cancel := context.WithTimeout(ctx, a.eventInterval)
+		err := a.client.ReportEvents(batchCtx, cred.DeviceToken, req)
+		cancel()
+		if err != nil {
+			return err
+		}
+		if err := a.eventQueue.Discard(len(batch)); err != nil {
+			return err
+		}
 	}
-	return a.eventQueue.Replace([]api.Event{})
+	return nil
 }
 
 func (a *Agent) backoffLoop(ctx context.Context, interval time.Duration, work func(context.Context) error) error {
-	if interval <= 0 {
-		interval = time.Second
-	}
+	return a.backoffLoopFunc(ctx, func() time.Duration { return interval }, work)
+}
+
+// backoffLoopFunc is like backoffLoop but re-evaluates the interval after every
+// successful iteration.
+func (a *Agent) backoffLoopFunc(ctx context.Context, intervalFn func() time.Duration, work func(context.Context) error) error {
 	baseBackoff := a.retryBackoff
 	if baseBackoff <= 0 {
 		baseBackoff = time.Second
@@ -368,7 +879,18 @@ func (a *Agent) backoffLoop(ctx context.Context, interval time.Duration, work fu
 				return err
 			}
 		}
+		generation := a.credentialGeneration()
 		err := work(ctx)
+		if errors.Is(err, api.ErrDecommissioned) {
+			return err
+		}
+		if errors.Is(err, api.ErrUnauthorized) {
+			if rerr := a.recoverCredentials(ctx, generation); rerr != nil {
+				a.logger.Warn("credential recovery failed", slog.String("error", rerr.Error()))
+			} else {
+				err = nil
+			}
+		}
 		if err != nil {
 			if errors.Is(err, context.Canceled) {
 				return err
@@ -382,7 +904,10 @@ func (a *Agent) backoffLoop(ctx context.Context, interval time.Duration, work fu
 			}
 			continue
 		}
-		wait = interval
+		wait = intervalFn()
+		if wait <= 0 {
+			wait = time.Second
+		}
 		delay = baseBackoff
 	}
 }
@@ -0,0 +1,526 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/evergreen-os/device-agent/internal/browser"
+	"github.com/evergreen-os/device-agent/internal/config"
+	"github.com/evergreen-os/device-agent/internal/enroll"
+	"github.com/evergreen-os/device-agent/internal/events"
+	"github.com/evergreen-os/device-agent/internal/network"
+	"github.com/evergreen-os/device-agent/internal/policy"
+	"github.com/evergreen-os/device-agent/internal/security"
+	"github.com/evergreen-os/device-agent/internal/util"
+	"github.com/evergreen-os/device-agent/pkg/api"
+	"github.com/evergreen-os/device-agent/pkg/api/apitest"
+)
+
+func newTestAgent(t *testing.T, server *apitest.Server, mutate func(*config.Config)) *Agent {
+	t.Helper()
+	dir := t.TempDir()
+	keyPath := filepath.Join(dir, "policy.pem")
+	if err := os.WriteFile(keyPath, server.PublicKeyPEM(), 0o600); err != nil {
+		t.Fatalf("write policy key: %v", err)
+	}
+	cfg := config.Config{
+		BackendURL:      server.URL,
+		DeviceTokenPath: filepath.Join(dir, "secrets.json"),
+		PolicyCachePath: filepath.Join(dir, "policy.json"),
+		EventQueuePath:  filepath.Join(dir, "events.json"),
+		StateQueuePath:  filepath.Join(dir, "state.json"),
+		PolicyPublicKey: keyPath,
+	}
+	cfg.Intervals.PolicyPoll.Duration = 5 * time.Second
+	cfg.Intervals.StateReport.Duration = 5 * time.Second
+	cfg.Intervals.EventFlush.Duration = 5 * time.Second
+	cfg.Logging.Level = "error"
+	if mutate != nil {
+		mutate(&cfg)
+	}
+	a, err := New(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("new agent: %v", err)
+	}
+	cred, _, err := a.enrollManager.EnsureEnrollment(context.Background())
+	if err != nil {
+		t.Fatalf("enroll: %v", err)
+	}
+	a.setCredentials(cred)
+	a.installTokenSource(cred)
+	a.installClientCertificate()
+	return a
+}
+
+func TestAgentUploadsQueuedStateInBatches(t *testing.T) {
+	server := apitest.NewServer(t)
+	a := newTestAgent(t, server, func(cfg *config.Config) {
+		cfg.Uploads.Compress = true
+		cfg.Uploads.MaxBatchSize = 2
+	})
+	for i := 0; i < 2; i++ {
+		if err := a.stateQueue.Append(api.DeviceState{UpdateStatus: "queued"}); err != nil {
+			t.Fatalf("queue state: %v", err)
+		}
+	}
+
+	server.Fail(apitest.EndpointState, apitest.Failure{Status: 503})
+	if err := a.reportState(context.Background()); err == nil {
+		t.Fatalf("expected scripted outage to fail the report")
+	}
+	if pending, _ := a.stateQueue.Load(); len(pending) != 3 {
+		t.Fatalf("expected snapshots to stay queued during outage, got %d", len(pending))
+	}
+
+	if err := a.reportState(context.Background()); err != nil {
+		t.Fatalf("report state: %v", err)
+	}
+	if got := server.States(); len(got) != 4 {
+		t.Fatalf("expected four uploaded snapshots, got %d", len(got))
+	}
+	if got := server.StateRequests(); got != 2 {
+		t.Fatalf("expected two batched requests, got %d", got)
+	}
+	if pending, _ := a.stateQueue.Load(); len(pending) != 0 {
+		t.Fatalf("expected queue to drain, got %d", len(pending))
+	}
+}
+
+func TestAgentReenrollsAfterCredentialsRevoked(t *testing.T) {
+	server := apitest.NewServer(t)
+	a := newTestAgent(t, server, nil)
+	previous := a.currentCredentials()
+	a.appendEvents([]api.Event{events.NewEvent("test.event", nil)})
+
+	server.RevokeTokens()
+	generation := a.credentialGeneration()
+	err := a.flushEvents(context.Background())
+	if !errors.Is(err, api.ErrUnauthorized) {
+		t.Fatalf("expected unauthorized after revocation, got %v", err)
+	}
+	if err := a.recoverCredentials(context.Background(), generation); err != nil {
+		t.Fatalf("recover credentials: %v", err)
+	}
+	current := a.currentCredentials()
+	if current.DeviceID == previous.DeviceID {
+		t.Fatalf("expected a new device identity after re-enrollment")
+	}
+	if err := a.flushEvents(context.Background()); err != nil {
+		t.Fatalf("flush after re-enrollment: %v", err)
+	}
+
+	var reenrolled bool
+	for _, event := range server.Events() {
+		if event.Type == "enroll.reenrolled" {
+			reenrolled = true
+		}
+	}
+	if !reenrolled {
+		t.Fatalf("expected enroll.reenrolled event to be uploaded, got %+v", server.Events())
+	}
+	if got := len(server.Enrollments()); got != 2 {
+		t.Fatalf("expected two enrollments, got %d", got)
+	}
+}
+
+func TestAgentHonoursPolicyNotModified(t *testing.T) {
+	server := apitest.NewServer(t)
+	server.SetPollInterval(time.Minute)
+	a := newTestAgent(t, server, nil)
+
+	server.Fail(apitest.EndpointPolicy, apitest.Failure{Status: 304})
+	if err := a.pullAndApplyPolicy(context.Background()); err != nil {
+		t.Fatalf("pull policy: %v", err)
+	}
+	if got := a.currentPolicyInterval(); got != 5*time.Second {
+		t.Fatalf("expected configured interval without a suggestion, got %v", got)
+	}
+	if err := a.pullAndApplyPolicy(context.Background()); err != nil {
+		t.Fatalf("pull policy: %v", err)
+	}
+	if got := a.currentPolicyInterval(); got != time.Minute {
+		t.Fatalf("expected backend suggested interval, got %v", got)
+	}
+}
+
+func TestAgentPersistsRotatedRefreshTokens(t *testing.T) {
+	server := apitest.NewServer(t)
+	server.EnableRefreshTokens(time.Minute, true)
+	a := newTestAgent(t, server, nil)
+	enrolled := a.currentCredentials()
+	if enrolled.RefreshToken == "" {
+		t.Fatalf("expected enrollment to issue a refresh token")
+	}
+
+	a.appendEvents([]api.Event{events.NewEvent("test.event", nil)})
+	if err := a.flushEvents(context.Background()); err != nil {
+		t.Fatalf("flush events: %v", err)
+	}
+	server.ExpireAccessTokens()
+	a.appendEvents([]api.Event{events.NewEvent("test.event", nil)})
+	if err := a.flushEvents(context.Background()); err != nil {
+		t.Fatalf("flush events after access token expiry: %v", err)
+	}
+	if got := server.TokenRefreshes(); got != 2 {
+		t.Fatalf("expected two token exchanges, got %d", got)
+	}
+
+	current := a.currentCredentials()
+	if current.RefreshToken == enrolled.RefreshToken {
+		t.Fatalf("expected refresh token to rotate")
+	}
+	if current.DeviceID != enrolled.DeviceID {
+		t.Fatalf("rotation must not change the device identity")
+	}
+	stored, _, err := a.enrollManager.EnsureEnrollment(context.Background())
+	if err != nil {
+		t.Fatalf("load stored credentials: %v", err)
+	}
+	if stored.RefreshToken != current.RefreshToken {
+		t.Fatalf("expected rotated refresh token to be persisted, got %q want %q", stored.RefreshToken, current.RefreshToken)
+	}
+}
+
+func TestAgentReportsClockSkew(t *testing.T) {
+	server := apitest.NewServer(t)
+	a := newTestAgent(t, server, nil)
+
+	server.SetClockOffset(3 * time.Hour)
+	if err := a.reportState(context.Background()); err != nil {
+		t.Fatalf("report state: %v", err)
+	}
+	if err := a.reportState(context.Background()); err != nil {
+		t.Fatalf("report state: %v", err)
+	}
+	states := server.States()
+	if got := states[len(states)-1].ClockSkewSeconds; got < 3*3600-5 || got > 3*3600+5 {
+		t.Fatalf("expected roughly three hours of skew in state, got %v", got)
+	}
+	server.SetClockOffset(0)
+	if err := a.reportState(context.Background()); err != nil {
+		t.Fatalf("report state: %v", err)
+	}
+	if err := a.reportState(context.Background()); err != nil {
+		t.Fatalf("report state: %v", err)
+	}
+	if err := a.flushEvents(context.Background()); err != nil {
+		t.Fatalf("flush events: %v", err)
+	}
+	var statuses []string
+	for _, event := range server.Events() {
+		if event.Type == "time.skew" {
+			payload := event.Payload.(map[string]any)
+			statuses = append(statuses, payload["status"].(string))
+		}
+	}
+	if len(statuses) != 2 || statuses[0] != "detected" || statuses[1] != "resolved" {
+		t.Fatalf("expected one detected and one resolved time.skew event, got %v", statuses)
+	}
+}
+
+func TestAgentNegotiatesCapabilities(t *testing.T) {
+	server := apitest.NewServer(t)
+	server.SetFeatures()
+	a := newTestAgent(t, server, nil)
+	if got := server.Enrollments()[0].Agent; got == nil || len(got.Capabilities) == 0 {
+		t.Fatalf("expected agent info in enrollment, got %+v", got)
+	}
+	if err := a.stateQueue.Append(api.DeviceState{UpdateStatus: "queued"}); err != nil {
+		t.Fatalf("queue state: %v", err)
+	}
+	if err := a.reportState(context.Background()); err != nil {
+		t.Fatalf("report state without batch support: %v", err)
+	}
+	if got := server.StateRequests(); got != 2 {
+		t.Fatalf("expected one request per snapshot, got %d", got)
+	}
+	announced := server.AgentCapabilities()
+	if !slices.Contains(announced, "policy.apps") {
+		t.Fatalf("expected policy sections in announced capabilities, got %v", announced)
+	}
+	if slices.Contains(announced, api.FeatureGzip) {
+		t.Fatalf("expected gzip not to be announced without compression, got %v", announced)
+	}
+	if !slices.Contains(capabilities(config.Uploads{Compress: true}), api.FeatureGzip) {
+		t.Fatalf("expected gzip to be announced with compression")
+	}
+}
+
+func TestAgentDecommissionedByBackend(t *testing.T) {
+	server := apitest.NewServer(t)
+	a := newTestAgent(t, server, nil)
+	dir := t.TempDir()
+	a.browserManager = browser.NewManager(a.logger, filepath.Join(dir, "chromium", "evergreen.json"))
+	a.networkManager = network.NewManager(a.logger, filepath.Join(dir, "connections"))
+	a.securityManager = security.NewManager(a.logger,
+		security.WithSSHConfigPath(filepath.Join(dir, "evergreen.conf")),
+		security.WithUSBGuardRulesPath(filepath.Join(dir, "rules.conf")),
+	)
+	if _, err := a.browserManager.Apply(api.BrowserPolicy{Homepage: "https://example.com"}); err != nil {
+		t.Fatalf("write browser policy: %v", err)
+	}
+	if _, err := a.networkManager.Apply(api.NetworkPolicy{WiFi: []api.WiFiNetwork{{SSID: "office"}}}); err != nil {
+		t.Fatalf("write network profile: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "evergreen.conf"), []byte("PermitRootLogin no\n"), 0o644); err != nil {
+		t.Fatalf("write ssh config: %v", err)
+	}
+	a.appendEvents([]api.Event{events.NewEvent("test.event", nil)})
+	cred := a.currentCredentials()
+
+	server.Decommission(cred.DeviceID)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := a.Run(ctx); err != nil {
+		t.Fatalf("expected clean exit after decommission, got %v", err)
+	}
+
+	reports := server.Unenrollments()
+	if len(reports) != 1 || reports[0].DeviceID != cred.DeviceID || reports[0].Reason != decommissionReasonBackend {
+		t.Fatalf("expected one final report for %s, got %+v", cred.DeviceID, reports)
+	}
+	var types []string
+	for _, event := range reports[0].Events {
+		types = append(types, event.Type)
+	}
+	for _, want := range []string{"test.event", "browser.policy.removed", "network.profiles.removed", "security.config.removed", "device.decommissioned"} {
+		if !slices.Contains(types, want) {
+			t.Fatalf("expected %s in final report, got %v", want, types)
+		}
+	}
+	for _, path := range []string{a.cfg.DeviceTokenPath, a.cfg.PolicyCachePath, a.cfg.EventQueuePath, a.cfg.StateQueuePath, filepath.Join(dir, "evergreen.conf"), filepath.Join(dir, "chromium", "evergreen.json")} {
+		if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("expected %s to be removed, got %v", path, err)
+		}
+	}
+	if entries, _ := os.ReadDir(filepath.Join(dir, "connections")); len(entries) != 0 {
+		t.Fatalf("expected network profiles to be removed, got %d", len(entries))
+	}
+	if _, _, err := a.enrollManager.EnsureEnrollment(context.Background()); !errors.Is(err, enroll.ErrDecommissioned) {
+		t.Fatalf("expected automatic enrollment to stay disabled, got %v", err)
+	}
+}
+
+func TestAgentUnenrollKeepsCredentialsWhenBackendUnreachable(t *testing.T) {
+	server := apitest.NewServer(t)
+	a := newTestAgent(t, server, nil)
+	dir := t.TempDir()
+	browserPolicy := filepath.Join(dir, "chromium", "evergreen.json")
+	sshConfig := filepath.Join(dir, "evergreen.conf")
+	a.browserManager = browser.NewManager(a.logger, browserPolicy)
+	a.networkManager = network.NewManager(a.logger, t.TempDir())
+	a.securityManager = security.NewManager(a.logger,
+		security.WithSSHConfigPath(sshConfig),
+		security.WithUSBGuardRulesPath(filepath.Join(dir, "rules.conf")),
+	)
+	if _, err := a.browserManager.Apply(api.BrowserPolicy{Homepage: "https://example.com"}); err != nil {
+		t.Fatalf("write browser policy: %v", err)
+	}
+	if err := os.WriteFile(sshConfig, []byte("PermitRootLogin no\n"), 0o644); err != nil {
+		t.Fatalf("write ssh config: %v", err)
+	}
+
+	server.Fail(apitest.EndpointUnenroll, apitest.Failure{Status: 503})
+	if _, err := a.Unenroll(context.Background(), DecommissionOptions{}); err == nil {
+		t.Fatalf("expected unenroll to fail while the backend is unavailable")
+	}
+	for _, path := range []string{a.cfg.DeviceTokenPath, browserPolicy, sshConfig} {
+		if _, err := os.Stat(path); err != nil {
+			t.Fatalf("expected %s to be kept for a retry: %v", path, err)
+		}
+	}
+	report, err := a.Unenroll(context.Background(), DecommissionOptions{})
+	if err != nil {
+		t.Fatalf("unenroll: %v", err)
+	}
+	if !report.Notified || report.Reason != decommissionReasonUnenroll {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	// The removal results follow the final report.
+	reports := server.Unenrollments()
+	if len(reports) != 2 || reports[0].State == nil ||
+		!slices.ContainsFunc(reports[1].Events, func(event api.Event) bool { return event.Type == "browser.policy.removed" }) {
+		t.Fatalf("unexpected reports %+v", reports)
+	}
+	if _, err := os.Stat(browserPolicy); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected the browser policy to be removed, got %v", err)
+	}
+	if _, err := os.Stat(a.cfg.DeviceTokenPath); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected credentials to be wiped, got %v", err)
+	}
+	if _, err := a.Unenroll(context.Background(), DecommissionOptions{}); !errors.Is(err, ErrNotEnrolled) {
+		t.Fatalf("expected second unenroll to report not enrolled, got %v", err)
+	}
+}
+
+func TestAgentReenrollsAfterHardwareChange(t *testing.T) {
+	server := apitest.NewServer(t)
+	a := newTestAgent(t, server, nil)
+	previous := a.currentCredentials()
+	// Pretend the device enrolled on a different motherboard.
+	facts, err := util.CollectHardwareFacts()
+	if err != nil {
+		t.Fatalf("collect hardware facts: %v", err)
+	}
+	facts.SystemUUID = "enrolled-board"
+	if err := a.hardwareMon.Record(facts); err != nil {
+		t.Fatalf("record fingerprint: %v", err)
+	}
+
+	if a.checkHardware(context.Background(), nil) {
+		t.Fatalf("expected the default policy to only alert")
+	}
+	snapshot, err := a.stateCollector.Snapshot(context.Background())
+	if err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+	if change, ok := snapshot.HardwareChanges["system_uuid"]; !ok || change.Previous != "enrolled-board" {
+		t.Fatalf("expected the change in state reports, got %+v", snapshot.HardwareChanges)
+	}
+
+	if !a.checkHardware(context.Background(), &api.HardwarePolicy{OnChange: api.HardwareOnChangeReenroll}) {
+		t.Fatalf("expected re-enrollment after hardware change")
+	}
+	if a.currentCredentials().DeviceID == previous.DeviceID || len(server.Enrollments()) != 2 {
+		t.Fatalf("expected a new device identity")
+	}
+	if len(a.hardwareMon.Changes()) != 0 {
+		t.Fatalf("expected re-enrollment to record the new hardware, got %+v", a.hardwareMon.Changes())
+	}
+	queued, err := a.eventQueue.Load()
+	if err != nil {
+		t.Fatalf("load events: %v", err)
+	}
+	var types []string
+	for _, event := range queued {
+		types = append(types, event.Type)
+	}
+	if !slices.Contains(types, "hardware.changed") || !slices.Contains(types, "enroll.reenrolled") {
+		t.Fatalf("expected hardware.changed and enroll.reenrolled events, got %v", types)
+	}
+}
+
+func TestSetCredentialsAdvancesGenerationOnIdentityChange(t *testing.T) {
+	a := &Agent{}
+	a.setCredentials(enroll.Credentials{DeviceID: "device-1", DeviceToken: "token-1"})
+	generation := a.credentialGeneration()
+	a.setCredentials(enroll.Credentials{DeviceID: "device-1", DeviceToken: "token-1", Version: "v2"})
+	if a.credentialGeneration() != generation {
+		t.Fatalf("expected an applied policy to keep the credential generation")
+	}
+	a.setCredentials(enroll.Credentials{DeviceID: "device-1", DeviceToken: "token-2"})
+	if a.credentialGeneration() == generation {
+		t.Fatalf("expected a rotated token to advance the credential generation")
+	}
+}
+
+func TestAgentKeepsRunningOnUnsupportedInitialPolicy(t *testing.T) {
+	server := apitest.NewServer(t)
+	a := newTestAgent(t, server, nil)
+	envelope := server.SetPolicy("v9", api.PolicyDocument{Unknown: map[string]json.RawMessage{"kiosk": json.RawMessage(`{"app":"edu.example.Exam"}`)}})
+
+	if err := a.applyInitialPolicy(context.Background(), envelope); err != nil {
+		t.Fatalf("expected an unsupported initial policy to be tolerated, got %v", err)
+	}
+	snapshot, err := a.stateCollector.Snapshot(context.Background())
+	if err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+	if !strings.Contains(snapshot.LastError, "kiosk") {
+		t.Fatalf("expected the unsupported section to be reported, got %q", snapshot.LastError)
+	}
+	queued, err := a.eventQueue.Load()
+	if err != nil {
+		t.Fatalf("load events: %v", err)
+	}
+	if !slices.ContainsFunc(queued, func(event api.Event) bool { return event.Type == "policy.unsupported" }) {
+		t.Fatalf("expected a policy.unsupported event, got %+v", queued)
+	}
+}
+
+func TestAgentSkipsRenewalWithoutCertificate(t *testing.T) {
+	server := apitest.NewServer(t)
+	a := newTestAgent(t, server, nil)
+	// The backend issued no certificate at enrollment.
+	if err := os.Remove(filepath.Join(filepath.Dir(a.cfg.DeviceTokenPath), "device-cert.pem")); err != nil {
+		t.Fatalf("remove certificate: %v", err)
+	}
+	server.Fail(apitest.EndpointCertificate, apitest.Failure{Status: http.StatusInternalServerError})
+
+	if err := a.renewCertificate(context.Background()); err != nil {
+		t.Fatalf("expected renewal to be skipped, got %v", err)
+	}
+	queued, err := a.eventQueue.Load()
+	if err != nil {
+		t.Fatalf("load events: %v", err)
+	}
+	if slices.ContainsFunc(queued, func(event api.Event) bool { return event.Type == "identity.certificate.failure" }) {
+		t.Fatalf("expected no renewal attempt, got %+v", queued)
+	}
+}
+
+func TestAgentInstallsAppsBeyondPollInterval(t *testing.T) {
+	server := apitest.NewServer(t)
+	a := newTestAgent(t, server, func(cfg *config.Config) {
+		cfg.Intervals.PolicyPoll.Duration = 100 * time.Millisecond
+	})
+	// Stand-ins for flatpak and rpm-ostree; installs outlast a poll.
+	bin := t.TempDir()
+	scripts := map[string]string{
+		"flatpak":    "#!/bin/sh\nif [ \"$1\" = install ]; then /bin/sleep 0.5; fi\n",
+		"rpm-ostree": "#!/bin/sh\necho '{}'\n",
+	}
+	for name, script := range scripts {
+		if err := os.WriteFile(filepath.Join(bin, name), []byte(script), 0o755); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+	}
+	t.Setenv("PATH", bin)
+	dir := t.TempDir()
+	verifier, err := policy.NewVerifier(a.cfg.PolicyPublicKey)
+	if err != nil {
+		t.Fatalf("new verifier: %v", err)
+	}
+	a.policyManager = policy.NewManager(a.logger, a.cfg, verifier, a.appsManager,
+		browser.NewManager(a.logger, filepath.Join(dir, "chromium", "evergreen.json")), a.updatesManager,
+		network.NewManager(a.logger, filepath.Join(dir, "connections")),
+		security.NewManager(a.logger,
+			security.WithSSHConfigPath(filepath.Join(dir, "evergreen.conf")),
+			security.WithUSBGuardRulesPath(filepath.Join(dir, "rules.conf")),
+		))
+	server.SetPolicy("v2", api.PolicyDocument{Apps: api.AppsPolicy{Required: []api.AppDefinition{{ID: "org.example.Large"}}}})
+
+	if err := a.pullAndApplyPolicy(context.Background()); err != nil {
+		t.Fatalf("pull policy: %v", err)
+	}
+	queued, err := a.eventQueue.Load()
+	if err != nil {
+		t.Fatalf("load events: %v", err)
+	}
+	if !slices.ContainsFunc(queued, func(event api.Event) bool { return event.Type == "app.install.success" }) {
+		t.Fatalf("expected the install to finish, got %+v", queued)
+	}
+}
+
+func TestTransportOptionsHonourDirectPAC(t *testing.T) {
+	t.Setenv("HTTPS_PROXY", "http://proxy.school.example:3128")
+	path := filepath.Join(t.TempDir(), "proxy.pac")
+	if err := os.WriteFile(path, []byte(`function FindProxyForURL(url, host) { return "DIRECT"; }`), 0o644); err != nil {
+		t.Fatalf("write pac: %v", err)
+	}
+	opts, err := transportOptions(config.Transport{StaticPACPath: path})
+	if err != nil {
+		t.Fatalf("transport options: %v", err)
+	}
+	if !opts.Direct || opts.Proxy != nil {
+		t.Fatalf("expected a direct connection, got %+v", opts)
+	}
+}
@@ -0,0 +1,171 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/evergreen-os/device-agent/internal/enroll"
+	"github.com/evergreen-os/device-agent/internal/events"
+	"github.com/evergreen-os/device-agent/pkg/api"
+)
+
+// Reasons reported to the backend when the device is released.
+const (
+	decommissionReasonUnenroll = "unenrolled"
+	decommissionReasonBackend  = "backend_decommissioned"
+)
+
+// decommissionTimeout bounds the cleanup after the backend released the
+// device, including uninstalling apps and the final report.
+const decommissionTimeout = 5 * time.Minute
+
+// ErrNotEnrolled is returned by Unenroll when no credentials are stored.
+var ErrNotEnrolled = errors.New("device is not enrolled")
+
+// DecommissionOptions controls how the device is released.
+type DecommissionOptions struct {
+	// RemoveApps uninstalls the Flatpaks required by the cached policy.
+	RemoveApps bool
+	// Force wipes local state even when the backend cannot be notified.
+	Force bool
+}
+
+// DecommissionReport is the final report sent to the backend.
+type DecommissionReport struct {
+	DeviceID string
+	Reason   string
+	Events   []api.Event
+	// Notified is false when the backend could not be reached.
+	Notified bool
+}
+
+// Unenroll releases the device: it notifies the backend with a final report,
+// removes every file the agent manages and wipes the credentials and caches.
+// Without Force, a failed notification leaves the device untouched so the
+// command can be retried; with Force the files are removed first and the
+// report is sent on a best-effort basis.
+func (a *Agent) Unenroll(ctx context.Context, opts DecommissionOptions) (DecommissionReport, error) {
+	cred, err := a.enrollManager.StoredCredentials()
+	if err != nil {
+		return DecommissionReport{}, fmt.Errorf("%w: %v", ErrNotEnrolled, err)
+	}
+	a.setCredentials(cred)
+	a.installTokenSource(cred)
+	a.installClientCertificate()
+	return a.decommission(ctx, decommissionReasonUnenroll, opts)
+}
+
+func (a *Agent) decommission(ctx context.Context, reason string, opts DecommissionOptions) (DecommissionReport, error) {
+	cred := a.currentCredentials()
+	report := DecommissionReport{DeviceID: cred.DeviceID, Reason: reason}
+	a.logger.Warn("decommissioning device", slog.String("device_id", cred.DeviceID), slog.String("reason", reason))
+
+	// Events that were never flushed are part of the final report.
+	queued, err := a.eventQueue.Load()
+	if err != nil {
+		a.logger.Warn("failed to load queued events", slog.String("error", err.Error()))
+	}
+	report.Events = append(report.Events, queued...)
+
+	req := api.UnenrollRequest{DeviceID: cred.DeviceID, Reason: reason}
+	if snapshot, err := a.stateCollector.Snapshot(ctx); err == nil {
+		req.State = &snapshot
+	} else {
+		a.logger.Warn("failed to collect final state", slog.String("error", err.Error()))
+	}
+	if !opts.Force {
+		// A failed notification must leave the device fully managed, so the
+		// backend hears first and the removal results follow.
+		req.Events = report.Events
+		if err := a.notifyUnenroll(ctx, cred, req); err != nil {
+			return report, fmt.Errorf("notify backend: %w", err)
+		}
+		report.Notified = true
+		req = api.UnenrollRequest{DeviceID: cred.DeviceID, Reason: reason}
+	}
+
+	var errs []error
+	var removed []api.Event
+	collect := func(generated []api.Event, err error) {
+		removed = append(removed, generated...)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if opts.RemoveApps {
+		if cached, err := a.policyManager.CachedPolicy(); err == nil {
+			collect(a.appsManager.RemoveManaged(ctx, cached.Policy.Apps))
+		} else {
+			a.logger.Warn("no cached policy, keeping apps", slog.String("error", err.Error()))
+		}
+	}
+	collect(a.appsManager.Remove(ctx))
+	collect(a.browserManager.Remove())
+	collect(a.networkManager.Remove())
+	collect(a.securityManager.Remove(ctx))
+	removed = append(removed, events.NewEvent("device.decommissioned", map[string]any{
+		"reason":          reason,
+		"removed_apps":    opts.RemoveApps,
+		"cleanup_failure": len(errs) > 0,
+	}))
+	report.Events = append(report.Events, removed...)
+
+	if report.Notified {
+		// The removal results follow the final report; the device is
+		// released either way.
+		req.Events = removed
+		if err := a.notifyUnenroll(ctx, cred, req); err != nil {
+			a.logger.Warn("failed to send removal results", slog.String("error", err.Error()))
+		}
+	} else {
+		req.Events = report.Events
+		if err := a.notifyUnenroll(ctx, cred, req); err != nil {
+			a.logger.Warn("failed to notify backend, wiping local state anyway", slog.String("error", err.Error()))
+		} else {
+			report.Notified = true
+		}
+	}
+
+	if err := a.policyManager.Clear(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := a.eventQueue.Clear(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := a.stateQueue.Clear(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := a.attestManager.Remove(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := a.hardwareMon.Remove(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := a.appsManager.Forget(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := a.enrollManager.Remove(reason); err != nil {
+		errs = append(errs, err)
+	}
+	a.client.SetTokenSource(nil)
+	a.logger.Warn("device decommissioned",
+		slog.String("device_id", cred.DeviceID),
+		slog.String("reason", reason),
+		slog.Int("events", len(report.Events)),
+		slog.Bool("notified", report.Notified),
+	)
+	return report, errors.Join(errs...)
+}
+
+// notifyUnenroll sends a final report. A 410 means the backend has already
+// released the device, which counts as notified.
+func (a *Agent) notifyUnenroll(ctx context.Context, cred enroll.Credentials, req api.UnenrollRequest) error {
+	err := a.client.Unenroll(ctx, cred.DeviceToken, req)
+	if errors.Is(err, api.ErrDecommissioned) {
+		return nil
+	}
+	return err
+}
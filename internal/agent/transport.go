@@ -0,0 +1,65 @@
+package agent
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/url"
+	"os"
+
+	"github.com/evergreen-os/device-agent/internal/config"
+	"github.com/evergreen-os/device-agent/pkg/api"
+)
+
+// transportOptions translates the transport configuration into API client options.
+func transportOptions(cfg config.Transport) (api.TransportOptions, error) {
+	var opts api.TransportOptions
+	switch {
+	case cfg.ProxyURL != "":
+		proxy, err := url.Parse(cfg.ProxyURL)
+		if err != nil {
+			return opts, fmt.Errorf("parse proxy url: %w", err)
+		}
+		opts.Proxy = proxy
+	case cfg.StaticPACPath != "":
+		script, err := os.ReadFile(cfg.StaticPACPath)
+		if err != nil {
+			return opts, fmt.Errorf("read pac file: %w", err)
+		}
+		proxy, err := api.StaticProxyFromPAC(script)
+		if err != nil {
+			return opts, err
+		}
+		opts.Proxy = proxy
+		// The admin's DIRECT also overrides HTTPS_PROXY in the environment.
+		opts.Direct = proxy == nil
+	}
+	if cfg.CABundlePath != "" {
+		bundle, err := os.ReadFile(cfg.CABundlePath)
+		if err != nil {
+			return opts, fmt.Errorf("read ca bundle: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(bundle) {
+			return opts, fmt.Errorf("ca bundle %s contains no certificates", cfg.CABundlePath)
+		}
+		opts.RootCAs = pool
+	}
+	for _, value := range cfg.PinnedSPKISHA256 {
+		pin, err := api.ParseSPKIPin(value)
+		if err != nil {
+			return opts, err
+		}
+		opts.PinnedSPKI = append(opts.PinnedSPKI, pin)
+	}
+	switch cfg.MinTLSVersion {
+	case "1.3":
+		opts.MinVersion = tls.VersionTLS13
+	default:
+		opts.MinVersion = tls.VersionTLS12
+	}
+	return opts, nil
+}
@@ -0,0 +1,68 @@
+package apps
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/evergreen-os/device-agent/internal/events"
+	"github.com/evergreen-os/device-agent/pkg/api"
+)
+
+// lowSpaceCleanupInterval keeps a device that stays short of space from
+// running cleanup on every state report.
+const lowSpaceCleanupInterval = 24 * time.Hour
+
+// Cleanup triggers reported in apps.cleanup events.
+const (
+	cleanupAfterRemoval = "removal"
+	cleanupLowSpace     = "low_disk_space"
+)
+
+// cleanupUnused uninstalls runtimes and extensions no installed app uses and
+// reports the disk space that freed, or the error when flatpak failed.
+func (m *Manager) cleanupUnused(ctx context.Context, trigger string) api.Event {
+	dir := m.installations["system"]
+	_, before, beforeErr := m.diskUsage(dir)
+	m.mu.Lock()
+	m.lastCleanup = m.now()
+	m.mu.Unlock()
+	if _, err := m.flatpak(ctx, "uninstall", "-y", "--noninteractive", "--unused"); err != nil {
+		m.logger.Error("failed to remove unused runtimes", slog.String("trigger", trigger), slog.String("error", err.Error()))
+		return events.NewEvent("apps.cleanup", map[string]any{"trigger": trigger, "error": err.Error()})
+	}
+	payload := map[string]any{"trigger": trigger}
+	if _, after, err := m.diskUsage(dir); err == nil && beforeErr == nil {
+		var reclaimed uint64
+		if after > before {
+			reclaimed = after - before
+		}
+		payload["reclaimed_bytes"] = reclaimed
+		payload["free_bytes"] = after
+	} else {
+		m.logger.Warn("disk usage lookup failed", slog.String("path", dir))
+	}
+	return events.NewEvent("apps.cleanup", payload)
+}
+
+// cleanupIfLow runs cleanup when free space is below the policy threshold,
+// at most once per lowSpaceCleanupInterval.
+func (m *Manager) cleanupIfLow(ctx context.Context, policy *api.AppCleanupPolicy) ([]api.Event, error) {
+	if policy == nil || policy.MinFreeBytes == 0 {
+		return nil, nil
+	}
+	m.mu.Lock()
+	recent := !m.lastCleanup.IsZero() && m.now().Sub(m.lastCleanup) < lowSpaceCleanupInterval
+	m.mu.Unlock()
+	if recent {
+		return nil, nil
+	}
+	_, free, err := m.diskUsage(m.installations["system"])
+	if err != nil {
+		return nil, err
+	}
+	if free >= policy.MinFreeBytes {
+		return nil, nil
+	}
+	return []api.Event{m.cleanupUnused(ctx, cleanupLowSpace)}, nil
+}
@@ -0,0 +1,96 @@
+package apps
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/evergreen-os/device-agent/pkg/api"
+)
+
+func TestManagerCleansUpAfterRemoval(t *testing.T) {
+	fake := newFakeFlatpak("com.valvesoftware.Steam")
+	manager := newTestManager(t, fake.run)
+	free := uint64(1 << 30)
+	manager.diskUsage = func(string) (uint64, uint64, error) {
+		return 16 << 30, free, nil
+	}
+	run := manager.flatpak
+	manager.flatpak = func(ctx context.Context, args ...string) ([]byte, error) {
+		if len(args) > 0 && args[len(args)-1] == "--unused" {
+			free += 700 << 20
+		}
+		return run(ctx, args...)
+	}
+	policy := api.AppsPolicy{Blocked: []string{"com.valvesoftware.*"}, Cleanup: &api.AppCleanupPolicy{AfterRemoval: true}}
+	events, err := manager.Apply(context.Background(), policy)
+	if err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	if fake.commands[len(fake.commands)-1] != "uninstall -y --noninteractive --unused" {
+		t.Fatalf("expected unused runtimes to be removed, got %q", fake.commands)
+	}
+	event := events[len(events)-1]
+	payload, _ := event.Payload.(map[string]any)
+	if event.Type != "apps.cleanup" || payload["trigger"] != cleanupAfterRemoval || payload["reclaimed_bytes"] != uint64(700<<20) || payload["error"] != nil {
+		t.Fatalf("unexpected cleanup event %+v", event)
+	}
+}
+
+func TestManagerCleansUpWhenDiskIsLow(t *testing.T) {
+	var cleanups int
+	manager := newTestManager(t, func(_ context.Context, args ...string) ([]byte, error) {
+		if args[len(args)-1] == "--unused" {
+			cleanups++
+		}
+		return nil, nil
+	})
+	free := uint64(3 << 30)
+	manager.diskUsage = func(string) (uint64, uint64, error) {
+		return 32 << 30, free, nil
+	}
+	now := time.Date(2026, 10, 17, 9, 0, 0, 0, time.UTC)
+	manager.now = func() time.Time { return now }
+	ctx := context.Background()
+	policy := api.AppsPolicy{Cleanup: &api.AppCleanupPolicy{MinFreeBytes: 2 << 30}}
+	if _, err := manager.Apply(ctx, policy); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	if _, err := manager.Update(ctx); err != nil || cleanups != 0 {
+		t.Fatalf("expected no cleanup with enough space, got %d (%v)", cleanups, err)
+	}
+
+	free = 1 << 30
+	result, err := manager.Update(ctx)
+	if err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if cleanups != 1 || len(result.Events) != 1 || result.Events[0].Type != "apps.cleanup" {
+		t.Fatalf("expected a low space cleanup, got %d and %+v", cleanups, result.Events)
+	}
+
+	// Cleanup that cannot free enough is not repeated on every report.
+	now = now.Add(time.Hour)
+	if _, err := manager.Update(ctx); err != nil || cleanups != 1 {
+		t.Fatalf("expected cleanup to wait, got %d (%v)", cleanups, err)
+	}
+	now = now.Add(lowSpaceCleanupInterval)
+	if _, err := manager.Update(ctx); err != nil || cleanups != 2 {
+		t.Fatalf("expected cleanup to run again, got %d (%v)", cleanups, err)
+	}
+}
+
+func TestManagerReportsFailedCleanup(t *testing.T) {
+	manager := newTestManager(t, func(context.Context, ...string) ([]byte, error) {
+		return nil, errors.New("flatpak: no such installation")
+	})
+	manager.diskUsage = func(string) (uint64, uint64, error) {
+		return 16 << 30, 1 << 30, nil
+	}
+	event := manager.cleanupUnused(context.Background(), cleanupLowSpace)
+	payload, _ := event.Payload.(map[string]any)
+	if event.Type != "apps.cleanup" || payload["trigger"] != cleanupLowSpace || payload["error"] != "flatpak: no such installation" {
+		t.Fatalf("unexpected cleanup event %+v", event)
+	}
+}
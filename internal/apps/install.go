@@ -0,0 +1,198 @@
+package apps
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/evergreen-os/device-agent/internal/events"
+	"github.com/evergreen-os/device-agent/pkg/api"
+)
+
+const (
+	defaultInstallConcurrency = 3
+	defaultInstallAttempts    = 3
+	defaultInstallRetryDelay  = 30 * time.Second
+	// defaultMeteredMaxDownload is the largest install started on a metered
+	// connection when policy does not say otherwise.
+	defaultMeteredMaxDownload = 50 * 1000 * 1000
+)
+
+// installOutcome sorts the apps handed to installApps by result.
+type installOutcome struct {
+	Installed []api.AppDefinition
+	Failed    []api.AppDefinition
+	// Deferred apps wait for an unmetered connection.
+	Deferred []api.AppDefinition
+	Events   []api.Event
+}
+
+// installApps installs apps concurrently, retrying each with exponential
+// backoff. On a metered connection apps whose download exceeds maxDownload,
+// or whose size is unknown, are deferred instead.
+func (m *Manager) installApps(ctx context.Context, defs []api.AppDefinition, maxDownload uint64) installOutcome {
+	var outcome installOutcome
+	if len(defs) == 0 {
+		return outcome
+	}
+	if maxDownload == 0 {
+		maxDownload = defaultMeteredMaxDownload
+	}
+	queue := defs
+	metered, err := m.metered(ctx)
+	if err != nil {
+		m.logger.Debug("metered state unknown", slog.String("error", err.Error()))
+	}
+	if metered {
+		sizes, err := m.downloadSizes(ctx)
+		if err != nil {
+			m.logger.Warn("failed to look up download sizes", slog.String("error", err.Error()))
+		}
+		queue = nil
+		for _, def := range defs {
+			size, known := sizes[def.ID+"//"+def.Branch]
+			if !known && def.Branch == "" {
+				size, known = sizes[def.ID]
+			}
+			if known && size <= maxDownload {
+				queue = append(queue, def)
+				continue
+			}
+			payload := map[string]any{"app": def.ID, "reason": "metered"}
+			if known {
+				payload["download_bytes"] = size
+			}
+			outcome.Deferred = append(outcome.Deferred, def)
+			outcome.Events = append(outcome.Events, events.NewEvent("app.install.deferred", payload))
+		}
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, m.installConcurrency)
+	done := 0
+	for _, def := range queue {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			err := m.installWithRetry(ctx, def, func(attempt int, err error) {
+				mu.Lock()
+				defer mu.Unlock()
+				outcome.Events = append(outcome.Events, events.NewEvent("app.install.retry", map[string]any{
+					"app": def.ID, "attempt": attempt, "error": err.Error(),
+				}))
+			})
+			mu.Lock()
+			defer mu.Unlock()
+			done++
+			if err != nil {
+				m.logger.Error("failed to install app", slog.String("app", def.ID), slog.String("error", err.Error()))
+				outcome.Failed = append(outcome.Failed, def)
+				outcome.Events = append(outcome.Events, events.NewEvent("app.install.failure", map[string]string{"app": def.ID, "error": err.Error()}))
+			} else {
+				outcome.Installed = append(outcome.Installed, def)
+				outcome.Events = append(outcome.Events, events.NewEvent("app.install.success", map[string]string{"app": def.ID}))
+			}
+			outcome.Events = append(outcome.Events, events.NewEvent("apps.install.progress", map[string]any{
+				"app": def.ID, "completed": done, "total": len(queue),
+			}))
+		}()
+	}
+	wg.Wait()
+	return outcome
+}
+
+// installWithRetry makes up to installAttempts attempts, doubling the delay
+// after each failure. retry is called before every further attempt.
+func (m *Manager) installWithRetry(ctx context.Context, def api.AppDefinition, retry func(attempt int, err error)) error {
+	delay := m.installRetryDelay
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = m.installFlatpak(ctx, def); err == nil || attempt >= m.installAttempts {
+			return err
+		}
+		retry(attempt+1, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// downloadSizes returns the download size of every app the remotes offer,
+// keyed by both "id//branch" and "id".
+func (m *Manager) downloadSizes(ctx context.Context) (map[string]uint64, error) {
+	output, err := m.flatpak(ctx, "remote-ls", "--system", "--app", "--columns=application,branch,download-size")
+	if err != nil {
+		return nil, err
+	}
+	sizes := map[string]uint64{}
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		parts := strings.Split(scanner.Text(), "\t")
+		if len(parts) < 3 {
+			continue
+		}
+		size, err := parseSize(parts[2])
+		if err != nil {
+			continue
+		}
+		sizes[parts[0]+"//"+parts[1]] = size
+		if size > sizes[parts[0]] {
+			sizes[parts[0]] = size
+		}
+	}
+	return sizes, scanner.Err()
+}
+
+// parseSize reads sizes as flatpak prints them with g_format_size, e.g.
+// "839 bytes" or "45.2 MB" (decimal units, possibly with a no-break space).
+func parseSize(value string) (uint64, error) {
+	fields := strings.Fields(value)
+	if len(fields) != 2 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	number, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q: %w", value, err)
+	}
+	multipliers := map[string]float64{
+		"byte": 1, "bytes": 1, "kB": 1e3, "MB": 1e6, "GB": 1e9, "TB": 1e12,
+	}
+	multiplier, ok := multipliers[fields[1]]
+	if !ok {
+		return 0, fmt.Errorf("invalid size unit %q", fields[1])
+	}
+	return uint64(number * multiplier), nil
+}
+
+// networkMetered asks NetworkManager whether the primary connection is
+// metered, counting its guesses as well.
+func networkMetered(ctx context.Context) (bool, error) {
+	if _, err := exec.LookPath("busctl"); err != nil {
+		return false, fmt.Errorf("busctl not available: %w", err)
+	}
+	cmd := exec.CommandContext(ctx, "busctl", "get-property", "org.freedesktop.NetworkManager",
+		"/org/freedesktop/NetworkManager", "org.freedesktop.NetworkManager", "Metered")
+	output, err := cmd.Output()
+	if err != nil {
+		return false, fmt.Errorf("query metered state: %w", err)
+	}
+	// NMMetered: 1 yes, 3 guess-yes.
+	switch strings.TrimSpace(string(output)) {
+	case "u 1", "u 3":
+		return true, nil
+	}
+	return false, nil
+}
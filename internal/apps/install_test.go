@@ -0,0 +1,189 @@
+package apps
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/evergreen-os/device-agent/pkg/api"
+)
+
+func TestInstallAppsBoundsConcurrencyAndRetries(t *testing.T) {
+	var running, peak atomic.Int32
+	var mu sync.Mutex
+	attempts := map[string]int{}
+	run := func(_ context.Context, args ...string) ([]byte, error) {
+		if args[0] != "install" {
+			return nil, nil
+		}
+		id := args[len(args)-1]
+		n := running.Add(1)
+		defer running.Add(-1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		mu.Lock()
+		defer mu.Unlock()
+		attempts[id]++
+		if id == "org.example.Flaky" && attempts[id] < 3 {
+			return nil, errors.New("connection reset")
+		}
+		if id == "org.example.Broken" {
+			return nil, errors.New("no such ref")
+		}
+		return nil, nil
+	}
+	manager := newTestManager(t, run)
+	manager.installConcurrency = 2
+	var defs []api.AppDefinition
+	for i := range 5 {
+		defs = append(defs, api.AppDefinition{ID: fmt.Sprintf("org.example.App%d", i)})
+	}
+	defs = append(defs, api.AppDefinition{ID: "org.example.Flaky"}, api.AppDefinition{ID: "org.example.Broken"})
+
+	outcome := manager.installApps(context.Background(), defs, 0)
+	if peak.Load() > 2 {
+		t.Fatalf("expected at most 2 concurrent installs, saw %d", peak.Load())
+	}
+	if len(outcome.Installed) != 6 || len(outcome.Failed) != 1 || outcome.Failed[0].ID != "org.example.Broken" {
+		t.Fatalf("unexpected outcome installed=%v failed=%v", outcome.Installed, outcome.Failed)
+	}
+	if attempts["org.example.Flaky"] != 3 || attempts["org.example.Broken"] != defaultInstallAttempts {
+		t.Fatalf("unexpected attempts %v", attempts)
+	}
+	var retries, progress int
+	for _, event := range outcome.Events {
+		switch event.Type {
+		case "app.install.retry":
+			retries++
+		case "apps.install.progress":
+			progress++
+		}
+	}
+	if retries != 4 || progress != len(defs) {
+		t.Fatalf("expected 4 retry and %d progress events, got %d and %d", len(defs), retries, progress)
+	}
+}
+
+func TestMeteredInstallsAreDeferred(t *testing.T) {
+	fake := newFakeFlatpak()
+	run := func(ctx context.Context, args ...string) ([]byte, error) {
+		if args[0] == "remote-ls" && slices.Contains(args, "--columns=application,branch,download-size") {
+			return []byte("org.mozilla.firefox\tstable\t98.1 MB\norg.gnome.Chess\tstable\t2.3 MB\n"), nil
+		}
+		return fake.run(ctx, args...)
+	}
+	manager := newTestManager(t, run)
+	metered := true
+	manager.metered = func(context.Context) (bool, error) { return metered, nil }
+	policy := api.AppsPolicy{Required: []api.AppDefinition{{ID: "org.mozilla.firefox"}, {ID: "org.gnome.Chess"}}}
+	events, err := manager.Apply(context.Background(), policy)
+	if err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	if len(fake.installed) != 1 || fake.installed[0].ID != "org.gnome.Chess" {
+		t.Fatalf("expected only the small app to be installed, got %+v", fake.installed)
+	}
+	if events[0].Type != "app.install.deferred" {
+		t.Fatalf("expected a deferral event, got %+v", events)
+	}
+
+	// The periodic update check installs it once the connection is unmetered.
+	metered = false
+	if _, err := manager.Update(context.Background()); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if len(fake.installed) != 2 {
+		t.Fatalf("expected the deferred app to be installed, got %+v", fake.installed)
+	}
+	record, err := manager.loadManaged()
+	if err != nil {
+		t.Fatalf("load managed: %v", err)
+	}
+	if !slices.Equal(record.Apps, []string{"org.gnome.Chess", "org.mozilla.firefox"}) {
+		t.Fatalf("unexpected managed apps %v", record.Apps)
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	for value, want := range map[string]uint64{
+		"839 bytes": 839,
+		"45.2 MB":   45_200_000,
+		"1.1 GB":    1_100_000_000,
+		"512.0 kB":  512_000,
+	} {
+		got, err := parseSize(value)
+		if err != nil || got != want {
+			t.Fatalf("parseSize(%q) = %d, %v; want %d", value, got, err, want)
+		}
+	}
+	if _, err := parseSize("lots"); err == nil {
+		t.Fatalf("expected unparsable size to fail")
+	}
+}
+
+func TestDeferredInstallDoesNotRaceApply(t *testing.T) {
+	fake := newFakeFlatpak()
+	started := make(chan struct{})
+	var once sync.Once
+	metered := true
+	var meteredMu sync.Mutex
+	run := func(ctx context.Context, args ...string) ([]byte, error) {
+		if args[0] == "remote-ls" {
+			return []byte("org.mozilla.firefox\tstable\t98.1 MB\n"), nil
+		}
+		if args[0] == "install" && args[len(args)-1] == "org.mozilla.firefox" {
+			once.Do(func() { close(started) })
+			time.Sleep(20 * time.Millisecond)
+		}
+		return fake.run(ctx, args...)
+	}
+	manager := newTestManager(t, run)
+	manager.metered = func(context.Context) (bool, error) {
+		meteredMu.Lock()
+		defer meteredMu.Unlock()
+		return metered, nil
+	}
+	ctx := context.Background()
+	firefox := api.AppDefinition{ID: "org.mozilla.firefox"}
+	if _, err := manager.Apply(ctx, api.AppsPolicy{Required: []api.AppDefinition{firefox}}); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	meteredMu.Lock()
+	metered = false
+	meteredMu.Unlock()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := manager.Update(ctx)
+		done <- err
+	}()
+	<-started
+	policy := api.AppsPolicy{Required: []api.AppDefinition{firefox, {ID: "org.kde.krita"}}}
+	if _, err := manager.Apply(ctx, policy); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	record, err := manager.loadManaged()
+	if err != nil {
+		t.Fatalf("load managed: %v", err)
+	}
+	if !slices.Equal(record.Apps, []string{"org.kde.krita", "org.mozilla.firefox"}) {
+		t.Fatalf("expected both apps to be managed, got %v", record.Apps)
+	}
+	if n := strings.Count(strings.Join(fake.commands, "\n"), "install -y org.mozilla.firefox"); n != 1 {
+		t.Fatalf("expected a single firefox install, got %q", fake.commands)
+	}
+}
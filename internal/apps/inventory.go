@@ -0,0 +1,79 @@
+package apps
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/evergreen-os/device-agent/pkg/api"
+)
+
+// inventoryColumns are the flatpak list columns ListInstalled parses, in order.
+const inventoryColumns = "ref,version,origin,installation,active,size,runtime,options"
+
+// defaultInstallations returns the directories of the system installation and
+// of the user installation of the account running the agent.
+func defaultInstallations() map[string]string {
+	dirs := map[string]string{"system": "/var/lib/flatpak"}
+	if home, err := os.UserHomeDir(); err == nil {
+		dirs["user"] = filepath.Join(home, ".local", "share", "flatpak")
+	}
+	return dirs
+}
+
+// ListInstalled returns the installed Flatpak apps and runtimes for state
+// reports.
+func (m *Manager) ListInstalled(ctx context.Context) ([]api.InstalledApp, error) {
+	output, err := m.flatpak(ctx, "list", "--columns="+inventoryColumns)
+	if err != nil {
+		return nil, err
+	}
+	var installed []api.InstalledApp
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		parts := strings.Split(scanner.Text(), "\t")
+		if len(parts) < 8 {
+			continue
+		}
+		// Refs look like app/org.mozilla.firefox/x86_64/stable.
+		refParts := strings.Split(strings.TrimSpace(parts[0]), "/")
+		if len(refParts) != 4 {
+			continue
+		}
+		item := api.InstalledApp{
+			Kind:         refParts[0],
+			ID:           refParts[1],
+			Arch:         refParts[2],
+			Branch:       refParts[3],
+			Version:      strings.TrimSpace(parts[1]),
+			Origin:       strings.TrimSpace(parts[2]),
+			Installation: strings.TrimSpace(parts[3]),
+			Commit:       strings.TrimSpace(parts[4]),
+			Runtime:      strings.TrimSpace(parts[6]),
+		}
+		if size, err := parseSize(parts[5]); err == nil {
+			item.InstalledSizeBytes = size
+		}
+		for _, option := range strings.Split(parts[7], ",") {
+			if reason, ok := strings.CutPrefix(strings.TrimSpace(option), "eol="); ok {
+				item.EOL = reason
+			}
+		}
+		if dir, ok := m.installations[item.Installation]; ok {
+			// active links to the deployment created by the last install or update.
+			active := filepath.Join(dir, item.Kind, item.ID, item.Arch, item.Branch, "active")
+			if info, err := os.Stat(active); err == nil {
+				updated := info.ModTime().UTC()
+				item.LastUpdated = &updated
+			} else {
+				m.logger.Debug("flatpak deployment not found", slog.String("path", active), slog.String("error", err.Error()))
+			}
+		}
+		installed = append(installed, item)
+	}
+	return installed, scanner.Err()
+}
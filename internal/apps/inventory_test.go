@@ -0,0 +1,67 @@
+package apps
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/evergreen-os/device-agent/pkg/api"
+)
+
+func TestListInstalledReportsAppsAndRuntimes(t *testing.T) {
+	fixture, err := os.ReadFile(filepath.Join("testdata", "flatpak-list.txt"))
+	if err != nil {
+		t.Fatalf("read fixture: %v", err)
+	}
+	var args []string
+	manager := newTestManager(t, func(_ context.Context, a ...string) ([]byte, error) {
+		args = a
+		return fixture, nil
+	})
+	system := t.TempDir()
+	manager.installations = map[string]string{"system": system}
+	active := filepath.Join(system, "app", "org.mozilla.firefox", "x86_64", "stable", "active")
+	if err := os.MkdirAll(filepath.Join(filepath.Dir(active), "8f2a61c0d4e1"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.Symlink("8f2a61c0d4e1", active); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+	updated := time.Date(2026, 10, 1, 8, 30, 0, 0, time.UTC)
+	if err := os.Chtimes(active, updated, updated); err != nil {
+		t.Fatalf("chtimes: %v", err)
+	}
+
+	installed, err := manager.ListInstalled(context.Background())
+	if err != nil {
+		t.Fatalf("list installed: %v", err)
+	}
+	if want := []string{"list", "--columns=" + inventoryColumns}; !reflect.DeepEqual(args, want) {
+		t.Fatalf("unexpected command %q", args)
+	}
+	if len(installed) != 4 {
+		t.Fatalf("expected 4 refs, got %+v", installed)
+	}
+	want := api.InstalledApp{
+		ID: "org.mozilla.firefox", Version: "131.0.3", Branch: "stable", Commit: "8f2a61c0d4e1",
+		Kind: "app", Arch: "x86_64", Origin: "flathub", Installation: "system",
+		InstalledSizeBytes: 262_100_000, Runtime: "org.freedesktop.Platform/x86_64/24.08",
+		LastUpdated: &updated,
+	}
+	if !reflect.DeepEqual(installed[0], want) {
+		t.Fatalf("unexpected app:\n got %+v\nwant %+v", installed[0], want)
+	}
+	if chess := installed[1]; chess.Installation != "user" || chess.Version != "" || chess.LastUpdated != nil {
+		t.Fatalf("unexpected user app %+v", chess)
+	}
+	runtime := installed[2]
+	if runtime.Kind != "runtime" || runtime.ID != "org.gnome.Platform" || runtime.EOL != "The GNOME 44 runtime is no longer supported" {
+		t.Fatalf("expected an end-of-life runtime, got %+v", runtime)
+	}
+	if installed[3].EOL != "" || installed[3].Version != "freedesktop-sdk-24.08.5" {
+		t.Fatalf("unexpected runtime %+v", installed[3])
+	}
+}
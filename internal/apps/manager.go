@@ -2,36 +2,89 @@ package apps
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log/slog"
+	"os"
 	"os/exec"
+	"slices"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/evergreen-os/device-agent/internal/events"
+	"github.com/evergreen-os/device-agent/internal/util"
 	"github.com/evergreen-os/device-agent/pkg/api"
 )
 
 // Manager reconciles Flatpak applications against policy.
 type Manager struct {
 	logger *slog.Logger
-}
+	// path records the apps the agent installed, so they can be removed once
+	// policy drops them without touching apps users installed themselves.
+	path    string
+	flatpak func(ctx context.Context, args ...string) ([]byte, error)
+
+	// dconfDir holds the system dconf databases GNOME Software reads.
+	dconfDir    string
+	dconfUpdate func(ctx context.Context) error
+	now         func() time.Time
+
+	metered            func(ctx context.Context) (bool, error)
+	installConcurrency int
+	installAttempts    int
+	installRetryDelay  time.Duration
+
+	// installations maps Flatpak installation names to their directories.
+	installations map[string]string
+	diskUsage     func(path string) (total, free uint64, err error)
 
-// NewManager constructs a new Manager.
-func NewManager(logger *slog.Logger) *Manager {
-	return &Manager{logger: logger}
+	// reconcileMu serialises flatpak transactions and the managed record
+	// read-modify-write cycles of the policy and state loops.
+	reconcileMu sync.Mutex
+
+	mu      sync.Mutex
+	updates *updateSettings
+	// lastCleanup is when unused runtimes were last removed.
+	lastCleanup time.Time
+	// deferred holds required apps waiting for an unmetered connection.
+	deferred []api.AppDefinition
+	// updatesDeferred is set while app updates wait for an unmetered
+	// connection.
+	updatesDeferred bool
 }
 
-// ListInstalled returns installed Flatpak applications.
-func (m *Manager) ListInstalled(ctx context.Context) ([]api.InstalledApp, error) {
-	if _, err := exec.LookPath("flatpak"); err != nil {
-		return nil, fmt.Errorf("flatpak not available: %w", err)
+// NewManager constructs a new Manager recording managed apps at path.
+func NewManager(logger *slog.Logger, path string) *Manager {
+	if path == "" {
+		path = "/var/lib/evergreen/managed-apps.json"
 	}
-	cmd := exec.CommandContext(ctx, "flatpak", "list", "--app", "--columns=application,branch,commit")
-	output, err := cmd.Output()
+	return &Manager{
+		logger:      logger,
+		path:        path,
+		flatpak:     runFlatpak,
+		dconfDir:    "/etc/dconf/db",
+		dconfUpdate: runDconfUpdate,
+		now:         time.Now,
+
+		metered:            networkMetered,
+		installConcurrency: defaultInstallConcurrency,
+		installAttempts:    defaultInstallAttempts,
+		installRetryDelay:  defaultInstallRetryDelay,
+
+		installations: defaultInstallations(),
+		diskUsage:     util.DiskUsage,
+	}
+}
+
+// listApps returns installed Flatpak applications.
+func (m *Manager) listApps(ctx context.Context) ([]api.InstalledApp, error) {
+	output, err := m.flatpak(ctx, "list", "--app", "--columns=application,branch,commit")
 	if err != nil {
-		return nil, fmt.Errorf("flatpak list: %w", err)
+		return nil, err
 	}
 	scanner := bufio.NewScanner(strings.NewReader(string(output)))
 	var apps []api.InstalledApp
@@ -45,77 +98,329 @@ func (m *Manager) ListInstalled(ctx context.Context) ([]api.InstalledApp, error)
 			parts = strings.Fields(line)
 		}
 		if len(parts) >= 3 {
-			apps = append(apps, api.InstalledApp{ID: parts[0], Branch: parts[1], Version: parts[2]})
+			apps = append(apps, api.InstalledApp{ID: parts[0], Branch: parts[1], Commit: parts[2]})
 		}
 	}
 	return apps, scanner.Err()
 }
 
-// Apply enforces the desired application list.
+// Apply installs required apps and uninstalls blocked apps, apps the agent
+// installed for an earlier policy, and, depending on policy.Unmanaged, apps
+// the policy does not mention.
 func (m *Manager) Apply(ctx context.Context, policy api.AppsPolicy) ([]api.Event, error) {
-	installed, err := m.ListInstalled(ctx)
+	m.reconcileMu.Lock()
+	defer m.reconcileMu.Unlock()
+	installed, err := m.listApps(ctx)
+	if err != nil {
+		return nil, err
+	}
+	record, err := m.loadManaged()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(m.path); errors.Is(err, os.ErrNotExist) {
+		// Agents before the managed record installed the required apps without
+		// recording them; adopt them so dropping one from policy still removes it.
+		record.Apps = seedManaged(policy.Required, installed)
+	}
+	plan, err := planApps(policy, installed, record.Apps)
+	if err != nil {
+		return nil, err
+	}
+	schedule, err := validateUpdatePolicy(policy.Updates)
+	if err != nil {
+		return nil, err
+	}
+	generated, err := m.reconcileRemotes(ctx, policy.Remotes, &record)
+	if err != nil {
+		return nil, err
+	}
+	managed := record.Apps
+	// Apps stay managed while required, and until a removal succeeds.
+	stillManaged := map[string]bool{}
+	for _, def := range policy.Required {
+		if slices.Contains(managed, def.ID) {
+			stillManaged[def.ID] = true
+		}
+	}
+	for _, d := range plan.Deviations {
+		m.logger.Warn("app deviates from policy", slog.String("app", d.ID), slog.String("field", d.Field),
+			slog.String("expected", d.Expected), slog.String("actual", d.Actual))
+		generated = append(generated, events.NewEvent("app.deviation", d))
+	}
+	installs := m.installApps(ctx, plan.Install, policy.MeteredMaxDownloadBytes)
+	generated = append(generated, installs.Events...)
+	for _, def := range installs.Installed {
+		stillManaged[def.ID] = true
+	}
+	failed := map[string]bool{}
+	for _, def := range slices.Concat(installs.Failed, installs.Deferred) {
+		failed[def.ID] = true
+	}
+	for _, def := range plan.Pin {
+		if err := m.pinFlatpak(ctx, def); err != nil {
+			m.logger.Error("failed to pin app", slog.String("app", def.ID), slog.String("error", err.Error()))
+			generated = append(generated, events.NewEvent("app.pin.failure", map[string]string{"app": def.ID, "commit": def.Commit, "error": err.Error()}))
+			continue
+		}
+		generated = append(generated, events.NewEvent("app.pin.success", map[string]string{"app": def.ID, "commit": def.Commit}))
+	}
+	generated = append(generated, m.reconcileOverrides(ctx, policy.Required, &record)...)
+	removed := false
+	for _, r := range plan.Remove {
+		if r.Branch != "" && failed[r.ID] {
+			// Keep the wrong branch until the right one is installed.
+			continue
+		}
+		if err := m.removeFlatpak(ctx, ref(r.ID, r.Branch)); err != nil {
+			m.logger.Error("failed to remove app", slog.String("app", ref(r.ID, r.Branch)), slog.String("error", err.Error()))
+			generated = append(generated, events.NewEvent("app.remove.failure", map[string]string{"app": ref(r.ID, r.Branch), "reason": r.Reason, "error": err.Error()}))
+			if slices.Contains(managed, r.ID) {
+				stillManaged[r.ID] = true
+			}
+			continue
+		}
+		generated = append(generated, events.NewEvent("app.remove.success", map[string]string{"app": ref(r.ID, r.Branch), "reason": r.Reason}))
+		removed = true
+	}
+	if removed && policy.Cleanup != nil && policy.Cleanup.AfterRemoval {
+		generated = append(generated, m.cleanupUnused(ctx, cleanupAfterRemoval))
+	}
+	if len(plan.Unmanaged) > 0 {
+		generated = append(generated, events.NewEvent("apps.unmanaged", map[string]any{"apps": plan.Unmanaged}))
+	}
+	holds := heldApps(policy)
+	holdEvents, err := m.reconcileHolds(ctx, holds, &record)
+	generated = append(generated, holdEvents...)
+	if err != nil {
+		return generated, err
+	}
+	if err := m.configureSoftware(ctx, policy.Updates); err != nil {
+		return generated, err
+	}
+	m.mu.Lock()
+	m.updates = &updateSettings{policy: policy.Updates, schedule: schedule, holds: holds,
+		maxDownload: policy.MeteredMaxDownloadBytes, cleanup: policy.Cleanup}
+	m.deferred = installs.Deferred
+	m.mu.Unlock()
+	ids := make([]string, 0, len(stillManaged))
+	for id := range stillManaged {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	record.Apps = ids
+	if err := m.saveManaged(record); err != nil {
+		return generated, err
+	}
+	return generated, nil
+}
+
+// RemoveManaged uninstalls the applications the policy required or the agent
+// installed, leaving apps the user installed alone.
+func (m *Manager) RemoveManaged(ctx context.Context, policy api.AppsPolicy) ([]api.Event, error) {
+	m.reconcileMu.Lock()
+	defer m.reconcileMu.Unlock()
+	installed, err := m.listApps(ctx)
 	if err != nil {
 		return nil, err
 	}
-	desired := map[string]api.AppDefinition{}
-	for _, app := range policy.Required {
-		desired[app.ID] = app
+	record, err := m.loadManaged()
+	if err != nil {
+		return nil, err
 	}
-	installedSet := map[string]api.InstalledApp{}
+	installedSet := map[string]struct{}{}
 	for _, app := range installed {
-		installedSet[app.ID] = app
+		installedSet[app.ID] = struct{}{}
+	}
+	ids := slices.Clone(record.Apps)
+	for _, def := range policy.Required {
+		if !slices.Contains(ids, def.ID) {
+			ids = append(ids, def.ID)
+		}
 	}
 	var generated []api.Event
-	for id, def := range desired {
-		if _, ok := installedSet[id]; ok {
+	for _, id := range ids {
+		if _, ok := installedSet[id]; !ok {
 			continue
 		}
-		if err := m.installFlatpak(ctx, def); err != nil {
-			m.logger.Error("failed to install app", slog.String("app", id), slog.String("error", err.Error()))
-			generated = append(generated, events.NewEvent("app.install.failure", map[string]string{"app": id, "error": err.Error()}))
+		if err := m.removeFlatpak(ctx, id); err != nil {
+			m.logger.Error("failed to remove app", slog.String("app", id), slog.String("error", err.Error()))
+			generated = append(generated, events.NewEvent("app.remove.failure", map[string]string{"app": id, "error": err.Error()}))
 			continue
 		}
-		generated = append(generated, events.NewEvent("app.install.success", map[string]string{"app": id}))
-	}
-	for id := range installedSet {
-		if _, ok := desired[id]; !ok {
-			if err := m.removeFlatpak(ctx, id); err != nil {
-				m.logger.Error("failed to remove app", slog.String("app", id), slog.String("error", err.Error()))
-				generated = append(generated, events.NewEvent("app.remove.failure", map[string]string{"app": id, "error": err.Error()}))
-				continue
+		generated = append(generated, events.NewEvent("app.remove.success", map[string]string{"app": id}))
+	}
+	// The rest of the record is needed by Remove.
+	record.Apps = nil
+	return generated, m.saveManaged(record)
+}
+
+// Remove undoes the system configuration the agent applied for policy: it
+// resets sandbox overrides, releases app holds, removes the GNOME Software
+// lockdown and deletes the remotes it added. Installed apps are left alone;
+// see RemoveManaged.
+func (m *Manager) Remove(ctx context.Context) ([]api.Event, error) {
+	m.reconcileMu.Lock()
+	defer m.reconcileMu.Unlock()
+	record, err := m.loadManaged()
+	if err != nil {
+		return nil, err
+	}
+	var errs []error
+	generated := m.reconcileOverrides(ctx, nil, &record)
+	holdEvents, err := m.reconcileHolds(ctx, nil, &record)
+	generated = append(generated, holdEvents...)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("release app holds: %w", err))
+	}
+	if err := m.configureSoftware(ctx, nil); err != nil {
+		errs = append(errs, err)
+	}
+	var added []string
+	for name, entry := range record.Remotes {
+		if entry.Added {
+			added = append(added, name)
+		}
+	}
+	remoteEvents, err := m.reconcileRemotes(ctx, nil, &record)
+	generated = append(generated, remoteEvents...)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("remove app remotes: %w", err))
+	}
+	for _, name := range added {
+		// Filters of remotes deleted outside the agent are left behind otherwise.
+		if _, kept := record.Remotes[name]; !kept {
+			if err := m.removeFilter(name); err != nil {
+				errs = append(errs, err)
 			}
-			generated = append(generated, events.NewEvent("app.remove.success", map[string]string{"app": id}))
 		}
 	}
-	return generated, nil
+	m.mu.Lock()
+	m.updates = nil
+	m.deferred = nil
+	m.mu.Unlock()
+	if err := m.saveManaged(record); err != nil {
+		errs = append(errs, err)
+	}
+	return generated, errors.Join(errs...)
+}
+
+// Forget discards the record of managed apps, leaving them installed.
+func (m *Manager) Forget() error {
+	m.reconcileMu.Lock()
+	defer m.reconcileMu.Unlock()
+	if _, err := util.RemoveFile(m.path); err != nil {
+		return fmt.Errorf("remove managed apps: %w", err)
+	}
+	return nil
+}
+
+// managedRecord is the on-disk record of the apps and remotes the agent
+// manages.
+type managedRecord struct {
+	Apps    []string                 `json:"apps"`
+	Remotes map[string]managedRemote `json:"remotes,omitempty"`
+	// Overrides lists apps whose sandbox overrides come from policy.
+	Overrides []string `json:"overrides,omitempty"`
+	// Masks lists the flatpak mask patterns the agent added for holds.
+	Masks []string `json:"masks,omitempty"`
+}
+
+// seedManaged returns the required apps that are already installed.
+func seedManaged(required []api.AppDefinition, installed []api.InstalledApp) []string {
+	var managed []string
+	for _, def := range required {
+		if slices.Contains(managed, def.ID) {
+			continue
+		}
+		if slices.ContainsFunc(installed, func(app api.InstalledApp) bool { return app.ID == def.ID }) {
+			managed = append(managed, def.ID)
+		}
+	}
+	return managed
+}
+
+func (m *Manager) loadManaged() (managedRecord, error) {
+	var record managedRecord
+	data, err := os.ReadFile(m.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return record, nil
+	}
+	if err != nil {
+		return record, fmt.Errorf("read managed apps: %w", err)
+	}
+	if err := json.Unmarshal(data, &record); err != nil {
+		return record, fmt.Errorf("decode managed apps: %w", err)
+	}
+	return record, nil
+}
+
+func (m *Manager) saveManaged(record managedRecord) error {
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal managed apps: %w", err)
+	}
+	if err := util.EnsureParentDir(m.path, 0o700); err != nil {
+		return err
+	}
+	tmp := m.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("write managed apps: %w", err)
+	}
+	if err := os.Rename(tmp, m.path); err != nil {
+		return fmt.Errorf("rename managed apps: %w", err)
+	}
+	return nil
 }
 
 func (m *Manager) installFlatpak(ctx context.Context, def api.AppDefinition) error {
 	if def.ID == "" {
 		return errors.New("app id missing")
 	}
-	if _, err := exec.LookPath("flatpak"); err != nil {
-		return fmt.Errorf("flatpak not available: %w", err)
-	}
 	args := []string{"install", "-y"}
 	if def.Source != "" {
 		args = append(args, def.Source)
 	}
-	args = append(args, def.ID)
-	cmd := exec.CommandContext(ctx, "flatpak", args...)
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("flatpak install %s: %w (%s)", def.ID, err, string(output))
+	args = append(args, ref(def.ID, def.Branch))
+	if _, err := m.flatpak(ctx, args...); err != nil {
+		return err
+	}
+	if def.Commit != "" {
+		return m.pinFlatpak(ctx, def)
 	}
 	return nil
 }
 
+// pinFlatpak moves an installed app to def.Commit, which may be older than
+// the installed commit.
+func (m *Manager) pinFlatpak(ctx context.Context, def api.AppDefinition) error {
+	_, err := m.flatpak(ctx, "update", "-y", "--commit="+def.Commit, ref(def.ID, def.Branch))
+	return err
+}
+
+// ref returns the partial ref flatpak accepts for an app on a branch.
+func ref(id, branch string) string {
+	if branch == "" {
+		return id
+	}
+	return id + "//" + branch
+}
+
 func (m *Manager) removeFlatpak(ctx context.Context, id string) error {
+	_, err := m.flatpak(ctx, "uninstall", "-y", id)
+	return err
+}
+
+func runFlatpak(ctx context.Context, args ...string) ([]byte, error) {
 	if _, err := exec.LookPath("flatpak"); err != nil {
-		return fmt.Errorf("flatpak not available: %w", err)
+		return nil, fmt.Errorf("flatpak not available: %w", err)
 	}
-	cmd := exec.CommandContext(ctx, "flatpak", "uninstall", "-y", id)
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("flatpak uninstall %s: %w (%s)", id, err, string(output))
+	cmd := exec.CommandContext(ctx, "flatpak", args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("flatpak %s: %w (%s)", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
 	}
-	return nil
+	return output, nil
 }
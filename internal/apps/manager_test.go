@@ -0,0 +1,169 @@
+package apps
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/evergreen-os/device-agent/pkg/api"
+)
+
+// newTestManager returns a Manager keeping its files in a temporary
+// directory and running flatpak commands through run.
+func newTestManager(t *testing.T, run func(context.Context, ...string) ([]byte, error)) *Manager {
+	t.Helper()
+	dir := t.TempDir()
+	manager := NewManager(slog.New(slog.NewTextHandler(io.Discard, nil)), filepath.Join(dir, "managed-apps.json"))
+	manager.flatpak = run
+	manager.dconfDir = filepath.Join(dir, "dconf")
+	manager.dconfUpdate = func(context.Context) error { return nil }
+	manager.metered = func(context.Context) (bool, error) { return false, nil }
+	manager.installRetryDelay = time.Millisecond
+	return manager
+}
+
+// fakeFlatpak keeps an installed app list and records the commands run.
+type fakeFlatpak struct {
+	mu        sync.Mutex
+	installed []api.InstalledApp
+	commands  []string
+}
+
+func newFakeFlatpak(ids ...string) *fakeFlatpak {
+	f := &fakeFlatpak{}
+	for _, id := range ids {
+		f.installed = append(f.installed, api.InstalledApp{ID: id, Branch: "stable", Commit: "abc123"})
+	}
+	return f
+}
+
+func (f *fakeFlatpak) run(_ context.Context, args ...string) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id, branch, _ := strings.Cut(args[len(args)-1], "//")
+	switch args[0] {
+	case "list":
+		var out strings.Builder
+		for _, app := range f.installed {
+			out.WriteString(app.ID + "\t" + app.Branch + "\t" + app.Commit + "\n")
+		}
+		return []byte(out.String()), nil
+	case "install":
+		if branch == "" {
+			branch = "stable"
+		}
+		f.installed = append(f.installed, api.InstalledApp{ID: id, Branch: branch, Commit: "def456"})
+	case "uninstall":
+		f.installed = slices.DeleteFunc(f.installed, func(app api.InstalledApp) bool {
+			return app.ID == id && (branch == "" || app.Branch == branch)
+		})
+	}
+	f.commands = append(f.commands, strings.Join(args, " "))
+	return nil, nil
+}
+
+func TestManagerRemovesOnlyAppsItInstalled(t *testing.T) {
+	fake := newFakeFlatpak("org.gnome.Calculator")
+	manager := newTestManager(t, fake.run)
+	ctx := context.Background()
+	// With a record in place the installed Calculator is the user's own.
+	if err := manager.saveManaged(managedRecord{}); err != nil {
+		t.Fatalf("save managed: %v", err)
+	}
+
+	first := api.AppsPolicy{Required: []api.AppDefinition{{ID: "org.mozilla.firefox", Source: "flathub"}, {ID: "org.gnome.Calculator"}}}
+	if _, err := manager.Apply(ctx, first); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	second := api.AppsPolicy{Required: []api.AppDefinition{{ID: "org.kde.krita"}}}
+	events, err := manager.Apply(ctx, second)
+	if err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	want := []string{
+		"install -y flathub org.mozilla.firefox",
+		"install -y org.kde.krita",
+		"uninstall -y org.mozilla.firefox",
+	}
+	if !reflect.DeepEqual(fake.commands, want) {
+		t.Fatalf("unexpected commands:\n got %q\nwant %q", fake.commands, want)
+	}
+	if len(events) == 0 || events[len(events)-1].Type != "app.remove.success" {
+		t.Fatalf("unexpected events %+v", events)
+	}
+	managed, err := manager.loadManaged()
+	if err != nil {
+		t.Fatalf("load managed: %v", err)
+	}
+	if !reflect.DeepEqual(managed.Apps, []string{"org.kde.krita"}) {
+		t.Fatalf("unexpected managed apps %v", managed)
+	}
+	if len(fake.installed) != 2 || fake.installed[0].ID != "org.gnome.Calculator" {
+		t.Fatalf("expected the user's app to stay installed, got %v", fake.installed)
+	}
+}
+
+func TestManagerSeedsRecordFromRequiredApps(t *testing.T) {
+	fake := newFakeFlatpak("org.mozilla.firefox", "org.gnome.Calculator")
+	manager := newTestManager(t, fake.run)
+	ctx := context.Background()
+
+	// No record yet: the previous agent installed the required Firefox.
+	first := api.AppsPolicy{Required: []api.AppDefinition{{ID: "org.mozilla.firefox"}, {ID: "org.kde.krita"}}}
+	if _, err := manager.Apply(ctx, first); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	managed, err := manager.loadManaged()
+	if err != nil {
+		t.Fatalf("load managed: %v", err)
+	}
+	if !reflect.DeepEqual(managed.Apps, []string{"org.kde.krita", "org.mozilla.firefox"}) {
+		t.Fatalf("unexpected managed apps %v", managed.Apps)
+	}
+	if _, err := manager.Apply(ctx, api.AppsPolicy{}); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	want := []string{
+		"install -y org.kde.krita",
+		"uninstall -y org.kde.krita",
+		"uninstall -y org.mozilla.firefox",
+	}
+	if !reflect.DeepEqual(fake.commands, want) {
+		t.Fatalf("unexpected commands:\n got %q\nwant %q", fake.commands, want)
+	}
+}
+
+func TestManagerReplacesWrongBranch(t *testing.T) {
+	fake := newFakeFlatpak("org.mozilla.firefox")
+	manager := newTestManager(t, fake.run)
+
+	policy := api.AppsPolicy{Required: []api.AppDefinition{{ID: "org.mozilla.firefox", Branch: "beta", Commit: "0123abcd"}}}
+	events, err := manager.Apply(context.Background(), policy)
+	if err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	want := []string{
+		"install -y org.mozilla.firefox//beta",
+		"update -y --commit=0123abcd org.mozilla.firefox//beta",
+		"uninstall -y org.mozilla.firefox//stable",
+		// Pinned apps are masked so updates leave them alone.
+		"mask --system",
+		"mask --system org.mozilla.firefox",
+	}
+	if !reflect.DeepEqual(fake.commands, want) {
+		t.Fatalf("unexpected commands:\n got %q\nwant %q", fake.commands, want)
+	}
+	if len(events) == 0 || events[0].Type != "app.deviation" {
+		t.Fatalf("expected a deviation event first, got %+v", events)
+	}
+	if d, ok := events[0].Payload.(deviation); !ok || d.Field != "branch" || d.Actual != "stable" {
+		t.Fatalf("unexpected deviation %+v", events[0].Payload)
+	}
+}
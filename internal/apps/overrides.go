@@ -0,0 +1,186 @@
+package apps
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/evergreen-os/device-agent/internal/events"
+	"github.com/evergreen-os/device-agent/pkg/api"
+)
+
+// overrideSet is the normalised content of a flatpak override keyfile, keyed
+// by "section/key". List values are sorted so equal overrides compare equal.
+type overrideSet map[string]string
+
+// String renders the set compactly for events and logs.
+func (o overrideSet) String() string {
+	var parts []string
+	for _, key := range slices.Sorted(maps.Keys(o)) {
+		parts = append(parts, key+"="+o[key])
+	}
+	return strings.Join(parts, " ")
+}
+
+// overrideKinds maps the permission lists to their keyfile key and the
+// flatpak override flags granting and revoking them.
+var overrideKinds = []struct {
+	key    string
+	list   func(*api.SandboxOverrides) []string
+	grant  string
+	revoke string
+}{
+	{"Context/filesystems", func(o *api.SandboxOverrides) []string { return o.Filesystems }, "--filesystem=", "--nofilesystem="},
+	{"Context/shared", func(o *api.SandboxOverrides) []string { return o.Shares }, "--share=", "--unshare="},
+	{"Context/sockets", func(o *api.SandboxOverrides) []string { return o.Sockets }, "--socket=", "--nosocket="},
+	{"Context/devices", func(o *api.SandboxOverrides) []string { return o.Devices }, "--device=", "--nodevice="},
+}
+
+// overrideArgs returns the flatpak override flags for o and the keyfile
+// content they produce.
+func overrideArgs(o *api.SandboxOverrides) ([]string, overrideSet, error) {
+	var args []string
+	want := overrideSet{}
+	for _, kind := range overrideKinds {
+		values := kind.list(o)
+		for _, value := range values {
+			name := strings.TrimPrefix(value, "!")
+			if name == "" || strings.ContainsAny(name, ";\n") {
+				return nil, nil, fmt.Errorf("invalid %s override %q", kind.key, value)
+			}
+			if strings.HasPrefix(value, "!") {
+				args = append(args, kind.revoke+name)
+			} else {
+				args = append(args, kind.grant+name)
+			}
+		}
+		if len(values) > 0 {
+			want[kind.key] = normalizeList(strings.Join(values, ";"))
+		}
+	}
+	for _, key := range slices.Sorted(maps.Keys(o.Environment)) {
+		if key == "" || strings.ContainsAny(key, "=\n") || strings.Contains(o.Environment[key], "\n") {
+			return nil, nil, fmt.Errorf("invalid environment override %q", key)
+		}
+		args = append(args, "--env="+key+"="+o.Environment[key])
+		want["Environment/"+key] = o.Environment[key]
+	}
+	for _, value := range o.TalkNames {
+		name := strings.TrimPrefix(value, "!")
+		if name == "" || strings.ContainsAny(name, "=\n") {
+			return nil, nil, fmt.Errorf("invalid talk name override %q", value)
+		}
+		if strings.HasPrefix(value, "!") {
+			args = append(args, "--no-talk-name="+name)
+			want["Session Bus Policy/"+name] = "none"
+		} else {
+			args = append(args, "--talk-name="+name)
+			want["Session Bus Policy/"+name] = "talk"
+		}
+	}
+	return args, want, nil
+}
+
+// parseOverrides reads the keyfile printed by flatpak override --show.
+func parseOverrides(keyfile string) overrideSet {
+	current := overrideSet{}
+	section := ""
+	scanner := bufio.NewScanner(strings.NewReader(keyfile))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = line[1 : len(line)-1]
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		if section == "Context" {
+			value = normalizeList(value)
+			if value == "" {
+				continue
+			}
+		}
+		current[section+"/"+key] = value
+	}
+	return current
+}
+
+func normalizeList(value string) string {
+	var items []string
+	for _, item := range strings.Split(value, ";") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	slices.Sort(items)
+	return strings.Join(slices.Compact(items), ";")
+}
+
+// reconcileOverrides applies the sandbox overrides of required apps, resets
+// them when they drifted, and resets apps whose overrides left the policy.
+// record.Overrides is updated with the apps whose overrides the agent owns.
+func (m *Manager) reconcileOverrides(ctx context.Context, required []api.AppDefinition, record *managedRecord) []api.Event {
+	var generated []api.Event
+	failure := func(id string, err error) {
+		m.logger.Error("failed to apply app overrides", slog.String("app", id), slog.String("error", err.Error()))
+		generated = append(generated, events.NewEvent("app.override.failure", map[string]string{"app": id, "error": err.Error()}))
+	}
+	var owned []string
+	for _, def := range required {
+		if def.Overrides == nil || slices.Contains(owned, def.ID) {
+			continue
+		}
+		owned = append(owned, def.ID)
+		args, want, err := overrideArgs(def.Overrides)
+		if err != nil {
+			failure(def.ID, err)
+			continue
+		}
+		output, err := m.flatpak(ctx, "override", "--system", "--show", def.ID)
+		if err != nil {
+			failure(def.ID, err)
+			continue
+		}
+		current := parseOverrides(string(output))
+		if maps.Equal(current, want) {
+			continue
+		}
+		if slices.Contains(record.Overrides, def.ID) {
+			d := deviation{ID: def.ID, Field: "overrides", Expected: want.String(), Actual: current.String()}
+			m.logger.Warn("app overrides drifted", slog.String("app", def.ID), slog.String("actual", d.Actual))
+			generated = append(generated, events.NewEvent("app.deviation", d))
+		}
+		if _, err := m.flatpak(ctx, "override", "--system", "--reset", def.ID); err != nil {
+			failure(def.ID, err)
+			continue
+		}
+		if _, err := m.flatpak(ctx, append([]string{"override", "--system"}, append(args, def.ID)...)...); err != nil {
+			failure(def.ID, err)
+			continue
+		}
+		generated = append(generated, events.NewEvent("app.override.success", map[string]string{"app": def.ID}))
+	}
+	for _, id := range record.Overrides {
+		if slices.Contains(owned, id) {
+			continue
+		}
+		if _, err := m.flatpak(ctx, "override", "--system", "--reset", id); err != nil {
+			failure(id, err)
+			owned = append(owned, id)
+			continue
+		}
+		generated = append(generated, events.NewEvent("app.override.reset", map[string]string{"app": id}))
+	}
+	slices.Sort(owned)
+	record.Overrides = owned
+	return generated
+}
@@ -0,0 +1,133 @@
+package apps
+
+import (
+	"context"
+	"maps"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/evergreen-os/device-agent/pkg/api"
+)
+
+func TestOverrideArgsMatchFlatpakKeyfile(t *testing.T) {
+	overrides := &api.SandboxOverrides{
+		Filesystems: []string{"!home", "xdg-download:ro"},
+		Shares:      []string{"!network"},
+		Sockets:     []string{"!x11", "wayland"},
+		Devices:     []string{"!all"},
+		Environment: map[string]string{"EXAM_MODE": "1"},
+		TalkNames:   []string{"!org.freedesktop.Flatpak"},
+	}
+	args, want, err := overrideArgs(overrides)
+	if err != nil {
+		t.Fatalf("override args: %v", err)
+	}
+	wantArgs := []string{
+		"--nofilesystem=home", "--filesystem=xdg-download:ro", "--unshare=network",
+		"--nosocket=x11", "--socket=wayland", "--nodevice=all", "--env=EXAM_MODE=1",
+		"--no-talk-name=org.freedesktop.Flatpak",
+	}
+	if !reflect.DeepEqual(args, wantArgs) {
+		t.Fatalf("unexpected args:\n got %q\nwant %q", args, wantArgs)
+	}
+	// What flatpak override --show prints after running those flags.
+	keyfile := `[Context]
+shared=!network;
+sockets=wayland;!x11;
+devices=!all;
+filesystems=xdg-download:ro;!home;
+
+[Environment]
+EXAM_MODE=1
+
+[Session Bus Policy]
+org.freedesktop.Flatpak=none
+`
+	if got := parseOverrides(keyfile); !maps.Equal(got, want) {
+		t.Fatalf("keyfile does not match:\n got %v\nwant %v", got, want)
+	}
+	if _, _, err := overrideArgs(&api.SandboxOverrides{Shares: []string{"!"}}); err == nil {
+		t.Fatalf("expected empty permission to fail")
+	}
+}
+
+func TestManagerResetsDriftedOverrides(t *testing.T) {
+	var keyfile string
+	var commands []string
+	run := func(_ context.Context, args ...string) ([]byte, error) {
+		if args[0] != "override" {
+			return nil, nil
+		}
+		commands = append(commands, strings.Join(args[1:], " "))
+		switch args[2] {
+		case "--show":
+			return []byte(keyfile), nil
+		case "--reset":
+			keyfile = ""
+		default:
+			keyfile = "[Context]\nshared=!network;\n"
+		}
+		return nil, nil
+	}
+	manager := newTestManager(t, run)
+	ctx := context.Background()
+	exam := api.AppDefinition{ID: "edu.example.Exam", Overrides: &api.SandboxOverrides{Shares: []string{"!network"}}}
+
+	if _, err := manager.Apply(ctx, api.AppsPolicy{Required: []api.AppDefinition{exam}}); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	// A local administrator grants network access again.
+	keyfile = "[Context]\nshared=network;\n"
+	events, err := manager.Apply(ctx, api.AppsPolicy{Required: []api.AppDefinition{exam}})
+	if err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	if n := len(events); n < 2 || events[n-2].Type != "app.deviation" || events[n-1].Type != "app.override.success" {
+		t.Fatalf("expected drift to be reported and repaired, got %+v", events)
+	}
+	// Dropping the overrides from policy resets them.
+	exam.Overrides = nil
+	if _, err := manager.Apply(ctx, api.AppsPolicy{Required: []api.AppDefinition{exam}}); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	want := []string{
+		"--system --show edu.example.Exam",
+		"--system --reset edu.example.Exam",
+		"--system --unshare=network edu.example.Exam",
+		"--system --show edu.example.Exam",
+		"--system --reset edu.example.Exam",
+		"--system --unshare=network edu.example.Exam",
+		"--system --reset edu.example.Exam",
+	}
+	if !reflect.DeepEqual(commands, want) {
+		t.Fatalf("unexpected commands:\n got %q\nwant %q", commands, want)
+	}
+}
+
+func TestManagerRemoveResetsOverrides(t *testing.T) {
+	var commands []string
+	run := func(_ context.Context, args ...string) ([]byte, error) {
+		if args[0] == "override" {
+			commands = append(commands, strings.Join(args[1:], " "))
+		}
+		return nil, nil
+	}
+	manager := newTestManager(t, run)
+	ctx := context.Background()
+	exam := api.AppDefinition{ID: "edu.example.Exam", Overrides: &api.SandboxOverrides{Shares: []string{"!network"}}}
+	if _, err := manager.Apply(ctx, api.AppsPolicy{Required: []api.AppDefinition{exam}}); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	commands = nil
+	events, err := manager.Remove(ctx)
+	if err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	if want := []string{"--system --reset edu.example.Exam"}; !reflect.DeepEqual(commands, want) {
+		t.Fatalf("unexpected commands %q, want %q", commands, want)
+	}
+	if len(events) != 1 || events[0].Type != "app.override.reset" {
+		t.Fatalf("unexpected events %+v", events)
+	}
+}
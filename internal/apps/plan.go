@@ -0,0 +1,151 @@
+package apps
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/evergreen-os/device-agent/pkg/api"
+)
+
+// Reasons an app is uninstalled.
+const (
+	removeBlocked        = "blocked"
+	removeDropped        = "no_longer_required"
+	removeUnmanaged      = "unmanaged"
+	removeBranchMismatch = "branch_mismatch"
+)
+
+type removal struct {
+	ID string
+	// Branch limits the removal to one installed branch of the app.
+	Branch string
+	Reason string
+}
+
+// deviation is a required app installed differently from what policy asks.
+type deviation struct {
+	ID       string `json:"app"`
+	Field    string `json:"field"`
+	Expected string `json:"expected"`
+	Actual   string `json:"actual"`
+}
+
+// plan lists the changes that bring the installed apps in line with policy.
+type plan struct {
+	Install []api.AppDefinition
+	// Pin lists installed apps to move to their pinned commit.
+	Pin    []api.AppDefinition
+	Remove []removal
+	// Unmanaged lists apps the policy does not mention, reported when the
+	// unmanaged mode is AppsUnmanagedReport.
+	Unmanaged  []string
+	Deviations []deviation
+}
+
+// planApps decides what to install and uninstall. managed holds the apps the
+// agent installed for earlier policies; those are removed once the policy no
+// longer requires or allows them, while apps a user installed are only
+// removed when blocked or when the unmanaged mode is AppsUnmanagedRemove.
+// Required apps take precedence over Allowed and Blocked patterns.
+func planApps(policy api.AppsPolicy, installed []api.InstalledApp, managed []string) (plan, error) {
+	mode := policy.Unmanaged
+	switch mode {
+	case "":
+		mode = api.AppsUnmanagedKeep
+	case api.AppsUnmanagedKeep, api.AppsUnmanagedReport, api.AppsUnmanagedRemove:
+	default:
+		return plan{}, fmt.Errorf("unknown unmanaged apps mode %q", policy.Unmanaged)
+	}
+	for _, pattern := range slices.Concat(policy.Allowed, policy.Blocked) {
+		if err := validatePattern(pattern); err != nil {
+			return plan{}, err
+		}
+	}
+
+	required := map[string]bool{}
+	installedSet := map[string][]api.InstalledApp{}
+	for _, app := range installed {
+		installedSet[app.ID] = append(installedSet[app.ID], app)
+	}
+	var result plan
+	for _, def := range policy.Required {
+		if required[def.ID] {
+			continue
+		}
+		required[def.ID] = true
+		result.planRequired(def, installedSet[def.ID])
+	}
+	ids := make([]string, 0, len(installedSet))
+	for id := range installedSet {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	for _, id := range ids {
+		switch {
+		case required[id]:
+		case matchAny(policy.Blocked, id):
+			result.Remove = append(result.Remove, removal{ID: id, Reason: removeBlocked})
+		case matchAny(policy.Allowed, id):
+		case slices.Contains(managed, id):
+			result.Remove = append(result.Remove, removal{ID: id, Reason: removeDropped})
+		case mode == api.AppsUnmanagedRemove:
+			result.Remove = append(result.Remove, removal{ID: id, Reason: removeUnmanaged})
+		case mode == api.AppsUnmanagedReport:
+			result.Unmanaged = append(result.Unmanaged, id)
+		}
+	}
+	return result, nil
+}
+
+// planRequired compares a required app with its installed branches.
+func (p *plan) planRequired(def api.AppDefinition, refs []api.InstalledApp) {
+	if len(refs) == 0 {
+		p.Install = append(p.Install, def)
+		return
+	}
+	current := refs[0]
+	if def.Branch != "" {
+		i := slices.IndexFunc(refs, func(ref api.InstalledApp) bool { return ref.Branch == def.Branch })
+		if i < 0 {
+			// Replace the wrong branch rather than keeping both around.
+			p.Deviations = append(p.Deviations, deviation{ID: def.ID, Field: "branch", Expected: def.Branch, Actual: current.Branch})
+			p.Install = append(p.Install, def)
+			for _, ref := range refs {
+				p.Remove = append(p.Remove, removal{ID: def.ID, Branch: ref.Branch, Reason: removeBranchMismatch})
+			}
+			return
+		}
+		current = refs[i]
+	}
+	if def.Commit != "" && !sameCommit(def.Commit, current.Commit) {
+		p.Deviations = append(p.Deviations, deviation{ID: def.ID, Field: "commit", Expected: def.Commit, Actual: current.Commit})
+		p.Pin = append(p.Pin, def)
+	}
+}
+
+// sameCommit compares commits, allowing either side to be abbreviated as
+// flatpak list does.
+func sameCommit(a, b string) bool {
+	if a == "" || b == "" {
+		return a == b
+	}
+	return strings.HasPrefix(a, b) || strings.HasPrefix(b, a)
+}
+
+func validatePattern(pattern string) error {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("invalid app pattern %q: %w", pattern, err)
+	}
+	return nil
+}
+
+func matchAny(patterns []string, id string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, id); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,108 @@
+package apps
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/evergreen-os/device-agent/pkg/api"
+)
+
+func TestPlanApps(t *testing.T) {
+	installed := []api.InstalledApp{
+		{ID: "org.gnome.Calculator"},
+		{ID: "org.mozilla.firefox"},
+		{ID: "com.valvesoftware.Steam"},
+		{ID: "org.kde.krita"},
+		{ID: "org.gimp.GIMP"},
+	}
+	cases := []struct {
+		name    string
+		policy  api.AppsPolicy
+		managed []string
+		want    plan
+	}{
+		{
+			name:   "user apps are kept by default",
+			policy: api.AppsPolicy{Required: []api.AppDefinition{{ID: "org.mozilla.firefox"}, {ID: "org.libreoffice.LibreOffice"}}},
+			want:   plan{Install: []api.AppDefinition{{ID: "org.libreoffice.LibreOffice"}}},
+		},
+		{
+			name: "blocked patterns and dropped managed apps are removed",
+			policy: api.AppsPolicy{
+				Required: []api.AppDefinition{{ID: "org.mozilla.firefox"}},
+				Allowed:  []string{"org.gnome.*"},
+				Blocked:  []string{"com.valvesoftware.*"},
+			},
+			managed: []string{"org.mozilla.firefox", "org.kde.krita", "org.gnome.Calculator"},
+			want: plan{Remove: []removal{
+				{ID: "com.valvesoftware.Steam", Reason: removeBlocked},
+				{ID: "org.kde.krita", Reason: removeDropped},
+			}},
+		},
+		{
+			name:   "required apps win over blocked patterns",
+			policy: api.AppsPolicy{Required: []api.AppDefinition{{ID: "org.gimp.GIMP"}}, Blocked: []string{"*"}},
+			want: plan{Remove: []removal{
+				{ID: "com.valvesoftware.Steam", Reason: removeBlocked},
+				{ID: "org.gnome.Calculator", Reason: removeBlocked},
+				{ID: "org.kde.krita", Reason: removeBlocked},
+				{ID: "org.mozilla.firefox", Reason: removeBlocked},
+			}},
+		},
+		{
+			name:   "unmanaged apps are reported",
+			policy: api.AppsPolicy{Allowed: []string{"org.*"}, Unmanaged: api.AppsUnmanagedReport},
+			want:   plan{Unmanaged: []string{"com.valvesoftware.Steam"}},
+		},
+		{
+			name:   "unmanaged apps are removed",
+			policy: api.AppsPolicy{Allowed: []string{"org.gnome.*", "org.mozilla.*"}, Unmanaged: api.AppsUnmanagedRemove},
+			want: plan{Remove: []removal{
+				{ID: "com.valvesoftware.Steam", Reason: removeUnmanaged},
+				{ID: "org.gimp.GIMP", Reason: removeUnmanaged},
+				{ID: "org.kde.krita", Reason: removeUnmanaged},
+			}},
+		},
+	}
+	for _, tc := range cases {
+		got, err := planApps(tc.policy, installed, tc.managed)
+		if err != nil {
+			t.Fatalf("%s: plan: %v", tc.name, err)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Fatalf("%s: unexpected plan:\n got %+v\nwant %+v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestPlanAppsBranchAndCommit(t *testing.T) {
+	installed := []api.InstalledApp{
+		{ID: "org.mozilla.firefox", Branch: "stable", Commit: "1111aaaa2222"},
+		{ID: "org.gnome.Builder", Branch: "stable", Commit: "3333bbbb4444"},
+		{ID: "org.gnome.Builder", Branch: "nightly", Commit: "5555cccc6666"},
+	}
+	policy := api.AppsPolicy{Required: []api.AppDefinition{
+		{ID: "org.mozilla.firefox", Branch: "stable", Commit: "1111aaaa2222ffff"},
+		{ID: "org.gnome.Builder", Branch: "stable", Commit: "7777dddd"},
+	}}
+	got, err := planApps(policy, installed, nil)
+	if err != nil {
+		t.Fatalf("plan: %v", err)
+	}
+	want := plan{
+		Pin:        []api.AppDefinition{policy.Required[1]},
+		Deviations: []deviation{{ID: "org.gnome.Builder", Field: "commit", Expected: "7777dddd", Actual: "3333bbbb4444"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected plan:\n got %+v\nwant %+v", got, want)
+	}
+}
+
+func TestPlanAppsRejectsInvalidPolicy(t *testing.T) {
+	if _, err := planApps(api.AppsPolicy{Unmanaged: "purge"}, nil, nil); err == nil {
+		t.Fatalf("expected unknown unmanaged mode to fail")
+	}
+	if _, err := planApps(api.AppsPolicy{Blocked: []string{"org.[gnome"}}, nil, nil); err == nil {
+		t.Fatalf("expected malformed pattern to fail")
+	}
+}
@@ -0,0 +1,269 @@
+package apps
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/evergreen-os/device-agent/internal/events"
+	"github.com/evergreen-os/device-agent/internal/util"
+	"github.com/evergreen-os/device-agent/pkg/api"
+)
+
+// defaultRemotePriority is the priority flatpak gives remotes without one.
+const defaultRemotePriority = 1
+
+// remoteInfo is a configured remote as listed by flatpak.
+type remoteInfo struct {
+	Name         string
+	URL          string
+	Priority     int
+	CollectionID string
+	Disabled     bool
+}
+
+// managedRemote records a remote the agent configured from policy.
+type managedRemote struct {
+	// Digest identifies the policy definition last applied, so changes
+	// flatpak does not list (such as the GPG key) are still noticed.
+	Digest string `json:"digest"`
+	// Added is set for remotes the agent created; only those are deleted
+	// when policy drops them.
+	Added bool `json:"added,omitempty"`
+}
+
+// remotePlan lists the changes that bring the configured remotes in line
+// with policy.
+type remotePlan struct {
+	Add    []api.FlatpakRemote
+	Modify []api.FlatpakRemote
+	Delete []string
+}
+
+// planRemotes compares the remotes policy asks for with those configured.
+// Remotes that drifted or whose definition changed are modified; remotes the
+// agent added are deleted once policy no longer lists them.
+func planRemotes(desired []api.FlatpakRemote, current []remoteInfo, managed map[string]managedRemote) (remotePlan, error) {
+	var result remotePlan
+	seen := map[string]bool{}
+	for _, remote := range desired {
+		if remote.Name == "" || remote.URL == "" {
+			return remotePlan{}, fmt.Errorf("remote %q needs a name and url", remote.Name)
+		}
+		if strings.ContainsAny(remote.Name, "/ ") {
+			return remotePlan{}, fmt.Errorf("invalid remote name %q", remote.Name)
+		}
+		if seen[remote.Name] {
+			return remotePlan{}, fmt.Errorf("remote %q listed twice", remote.Name)
+		}
+		seen[remote.Name] = true
+		i := slices.IndexFunc(current, func(info remoteInfo) bool { return info.Name == remote.Name })
+		if i < 0 {
+			result.Add = append(result.Add, remote)
+			continue
+		}
+		info := current[i]
+		if info.URL != remote.URL || info.Priority != remotePriority(remote) ||
+			info.CollectionID != remote.CollectionID || info.Disabled != remote.Disabled ||
+			managed[remote.Name].Digest != remoteDigest(remote) {
+			result.Modify = append(result.Modify, remote)
+		}
+	}
+	for _, info := range current {
+		if !seen[info.Name] && managed[info.Name].Added {
+			result.Delete = append(result.Delete, info.Name)
+		}
+	}
+	return result, nil
+}
+
+func remotePriority(remote api.FlatpakRemote) int {
+	if remote.Priority == 0 {
+		return defaultRemotePriority
+	}
+	return remote.Priority
+}
+
+func remoteDigest(remote api.FlatpakRemote) string {
+	data, _ := json.Marshal(remote)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// listRemotes returns the system-wide remotes, including disabled ones.
+func (m *Manager) listRemotes(ctx context.Context) ([]remoteInfo, error) {
+	output, err := m.flatpak(ctx, "remotes", "--system", "--show-disabled", "--columns=name,url,priority,collection,options")
+	if err != nil {
+		return nil, err
+	}
+	var remotes []remoteInfo
+	scanner := bufio.NewScanner(strings.NewReader(string(output)))
+	for scanner.Scan() {
+		parts := strings.Split(scanner.Text(), "\t")
+		if len(parts) < 5 || strings.TrimSpace(parts[0]) == "" {
+			continue
+		}
+		column := func(i int) string {
+			value := strings.TrimSpace(parts[i])
+			if value == "-" {
+				return ""
+			}
+			return value
+		}
+		info := remoteInfo{Name: column(0), URL: column(1), CollectionID: column(3)}
+		info.Priority, _ = strconv.Atoi(column(2))
+		info.Disabled = slices.Contains(strings.Split(column(4), ","), "disabled")
+		remotes = append(remotes, info)
+	}
+	return remotes, scanner.Err()
+}
+
+// reconcileRemotes adds, modifies and deletes remotes and updates
+// record.Remotes with the outcome.
+func (m *Manager) reconcileRemotes(ctx context.Context, desired []api.FlatpakRemote, record *managedRecord) ([]api.Event, error) {
+	if len(desired) == 0 && len(record.Remotes) == 0 {
+		return nil, nil
+	}
+	current, err := m.listRemotes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	plan, err := planRemotes(desired, current, record.Remotes)
+	if err != nil {
+		return nil, err
+	}
+	// Remotes keep their previous record until a change succeeds, so
+	// failures are retried with the next policy.
+	managed := map[string]managedRemote{}
+	for _, remote := range desired {
+		if entry, ok := record.Remotes[remote.Name]; ok {
+			managed[remote.Name] = entry
+		}
+	}
+	var generated []api.Event
+	result := func(action string, remote api.FlatpakRemote, err error) {
+		if err != nil {
+			m.logger.Error("failed to "+action+" remote", slog.String("remote", remote.Name), slog.String("error", err.Error()))
+			generated = append(generated, events.NewEvent("app.remote."+action+".failure", map[string]string{"remote": remote.Name, "error": err.Error()}))
+			return
+		}
+		generated = append(generated, events.NewEvent("app.remote."+action+".success", map[string]string{"remote": remote.Name, "url": remote.URL}))
+	}
+	for _, remote := range plan.Add {
+		err := m.addRemote(ctx, remote)
+		if err == nil {
+			managed[remote.Name] = managedRemote{Digest: remoteDigest(remote), Added: true}
+		}
+		result("add", remote, err)
+	}
+	for _, remote := range plan.Modify {
+		err := m.modifyRemote(ctx, remote)
+		if err == nil {
+			managed[remote.Name] = managedRemote{Digest: remoteDigest(remote), Added: record.Remotes[remote.Name].Added}
+		}
+		result("update", remote, err)
+	}
+	for _, name := range plan.Delete {
+		_, err := m.flatpak(ctx, "remote-delete", "--system", "--force", name)
+		if err == nil {
+			err = m.removeFilter(name)
+		}
+		if err != nil {
+			managed[name] = record.Remotes[name]
+		}
+		result("remove", api.FlatpakRemote{Name: name}, err)
+	}
+	record.Remotes = managed
+	return generated, nil
+}
+
+func (m *Manager) addRemote(ctx context.Context, remote api.FlatpakRemote) error {
+	args := []string{"remote-add", "--system", "--prio=" + strconv.Itoa(remotePriority(remote))}
+	if remote.CollectionID != "" {
+		args = append(args, "--collection-id="+remote.CollectionID)
+	}
+	if remote.Disabled {
+		args = append(args, "--disable")
+	}
+	return m.runRemoteCommand(ctx, remote, args, remote.Name, remote.URL)
+}
+
+func (m *Manager) modifyRemote(ctx context.Context, remote api.FlatpakRemote) error {
+	args := []string{"remote-modify", "--system", "--url=" + remote.URL, "--prio=" + strconv.Itoa(remotePriority(remote))}
+	if remote.CollectionID != "" {
+		args = append(args, "--collection-id="+remote.CollectionID)
+	}
+	if remote.Disabled {
+		args = append(args, "--disable")
+	} else {
+		args = append(args, "--enable")
+	}
+	if remote.Filter == "" {
+		args = append(args, "--no-filter")
+		if err := m.removeFilter(remote.Name); err != nil {
+			return err
+		}
+	}
+	return m.runRemoteCommand(ctx, remote, args, remote.Name)
+}
+
+// runRemoteCommand writes the remote's filter and GPG key to files flatpak
+// can read, then runs the command with the given trailing arguments.
+func (m *Manager) runRemoteCommand(ctx context.Context, remote api.FlatpakRemote, args []string, trailing ...string) error {
+	if remote.Filter != "" {
+		path := m.filterPath(remote.Name)
+		if err := writeFileAtomic(path, []byte(remote.Filter), 0o644); err != nil {
+			return fmt.Errorf("write remote filter: %w", err)
+		}
+		args = append(args, "--filter="+path)
+	}
+	if remote.GPGKey != "" {
+		key, err := os.CreateTemp("", "evergreen-remote-*.gpg")
+		if err != nil {
+			return fmt.Errorf("create gpg key file: %w", err)
+		}
+		defer os.Remove(key.Name())
+		_, err = key.WriteString(remote.GPGKey)
+		if closeErr := key.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return fmt.Errorf("write gpg key file: %w", err)
+		}
+		args = append(args, "--gpg-import="+key.Name())
+	}
+	_, err := m.flatpak(ctx, append(args, trailing...)...)
+	return err
+}
+
+// filterPath is where the filter file of a remote is kept.
+func (m *Manager) filterPath(name string) string {
+	return filepath.Join(filepath.Dir(m.path), "flatpak-filters", name+".filter")
+}
+
+func (m *Manager) removeFilter(name string) error {
+	if _, err := util.RemoveFile(m.filterPath(name)); err != nil {
+		return fmt.Errorf("remove remote filter: %w", err)
+	}
+	return nil
+}
+
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	if err := util.EnsureParentDir(path, 0o755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,148 @@
+package apps
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/evergreen-os/device-agent/pkg/api"
+)
+
+func TestPlanRemotes(t *testing.T) {
+	school := api.FlatpakRemote{Name: "school", URL: "https://apps.example.edu/repo", Priority: 10}
+	flathub := api.FlatpakRemote{Name: "flathub", URL: "https://dl.flathub.org/repo/", Disabled: true}
+	current := []remoteInfo{
+		{Name: "flathub", URL: "https://dl.flathub.org/repo/", Priority: 1},
+		{Name: "old", URL: "https://old.example.edu/repo", Priority: 1},
+		{Name: "fedora", URL: "oci+https://registry.fedoraproject.org", Priority: 1},
+	}
+	managed := map[string]managedRemote{
+		"old":    {Digest: "x", Added: true},
+		"fedora": {Digest: "y"},
+	}
+	got, err := planRemotes([]api.FlatpakRemote{school, flathub}, current, managed)
+	if err != nil {
+		t.Fatalf("plan: %v", err)
+	}
+	want := remotePlan{
+		Add:    []api.FlatpakRemote{school},
+		Modify: []api.FlatpakRemote{flathub},
+		Delete: []string{"old"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected plan:\n got %+v\nwant %+v", got, want)
+	}
+
+	// Once applied, an unchanged remote is left alone.
+	current = append(current, remoteInfo{Name: "school", URL: school.URL, Priority: 10})
+	managed["school"] = managedRemote{Digest: remoteDigest(school), Added: true}
+	got, err = planRemotes([]api.FlatpakRemote{school}, current[2:], managed)
+	if err != nil {
+		t.Fatalf("plan: %v", err)
+	}
+	if len(got.Add) != 0 || len(got.Modify) != 0 || len(got.Delete) != 0 {
+		t.Fatalf("expected no changes, got %+v", got)
+	}
+
+	if _, err := planRemotes([]api.FlatpakRemote{school, school}, nil, nil); err == nil {
+		t.Fatalf("expected duplicate remotes to fail")
+	}
+}
+
+func TestManagerAddsRemoteBeforeInstalling(t *testing.T) {
+	var commands []string
+	var filter, key string
+	run := func(_ context.Context, args ...string) ([]byte, error) {
+		commands = append(commands, args[0])
+		for _, arg := range args {
+			if path, ok := strings.CutPrefix(arg, "--filter="); ok {
+				data, _ := os.ReadFile(path)
+				filter = string(data)
+			}
+			if path, ok := strings.CutPrefix(arg, "--gpg-import="); ok {
+				data, _ := os.ReadFile(path)
+				key = string(data)
+			}
+		}
+		return nil, nil
+	}
+	manager := newTestManager(t, run)
+
+	policy := api.AppsPolicy{
+		Required: []api.AppDefinition{{ID: "edu.example.Exam", Source: "school"}},
+		Remotes: []api.FlatpakRemote{{
+			Name:   "school",
+			URL:    "https://apps.example.edu/repo",
+			GPGKey: "-----BEGIN PGP PUBLIC KEY BLOCK-----",
+			Filter: "deny *\nallow app/edu.example.*\n",
+		}},
+	}
+	if _, err := manager.Apply(context.Background(), policy); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	if want := []string{"list", "remotes", "remote-add", "install"}; !reflect.DeepEqual(commands, want) {
+		t.Fatalf("unexpected commands %q, want %q", commands, want)
+	}
+	if filter != policy.Remotes[0].Filter || key != policy.Remotes[0].GPGKey {
+		t.Fatalf("expected filter and key files to be passed, got %q %q", filter, key)
+	}
+	record, err := manager.loadManaged()
+	if err != nil {
+		t.Fatalf("load managed: %v", err)
+	}
+	if !record.Remotes["school"].Added {
+		t.Fatalf("expected the remote to be recorded as added, got %+v", record.Remotes)
+	}
+}
+
+func TestManagerRemoveDeletesAddedRemotes(t *testing.T) {
+	remotes := map[string]string{"flathub": "https://dl.flathub.org/repo/"}
+	var commands []string
+	run := func(_ context.Context, args ...string) ([]byte, error) {
+		switch args[0] {
+		case "remotes":
+			var out strings.Builder
+			for name, url := range remotes {
+				out.WriteString(name + "\t" + url + "\t1\t-\tsystem\n")
+			}
+			return []byte(out.String()), nil
+		case "remote-add":
+			remotes[args[len(args)-2]] = args[len(args)-1]
+		case "remote-modify", "remote-delete":
+			commands = append(commands, args[0]+" "+args[len(args)-1])
+			if args[0] == "remote-delete" {
+				delete(remotes, args[len(args)-1])
+			}
+		}
+		return nil, nil
+	}
+	manager := newTestManager(t, run)
+	ctx := context.Background()
+	policy := api.AppsPolicy{Remotes: []api.FlatpakRemote{
+		{Name: "school", URL: "https://apps.example.edu/repo", Priority: 1, Filter: "allow app/edu.example.*\n"},
+		{Name: "flathub", URL: "https://dl.flathub.org/repo/", Priority: 1, Disabled: true},
+	}}
+	if _, err := manager.Apply(ctx, policy); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	if _, err := os.Stat(manager.filterPath("school")); err != nil {
+		t.Fatalf("expected a filter file, got %v", err)
+	}
+	commands = nil
+	events, err := manager.Remove(ctx)
+	if err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	// Image remotes are never deleted, only the ones the agent added.
+	if want := []string{"remote-delete school"}; !reflect.DeepEqual(commands, want) {
+		t.Fatalf("unexpected commands %q, want %q", commands, want)
+	}
+	if len(events) != 1 || events[0].Type != "app.remote.remove.success" {
+		t.Fatalf("unexpected events %+v", events)
+	}
+	if _, err := os.Stat(manager.filterPath("school")); !os.IsNotExist(err) {
+		t.Fatalf("expected the filter file to be removed, got %v", err)
+	}
+}
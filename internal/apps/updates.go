@@ -0,0 +1,351 @@
+package apps
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/evergreen-os/device-agent/internal/events"
+	"github.com/evergreen-os/device-agent/internal/updates"
+	"github.com/evergreen-os/device-agent/internal/util"
+	"github.com/evergreen-os/device-agent/pkg/api"
+)
+
+// softwareDconfFile names the dconf keyfile and lock file the agent writes
+// to keep GNOME Software from updating apps behind its back.
+const softwareDconfFile = "00-evergreen-software"
+
+// UpdateResult summarises a periodic update check.
+type UpdateResult struct {
+	Available []api.AppUpdate
+	Events    []api.Event
+}
+
+// updateSettings is the update policy captured by the last Apply.
+type updateSettings struct {
+	policy      *api.AppUpdatePolicy
+	schedule    updates.Schedule
+	holds       []string
+	maxDownload uint64
+	cleanup     *api.AppCleanupPolicy
+}
+
+// validateUpdatePolicy checks the mode and parses the maintenance windows.
+func validateUpdatePolicy(policy *api.AppUpdatePolicy) (updates.Schedule, error) {
+	if policy == nil {
+		return nil, nil
+	}
+	switch policy.Mode {
+	case api.AppUpdatesAuto, api.AppUpdatesManual, api.AppUpdatesWindow:
+	default:
+		return nil, fmt.Errorf("unknown app update mode %q", policy.Mode)
+	}
+	schedule, err := updates.ParseSchedule(policy.MaintenanceWindows)
+	if err != nil {
+		return nil, err
+	}
+	if policy.Mode == api.AppUpdatesWindow && len(schedule) == 0 {
+		return nil, fmt.Errorf("app update mode %q needs maintenance windows", policy.Mode)
+	}
+	for _, pattern := range policy.Holds {
+		if err := validatePattern(pattern); err != nil {
+			return nil, err
+		}
+	}
+	return schedule, nil
+}
+
+// heldApps returns the mask patterns policy asks for: explicit holds plus
+// apps pinned to a commit, which an update would move off the pin.
+func heldApps(policy api.AppsPolicy) []string {
+	var holds []string
+	if policy.Updates != nil {
+		holds = append(holds, policy.Updates.Holds...)
+	}
+	for _, def := range policy.Required {
+		if def.Commit != "" {
+			holds = append(holds, def.ID)
+		}
+	}
+	slices.Sort(holds)
+	return slices.Compact(holds)
+}
+
+// reconcileHolds masks held apps so neither the agent nor GNOME Software
+// updates them, and unmasks patterns the agent added that left the policy.
+func (m *Manager) reconcileHolds(ctx context.Context, holds []string, record *managedRecord) ([]api.Event, error) {
+	if len(holds) == 0 && len(record.Masks) == 0 {
+		return nil, nil
+	}
+	output, err := m.flatpak(ctx, "mask", "--system")
+	if err != nil {
+		return nil, err
+	}
+	current := strings.Fields(string(output))
+	var generated []api.Event
+	owned := slices.Clone(holds)
+	for _, pattern := range holds {
+		if slices.Contains(current, pattern) {
+			continue
+		}
+		if _, err := m.flatpak(ctx, "mask", "--system", pattern); err != nil {
+			m.logger.Error("failed to hold app", slog.String("pattern", pattern), slog.String("error", err.Error()))
+			generated = append(generated, events.NewEvent("app.hold.failure", map[string]string{"pattern": pattern, "error": err.Error()}))
+			continue
+		}
+		generated = append(generated, events.NewEvent("app.hold.success", map[string]string{"pattern": pattern}))
+	}
+	for _, pattern := range record.Masks {
+		if slices.Contains(holds, pattern) || !slices.Contains(current, pattern) {
+			continue
+		}
+		if _, err := m.flatpak(ctx, "mask", "--system", "--remove", pattern); err != nil {
+			m.logger.Error("failed to release app", slog.String("pattern", pattern), slog.String("error", err.Error()))
+			generated = append(generated, events.NewEvent("app.release.failure", map[string]string{"pattern": pattern, "error": err.Error()}))
+			owned = append(owned, pattern)
+			continue
+		}
+		generated = append(generated, events.NewEvent("app.release.success", map[string]string{"pattern": pattern}))
+	}
+	slices.Sort(owned)
+	record.Masks = owned
+	return generated, nil
+}
+
+// configureSoftware writes the GNOME Software dconf defaults and locks that
+// match the update policy, or removes them when there is none.
+func (m *Manager) configureSoftware(ctx context.Context, policy *api.AppUpdatePolicy) error {
+	settings := filepath.Join(m.dconfDir, "local.d", softwareDconfFile)
+	locks := filepath.Join(m.dconfDir, "local.d", "locks", softwareDconfFile)
+	var changed bool
+	if policy == nil {
+		for _, path := range []string{settings, locks} {
+			removed, err := util.RemoveFile(path)
+			if err != nil {
+				return fmt.Errorf("remove gnome software settings: %w", err)
+			}
+			changed = changed || removed
+		}
+	} else {
+		// The agent installs updates itself; GNOME Software may still offer
+		// them to users unless updates are restricted to a window.
+		content := fmt.Sprintf("[org/gnome/software]\ndownload-updates=false\ndownload-updates-notify=false\nallow-updates=%t\n",
+			policy.Mode != api.AppUpdatesWindow)
+		lockContent := "/org/gnome/software/download-updates\n/org/gnome/software/download-updates-notify\n/org/gnome/software/allow-updates\n"
+		for path, data := range map[string]string{settings: content, locks: lockContent} {
+			current, err := os.ReadFile(path)
+			if err == nil && string(current) == data {
+				continue
+			}
+			if err := writeFileAtomic(path, []byte(data), 0o644); err != nil {
+				return fmt.Errorf("write gnome software settings: %w", err)
+			}
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return m.dconfUpdate(ctx)
+}
+
+func runDconfUpdate(ctx context.Context) error {
+	if _, err := exec.LookPath("dconf"); err != nil {
+		return fmt.Errorf("dconf not available: %w", err)
+	}
+	if output, err := exec.CommandContext(ctx, "dconf", "update").CombinedOutput(); err != nil {
+		return fmt.Errorf("dconf update: %w (%s)", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// Update installs apps deferred on a metered connection, removes unused
+// runtimes when disk space runs low, lists available app updates and installs
+// those the update policy allows right now. It does nothing until a policy
+// has been applied.
+func (m *Manager) Update(ctx context.Context) (UpdateResult, error) {
+	m.reconcileMu.Lock()
+	defer m.reconcileMu.Unlock()
+	m.mu.Lock()
+	settings := m.updates
+	deferred := m.deferred
+	m.mu.Unlock()
+	if settings == nil {
+		return UpdateResult{}, nil
+	}
+	var result UpdateResult
+	if len(deferred) > 0 {
+		events, err := m.installDeferred(ctx, deferred, settings.maxDownload)
+		result.Events = append(result.Events, events...)
+		if err != nil {
+			return result, err
+		}
+	}
+	cleanupEvents, err := m.cleanupIfLow(ctx, settings.cleanup)
+	result.Events = append(result.Events, cleanupEvents...)
+	if err != nil {
+		m.logger.Warn("low disk space check failed", slog.String("error", err.Error()))
+	}
+	available, err := m.listUpdates(ctx, settings.holds)
+	if err != nil {
+		return result, err
+	}
+	result.Available = available
+	policy := settings.policy
+	if policy == nil || policy.Mode == api.AppUpdatesManual {
+		return result, nil
+	}
+	if policy.Mode == api.AppUpdatesWindow && !settings.schedule.Allows(m.now()) {
+		return result, nil
+	}
+	var pending []string
+	for _, update := range available {
+		if !update.Held {
+			pending = append(pending, ref(update.ID, update.Branch))
+		}
+	}
+	if len(pending) == 0 {
+		return result, nil
+	}
+	if deferEvent, deferred := m.deferMeteredUpdate(ctx, result.Available, pending, settings.maxDownload); deferred {
+		for i := range result.Available {
+			result.Available[i].Deferred = !result.Available[i].Held
+		}
+		if deferEvent != nil {
+			result.Events = append(result.Events, *deferEvent)
+		}
+		return result, nil
+	}
+	// Masks keep held apps out of the update.
+	if _, err := m.flatpak(ctx, "update", "-y", "--noninteractive"); err != nil {
+		m.logger.Error("app update failed", slog.String("error", err.Error()))
+		result.Events = append(result.Events, events.NewEvent("apps.update.failure", map[string]any{"apps": pending, "error": err.Error()}))
+		return result, err
+	}
+	result.Events = append(result.Events, events.NewEvent("apps.update.success", map[string]any{"apps": pending}))
+	result.Available = slices.DeleteFunc(result.Available, func(update api.AppUpdate) bool { return !update.Held })
+	return result, nil
+}
+
+// deferMeteredUpdate reports whether the pending updates must wait because
+// the connection is metered and they, including runtime updates, download
+// more than maxDownload or an unknown amount. The event is only returned when
+// the deferral starts.
+func (m *Manager) deferMeteredUpdate(ctx context.Context, available []api.AppUpdate, pending []string, maxDownload uint64) (*api.Event, bool) {
+	if maxDownload == 0 {
+		maxDownload = defaultMeteredMaxDownload
+	}
+	metered, err := m.metered(ctx)
+	if err != nil {
+		m.logger.Debug("metered state unknown", slog.String("error", err.Error()))
+	}
+	var size uint64
+	known := true
+	if metered {
+		size, known, err = m.updateDownloadSize(ctx, available)
+		if err != nil {
+			m.logger.Warn("failed to look up update sizes", slog.String("error", err.Error()))
+		}
+	}
+	deferred := metered && (!known || size > maxDownload)
+	m.mu.Lock()
+	started := deferred && !m.updatesDeferred
+	m.updatesDeferred = deferred
+	m.mu.Unlock()
+	if !started {
+		return nil, deferred
+	}
+	payload := map[string]any{"apps": pending, "reason": "metered"}
+	if known {
+		payload["download_bytes"] = size
+	}
+	event := events.NewEvent("apps.update.deferred", payload)
+	return &event, true
+}
+
+// updateDownloadSize sums the download size of the pending app and runtime
+// updates, leaving out held apps. known is false when a size is missing.
+func (m *Manager) updateDownloadSize(ctx context.Context, available []api.AppUpdate) (size uint64, known bool, err error) {
+	output, err := m.flatpak(ctx, "remote-ls", "--system", "--updates", "--columns=application,branch,download-size")
+	if err != nil {
+		return 0, false, err
+	}
+	held := map[string]bool{}
+	for _, update := range available {
+		if update.Held {
+			held[update.ID] = true
+		}
+	}
+	known = true
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		parts := strings.Split(strings.TrimSpace(scanner.Text()), "\t")
+		if parts[0] == "" || held[parts[0]] {
+			continue
+		}
+		if len(parts) < 3 {
+			known = false
+			continue
+		}
+		download, err := parseSize(parts[2])
+		if err != nil {
+			known = false
+			continue
+		}
+		size += download
+	}
+	return size, known, scanner.Err()
+}
+
+// installDeferred retries deferred installs and records the installed apps
+// as managed. reconcileMu must be held.
+func (m *Manager) installDeferred(ctx context.Context, deferred []api.AppDefinition, maxDownload uint64) ([]api.Event, error) {
+	outcome := m.installApps(ctx, deferred, maxDownload)
+	m.mu.Lock()
+	m.deferred = slices.Concat(outcome.Deferred, outcome.Failed)
+	m.mu.Unlock()
+	if len(outcome.Installed) == 0 {
+		return outcome.Events, nil
+	}
+	record, err := m.loadManaged()
+	if err != nil {
+		return outcome.Events, err
+	}
+	for _, def := range outcome.Installed {
+		if !slices.Contains(record.Apps, def.ID) {
+			record.Apps = append(record.Apps, def.ID)
+		}
+	}
+	slices.Sort(record.Apps)
+	return outcome.Events, m.saveManaged(record)
+}
+
+// listUpdates returns the apps with updates available on their remote.
+func (m *Manager) listUpdates(ctx context.Context, holds []string) ([]api.AppUpdate, error) {
+	output, err := m.flatpak(ctx, "remote-ls", "--system", "--updates", "--app", "--columns=application,branch,commit")
+	if err != nil {
+		return nil, err
+	}
+	var available []api.AppUpdate
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		parts := strings.Split(strings.TrimSpace(scanner.Text()), "\t")
+		if len(parts) < 3 || parts[0] == "" {
+			continue
+		}
+		available = append(available, api.AppUpdate{
+			ID:     parts[0],
+			Branch: parts[1],
+			Commit: parts[2],
+			Held:   matchAny(holds, parts[0]),
+		})
+	}
+	return available, scanner.Err()
+}
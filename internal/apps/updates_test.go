@@ -0,0 +1,224 @@
+package apps
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/evergreen-os/device-agent/pkg/api"
+)
+
+func TestManagerUpdatesInsideWindowOnly(t *testing.T) {
+	var commands []string
+	run := func(_ context.Context, args ...string) ([]byte, error) {
+		commands = append(commands, strings.Join(args, " "))
+		if args[0] == "remote-ls" {
+			return []byte("org.mozilla.firefox\tstable\taaaa\norg.gnome.Chess\tstable\tbbbb\n"), nil
+		}
+		return nil, nil
+	}
+	manager := newTestManager(t, run)
+	policy := api.AppsPolicy{Updates: &api.AppUpdatePolicy{
+		Mode:               api.AppUpdatesWindow,
+		MaintenanceWindows: []string{"Sat 02:00-04:00"},
+		Holds:              []string{"org.gnome.*"},
+	}}
+	ctx := context.Background()
+	if _, err := manager.Apply(ctx, policy); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	settings, err := os.ReadFile(filepath.Join(manager.dconfDir, "local.d", softwareDconfFile))
+	if err != nil {
+		t.Fatalf("read gnome software settings: %v", err)
+	}
+	if !strings.Contains(string(settings), "allow-updates=false") {
+		t.Fatalf("expected gnome software updates to be disabled, got %s", settings)
+	}
+
+	// Friday: outside the window, updates are only reported.
+	manager.now = func() time.Time { return time.Date(2026, 10, 16, 3, 0, 0, 0, time.Local) }
+	commands = nil
+	result, err := manager.Update(ctx)
+	if err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	want := []api.AppUpdate{
+		{ID: "org.mozilla.firefox", Branch: "stable", Commit: "aaaa"},
+		{ID: "org.gnome.Chess", Branch: "stable", Commit: "bbbb", Held: true},
+	}
+	if !reflect.DeepEqual(result.Available, want) || len(commands) != 1 {
+		t.Fatalf("unexpected result %+v after %q", result.Available, commands)
+	}
+
+	// Saturday inside the window, everything but held apps is updated.
+	manager.now = func() time.Time { return time.Date(2026, 10, 17, 3, 0, 0, 0, time.Local) }
+	result, err = manager.Update(ctx)
+	if err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if commands[len(commands)-1] != "update -y --noninteractive" {
+		t.Fatalf("expected an update, got %q", commands)
+	}
+	if len(result.Events) != 1 || result.Events[0].Type != "apps.update.success" {
+		t.Fatalf("unexpected events %+v", result.Events)
+	}
+	if !reflect.DeepEqual(result.Available, want[1:]) {
+		t.Fatalf("expected the held app to remain outstanding, got %+v", result.Available)
+	}
+}
+
+func TestMeteredUpdatesAreDeferred(t *testing.T) {
+	var commands []string
+	run := func(_ context.Context, args ...string) ([]byte, error) {
+		commands = append(commands, strings.Join(args, " "))
+		switch {
+		case args[0] == "remote-ls" && slices.Contains(args, "--app"):
+			return []byte("org.mozilla.firefox\tstable\taaaa\n"), nil
+		case args[0] == "remote-ls":
+			// The runtime update dwarfs the app update.
+			return []byte("org.mozilla.firefox\tstable\t12.0 MB\norg.freedesktop.Platform\t24.08\t310.5 MB\n"), nil
+		}
+		return nil, nil
+	}
+	manager := newTestManager(t, run)
+	metered := true
+	manager.metered = func(context.Context) (bool, error) { return metered, nil }
+	ctx := context.Background()
+	if _, err := manager.Apply(ctx, api.AppsPolicy{Updates: &api.AppUpdatePolicy{Mode: api.AppUpdatesAuto}}); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		result, err := manager.Update(ctx)
+		if err != nil {
+			t.Fatalf("update: %v", err)
+		}
+		if slices.Contains(commands, "update -y --noninteractive") {
+			t.Fatalf("expected no update on a metered connection, got %q", commands)
+		}
+		if len(result.Available) != 1 || !result.Available[0].Deferred {
+			t.Fatalf("expected the update to be reported as deferred, got %+v", result.Available)
+		}
+		// The deferral is reported once, not on every check.
+		if wantEvents := 1 - i; len(result.Events) != wantEvents {
+			t.Fatalf("check %d: unexpected events %+v", i, result.Events)
+		}
+	}
+
+	metered = false
+	result, err := manager.Update(ctx)
+	if err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if len(result.Events) != 1 || result.Events[0].Type != "apps.update.success" {
+		t.Fatalf("expected the update once unmetered, got %+v", result.Events)
+	}
+}
+
+func TestManagerReleasesHolds(t *testing.T) {
+	masks := map[string]bool{}
+	run := func(_ context.Context, args ...string) ([]byte, error) {
+		if args[0] != "mask" {
+			return nil, nil
+		}
+		switch {
+		case len(args) == 2:
+			var out strings.Builder
+			for pattern := range masks {
+				out.WriteString(pattern + "\n")
+			}
+			return []byte(out.String()), nil
+		case args[2] == "--remove":
+			delete(masks, args[3])
+		default:
+			masks[args[2]] = true
+		}
+		return nil, nil
+	}
+	manager := newTestManager(t, run)
+	masks["org.example.LocalMask"] = true
+	ctx := context.Background()
+	policy := api.AppsPolicy{Updates: &api.AppUpdatePolicy{Mode: api.AppUpdatesAuto, Holds: []string{"org.libreoffice.LibreOffice"}}}
+	if _, err := manager.Apply(ctx, policy); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	if !masks["org.libreoffice.LibreOffice"] {
+		t.Fatalf("expected the held app to be masked, got %v", masks)
+	}
+	if _, err := manager.Apply(ctx, api.AppsPolicy{}); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	if !reflect.DeepEqual(masks, map[string]bool{"org.example.LocalMask": true}) {
+		t.Fatalf("expected only the agent's mask to be released, got %v", masks)
+	}
+	if _, err := os.Stat(filepath.Join(manager.dconfDir, "local.d", softwareDconfFile)); !os.IsNotExist(err) {
+		t.Fatalf("expected gnome software settings to be removed, got %v", err)
+	}
+}
+
+func TestValidateUpdatePolicy(t *testing.T) {
+	for _, policy := range []*api.AppUpdatePolicy{
+		{Mode: "nightly"},
+		{Mode: api.AppUpdatesWindow},
+		{Mode: api.AppUpdatesAuto, MaintenanceWindows: []string{"Funday 01:00-02:00"}},
+		{Mode: api.AppUpdatesAuto, Holds: []string{"org.[gnome"}},
+	} {
+		if _, err := validateUpdatePolicy(policy); err == nil {
+			t.Fatalf("expected %+v to be rejected", policy)
+		}
+	}
+}
+
+func TestManagerRemoveUndoesLockdown(t *testing.T) {
+	masks := map[string]bool{"org.example.LocalMask": true}
+	run := func(_ context.Context, args ...string) ([]byte, error) {
+		if args[0] != "mask" {
+			return nil, nil
+		}
+		switch {
+		case len(args) == 2:
+			var out strings.Builder
+			for pattern := range masks {
+				out.WriteString(pattern + "\n")
+			}
+			return []byte(out.String()), nil
+		case args[2] == "--remove":
+			delete(masks, args[3])
+		default:
+			masks[args[2]] = true
+		}
+		return nil, nil
+	}
+	manager := newTestManager(t, run)
+	ctx := context.Background()
+	policy := api.AppsPolicy{Updates: &api.AppUpdatePolicy{Mode: api.AppUpdatesManual, Holds: []string{"org.libreoffice.LibreOffice"}}}
+	if _, err := manager.Apply(ctx, policy); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	events, err := manager.Remove(ctx)
+	if err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	if !reflect.DeepEqual(masks, map[string]bool{"org.example.LocalMask": true}) {
+		t.Fatalf("expected the agent's masks to be released, got %v", masks)
+	}
+	if len(events) != 1 || events[0].Type != "app.release.success" {
+		t.Fatalf("unexpected events %+v", events)
+	}
+	for _, path := range []string{
+		filepath.Join(manager.dconfDir, "local.d", softwareDconfFile),
+		filepath.Join(manager.dconfDir, "local.d", "locks", softwareDconfFile),
+	} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Fatalf("expected %s to be removed, got %v", path, err)
+		}
+	}
+	if result, err := manager.Update(ctx); err != nil || len(result.Events) != 0 {
+		t.Fatalf("expected no update checks after removal, got %+v (%v)", result, err)
+	}
+}
@@ -0,0 +1,145 @@
+package attestation
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/evergreen-os/device-agent/internal/util"
+	"github.com/evergreen-os/device-agent/pkg/api"
+	"github.com/google/go-attestation/attest"
+)
+
+// EnrollmentParameters returns the TPM endorsement key and the parameters of
+// the persistent attestation key for enrollment. It returns nil when the
+// device has no TPM.
+func (m *Manager) EnrollmentParameters(ctx context.Context) (*api.TPMEnrollment, error) {
+	if !m.hasTPM() {
+		return nil, nil
+	}
+	m.tpmMu.Lock()
+	defer m.tpmMu.Unlock()
+	tpm, err := attest.OpenTPM(m.openConfig)
+	if err != nil {
+		if errors.Is(err, attest.ErrTPMNotAvailable) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("open tpm: %w", err)
+	}
+	defer tpm.Close()
+
+	eks, err := tpm.EKs()
+	if err != nil {
+		return nil, fmt.Errorf("read endorsement keys: %w", err)
+	}
+	ek, err := selectEK(eks)
+	if err != nil {
+		return nil, err
+	}
+	ekPublic, err := x509.MarshalPKIXPublicKey(ek.Public)
+	if err != nil {
+		return nil, fmt.Errorf("marshal endorsement key: %w", err)
+	}
+	ak, err := m.loadOrCreateAK(tpm)
+	if err != nil {
+		return nil, fmt.Errorf("load attestation key: %w", err)
+	}
+	defer ak.Close(tpm)
+
+	params := ak.AttestationParameters()
+	enrollment := &api.TPMEnrollment{
+		EKPublic:         ekPublic,
+		EKCertificateURL: ek.CertificateURL,
+		AK: api.AKParameters{
+			Public:            params.Public,
+			CreateData:        params.CreateData,
+			CreateAttestation: params.CreateAttestation,
+			CreateSignature:   params.CreateSignature,
+		},
+	}
+	if ek.Certificate != nil {
+		enrollment.EKCertificate = ek.Certificate.Raw
+	}
+	return enrollment, nil
+}
+
+// ActivateCredential proves the persistent attestation key lives on the same
+// TPM as the endorsement key by decrypting the backend's challenge.
+func (m *Manager) ActivateCredential(ctx context.Context, challenge api.AKChallenge) ([]byte, error) {
+	m.tpmMu.Lock()
+	defer m.tpmMu.Unlock()
+	tpm, err := attest.OpenTPM(m.openConfig)
+	if err != nil {
+		return nil, fmt.Errorf("open tpm: %w", err)
+	}
+	defer tpm.Close()
+
+	ak, err := m.loadOrCreateAK(tpm)
+	if err != nil {
+		return nil, fmt.Errorf("load attestation key: %w", err)
+	}
+	defer ak.Close(tpm)
+	secret, err := ak.ActivateCredential(tpm, attest.EncryptedCredential{
+		Credential: challenge.Credential,
+		Secret:     challenge.Secret,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("activate credential: %w", err)
+	}
+	return secret, nil
+}
+
+// Remove deletes the persisted attestation key blob. The key itself is not
+// resident in the TPM, so the blob is all that ties the device to it.
+func (m *Manager) Remove() error {
+	if _, err := util.RemoveFile(m.akPath); err != nil {
+		return fmt.Errorf("remove attestation key: %w", err)
+	}
+	return nil
+}
+
+// loadOrCreateAK loads the persisted attestation key, creating and persisting
+// one on first use. Callers must close the returned key.
+func (m *Manager) loadOrCreateAK(tpm *attest.TPM) (*attest.AK, error) {
+	if m.akPath == "" {
+		return tpm.NewAK(nil)
+	}
+	blob, err := util.ReadSecretFile(m.akPath)
+	if err == nil {
+		return tpm.LoadAK(blob)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("read attestation key: %w", err)
+	}
+	ak, err := tpm.NewAK(nil)
+	if err != nil {
+		return nil, err
+	}
+	blob, err = ak.Marshal()
+	if err != nil {
+		ak.Close(tpm)
+		return nil, fmt.Errorf("marshal attestation key: %w", err)
+	}
+	if err := util.WriteSecretFile(m.akPath, blob); err != nil {
+		ak.Close(tpm)
+		return nil, fmt.Errorf("write attestation key: %w", err)
+	}
+	return ak, nil
+}
+
+// selectEK prefers the RSA endorsement key, which credential activation
+// requires, and falls back to the first key reported.
+func selectEK(eks []attest.EK) (attest.EK, error) {
+	if len(eks) == 0 {
+		return attest.EK{}, errors.New("tpm reported no endorsement keys")
+	}
+	for _, ek := range eks {
+		if _, ok := ek.Public.(*rsa.PublicKey); ok {
+			return ek, nil
+		}
+	}
+	return eks[0], nil
+}
@@ -0,0 +1,72 @@
+//go:build cgo
+
+package attestation
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/evergreen-os/device-agent/internal/config"
+	"github.com/evergreen-os/device-agent/internal/enroll"
+	"github.com/evergreen-os/device-agent/pkg/api"
+	"github.com/evergreen-os/device-agent/pkg/api/apitest"
+	"github.com/google/go-attestation/attest"
+	"github.com/google/go-tpm-tools/simulator"
+)
+
+// simulatedTPM adapts the software TPM to go-attestation. Close is a no-op
+// because go-attestation closes the channel after every session.
+type simulatedTPM struct {
+	*simulator.Simulator
+}
+
+func (simulatedTPM) Close() error { return nil }
+
+func (simulatedTPM) MeasurementLog() ([]byte, error) { return nil, nil }
+
+func newSimulatedTPM(t *testing.T) *attest.OpenConfig {
+	t.Helper()
+	sim, err := simulator.Get()
+	if err != nil {
+		t.Fatalf("start tpm simulator: %v", err)
+	}
+	t.Cleanup(func() { sim.Close() })
+	return &attest.OpenConfig{TPMVersion: attest.TPMVersion20, CommandChannel: simulatedTPM{sim}}
+}
+
+func TestEnrollmentRegistersPersistentAK(t *testing.T) {
+	dir := t.TempDir()
+	manager := NewManager(nil, WithAKPath(filepath.Join(dir, "ak.blob")), WithOpenConfig(newSimulatedTPM(t)))
+	server := apitest.NewServer(t)
+	client, err := api.New(server.URL)
+	if err != nil {
+		t.Fatalf("new client: %v", err)
+	}
+	cfg := config.Config{DeviceTokenPath: filepath.Join(dir, "secrets.json")}
+	enrollManager := enroll.NewManager(cfg, client, enroll.WithTPM(manager))
+	cred, _, err := enrollManager.EnsureEnrollment(context.Background())
+	if err != nil {
+		t.Fatalf("enroll: %v", err)
+	}
+
+	if got := server.ActivatedAKs(); len(got) != 1 || got[0] != cred.DeviceID {
+		t.Fatalf("expected the attestation key to be activated for %s, got %v", cred.DeviceID, got)
+	}
+	enrolled := server.Enrollments()[0].TPM
+	if enrolled == nil || len(enrolled.EKPublic) == 0 || len(enrolled.AK.Public) == 0 {
+		t.Fatalf("expected TPM identity in enrollment, got %+v", enrolled)
+	}
+
+	params, err := manager.EnrollmentParameters(context.Background())
+	if err != nil {
+		t.Fatalf("enrollment parameters: %v", err)
+	}
+	if !bytes.Equal(params.AK.Public, enrolled.AK.Public) {
+		t.Fatalf("expected the registered attestation key to be reused")
+	}
+	if !bytes.Equal(params.EKPublic, enrolled.EKPublic) {
+		t.Fatalf("expected a stable endorsement key")
+	}
+}
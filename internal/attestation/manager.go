@@ -27,11 +27,40 @@ type Manager struct {
 	lastDigest  string
 	lastAttempt time.Time
 	minInterval time.Duration
+
+	akPath     string
+	openConfig *attest.OpenConfig
+	// tpmMu serialises TPM sessions; the resource manager handles concurrent
+	// clients but the simulator and /dev/tpm0 do not.
+	tpmMu sync.Mutex
+}
+
+// Option customises a Manager.
+type Option func(*Manager)
+
+// WithAKPath persists the attestation key blob at path so quotes are signed
+// by the key registered during enrollment. Without it a fresh AK is created
+// for every attestation.
+func WithAKPath(path string) Option {
+	return func(m *Manager) {
+		m.akPath = path
+	}
+}
+
+// WithOpenConfig overrides how the TPM is opened, e.g. to use a simulator.
+func WithOpenConfig(cfg *attest.OpenConfig) Option {
+	return func(m *Manager) {
+		m.openConfig = cfg
+	}
 }
 
 // NewManager constructs a manager with sensible defaults.
-func NewManager(logger *slog.Logger) *Manager {
-	return &Manager{logger: logger, minInterval: time.Hour}
+func NewManager(logger *slog.Logger, opts ...Option) *Manager {
+	m := &Manager{logger: logger, minInterval: time.Hour}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
 }
 
 // Attest performs a TPM-backed attestation if hardware is present.
@@ -44,7 +73,9 @@ func (m *Manager) Attest(ctx context.Context, client *api.Client, token, deviceI
 		return nil, nil
 	}
 
-	tpm, err := attest.OpenTPM(nil)
+	m.tpmMu.Lock()
+	defer m.tpmMu.Unlock()
+	tpm, err := attest.OpenTPM(m.openConfig)
 	if err != nil {
 		if errors.Is(err, attest.ErrTPMNotAvailable) {
 			return nil, nil
@@ -53,7 +84,7 @@ func (m *Manager) Attest(ctx context.Context, client *api.Client, token, deviceI
 	}
 	defer tpm.Close()
 
-	ak, err := tpm.NewAK(nil)
+	ak, err := m.loadOrCreateAK(tpm)
 	if err != nil {
 		event := agentevents.NewEvent("attestation.boot.failure", map[string]string{"error": err.Error()})
 		return []api.Event{event}, fmt.Errorf("create ak: %w", err)
@@ -132,6 +163,9 @@ func (m *Manager) ready(now time.Time) bool {
 }
 
 func (m *Manager) hasTPM() bool {
+	if m.openConfig != nil && m.openConfig.CommandChannel != nil {
+		return true
+	}
 	candidates := []string{"/dev/tpmrm0", "/dev/tpm0"}
 	for _, path := range candidates {
 		if _, err := os.Stat(path); err == nil {
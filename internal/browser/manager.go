@@ -48,6 +48,18 @@ func (m *Manager) Apply(policy api.BrowserPolicy) ([]api.Event, error) {
 	return []api.Event{event}, nil
 }
 
+// Remove deletes the managed browser policy file.
+func (m *Manager) Remove() ([]api.Event, error) {
+	removed, err := util.RemoveFile(m.path)
+	if err != nil {
+		return nil, fmt.Errorf("remove browser policy: %w", err)
+	}
+	if !removed {
+		return nil, nil
+	}
+	return []api.Event{events.NewEvent("browser.policy.removed", map[string]string{"path": filepath.Clean(m.path)})}, nil
+}
+
 func buildChromiumPolicy(policy api.BrowserPolicy) map[string]any {
 	cfg := map[string]any{}
 	homepage := strings.TrimSpace(policy.Homepage)
@@ -0,0 +1,32 @@
+// Package buildinfo exposes version metadata stamped into the binary at link
+// time, e.g. -ldflags "-X github.com/evergreen-os/device-agent/internal/buildinfo.Version=1.2.0".
+package buildinfo
+
+import "runtime/debug"
+
+var (
+	// Version is the release version of the agent.
+	Version = "dev"
+	// Commit is the VCS revision the agent was built from.
+	Commit = ""
+	// Date is the build timestamp in RFC 3339 format.
+	Date = ""
+)
+
+// Revision returns Commit, falling back to the VCS revision recorded by the Go
+// toolchain when the binary was built without ldflags.
+func Revision() string {
+	if Commit != "" {
+		return Commit
+	}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return ""
+	}
+	for _, setting := range info.Settings {
+		if setting.Key == "vcs.revision" {
+			return setting.Value
+		}
+	}
+	return ""
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"slices"
 	"time"
 )
 
@@ -11,19 +12,61 @@ import (
 type Config struct {
         BackendURL      string     `json:"backend_url"`
         DeviceTokenPath string     `json:"device_token_path"`
+        DeviceKeyPath   string     `json:"device_key_path"`
+        DeviceCertPath  string     `json:"device_cert_path"`
         PolicyCachePath string     `json:"policy_cache_path"`
         EventQueuePath  string     `json:"event_queue_path"`
         StateQueuePath  string     `json:"state_queue_path"`
         PolicyPublicKey string     `json:"policy_public_key"`
+        ControlSocket   string     `json:"control_socket"`
         Enrollment      Enrollment `json:"enrollment"`
         Intervals       Intervals  `json:"intervals"`
+        Uploads         Uploads    `json:"uploads"`
+        Transport       Transport  `json:"transport"`
+        Clock           Clock      `json:"clock"`
+        Secrets         Secrets    `json:"secrets"`
         Logging         Logging    `json:"logging"`
 }
 
 // Enrollment specific settings.
 type Enrollment struct {
-	PreSharedKey string `json:"pre_shared_key"`
-	ConfigPath   string `json:"config_path"`
+	PreSharedKey        string   `json:"pre_shared_key"`
+	ConfigPath          string   `json:"config_path"`
+	ReenrollMinInterval Duration `json:"reenroll_min_interval"`
+	// AttestationKeyPath stores the TPM attestation key registered during
+	// enrollment. Defaults to attestation-key.blob next to the device token.
+	AttestationKeyPath string `json:"attestation_key_path"`
+	// HardwareFingerprintPath stores the hardware fingerprint recorded at
+	// enrollment. Defaults to hardware-fingerprint.json next to the device
+	// token.
+	HardwareFingerprintPath string `json:"hardware_fingerprint_path"`
+	// Sources lists where zero-touch enrollment material is looked for, in
+	// priority order. Defaults to every source in DefaultEnrollmentSources.
+	Sources []string `json:"sources"`
+	// IgnitionPath is the enrollment file written by Ignition on first boot.
+	IgnitionPath string `json:"ignition_path"`
+	// OEMPartitionLabel names the filesystem label of the OEM partition
+	// carrying enrollment.json.
+	OEMPartitionLabel string `json:"oem_partition_label"`
+}
+
+// Zero-touch enrollment sources.
+const (
+	EnrollmentSourceConfig   = "config"
+	EnrollmentSourceCmdline  = "cmdline"
+	EnrollmentSourceIgnition = "ignition"
+	EnrollmentSourceOEM      = "oem"
+	EnrollmentSourceSMBIOS   = "smbios"
+)
+
+// DefaultEnrollmentSources is the default discovery order for enrollment
+// material.
+var DefaultEnrollmentSources = []string{
+	EnrollmentSourceConfig,
+	EnrollmentSourceCmdline,
+	EnrollmentSourceIgnition,
+	EnrollmentSourceOEM,
+	EnrollmentSourceSMBIOS,
 }
 
 // Intervals for background tasks.
@@ -35,6 +78,50 @@ type Intervals struct {
 	RetryMaxDelay Duration `json:"retry_max_delay"`
 }
 
+// Uploads controls how queued state and events are sent to the backend.
+type Uploads struct {
+	Compress      bool `json:"compress"`
+	MaxBatchSize  int  `json:"max_batch_size"`
+	MaxBatchBytes int  `json:"max_batch_bytes"`
+}
+
+// Transport controls how the agent connects to the backend.
+type Transport struct {
+	ProxyURL         string   `json:"proxy_url"`
+	StaticPACPath    string   `json:"static_pac_path"`
+	CABundlePath     string   `json:"ca_bundle_path"`
+	PinnedSPKISHA256 []string `json:"pinned_spki_sha256"`
+	MinTLSVersion    string   `json:"min_tls_version"`
+}
+
+// Clock controls time sanity checks against the backend clock.
+type Clock struct {
+	// MaxSkew is the largest tolerated offset before time-sensitive actions
+	// such as reboots are deferred. Zero selects the default.
+	MaxSkew Duration `json:"max_skew"`
+}
+
+// Secret store backends.
+const (
+	SecretsPlaintext    = "plaintext"
+	SecretsKeyfile      = "keyfile"
+	SecretsSystemdCreds = "systemd-creds"
+	SecretsTPM2         = "tpm2"
+)
+
+// Secrets selects how credential files are encrypted at rest.
+type Secrets struct {
+	// Backend is one of plaintext (the default), keyfile, systemd-creds or tpm2.
+	Backend string `json:"backend"`
+	// KeyFile holds the AES key of the keyfile backend. Defaults to
+	// secrets.key next to the device token.
+	KeyFile string `json:"key_file"`
+	// SystemdCredsKey is passed to systemd-creds --with-key (e.g. tpm2, host).
+	SystemdCredsKey string `json:"systemd_creds_key"`
+	// PCRs lists the SHA-256 PCRs the tpm2 backend seals to. Defaults to 7.
+	PCRs []int `json:"pcrs"`
+}
+
 // Logging configuration.
 type Logging struct {
 	Level string `json:"level"`
@@ -112,5 +199,37 @@ func (c Config) Validate() error {
 	if c.Intervals.EventFlush.Duration == 0 {
 		return fmt.Errorf("intervals.event_flush must be >0")
 	}
+	if c.Uploads.MaxBatchSize < 0 {
+		return fmt.Errorf("uploads.max_batch_size must be >=0")
+	}
+	if c.Uploads.MaxBatchBytes < 0 {
+		return fmt.Errorf("uploads.max_batch_bytes must be >=0")
+	}
+	if c.Transport.ProxyURL != "" && c.Transport.StaticPACPath != "" {
+		return fmt.Errorf("transport.proxy_url and transport.static_pac_path are mutually exclusive")
+	}
+	if c.Clock.MaxSkew.Duration < 0 {
+		return fmt.Errorf("clock.max_skew must be >=0")
+	}
+	for _, source := range c.Enrollment.Sources {
+		if !slices.Contains(DefaultEnrollmentSources, source) {
+			return fmt.Errorf("enrollment.sources: unknown source %q", source)
+		}
+	}
+	switch c.Secrets.Backend {
+	case "", SecretsPlaintext, SecretsKeyfile, SecretsSystemdCreds, SecretsTPM2:
+	default:
+		return fmt.Errorf("secrets.backend must be plaintext, keyfile, systemd-creds or tpm2")
+	}
+	for _, pcr := range c.Secrets.PCRs {
+		if pcr < 0 || pcr > 23 {
+			return fmt.Errorf("secrets.pcrs must be between 0 and 23")
+		}
+	}
+	switch c.Transport.MinTLSVersion {
+	case "", "1.2", "1.3":
+	default:
+		return fmt.Errorf("transport.min_tls_version must be 1.2 or 1.3")
+	}
 	return nil
 }
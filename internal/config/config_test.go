@@ -76,3 +76,82 @@ func TestValidateRequiresFields(t *testing.T) {
 		t.Fatalf("expected error for empty config")
 	}
 }
+
+func TestValidateTransport(t *testing.T) {
+	cfg := Config{
+		BackendURL:      "https://example.com",
+		DeviceTokenPath: "/tmp/token",
+		PolicyCachePath: "/tmp/policy.json",
+		EventQueuePath:  "/tmp/events.json",
+		StateQueuePath:  "/tmp/state.json",
+		PolicyPublicKey: "/tmp/key.pem",
+		Intervals: Intervals{
+			PolicyPoll:  Duration{time.Minute},
+			StateReport: Duration{time.Minute},
+			EventFlush:  Duration{time.Minute},
+		},
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cfg.Transport = Transport{ProxyURL: "http://proxy:3128", StaticPACPath: "/etc/proxy.pac"}
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("expected proxy_url and static_pac_path to conflict")
+	}
+	cfg.Transport = Transport{MinTLSVersion: "1.0"}
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("expected unsupported tls version to fail")
+	}
+}
+
+func TestValidateSecrets(t *testing.T) {
+	cfg := Config{
+		BackendURL:      "https://example.com",
+		DeviceTokenPath: "/tmp/token",
+		PolicyCachePath: "/tmp/policy.json",
+		EventQueuePath:  "/tmp/events.json",
+		StateQueuePath:  "/tmp/state.json",
+		PolicyPublicKey: "/tmp/key.pem",
+		Intervals: Intervals{
+			PolicyPoll:  Duration{time.Minute},
+			StateReport: Duration{time.Minute},
+			EventFlush:  Duration{time.Minute},
+		},
+		Secrets: Secrets{Backend: SecretsTPM2, PCRs: []int{7, 14}},
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cfg.Secrets.PCRs = []int{24}
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("expected out of range pcr to fail")
+	}
+	cfg.Secrets = Secrets{Backend: "vault"}
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("expected unknown backend to fail")
+	}
+}
+
+func TestValidateEnrollmentSources(t *testing.T) {
+	cfg := Config{
+		BackendURL:      "https://example.com",
+		DeviceTokenPath: "/tmp/token",
+		PolicyCachePath: "/tmp/policy.json",
+		EventQueuePath:  "/tmp/events.json",
+		StateQueuePath:  "/tmp/state.json",
+		PolicyPublicKey: "/tmp/key.pem",
+		Intervals: Intervals{
+			PolicyPoll:  Duration{time.Minute},
+			StateReport: Duration{time.Minute},
+			EventFlush:  Duration{time.Minute},
+		},
+		Enrollment: Enrollment{Sources: []string{EnrollmentSourceSMBIOS, EnrollmentSourceCmdline}},
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cfg.Enrollment.Sources = []string{"usb"}
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("expected unknown enrollment source to fail")
+	}
+}
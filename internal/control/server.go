@@ -0,0 +1,76 @@
+// Package control serves local diagnostics over a unix socket so operators and
+// provisioning tooling can inspect the agent without backend access, e.g.
+// `curl --unix-socket /run/evergreen-agent/control.sock http://agent/status`.
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/evergreen-os/device-agent/internal/util"
+)
+
+// StatusFunc returns the document served at GET /status.
+type StatusFunc func() any
+
+// Server is the local control endpoint.
+type Server struct {
+	logger *slog.Logger
+	path   string
+	status StatusFunc
+}
+
+// NewServer constructs a control server listening on the socket at path.
+func NewServer(logger *slog.Logger, path string, status StatusFunc) *Server {
+	return &Server{logger: logger, path: path, status: status}
+}
+
+// Handler returns the HTTP handler exposed on the socket.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		_ = encoder.Encode(s.status())
+	})
+	return mux
+}
+
+// Run serves requests until ctx is cancelled and removes the socket on exit.
+func (s *Server) Run(ctx context.Context) error {
+	if err := util.EnsureParentDir(s.path, 0o750); err != nil {
+		return err
+	}
+	if err := os.Remove(s.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("remove stale control socket: %w", err)
+	}
+	listener, err := net.Listen("unix", s.path)
+	if err != nil {
+		return fmt.Errorf("listen on control socket: %w", err)
+	}
+	defer os.Remove(s.path)
+	if err := os.Chmod(s.path, 0o660); err != nil {
+		listener.Close()
+		return fmt.Errorf("chmod control socket: %w", err)
+	}
+	server := &http.Server{Handler: s.Handler(), ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = server.Shutdown(shutdownCtx)
+	}()
+	s.logger.Info("control socket listening", slog.String("path", s.path))
+	if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("serve control socket: %w", err)
+	}
+	return nil
+}
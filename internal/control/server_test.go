@@ -0,0 +1,54 @@
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestServerServesStatusOverUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "control.sock")
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	server := NewServer(logger, path, func() any {
+		return map[string]string{"state": "pending_approval"}
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- server.Run(ctx) }()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", path)
+		},
+	}}
+	var resp *http.Response
+	var err error
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if resp, err = client.Get("http://agent/status"); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatalf("query control socket: %v", err)
+	}
+	defer resp.Body.Close()
+	var status map[string]string
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		t.Fatalf("decode status: %v", err)
+	}
+	if status["state"] != "pending_approval" {
+		t.Fatalf("unexpected status %v", status)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("run returned error: %v", err)
+	}
+}
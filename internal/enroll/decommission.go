@@ -0,0 +1,75 @@
+package enroll
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/evergreen-os/device-agent/internal/util"
+)
+
+// ErrDecommissioned is returned by EnsureEnrollment after the device was
+// released. Only interactive enrollment enrolls it again.
+var ErrDecommissioned = errors.New("device was decommissioned")
+
+type decommissionMarker struct {
+	Reason string    `json:"reason"`
+	At     time.Time `json:"at"`
+}
+
+// Remove deletes the stored credentials, device key and certificate, any
+// pending enrollment and archived credentials, then records that the device
+// was decommissioned so it does not silently enroll again.
+func (m *Manager) Remove(reason string) error {
+	m.storeMu.Lock()
+	defer m.storeMu.Unlock()
+	paths := []string{m.credentialsPath, m.keyPath, m.certPath, m.pendingPath()}
+	for _, base := range []string{m.credentialsPath, m.certPath} {
+		archived, err := filepath.Glob(base + ".revoked-*")
+		if err != nil {
+			return fmt.Errorf("find archived credentials: %w", err)
+		}
+		paths = append(paths, archived...)
+	}
+	var errs []error
+	for _, path := range paths {
+		if _, err := util.RemoveFile(path); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("remove credentials: %w", err)
+	}
+	data, err := json.MarshalIndent(decommissionMarker{Reason: reason, At: m.now().UTC()}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal decommission marker: %w", err)
+	}
+	if err := util.WriteSecretFile(m.decommissionedPath(), data); err != nil {
+		return fmt.Errorf("write decommission marker: %w", err)
+	}
+	m.updateStatus(func(s *Status) {
+		*s = Status{State: StateUnenrolled}
+	})
+	return nil
+}
+
+// Decommissioned reports whether the device was released and has not been
+// enrolled interactively since.
+func (m *Manager) Decommissioned() bool {
+	_, err := os.Stat(m.decommissionedPath())
+	return err == nil
+}
+
+func (m *Manager) decommissionedPath() string {
+	return m.credentialsPath + ".decommissioned"
+}
+
+func (m *Manager) clearDecommissioned() error {
+	if _, err := util.RemoveFile(m.decommissionedPath()); err != nil {
+		return fmt.Errorf("clear decommission marker: %w", err)
+	}
+	return nil
+}
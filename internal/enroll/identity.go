@@ -0,0 +1,134 @@
+package enroll
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/evergreen-os/device-agent/internal/util"
+	"github.com/evergreen-os/device-agent/pkg/api"
+)
+
+// ClientCertificate loads the device key pair used for mutual TLS. It returns
+// os.ErrNotExist when no certificate has been issued yet.
+func (m *Manager) ClientCertificate() (*tls.Certificate, error) {
+	keyPEM, err := util.ReadSecretFile(m.keyPath)
+	if err != nil {
+		return nil, err
+	}
+	certPEM, err := util.ReadSecretFile(m.certPath)
+	if err != nil {
+		return nil, err
+	}
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("load device certificate: %w", err)
+	}
+	if pair.Leaf == nil {
+		leaf, err := x509.ParseCertificate(pair.Certificate[0])
+		if err != nil {
+			return nil, fmt.Errorf("parse device certificate: %w", err)
+		}
+		pair.Leaf = leaf
+	}
+	return &pair, nil
+}
+
+// RenewCertificate requests a new client certificate for the existing device key.
+func (m *Manager) RenewCertificate(ctx context.Context, cred Credentials) (*tls.Certificate, error) {
+	key, err := m.ensureDeviceKey()
+	if err != nil {
+		return nil, err
+	}
+	csr, err := newCSR(key, cred.DeviceID)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := m.client.RenewCertificate(ctx, cred.DeviceToken, api.RenewCertificateRequest{DeviceID: cred.DeviceID, CSR: csr})
+	if err != nil {
+		return nil, fmt.Errorf("renew certificate: %w", err)
+	}
+	if err := m.saveCertificate(resp.Certificate); err != nil {
+		return nil, err
+	}
+	return m.ClientCertificate()
+}
+
+// NeedsRenewal reports whether a certificate is missing or has less than a
+// third of its validity period remaining.
+func NeedsRenewal(cert *tls.Certificate, now time.Time) bool {
+	if cert == nil || cert.Leaf == nil {
+		return true
+	}
+	lifetime := cert.Leaf.NotAfter.Sub(cert.Leaf.NotBefore)
+	return cert.Leaf.NotAfter.Sub(now) < lifetime/3
+}
+
+func (m *Manager) ensureDeviceKey() (*ecdsa.PrivateKey, error) {
+	data, err := util.ReadSecretFile(m.keyPath)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, errors.New("device key is not PEM encoded")
+		}
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parse device key: %w", err)
+		}
+		key, ok := parsed.(*ecdsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("unexpected device key type %T", parsed)
+		}
+		return key, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("read device key: %w", err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("generate device key: %w", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("marshal device key: %w", err)
+	}
+	if err := util.WriteSecretFile(m.keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})); err != nil {
+		return nil, fmt.Errorf("write device key: %w", err)
+	}
+	return key, nil
+}
+
+func (m *Manager) saveCertificate(chain string) error {
+	block, _ := pem.Decode([]byte(chain))
+	if block == nil || block.Type != "CERTIFICATE" {
+		return errors.New("backend returned an invalid certificate")
+	}
+	if _, err := x509.ParseCertificate(block.Bytes); err != nil {
+		return fmt.Errorf("parse issued certificate: %w", err)
+	}
+	if err := util.WriteSecretFile(m.certPath, []byte(chain)); err != nil {
+		return fmt.Errorf("write device certificate: %w", err)
+	}
+	return nil
+}
+
+func newCSR(key *ecdsa.PrivateKey, commonName string) (string, error) {
+	if commonName == "" {
+		commonName = "evergreen-device"
+	}
+	template := &x509.CertificateRequest{Subject: pkix.Name{CommonName: commonName}}
+	der, err := x509.CreateCertificateRequest(rand.Reader, template, key)
+	if err != nil {
+		return "", fmt.Errorf("create csr: %w", err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})), nil
+}
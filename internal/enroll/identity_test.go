@@ -0,0 +1,111 @@
+package enroll
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/evergreen-os/device-agent/internal/config"
+	"github.com/evergreen-os/device-agent/pkg/api"
+)
+
+func TestEnsureEnrollmentIssuesClientCertificate(t *testing.T) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate ca key: %v", err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("create ca: %v", err)
+	}
+	caCert, _ := x509.ParseCertificate(caDER)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req api.EnrollDeviceRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("decode request: %v", err)
+		}
+		block, _ := pem.Decode([]byte(req.CSR))
+		if block == nil {
+			t.Errorf("missing csr in enrollment request")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		csr, err := x509.ParseCertificateRequest(block.Bytes)
+		if err != nil {
+			t.Errorf("parse csr: %v", err)
+		}
+		leaf := &x509.Certificate{
+			SerialNumber: big.NewInt(2),
+			Subject:      csr.Subject,
+			NotBefore:    time.Now().Add(-time.Minute),
+			NotAfter:     time.Now().Add(12 * time.Hour),
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, leaf, caCert, csr.PublicKey, caKey)
+		if err != nil {
+			t.Errorf("sign csr: %v", err)
+		}
+		_ = json.NewEncoder(w).Encode(api.EnrollDeviceResponse{
+			DeviceID:    "device-1",
+			DeviceToken: "token-1",
+			Certificate: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		})
+	}))
+	defer server.Close()
+
+	client, err := api.New(server.URL)
+	if err != nil {
+		t.Fatalf("new client: %v", err)
+	}
+	dir := t.TempDir()
+	manager := NewManager(config.Config{DeviceTokenPath: filepath.Join(dir, "secrets.json")}, client)
+	if _, _, err := manager.EnsureEnrollment(context.Background()); err != nil {
+		t.Fatalf("EnsureEnrollment returned error: %v", err)
+	}
+
+	cert, err := manager.ClientCertificate()
+	if err != nil {
+		t.Fatalf("load client certificate: %v", err)
+	}
+	if _, ok := cert.PrivateKey.(*ecdsa.PrivateKey); !ok {
+		t.Fatalf("expected ecdsa device key, got %T", cert.PrivateKey)
+	}
+	if NeedsRenewal(cert, time.Now()) {
+		t.Fatalf("fresh certificate should not need renewal")
+	}
+	if !NeedsRenewal(cert, time.Now().Add(10*time.Hour)) {
+		t.Fatalf("expected renewal once less than a third of the lifetime remains")
+	}
+	if !NeedsRenewal(nil, time.Now()) {
+		t.Fatalf("expected renewal when no certificate is present")
+	}
+}
+
+func TestClientCertificateMissing(t *testing.T) {
+	dir := t.TempDir()
+	manager := NewManager(config.Config{DeviceTokenPath: filepath.Join(dir, "secrets.json")}, nil)
+	if _, err := manager.ClientCertificate(); err == nil {
+		t.Fatalf("expected error without issued certificate")
+	}
+}
@@ -0,0 +1,143 @@
+package enroll
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/evergreen-os/device-agent/internal/util"
+	"github.com/evergreen-os/device-agent/pkg/api"
+)
+
+// ErrAlreadyEnrolled is returned by interactive enrollment when credentials
+// are already stored.
+var ErrAlreadyEnrolled = errors.New("device is already enrolled")
+
+// ErrDeviceCodeExpired is returned when a device code expires before the
+// operator approves it.
+var ErrDeviceCodeExpired = errors.New("device code expired")
+
+// EnrollWithCode enrolls the device with a one-time enrollment code and
+// persists the credentials exactly like automatic enrollment. If the backend
+// holds the device for approval it waits until ctx is done.
+func (m *Manager) EnrollWithCode(ctx context.Context, code string) (Credentials, api.PolicyEnvelope, error) {
+	if code == "" {
+		return Credentials{}, api.PolicyEnvelope{}, errors.New("enrollment code is required")
+	}
+	return m.enrollInteractively(ctx, m.retryBackoff, func(req *api.EnrollDeviceRequest) {
+		req.EnrollmentCode = code
+	})
+}
+
+// RequestDeviceCode starts a device-code enrollment. The returned user code
+// and verification URI are shown to the operator before calling
+// EnrollWithDeviceCode.
+func (m *Manager) RequestDeviceCode(ctx context.Context) (api.DeviceCodeResponse, error) {
+	if err := m.checkNotEnrolled(); err != nil {
+		return api.DeviceCodeResponse{}, err
+	}
+	facts, err := util.CollectHardwareFacts()
+	if err != nil {
+		return api.DeviceCodeResponse{}, fmt.Errorf("collect hardware facts: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, 60*time.Second)
+	defer cancel()
+	resp, err := m.client.RequestDeviceCode(ctx, api.DeviceCodeRequest{SerialNumber: facts.SerialNumber})
+	if err != nil {
+		return api.DeviceCodeResponse{}, fmt.Errorf("request device code: %w", err)
+	}
+	return resp, nil
+}
+
+// EnrollWithDeviceCode redeems a device code and waits until the operator
+// approves it or the code expires. Approval is polled at the code's interval
+// until the backend suggests another.
+func (m *Manager) EnrollWithDeviceCode(ctx context.Context, code api.DeviceCodeResponse) (Credentials, api.PolicyEnvelope, error) {
+	if code.DeviceCode == "" {
+		return Credentials{}, api.PolicyEnvelope{}, errors.New("device code is required")
+	}
+	if code.ExpiresIn > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, time.Duration(code.ExpiresIn)*time.Second, ErrDeviceCodeExpired)
+		defer cancel()
+	}
+	interval := m.retryBackoff
+	if code.Interval > 0 {
+		interval = time.Duration(code.Interval) * time.Second
+	}
+	cred, policy, err := m.enrollInteractively(ctx, interval, func(req *api.EnrollDeviceRequest) {
+		req.DeviceCode = code.DeviceCode
+	})
+	if err != nil && errors.Is(context.Cause(ctx), ErrDeviceCodeExpired) {
+		return Credentials{}, api.PolicyEnvelope{}, ErrDeviceCodeExpired
+	}
+	return cred, policy, err
+}
+
+// enrollInteractively enrolls once with the given secrets and polls every
+// interval while the backend reports the enrollment as pending. Unlike
+// enrollWithRetry it gives up on the first failure so the operator sees a
+// rejected code immediately.
+func (m *Manager) enrollInteractively(ctx context.Context, interval time.Duration, customize func(*api.EnrollDeviceRequest)) (Credentials, api.PolicyEnvelope, error) {
+	if err := m.checkNotEnrolled(); err != nil {
+		return Credentials{}, api.PolicyEnvelope{}, err
+	}
+	// A poll token left behind by automatic enrollment belongs to a request
+	// without the operator's code.
+	if err := m.clearPending(); err != nil {
+		return Credentials{}, api.PolicyEnvelope{}, err
+	}
+	for {
+		m.updateStatus(func(s *Status) {
+			s.Attempts++
+			if s.State != StatePending {
+				s.State = StateEnrolling
+			}
+		})
+		cred, policy, err := m.attemptEnrollment(ctx, customize)
+		if err == nil {
+			if err := m.clearDecommissioned(); err != nil {
+				return Credentials{}, api.PolicyEnvelope{}, err
+			}
+			m.setEnrolled(cred.DeviceID)
+			return cred, policy, nil
+		}
+		if !errors.Is(err, ErrEnrollmentPending) {
+			m.updateStatus(func(s *Status) { s.LastError = err.Error() })
+			if cerr := m.clearPending(); cerr != nil {
+				return Credentials{}, api.PolicyEnvelope{}, cerr
+			}
+			return Credentials{}, api.PolicyEnvelope{}, err
+		}
+		wait := interval
+		if pending, perr := m.loadPending(); perr == nil {
+			if pending.PollInterval > 0 {
+				wait = time.Duration(pending.PollInterval) * time.Second
+			}
+			m.updateStatus(func(s *Status) {
+				s.State = StatePending
+				s.PendingSince = pending.Since
+			})
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return Credentials{}, api.PolicyEnvelope{}, fmt.Errorf("enrollment interrupted: %w", ctx.Err())
+		case <-timer.C:
+		}
+	}
+}
+
+func (m *Manager) checkNotEnrolled() error {
+	cred, _, err := m.loadCredentials()
+	if err == nil && cred.DeviceToken != "" {
+		return fmt.Errorf("%w as %s", ErrAlreadyEnrolled, cred.DeviceID)
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
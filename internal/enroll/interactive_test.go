@@ -0,0 +1,104 @@
+package enroll
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/evergreen-os/device-agent/internal/config"
+	"github.com/evergreen-os/device-agent/pkg/api"
+	"github.com/evergreen-os/device-agent/pkg/api/apitest"
+)
+
+func newInteractiveManager(t *testing.T, server *apitest.Server) *Manager {
+	t.Helper()
+	client, err := api.New(server.URL)
+	if err != nil {
+		t.Fatalf("new client: %v", err)
+	}
+	cfg := config.Config{DeviceTokenPath: filepath.Join(t.TempDir(), "secrets.json")}
+	cfg.Intervals.RetryBackoff.Duration = 10 * time.Millisecond
+	return NewManager(cfg, client)
+}
+
+func TestEnrollWithCode(t *testing.T) {
+	server := apitest.NewServer(t)
+	server.AddEnrollmentCode("ABCD-EFGH")
+	manager := newInteractiveManager(t, server)
+
+	if _, _, err := manager.EnrollWithCode(context.Background(), "WRONG-CODE"); err == nil {
+		t.Fatalf("expected unknown code to be rejected")
+	}
+	cred, _, err := manager.EnrollWithCode(context.Background(), "ABCD-EFGH")
+	if err != nil {
+		t.Fatalf("enroll with code: %v", err)
+	}
+	if got := server.Enrollments(); got[len(got)-1].EnrollmentCode != "ABCD-EFGH" {
+		t.Fatalf("expected enrollment code to be sent, got %+v", got)
+	}
+	if got := server.Enrollments(); got[len(got)-1].Hardware == nil {
+		t.Fatalf("expected the hardware inventory to be sent")
+	}
+	stored, _, err := manager.EnsureEnrollment(context.Background())
+	if err != nil {
+		t.Fatalf("load stored credentials: %v", err)
+	}
+	if stored.DeviceID != cred.DeviceID {
+		t.Fatalf("expected credentials to be persisted, got %q want %q", stored.DeviceID, cred.DeviceID)
+	}
+	if _, _, err := manager.EnrollWithCode(context.Background(), "ABCD-EFGH"); !errors.Is(err, ErrAlreadyEnrolled) {
+		t.Fatalf("expected already enrolled error, got %v", err)
+	}
+}
+
+func TestEnrollWithDeviceCodeWaitsForApproval(t *testing.T) {
+	server := apitest.NewServer(t)
+	manager := newInteractiveManager(t, server)
+
+	code, err := manager.RequestDeviceCode(context.Background())
+	if err != nil {
+		t.Fatalf("request device code: %v", err)
+	}
+	if code.UserCode == "" || code.VerificationURI == "" {
+		t.Fatalf("expected user code and verification uri, got %+v", code)
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := manager.EnrollWithDeviceCode(context.Background(), code)
+		done <- err
+	}()
+	waitForState(t, manager, StatePending)
+	server.Approve()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("enroll with device code: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for approval to complete enrollment")
+	}
+	if got := manager.Status(); got.State != StateEnrolled || got.ApprovedAt.IsZero() {
+		t.Fatalf("expected approved enrollment, got %+v", got)
+	}
+}
+
+func TestEnrollWithDeviceCodeExpires(t *testing.T) {
+	server := apitest.NewServer(t)
+	manager := newInteractiveManager(t, server)
+
+	code, err := manager.RequestDeviceCode(context.Background())
+	if err != nil {
+		t.Fatalf("request device code: %v", err)
+	}
+	code.ExpiresIn = 1
+	code.Interval = 2
+	if _, _, err := manager.EnrollWithDeviceCode(context.Background(), code); !errors.Is(err, ErrDeviceCodeExpired) {
+		t.Fatalf("expected the device code to expire, got %v", err)
+	}
+	// The code's interval replaces the retry backoff between polls.
+	if got := manager.Status(); got.Attempts != 1 {
+		t.Fatalf("expected a single attempt before expiry, got %d", got.Attempts)
+	}
+}
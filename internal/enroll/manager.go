@@ -6,6 +6,8 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/evergreen-os/device-agent/internal/config"
@@ -13,52 +15,259 @@ import (
 	"github.com/evergreen-os/device-agent/pkg/api"
 )
 
+// defaultReenrollInterval is the minimum spacing between automatic re-enrollments.
+const defaultReenrollInterval = time.Hour
+
+// ErrReenrollThrottled is returned when a re-enrollment was attempted too recently.
+var ErrReenrollThrottled = errors.New("re-enrollment rate limited")
+
 // Manager handles device enrollment and credential persistence.
 type Manager struct {
 	cfg             config.Config
 	client          *api.Client
 	credentialsPath string
+	keyPath         string
+	certPath        string
+
+	storeMu sync.Mutex
+
+	mu               sync.Mutex
+	lastReenroll     time.Time
+	reenrollInterval time.Duration
+	now              func() time.Time
+
+	retryBackoff  time.Duration
+	retryMaxDelay time.Duration
+
+	statusMu sync.Mutex
+	status   Status
+
+	tpm      TPMIdentity
+	hardware HardwareRecorder
+
+	// Zero-touch enrollment sources; see sources.go.
+	ignitionPath      string
+	oemPartitionLabel string
+	cmdlinePath       string
+	dmiEntriesDir     string
+	diskByLabelDir    string
+	mountOEM          func(ctx context.Context, device, dir string) error
+	unmountOEM        func(ctx context.Context, dir string) error
+}
+
+// TPMIdentity binds enrollment to the device TPM.
+type TPMIdentity interface {
+	// EnrollmentParameters returns the endorsement key and persistent
+	// attestation key parameters, or nil when no TPM is available.
+	EnrollmentParameters(ctx context.Context) (*api.TPMEnrollment, error)
+	// ActivateCredential decrypts the backend's AK activation challenge.
+	ActivateCredential(ctx context.Context, challenge api.AKChallenge) ([]byte, error)
+}
+
+// HardwareRecorder keeps the hardware fingerprint the device enrolled with.
+type HardwareRecorder interface {
+	Record(facts util.HardwareFacts) error
+}
+
+// Option customises a Manager.
+type Option func(*Manager)
+
+// WithTPM sends TPM identity with enrollment requests and answers the
+// backend's attestation key activation challenge.
+func WithTPM(identity TPMIdentity) Option {
+	return func(m *Manager) {
+		m.tpm = identity
+	}
+}
+
+// WithHardwareBaseline records the device hardware every time it enrolls so
+// later changes can be detected.
+func WithHardwareBaseline(recorder HardwareRecorder) Option {
+	return func(m *Manager) {
+		m.hardware = recorder
+	}
 }
 
 // Credentials describes the stored device identity.
 type Credentials struct {
-	DeviceID    string `json:"device_id"`
-	DeviceToken string `json:"device_token"`
-	Version     string `json:"policy_version"`
+	DeviceID     string `json:"device_id"`
+	DeviceToken  string `json:"device_token"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	Version      string `json:"policy_version"`
 }
 
 // NewManager constructs an enrollment manager.
-func NewManager(cfg config.Config, client *api.Client) *Manager {
-	return &Manager{
-		cfg:             cfg,
-		client:          client,
-		credentialsPath: cfg.DeviceTokenPath,
+func NewManager(cfg config.Config, client *api.Client, opts ...Option) *Manager {
+	keyPath := cfg.DeviceKeyPath
+	if keyPath == "" {
+		keyPath = filepath.Join(filepath.Dir(cfg.DeviceTokenPath), "device-key.pem")
+	}
+	certPath := cfg.DeviceCertPath
+	if certPath == "" {
+		certPath = filepath.Join(filepath.Dir(cfg.DeviceTokenPath), "device-cert.pem")
+	}
+	reenrollInterval := cfg.Enrollment.ReenrollMinInterval.Duration
+	if reenrollInterval <= 0 {
+		reenrollInterval = defaultReenrollInterval
+	}
+	retryBackoff := cfg.Intervals.RetryBackoff.Duration
+	if retryBackoff <= 0 {
+		retryBackoff = defaultRetryBackoff
+	}
+	retryMaxDelay := cfg.Intervals.RetryMaxDelay.Duration
+	if retryMaxDelay < retryBackoff {
+		retryMaxDelay = max(defaultRetryMaxDelay, retryBackoff)
+	}
+	ignitionPath := cfg.Enrollment.IgnitionPath
+	if ignitionPath == "" {
+		ignitionPath = defaultIgnitionPath
 	}
+	oemPartitionLabel := cfg.Enrollment.OEMPartitionLabel
+	if oemPartitionLabel == "" {
+		oemPartitionLabel = defaultOEMPartitionLabel
+	}
+	m := &Manager{
+		cfg:              cfg,
+		client:           client,
+		credentialsPath:  cfg.DeviceTokenPath,
+		keyPath:          keyPath,
+		certPath:         certPath,
+		reenrollInterval: reenrollInterval,
+		now:              time.Now,
+		retryBackoff:     retryBackoff,
+		retryMaxDelay:    retryMaxDelay,
+		status:           Status{State: StateUnenrolled},
+
+		ignitionPath:      ignitionPath,
+		oemPartitionLabel: oemPartitionLabel,
+		cmdlinePath:       "/proc/cmdline",
+		dmiEntriesDir:     "/sys/firmware/dmi/entries",
+		diskByLabelDir:    "/dev/disk/by-label",
+		mountOEM:          mountReadOnly,
+		unmountOEM:        unmount,
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
 }
 
-// EnsureEnrollment ensures the device is enrolled and credentials are persisted.
+// EnsureEnrollment ensures the device is enrolled and credentials are
+// persisted. Enrollment against the backend is retried with backoff, and waits
+// for administrator approval when the backend requires it, until ctx is done.
 func (m *Manager) EnsureEnrollment(ctx context.Context) (Credentials, api.PolicyEnvelope, error) {
 	cred, policy, err := m.loadCredentials()
 	if err == nil && cred.DeviceToken != "" {
+		m.setEnrolled(cred.DeviceID)
 		return cred, policy, nil
 	}
-	configCred, configPolicy, cfgErr := m.loadEnrollmentConfig()
-	if cfgErr == nil && configCred.DeviceToken != "" {
-		if err := m.saveCredentials(configCred, configPolicy); err != nil {
+	material, err := m.discoverEnrollment(ctx)
+	if err != nil {
+		return Credentials{}, api.PolicyEnvelope{}, err
+	}
+	if material != nil && material.hasCredentials() {
+		cred := material.credentials()
+		if err := m.saveCredentials(cred, material.Policy); err != nil {
 			return Credentials{}, api.PolicyEnvelope{}, err
 		}
-		if err := m.clearEnrollmentConfig(); err != nil {
+		if err := m.consumeEnrollment(material); err != nil {
 			return Credentials{}, api.PolicyEnvelope{}, err
 		}
-		return configCred, configPolicy, nil
+		if err := m.recordHardware(); err != nil {
+			return Credentials{}, api.PolicyEnvelope{}, err
+		}
+		m.setEnrolled(cred.DeviceID)
+		return cred, material.Policy, nil
+	}
+	if material == nil && m.Decommissioned() {
+		return Credentials{}, api.PolicyEnvelope{}, ErrDecommissioned
+	}
+	cred, policy, err = m.enrollWithRetry(ctx, material.customize)
+	if err != nil || material == nil {
+		return cred, policy, err
+	}
+	// Fresh provisioning material re-enrolls a decommissioned device.
+	if err := m.consumeEnrollment(material); err != nil {
+		return Credentials{}, api.PolicyEnvelope{}, err
+	}
+	if err := m.clearDecommissioned(); err != nil {
+		return Credentials{}, api.PolicyEnvelope{}, err
 	}
-	if cfgErr != nil && !errors.Is(cfgErr, os.ErrNotExist) {
-		return Credentials{}, api.PolicyEnvelope{}, cfgErr
+	return cred, policy, nil
+}
+
+// StoredCredentials returns the persisted credentials without enrolling. It
+// returns an error wrapping os.ErrNotExist when the device is not enrolled.
+func (m *Manager) StoredCredentials() (Credentials, error) {
+	cred, _, err := m.loadCredentials()
+	if err != nil {
+		return Credentials{}, err
+	}
+	if cred.DeviceToken == "" {
+		return Credentials{}, fmt.Errorf("credentials missing device token: %w", os.ErrNotExist)
 	}
+	return cred, nil
+}
+
+// Reenroll enrolls the device again and archives the credentials the backend
+// no longer accepts. Attempts are rate limited to avoid enrollment storms against a
+// misbehaving backend.
+func (m *Manager) Reenroll(ctx context.Context) (Credentials, api.PolicyEnvelope, error) {
+	m.mu.Lock()
+	now := m.now()
+	if !m.lastReenroll.IsZero() && now.Sub(m.lastReenroll) < m.reenrollInterval {
+		next := m.lastReenroll.Add(m.reenrollInterval)
+		m.mu.Unlock()
+		return Credentials{}, api.PolicyEnvelope{}, fmt.Errorf("%w until %s", ErrReenrollThrottled, next.Format(time.RFC3339))
+	}
+	m.lastReenroll = now
+	m.mu.Unlock()
+
+	// The old files stay in place until enrollment succeeds, so a backend
+	// outage does not leave the device without credentials.
+	previous := map[string][]byte{}
+	for _, path := range []string{m.credentialsPath, m.certPath} {
+		data, err := os.ReadFile(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return Credentials{}, api.PolicyEnvelope{}, fmt.Errorf("read %s: %w", path, err)
+		}
+		previous[path] = data
+	}
+	// A single attempt: the rate limit above paces retries, and callers hold
+	// up other work while re-enrolling.
+	cred, policy, err := m.enrollWithBackend(ctx, nil)
+	if err != nil {
+		m.updateStatus(func(s *Status) { s.LastError = err.Error() })
+		return Credentials{}, api.PolicyEnvelope{}, err
+	}
+	m.setEnrolled(cred.DeviceID)
+	suffix := ".revoked-" + now.UTC().Format("20060102T150405Z")
+	for path, data := range previous {
+		if err := os.WriteFile(path+suffix, data, 0o600); err != nil {
+			return cred, policy, fmt.Errorf("archive %s: %w", path, err)
+		}
+	}
+	return cred, policy, nil
+}
+
+// enrollWithBackend files a new enrollment request. customize, when non-nil,
+// adds interactive enrollment secrets to the request.
+func (m *Manager) enrollWithBackend(ctx context.Context, customize func(*api.EnrollDeviceRequest)) (Credentials, api.PolicyEnvelope, error) {
 	facts, err := util.CollectHardwareFacts()
 	if err != nil {
 		return Credentials{}, api.PolicyEnvelope{}, fmt.Errorf("collect hardware facts: %w", err)
 	}
+	key, err := m.ensureDeviceKey()
+	if err != nil {
+		return Credentials{}, api.PolicyEnvelope{}, err
+	}
+	csr, err := newCSR(key, facts.SerialNumber)
+	if err != nil {
+		return Credentials{}, api.PolicyEnvelope{}, err
+	}
 	req := api.EnrollDeviceRequest{
 		SerialNumber: facts.SerialNumber,
 		Model:        facts.Model,
@@ -67,6 +276,18 @@ func (m *Manager) EnsureEnrollment(ctx context.Context) (Credentials, api.Policy
 		TotalRAM:     facts.TotalRAM,
 		HasTPM:       facts.HasTPM,
 		PreSharedKey: m.cfg.Enrollment.PreSharedKey,
+		CSR:          csr,
+		Hardware:     &facts.HardwareInventory,
+	}
+	if m.tpm != nil {
+		params, err := m.tpm.EnrollmentParameters(ctx)
+		if err != nil {
+			return Credentials{}, api.PolicyEnvelope{}, fmt.Errorf("collect tpm identity: %w", err)
+		}
+		req.TPM = params
+	}
+	if customize != nil {
+		customize(&req)
 	}
 	ctx, cancel := context.WithTimeout(ctx, 60*time.Second)
 	defer cancel()
@@ -74,17 +295,80 @@ func (m *Manager) EnsureEnrollment(ctx context.Context) (Credentials, api.Policy
 	if err != nil {
 		return Credentials{}, api.PolicyEnvelope{}, fmt.Errorf("enroll device: %w", err)
 	}
-	cred = Credentials{
-		DeviceID:    resp.DeviceID,
-		DeviceToken: resp.DeviceToken,
-		Version:     resp.Policy.Version,
+	return m.completeEnrollment(ctx, resp)
+}
+
+// completeEnrollment persists the outcome of an enrollment or approval poll.
+// Pending responses store the poll token and return ErrEnrollmentPending.
+func (m *Manager) completeEnrollment(ctx context.Context, resp api.EnrollDeviceResponse) (Credentials, api.PolicyEnvelope, error) {
+	if resp.Pending() {
+		if err := m.savePending(resp); err != nil {
+			return Credentials{}, api.PolicyEnvelope{}, err
+		}
+		return Credentials{}, api.PolicyEnvelope{}, ErrEnrollmentPending
+	}
+	if resp.DeviceToken == "" {
+		return Credentials{}, api.PolicyEnvelope{}, errors.New("enrollment response missing device token")
+	}
+	if resp.AKChallenge != nil {
+		// Activate before persisting anything so a failed challenge is
+		// retried as a fresh enrollment rather than leaving an unbound AK.
+		if err := m.activateAK(ctx, resp); err != nil {
+			return Credentials{}, api.PolicyEnvelope{}, err
+		}
+	}
+	if resp.Certificate != "" {
+		if err := m.saveCertificate(resp.Certificate); err != nil {
+			return Credentials{}, api.PolicyEnvelope{}, err
+		}
+	}
+	cred := Credentials{
+		DeviceID:     resp.DeviceID,
+		DeviceToken:  resp.DeviceToken,
+		RefreshToken: resp.RefreshToken,
+		Version:      resp.Policy.Version,
 	}
 	if err := m.saveCredentials(cred, resp.Policy); err != nil {
 		return Credentials{}, api.PolicyEnvelope{}, err
 	}
+	if err := m.clearPending(); err != nil {
+		return Credentials{}, api.PolicyEnvelope{}, err
+	}
+	if err := m.recordHardware(); err != nil {
+		return Credentials{}, api.PolicyEnvelope{}, err
+	}
 	return cred, resp.Policy, nil
 }
 
+func (m *Manager) recordHardware() error {
+	if m.hardware == nil {
+		return nil
+	}
+	facts, err := util.CollectHardwareFacts()
+	if err != nil {
+		return fmt.Errorf("collect hardware facts: %w", err)
+	}
+	if err := m.hardware.Record(facts); err != nil {
+		return fmt.Errorf("record hardware fingerprint: %w", err)
+	}
+	return nil
+}
+
+func (m *Manager) activateAK(ctx context.Context, resp api.EnrollDeviceResponse) error {
+	if m.tpm == nil {
+		return errors.New("backend sent an attestation key challenge but no TPM is configured")
+	}
+	secret, err := m.tpm.ActivateCredential(ctx, *resp.AKChallenge)
+	if err != nil {
+		return fmt.Errorf("activate attestation key: %w", err)
+	}
+	req := api.ActivateAKRequest{DeviceID: resp.DeviceID, Secret: secret}
+	if err := m.client.ActivateAK(ctx, resp.DeviceToken, req); err != nil {
+		return fmt.Errorf("register attestation key: %w", err)
+	}
+	return nil
+}
+
 func (m *Manager) loadCredentials() (Credentials, api.PolicyEnvelope, error) {
 	data, err := util.ReadSecretFile(m.credentialsPath)
 	if err != nil {
@@ -104,6 +388,12 @@ func (m *Manager) loadCredentials() (Credentials, api.PolicyEnvelope, error) {
 }
 
 func (m *Manager) saveCredentials(cred Credentials, policy api.PolicyEnvelope) error {
+	m.storeMu.Lock()
+	defer m.storeMu.Unlock()
+	return m.saveCredentialsLocked(cred, policy)
+}
+
+func (m *Manager) saveCredentialsLocked(cred Credentials, policy api.PolicyEnvelope) error {
 	payload := struct {
 		Cred   Credentials        `json:"credentials"`
 		Policy api.PolicyEnvelope `json:"policy"`
@@ -118,44 +408,20 @@ func (m *Manager) saveCredentials(cred Credentials, policy api.PolicyEnvelope) e
 	return nil
 }
 
-func (m *Manager) loadEnrollmentConfig() (Credentials, api.PolicyEnvelope, error) {
-	if m.cfg.Enrollment.ConfigPath == "" {
-		return Credentials{}, api.PolicyEnvelope{}, os.ErrNotExist
-	}
-	data, err := os.ReadFile(m.cfg.Enrollment.ConfigPath)
-	if err != nil {
-		return Credentials{}, api.PolicyEnvelope{}, err
-	}
-	var payload struct {
-		DeviceID    string             `json:"device_id"`
-		DeviceToken string             `json:"device_token"`
-		Policy      api.PolicyEnvelope `json:"policy"`
-	}
-	if err := json.Unmarshal(data, &payload); err != nil {
-		return Credentials{}, api.PolicyEnvelope{}, fmt.Errorf("decode enrollment config: %w", err)
-	}
-	if payload.DeviceID == "" || payload.DeviceToken == "" {
-		return Credentials{}, api.PolicyEnvelope{}, fmt.Errorf("enrollment config missing credentials")
-	}
-	cred := Credentials{
-		DeviceID:    payload.DeviceID,
-		DeviceToken: payload.DeviceToken,
-		Version:     payload.Policy.Version,
-	}
-	return cred, payload.Policy, nil
-}
-
-func (m *Manager) clearEnrollmentConfig() error {
-	if m.cfg.Enrollment.ConfigPath == "" {
-		return nil
-	}
-	if err := os.Remove(m.cfg.Enrollment.ConfigPath); err != nil && !errors.Is(err, os.ErrNotExist) {
-		return fmt.Errorf("remove enrollment config: %w", err)
-	}
-	return nil
-}
-
 // Persist writes credentials and the latest policy bundle atomically.
 func (m *Manager) Persist(cred Credentials, policy api.PolicyEnvelope) error {
 	return m.saveCredentials(cred, policy)
 }
+
+// UpdateRefreshToken replaces the stored refresh credential after the backend
+// rotated it, keeping the rest of the stored credentials and policy intact.
+func (m *Manager) UpdateRefreshToken(refreshToken string) error {
+	m.storeMu.Lock()
+	defer m.storeMu.Unlock()
+	cred, policy, err := m.loadCredentials()
+	if err != nil {
+		return err
+	}
+	cred.RefreshToken = refreshToken
+	return m.saveCredentialsLocked(cred, policy)
+}
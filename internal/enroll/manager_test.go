@@ -4,9 +4,12 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/evergreen-os/device-agent/internal/config"
 	"github.com/evergreen-os/device-agent/pkg/api"
@@ -74,3 +77,88 @@ func TestEnsureEnrollmentUsesConfigFile(t *testing.T) {
 		t.Fatalf("stored credentials mismatch: %+v", stored.Cred)
 	}
 }
+
+func TestReenrollArchivesCredentialsAndRateLimits(t *testing.T) {
+	enrollments := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		enrollments++
+		_ = json.NewEncoder(w).Encode(api.EnrollDeviceResponse{DeviceID: "device-new", DeviceToken: "token-new"})
+	}))
+	defer server.Close()
+	client, err := api.New(server.URL)
+	if err != nil {
+		t.Fatalf("new client: %v", err)
+	}
+
+	dir := t.TempDir()
+	tokenPath := filepath.Join(dir, "secrets.json")
+	manager := NewManager(config.Config{DeviceTokenPath: tokenPath}, client)
+	if err := manager.Persist(Credentials{DeviceID: "device-old", DeviceToken: "revoked"}, api.PolicyEnvelope{}); err != nil {
+		t.Fatalf("persist old credentials: %v", err)
+	}
+	now := time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+	manager.now = func() time.Time { return now }
+
+	cred, _, err := manager.Reenroll(context.Background())
+	if err != nil {
+		t.Fatalf("Reenroll returned error: %v", err)
+	}
+	if cred.DeviceID != "device-new" || cred.DeviceToken != "token-new" {
+		t.Fatalf("unexpected credentials: %+v", cred)
+	}
+	archived, err := filepath.Glob(tokenPath + ".revoked-*")
+	if err != nil || len(archived) != 1 {
+		t.Fatalf("expected archived credentials, got %v (%v)", archived, err)
+	}
+	loaded, _, err := manager.loadCredentials()
+	if err != nil || loaded.DeviceToken != "token-new" {
+		t.Fatalf("expected new credentials persisted, got %+v (%v)", loaded, err)
+	}
+
+	now = now.Add(10 * time.Minute)
+	if _, _, err := manager.Reenroll(context.Background()); !errors.Is(err, ErrReenrollThrottled) {
+		t.Fatalf("expected throttled re-enrollment, got %v", err)
+	}
+	if enrollments != 1 {
+		t.Fatalf("expected a single enrollment call, got %d", enrollments)
+	}
+	now = now.Add(time.Hour)
+	if _, _, err := manager.Reenroll(context.Background()); err != nil {
+		t.Fatalf("expected re-enrollment after interval, got %v", err)
+	}
+}
+
+func TestReenrollMakesSingleAttempt(t *testing.T) {
+	enrollments := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		enrollments++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	client, err := api.New(server.URL)
+	if err != nil {
+		t.Fatalf("new client: %v", err)
+	}
+	tokenPath := filepath.Join(t.TempDir(), "secrets.json")
+	manager := NewManager(config.Config{DeviceTokenPath: tokenPath}, client)
+	manager.retryBackoff = time.Millisecond
+	if err := manager.Persist(Credentials{DeviceID: "device-old", DeviceToken: "revoked"}, api.PolicyEnvelope{}); err != nil {
+		t.Fatalf("persist old credentials: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, _, err := manager.Reenroll(ctx); err == nil || ctx.Err() != nil {
+		t.Fatalf("expected re-enrollment to fail promptly, got %v", err)
+	}
+	if enrollments != 1 {
+		t.Fatalf("expected a single enrollment call, got %d", enrollments)
+	}
+	// Nothing is archived until a new enrollment succeeds.
+	if archived, _ := filepath.Glob(tokenPath + ".revoked-*"); len(archived) != 0 {
+		t.Fatalf("expected no archived credentials, got %v", archived)
+	}
+	if cred, err := manager.StoredCredentials(); err != nil || cred.DeviceID != "device-old" {
+		t.Fatalf("expected old credentials kept, got %+v (%v)", cred, err)
+	}
+}
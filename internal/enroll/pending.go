@@ -0,0 +1,185 @@
+package enroll
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/evergreen-os/device-agent/internal/util"
+	"github.com/evergreen-os/device-agent/pkg/api"
+)
+
+// Backoff applied between failed enrollment attempts when the configuration
+// leaves retry intervals unset.
+const (
+	defaultRetryBackoff  = 15 * time.Second
+	defaultRetryMaxDelay = 5 * time.Minute
+)
+
+// ErrEnrollmentPending is returned while the backend waits for an
+// administrator to approve the device.
+var ErrEnrollmentPending = errors.New("enrollment pending approval")
+
+// Enrollment states reported by Status.
+const (
+	StateUnenrolled = "unenrolled"
+	StateEnrolling  = "enrolling"
+	StatePending    = "pending_approval"
+	StateEnrolled   = "enrolled"
+)
+
+// Status describes enrollment progress for local diagnostics.
+type Status struct {
+	State        string    `json:"state"`
+	DeviceID     string    `json:"device_id,omitempty"`
+	Attempts     int       `json:"attempts"`
+	LastError    string    `json:"last_error,omitempty"`
+	PendingSince time.Time `json:"pending_since,omitzero"`
+	ApprovedAt   time.Time `json:"approved_at,omitzero"`
+}
+
+type pendingEnrollment struct {
+	PollToken    string    `json:"poll_token"`
+	PollInterval int       `json:"poll_interval,omitempty"`
+	Since        time.Time `json:"since"`
+}
+
+// Status returns a snapshot of the enrollment progress.
+func (m *Manager) Status() Status {
+	m.statusMu.Lock()
+	defer m.statusMu.Unlock()
+	return m.status
+}
+
+func (m *Manager) updateStatus(fn func(*Status)) {
+	m.statusMu.Lock()
+	defer m.statusMu.Unlock()
+	fn(&m.status)
+}
+
+func (m *Manager) setEnrolled(deviceID string) {
+	m.updateStatus(func(s *Status) {
+		if s.State == StatePending {
+			s.ApprovedAt = m.now()
+		}
+		s.State = StateEnrolled
+		s.DeviceID = deviceID
+		s.LastError = ""
+	})
+}
+
+// enrollWithRetry enrolls against the backend until it succeeds or ctx is
+// done. Failures back off exponentially; pending approvals are polled at the
+// interval suggested by the backend.
+func (m *Manager) enrollWithRetry(ctx context.Context, customize func(*api.EnrollDeviceRequest)) (Credentials, api.PolicyEnvelope, error) {
+	delay := m.retryBackoff
+	for {
+		m.updateStatus(func(s *Status) {
+			s.Attempts++
+			if s.State != StatePending {
+				s.State = StateEnrolling
+			}
+		})
+		cred, policy, err := m.attemptEnrollment(ctx, customize)
+		if err == nil {
+			m.setEnrolled(cred.DeviceID)
+			return cred, policy, nil
+		}
+		wait := delay
+		if errors.Is(err, ErrEnrollmentPending) {
+			wait = m.retryBackoff
+			if pending, perr := m.loadPending(); perr == nil {
+				if pending.PollInterval > 0 {
+					wait = time.Duration(pending.PollInterval) * time.Second
+				}
+				m.updateStatus(func(s *Status) {
+					s.State = StatePending
+					s.PendingSince = pending.Since
+					s.LastError = ""
+				})
+			}
+		} else {
+			m.updateStatus(func(s *Status) { s.LastError = err.Error() })
+			delay = min(delay*2, m.retryMaxDelay)
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return Credentials{}, api.PolicyEnvelope{}, fmt.Errorf("enrollment interrupted: %w (last error: %v)", ctx.Err(), err)
+		case <-timer.C:
+		}
+	}
+}
+
+// attemptEnrollment polls a pending enrollment if one is stored and starts a
+// new enrollment otherwise. Credentials written meanwhile by another process,
+// such as `agent enroll`, are picked up instead.
+func (m *Manager) attemptEnrollment(ctx context.Context, customize func(*api.EnrollDeviceRequest)) (Credentials, api.PolicyEnvelope, error) {
+	if cred, policy, err := m.loadCredentials(); err == nil && cred.DeviceToken != "" {
+		return cred, policy, nil
+	}
+	pending, err := m.loadPending()
+	if errors.Is(err, os.ErrNotExist) {
+		return m.enrollWithBackend(ctx, customize)
+	}
+	if err != nil {
+		return Credentials{}, api.PolicyEnvelope{}, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, 60*time.Second)
+	defer cancel()
+	resp, err := m.client.PollEnrollment(ctx, api.PollEnrollmentRequest{PollToken: pending.PollToken})
+	if err != nil {
+		if errors.Is(err, api.ErrUnauthorized) {
+			// The poll token was rejected or expired; start over.
+			if cerr := m.clearPending(); cerr != nil {
+				return Credentials{}, api.PolicyEnvelope{}, cerr
+			}
+		}
+		return Credentials{}, api.PolicyEnvelope{}, fmt.Errorf("poll enrollment: %w", err)
+	}
+	return m.completeEnrollment(ctx, resp)
+}
+
+func (m *Manager) pendingPath() string {
+	return m.credentialsPath + ".pending"
+}
+
+func (m *Manager) loadPending() (pendingEnrollment, error) {
+	data, err := util.ReadSecretFile(m.pendingPath())
+	if err != nil {
+		return pendingEnrollment{}, err
+	}
+	var pending pendingEnrollment
+	if err := json.Unmarshal(data, &pending); err != nil {
+		return pendingEnrollment{}, fmt.Errorf("decode pending enrollment: %w", err)
+	}
+	return pending, nil
+}
+
+// savePending records the poll token so a restarted agent resumes waiting
+// instead of filing a second enrollment request.
+func (m *Manager) savePending(resp api.EnrollDeviceResponse) error {
+	pending := pendingEnrollment{PollToken: resp.PollToken, PollInterval: resp.PollInterval, Since: m.now().UTC()}
+	if existing, err := m.loadPending(); err == nil {
+		pending.Since = existing.Since
+	}
+	data, err := json.MarshalIndent(pending, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal pending enrollment: %w", err)
+	}
+	if err := util.WriteSecretFile(m.pendingPath(), data); err != nil {
+		return fmt.Errorf("write pending enrollment: %w", err)
+	}
+	return nil
+}
+
+func (m *Manager) clearPending() error {
+	if err := os.Remove(m.pendingPath()); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("remove pending enrollment: %w", err)
+	}
+	return nil
+}
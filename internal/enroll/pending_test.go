@@ -0,0 +1,82 @@
+package enroll
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/evergreen-os/device-agent/internal/config"
+	"github.com/evergreen-os/device-agent/pkg/api"
+	"github.com/evergreen-os/device-agent/pkg/api/apitest"
+)
+
+func waitForState(t *testing.T, manager *Manager, state string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for manager.Status().State != state {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for state %q, status %+v", state, manager.Status())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestEnsureEnrollmentRetriesAndWaitsForApproval(t *testing.T) {
+	server := apitest.NewServer(t)
+	server.RequireApproval(0)
+	server.Fail(apitest.EndpointEnroll, apitest.Failure{Status: 503})
+	client, err := api.New(server.URL)
+	if err != nil {
+		t.Fatalf("new client: %v", err)
+	}
+	cfg := config.Config{DeviceTokenPath: filepath.Join(t.TempDir(), "secrets.json")}
+	cfg.Intervals.RetryBackoff.Duration = 10 * time.Millisecond
+	cfg.Intervals.RetryMaxDelay.Duration = 20 * time.Millisecond
+	manager := NewManager(cfg, client)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := manager.EnsureEnrollment(ctx)
+		done <- err
+	}()
+	waitForState(t, manager, StatePending)
+	if attempts := manager.Status().Attempts; attempts < 2 {
+		t.Fatalf("expected enrollment to be retried after the outage, got %d attempts", attempts)
+	}
+	if _, err := os.Stat(cfg.DeviceTokenPath + ".pending"); err != nil {
+		t.Fatalf("expected poll token to be persisted: %v", err)
+	}
+	cancel()
+	if err := <-done; err == nil {
+		t.Fatalf("expected cancellation to interrupt enrollment")
+	}
+
+	// A restarted agent resumes polling instead of enrolling again.
+	restarted := NewManager(cfg, client)
+	done = make(chan error, 1)
+	go func() {
+		_, _, err := restarted.EnsureEnrollment(context.Background())
+		done <- err
+	}()
+	waitForState(t, restarted, StatePending)
+	server.Approve()
+	if err := <-done; err != nil {
+		t.Fatalf("EnsureEnrollment returned error: %v", err)
+	}
+	if got := len(server.Enrollments()); got != 1 {
+		t.Fatalf("expected a single enrollment request, got %d", got)
+	}
+	status := restarted.Status()
+	if status.State != StateEnrolled || status.ApprovedAt.IsZero() || status.PendingSince.IsZero() {
+		t.Fatalf("unexpected status after approval: %+v", status)
+	}
+	if _, err := os.Stat(cfg.DeviceTokenPath + ".pending"); !os.IsNotExist(err) {
+		t.Fatalf("expected poll token to be removed after approval, got %v", err)
+	}
+	if _, err := restarted.ClientCertificate(); err != nil {
+		t.Fatalf("expected certificate from approved enrollment: %v", err)
+	}
+}
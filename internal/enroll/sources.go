@@ -0,0 +1,359 @@
+package enroll
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/evergreen-os/device-agent/internal/config"
+	"github.com/evergreen-os/device-agent/internal/util"
+	"github.com/evergreen-os/device-agent/pkg/api"
+)
+
+const (
+	defaultIgnitionPath      = "/etc/evergreen/agent/enrollment.ign.json"
+	defaultOEMPartitionLabel = "EVERGREEN-OEM"
+	// oemEnrollmentFile is read from the root of the OEM partition.
+	oemEnrollmentFile = "enrollment.json"
+	// enrollmentKeyPrefix starts enrollment parameters on the kernel command
+	// line and in SMBIOS OEM strings, e.g. evergreen.enroll.code=ABCD-EFGH.
+	enrollmentKeyPrefix = "evergreen.enroll."
+	// smbiosOEMStrings is the SMBIOS structure type holding OEM strings.
+	smbiosOEMStrings = 11
+)
+
+// enrollmentMaterial is zero-touch enrollment input found on the device. It
+// either carries credentials issued ahead of time or secrets that authorise
+// a regular enrollment.
+type enrollmentMaterial struct {
+	DeviceID       string             `json:"device_id"`
+	DeviceToken    string             `json:"device_token"`
+	Policy         api.PolicyEnvelope `json:"policy"`
+	PreSharedKey   string             `json:"pre_shared_key"`
+	EnrollmentCode string             `json:"enrollment_code"`
+
+	// source names where the material was found.
+	source string
+	// path is removed once file-backed material is consumed. Read-only
+	// sources are remembered in the consumed marker instead.
+	path string
+}
+
+func (e *enrollmentMaterial) empty() bool {
+	return e.DeviceID == "" && e.DeviceToken == "" && e.PreSharedKey == "" && e.EnrollmentCode == ""
+}
+
+func (e *enrollmentMaterial) validate() error {
+	switch {
+	case e.DeviceID != "" || e.DeviceToken != "":
+		if e.DeviceID == "" || e.DeviceToken == "" {
+			return errors.New("device_id and device_token must be set together")
+		}
+		if e.PreSharedKey != "" || e.EnrollmentCode != "" {
+			return errors.New("credentials cannot be combined with enrollment secrets")
+		}
+	case e.PreSharedKey == "" && e.EnrollmentCode == "":
+		return errors.New("no credentials or enrollment secrets")
+	}
+	return nil
+}
+
+func (e *enrollmentMaterial) hasCredentials() bool {
+	return e.DeviceToken != ""
+}
+
+func (e *enrollmentMaterial) credentials() Credentials {
+	return Credentials{DeviceID: e.DeviceID, DeviceToken: e.DeviceToken, Version: e.Policy.Version}
+}
+
+// customize adds the enrollment secrets to a request. It is safe to call on a
+// nil material.
+func (e *enrollmentMaterial) customize(req *api.EnrollDeviceRequest) {
+	if e == nil {
+		return
+	}
+	if e.PreSharedKey != "" {
+		req.PreSharedKey = e.PreSharedKey
+	}
+	if e.EnrollmentCode != "" {
+		req.EnrollmentCode = e.EnrollmentCode
+	}
+}
+
+// digest identifies the material in the consumed marker without storing the
+// secrets themselves.
+func (e *enrollmentMaterial) digest() string {
+	data, _ := json.Marshal(e)
+	sum := sha256.Sum256(append([]byte(e.source+"\n"), data...))
+	return hex.EncodeToString(sum[:])
+}
+
+// discoverEnrollment returns material from the first configured source that
+// has any, skipping material consumed earlier. It returns nil when no source
+// has unused material.
+func (m *Manager) discoverEnrollment(ctx context.Context) (*enrollmentMaterial, error) {
+	sources := m.cfg.Enrollment.Sources
+	if len(sources) == 0 {
+		sources = config.DefaultEnrollmentSources
+	}
+	consumed, err := m.loadConsumed()
+	if err != nil {
+		return nil, err
+	}
+	for _, source := range sources {
+		var material *enrollmentMaterial
+		switch source {
+		case config.EnrollmentSourceConfig:
+			material, err = readEnrollmentFile(m.cfg.Enrollment.ConfigPath)
+		case config.EnrollmentSourceIgnition:
+			material, err = readEnrollmentFile(m.ignitionPath)
+		case config.EnrollmentSourceCmdline:
+			material, err = m.readCmdline()
+		case config.EnrollmentSourceOEM:
+			material, err = m.readOEMPartition(ctx)
+		case config.EnrollmentSourceSMBIOS:
+			material, err = m.readSMBIOS()
+		default:
+			err = errors.New("unknown source")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s enrollment source: %w", source, err)
+		}
+		if material == nil || material.empty() {
+			continue
+		}
+		material.source = source
+		if slices.Contains(consumed, material.digest()) {
+			continue
+		}
+		if err := material.validate(); err != nil {
+			return nil, fmt.Errorf("%s enrollment source: %w", source, err)
+		}
+		return material, nil
+	}
+	return nil, nil
+}
+
+// consumeEnrollment makes sure material is only ever used once: files are
+// removed and read-only sources are recorded in the consumed marker.
+func (m *Manager) consumeEnrollment(material *enrollmentMaterial) error {
+	if material.path != "" {
+		if _, err := util.RemoveFile(material.path); err != nil {
+			return fmt.Errorf("remove %s enrollment material: %w", material.source, err)
+		}
+		return nil
+	}
+	consumed, err := m.loadConsumed()
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(append(consumed, material.digest()), "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal consumed enrollment material: %w", err)
+	}
+	if err := util.WriteSecretFile(m.consumedPath(), data); err != nil {
+		return fmt.Errorf("write consumed enrollment material: %w", err)
+	}
+	return nil
+}
+
+func (m *Manager) consumedPath() string {
+	return m.credentialsPath + ".enrollment-consumed"
+}
+
+func (m *Manager) loadConsumed() ([]string, error) {
+	data, err := util.ReadSecretFile(m.consumedPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read consumed enrollment material: %w", err)
+	}
+	var consumed []string
+	if err := json.Unmarshal(data, &consumed); err != nil {
+		return nil, fmt.Errorf("decode consumed enrollment material: %w", err)
+	}
+	return consumed, nil
+}
+
+// readEnrollmentFile reads a JSON enrollment file such as the handoff written
+// by provisioning tooling or Ignition.
+func readEnrollmentFile(path string) (*enrollmentMaterial, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var material enrollmentMaterial
+	if err := json.Unmarshal(data, &material); err != nil {
+		return nil, fmt.Errorf("decode %s: %w", path, err)
+	}
+	material.path = path
+	return &material, nil
+}
+
+// readCmdline parses evergreen.enroll.* parameters from the kernel command
+// line.
+func (m *Manager) readCmdline() (*enrollmentMaterial, error) {
+	data, err := os.ReadFile(m.cmdlinePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseEnrollmentParams(splitCmdline(string(data)))
+}
+
+// splitCmdline splits the kernel command line on spaces outside double
+// quotes, dropping the quotes like the kernel does.
+func splitCmdline(cmdline string) []string {
+	var (
+		params  []string
+		current strings.Builder
+		quoted  bool
+	)
+	for _, r := range strings.TrimSpace(cmdline) {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case (r == ' ' || r == '\t' || r == '\n') && !quoted:
+			if current.Len() > 0 {
+				params = append(params, current.String())
+				current.Reset()
+			}
+		default:
+			current.WriteRune(r)
+		}
+	}
+	if current.Len() > 0 {
+		params = append(params, current.String())
+	}
+	return params
+}
+
+// parseEnrollmentParams builds material from key=value pairs, ignoring keys
+// outside the evergreen.enroll. namespace.
+func parseEnrollmentParams(params []string) (*enrollmentMaterial, error) {
+	var material enrollmentMaterial
+	for _, param := range params {
+		key, value, ok := strings.Cut(param, "=")
+		if !strings.HasPrefix(key, enrollmentKeyPrefix) {
+			continue
+		}
+		if !ok || value == "" {
+			return nil, fmt.Errorf("%s has no value", key)
+		}
+		switch strings.TrimPrefix(key, enrollmentKeyPrefix) {
+		case "device_id":
+			material.DeviceID = value
+		case "device_token":
+			material.DeviceToken = value
+		case "psk":
+			material.PreSharedKey = value
+		case "code":
+			material.EnrollmentCode = value
+		default:
+			return nil, fmt.Errorf("unknown parameter %s", key)
+		}
+	}
+	return &material, nil
+}
+
+// readOEMPartition mounts the partition labelled OEMPartitionLabel read-only
+// and reads enrollment.json from its root.
+func (m *Manager) readOEMPartition(ctx context.Context) (*enrollmentMaterial, error) {
+	device := filepath.Join(m.diskByLabelDir, m.oemPartitionLabel)
+	if _, err := os.Stat(device); errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	dir, err := os.MkdirTemp("", "evergreen-oem-")
+	if err != nil {
+		return nil, fmt.Errorf("create mount point: %w", err)
+	}
+	defer os.Remove(dir)
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	if err := m.mountOEM(ctx, device, dir); err != nil {
+		return nil, err
+	}
+	defer m.unmountOEM(context.WithoutCancel(ctx), dir)
+	material, err := readEnrollmentFile(filepath.Join(dir, oemEnrollmentFile))
+	if material != nil {
+		// The partition is mounted read-only; remember it was consumed
+		// instead.
+		material.path = ""
+	}
+	return material, err
+}
+
+func mountReadOnly(ctx context.Context, device, dir string) error {
+	cmd := exec.CommandContext(ctx, "mount", "-o", "ro,nodev,nosuid,noexec", device, dir)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("mount %s: %w (%s)", device, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+func unmount(ctx context.Context, dir string) error {
+	cmd := exec.CommandContext(ctx, "umount", dir)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("umount %s: %w (%s)", dir, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// readSMBIOS reads evergreen.enroll.* OEM strings (SMBIOS type 11), which
+// hypervisors and vendors can set per machine.
+func (m *Manager) readSMBIOS() (*enrollmentMaterial, error) {
+	entries, err := filepath.Glob(filepath.Join(m.dmiEntriesDir, fmt.Sprintf("%d-*", smbiosOEMStrings), "raw"))
+	if err != nil {
+		return nil, err
+	}
+	var params []string
+	for _, path := range entries {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		strs, err := parseSMBIOSStrings(data)
+		if err != nil {
+			return nil, fmt.Errorf("parse %s: %w", path, err)
+		}
+		params = append(params, strs...)
+	}
+	return parseEnrollmentParams(params)
+}
+
+// parseSMBIOSStrings returns the string set following the formatted area of
+// a raw SMBIOS structure.
+func parseSMBIOSStrings(raw []byte) ([]string, error) {
+	if len(raw) < 4 || int(raw[1]) > len(raw) {
+		return nil, errors.New("truncated structure")
+	}
+	var strs []string
+	for _, s := range bytes.Split(raw[raw[1]:], []byte{0}) {
+		if len(s) == 0 {
+			break
+		}
+		strs = append(strs, string(s))
+	}
+	return strs, nil
+}
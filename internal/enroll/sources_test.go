@@ -0,0 +1,134 @@
+package enroll
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/evergreen-os/device-agent/internal/config"
+	"github.com/evergreen-os/device-agent/pkg/api"
+	"github.com/evergreen-os/device-agent/pkg/api/apitest"
+)
+
+// newSourceManager points every zero-touch source at the testdata fixtures.
+func newSourceManager(t *testing.T, client *api.Client, sources ...string) *Manager {
+	t.Helper()
+	dir := t.TempDir()
+	ignition, err := os.ReadFile(filepath.Join("testdata", "ignition.json"))
+	if err != nil {
+		t.Fatalf("read fixture: %v", err)
+	}
+	ignitionPath := filepath.Join(dir, "enrollment.ign.json")
+	if err := os.WriteFile(ignitionPath, ignition, 0o600); err != nil {
+		t.Fatalf("write ignition file: %v", err)
+	}
+	byLabel := filepath.Join(dir, "by-label")
+	if err := os.MkdirAll(byLabel, 0o755); err != nil {
+		t.Fatalf("create by-label dir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(byLabel, defaultOEMPartitionLabel), nil, 0o600); err != nil {
+		t.Fatalf("create oem device: %v", err)
+	}
+	cfg := config.Config{DeviceTokenPath: filepath.Join(dir, "secrets.json")}
+	cfg.Enrollment.Sources = sources
+	cfg.Enrollment.IgnitionPath = ignitionPath
+	manager := NewManager(cfg, client)
+	manager.cmdlinePath = filepath.Join("testdata", "cmdline")
+	manager.dmiEntriesDir = filepath.Join("testdata", "dmi", "entries")
+	manager.diskByLabelDir = byLabel
+	manager.mountOEM = func(_ context.Context, device, target string) error {
+		data, err := os.ReadFile(filepath.Join("testdata", "oem", oemEnrollmentFile))
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(filepath.Join(target, oemEnrollmentFile), data, 0o600)
+	}
+	manager.unmountOEM = func(_ context.Context, target string) error {
+		return os.Remove(filepath.Join(target, oemEnrollmentFile))
+	}
+	return manager
+}
+
+func TestDiscoverEnrollmentSources(t *testing.T) {
+	cases := []struct {
+		sources []string
+		want    enrollmentMaterial
+	}{
+		{nil, enrollmentMaterial{EnrollmentCode: "ABCD-EFGH"}},
+		{[]string{config.EnrollmentSourceIgnition, config.EnrollmentSourceCmdline}, enrollmentMaterial{DeviceID: "device-ignition", DeviceToken: "token-ignition"}},
+		{[]string{config.EnrollmentSourceOEM}, enrollmentMaterial{PreSharedKey: "oem-psk"}},
+		{[]string{config.EnrollmentSourceSMBIOS}, enrollmentMaterial{EnrollmentCode: "SMBIOS-CODE"}},
+	}
+	for _, tc := range cases {
+		manager := newSourceManager(t, nil, tc.sources...)
+		material, err := manager.discoverEnrollment(context.Background())
+		if err != nil {
+			t.Fatalf("%v: discover: %v", tc.sources, err)
+		}
+		if material == nil {
+			t.Fatalf("%v: expected enrollment material", tc.sources)
+		}
+		if material.DeviceID != tc.want.DeviceID || material.DeviceToken != tc.want.DeviceToken ||
+			material.PreSharedKey != tc.want.PreSharedKey || material.EnrollmentCode != tc.want.EnrollmentCode {
+			t.Fatalf("%v: unexpected material %+v", tc.sources, material)
+		}
+	}
+}
+
+func TestEnsureEnrollmentConsumesIgnitionCredentials(t *testing.T) {
+	manager := newSourceManager(t, nil, config.EnrollmentSourceIgnition)
+	cred, policy, err := manager.EnsureEnrollment(context.Background())
+	if err != nil {
+		t.Fatalf("enroll: %v", err)
+	}
+	if cred.DeviceID != "device-ignition" || policy.Version != "v7" {
+		t.Fatalf("unexpected enrollment %+v %+v", cred, policy)
+	}
+	if _, err := os.Stat(manager.ignitionPath); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected ignition file removed, got %v", err)
+	}
+}
+
+func TestEnsureEnrollmentConsumesCmdlineOnce(t *testing.T) {
+	server := apitest.NewServer(t)
+	server.AddEnrollmentCode("ABCD-EFGH")
+	client, err := api.New(server.URL)
+	if err != nil {
+		t.Fatalf("new client: %v", err)
+	}
+	manager := newSourceManager(t, client, config.EnrollmentSourceCmdline)
+	if _, _, err := manager.EnsureEnrollment(context.Background()); err != nil {
+		t.Fatalf("enroll: %v", err)
+	}
+	if got := server.Enrollments(); len(got) != 1 || got[0].EnrollmentCode != "ABCD-EFGH" {
+		t.Fatalf("expected the kernel command line code to be sent, got %+v", got)
+	}
+	if err := os.Remove(manager.credentialsPath); err != nil {
+		t.Fatalf("remove credentials: %v", err)
+	}
+	material, err := manager.discoverEnrollment(context.Background())
+	if err != nil {
+		t.Fatalf("discover: %v", err)
+	}
+	if material != nil {
+		t.Fatalf("expected consumed command line material to be skipped, got %+v", material)
+	}
+}
+
+func TestParseEnrollmentParamsValidation(t *testing.T) {
+	if _, err := parseEnrollmentParams([]string{"evergreen.enroll.serial=1"}); err == nil {
+		t.Fatalf("expected unknown parameter to fail")
+	}
+	material, err := parseEnrollmentParams(splitCmdline(`quiet evergreen.enroll.device_id="device 1"`))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if material.DeviceID != "device 1" {
+		t.Fatalf("expected quoted value, got %q", material.DeviceID)
+	}
+	if err := material.validate(); err == nil {
+		t.Fatalf("expected device_id without device_token to fail validation")
+	}
+}
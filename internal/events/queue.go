@@ -66,6 +66,34 @@ func (q *Queue) Replace(events []api.Event) error {
 	return q.writeLocked(events)
 }
 
+// Clear deletes the queue file and any events still in it.
+func (q *Queue) Clear() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, err := util.RemoveFile(q.path); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Discard removes the oldest n events, typically after they were acknowledged.
+// Events appended concurrently are preserved.
+func (q *Queue) Discard(n int) error {
+	if n <= 0 {
+		return nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	existing, err := q.readLocked()
+	if err != nil {
+		return err
+	}
+	if n > len(existing) {
+		n = len(existing)
+	}
+	return q.writeLocked(existing[n:])
+}
+
 func (q *Queue) readLocked() ([]api.Event, error) {
 	data, err := os.ReadFile(q.path)
 	if err != nil {
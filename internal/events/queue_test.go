@@ -53,3 +53,28 @@ func TestQueueAppendLoadAndReplace(t *testing.T) {
 		t.Fatalf("expected queue to be empty, got %d", len(events))
 	}
 }
+
+func TestQueueDiscardKeepsNewerEvents(t *testing.T) {
+	queue := NewQueue(filepath.Join(t.TempDir(), "queue.json"))
+	for _, id := range []string{"1", "2", "3"} {
+		if err := queue.Append(api.Event{ID: id, Type: "test"}); err != nil {
+			t.Fatalf("append event: %v", err)
+		}
+	}
+	if err := queue.Discard(2); err != nil {
+		t.Fatalf("discard events: %v", err)
+	}
+	events, err := queue.Load()
+	if err != nil {
+		t.Fatalf("load events: %v", err)
+	}
+	if len(events) != 1 || events[0].ID != "3" {
+		t.Fatalf("expected only the newest event to remain, got %+v", events)
+	}
+	if err := queue.Discard(5); err != nil {
+		t.Fatalf("discard beyond length: %v", err)
+	}
+	if events, _ := queue.Load(); len(events) != 0 {
+		t.Fatalf("expected empty queue, got %d", len(events))
+	}
+}
@@ -0,0 +1,200 @@
+// Package hardware detects when a device's hardware no longer matches the
+// fingerprint recorded at enrollment, e.g. after a motherboard or disk swap.
+package hardware
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/evergreen-os/device-agent/internal/events"
+	"github.com/evergreen-os/device-agent/internal/util"
+	"github.com/evergreen-os/device-agent/pkg/api"
+)
+
+// Fingerprint maps identity-relevant hardware fields to their values.
+// Removable and external disks and network adapters are left out because
+// docks and USB devices come and go.
+type Fingerprint map[string]string
+
+// internalTransports are the disk transports counted in the fingerprint.
+// USB drives often do not report themselves as removable.
+var internalTransports = []string{"nvme", "sata", "mmc", "virtio"}
+
+// NewFingerprint derives the fingerprint of the given facts.
+func NewFingerprint(facts util.HardwareFacts) Fingerprint {
+	var disks []string
+	for _, disk := range facts.Disks {
+		if disk.Removable || !slices.Contains(internalTransports, disk.Transport) {
+			continue
+		}
+		id := disk.Serial
+		if id == "" {
+			id = disk.Model + ":" + strconv.FormatUint(disk.SizeBytes, 10)
+		}
+		disks = append(disks, id)
+	}
+	slices.Sort(disks)
+	return Fingerprint{
+		"serial":      facts.SerialNumber,
+		"system_uuid": facts.SystemUUID,
+		"model":       facts.Model,
+		"board":       strings.TrimSpace(facts.BoardVendor + " " + facts.BoardName + " " + facts.BoardVersion),
+		"disks":       strings.Join(disks, ","),
+		"tpm":         strconv.FormatBool(facts.HasTPM),
+	}
+}
+
+// Diff returns the fields whose values differ between previous and current.
+func Diff(previous, current Fingerprint) map[string]api.HardwareChange {
+	changes := map[string]api.HardwareChange{}
+	for _, field := range slices.Sorted(maps.Keys(current)) {
+		if previous[field] != current[field] {
+			changes[field] = api.HardwareChange{Previous: previous[field], Current: current[field]}
+		}
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+	return changes
+}
+
+func (f Fingerprint) digest() string {
+	data, _ := json.Marshal(f)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// record is the on-disk baseline.
+type record struct {
+	Fingerprint Fingerprint `json:"fingerprint"`
+	// Reported is the digest of the last changed fingerprint announced in a
+	// hardware.changed event, so a change is reported once rather than on
+	// every start.
+	Reported string `json:"reported,omitempty"`
+}
+
+// Monitor compares the current hardware with the enrollment baseline.
+type Monitor struct {
+	logger  *slog.Logger
+	path    string
+	collect func() (util.HardwareFacts, error)
+
+	mu      sync.Mutex
+	changes map[string]api.HardwareChange
+}
+
+// Option customises a Monitor.
+type Option func(*Monitor)
+
+// WithCollector replaces util.CollectHardwareFacts, e.g. with fixtures.
+func WithCollector(collect func() (util.HardwareFacts, error)) Option {
+	return func(m *Monitor) {
+		m.collect = collect
+	}
+}
+
+// NewMonitor constructs a Monitor storing its baseline at path.
+func NewMonitor(logger *slog.Logger, path string, opts ...Option) *Monitor {
+	m := &Monitor{logger: logger, path: path, collect: util.CollectHardwareFacts}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+// Record stores the fingerprint of facts as the new baseline and clears any
+// outstanding change. It is called whenever the device enrolls.
+func (m *Monitor) Record(facts util.HardwareFacts) error {
+	if err := m.save(record{Fingerprint: NewFingerprint(facts)}); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	m.changes = nil
+	m.mu.Unlock()
+	return nil
+}
+
+// Check compares the current hardware with the baseline and returns a
+// hardware.changed event the first time a given change is seen. Devices
+// enrolled before a baseline existed adopt the current hardware as theirs.
+func (m *Monitor) Check() ([]api.Event, error) {
+	facts, err := m.collect()
+	if err != nil {
+		return nil, fmt.Errorf("collect hardware facts: %w", err)
+	}
+	stored, err := m.load()
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, m.Record(facts)
+	}
+	if err != nil {
+		return nil, err
+	}
+	current := NewFingerprint(facts)
+	changes := Diff(stored.Fingerprint, current)
+	m.mu.Lock()
+	m.changes = changes
+	m.mu.Unlock()
+	if changes == nil || stored.Reported == current.digest() {
+		return nil, nil
+	}
+	m.logger.Warn("hardware differs from enrollment", slog.Any("fields", slices.Sorted(maps.Keys(changes))))
+	stored.Reported = current.digest()
+	if err := m.save(stored); err != nil {
+		return nil, err
+	}
+	return []api.Event{events.NewEvent("hardware.changed", map[string]any{"changes": changes})}, nil
+}
+
+// Changes returns the fields that differed at the last Check.
+func (m *Monitor) Changes() map[string]api.HardwareChange {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return maps.Clone(m.changes)
+}
+
+// Remove deletes the baseline.
+func (m *Monitor) Remove() error {
+	if _, err := util.RemoveFile(m.path); err != nil {
+		return fmt.Errorf("remove hardware fingerprint: %w", err)
+	}
+	m.mu.Lock()
+	m.changes = nil
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *Monitor) load() (record, error) {
+	data, err := util.ReadSecretFile(m.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return record{}, err
+		}
+		return record{}, fmt.Errorf("read hardware fingerprint: %w", err)
+	}
+	var stored record
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return record{}, fmt.Errorf("decode hardware fingerprint: %w", err)
+	}
+	return stored, nil
+}
+
+func (m *Monitor) save(stored record) error {
+	data, err := json.MarshalIndent(stored, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal hardware fingerprint: %w", err)
+	}
+	if err := util.WriteSecretFile(m.path, data); err != nil {
+		return fmt.Errorf("write hardware fingerprint: %w", err)
+	}
+	return nil
+}
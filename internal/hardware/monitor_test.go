@@ -0,0 +1,72 @@
+package hardware
+
+import (
+	"io"
+	"log/slog"
+	"path/filepath"
+	"testing"
+
+	"github.com/evergreen-os/device-agent/internal/util"
+	"github.com/evergreen-os/device-agent/pkg/api"
+)
+
+func testFacts() util.HardwareFacts {
+	facts := util.HardwareFacts{SerialNumber: "PF3ABCDE", Model: "ThinkPad T14 Gen 3", HasTPM: true}
+	facts.SystemUUID = "4c4c4544-0042-3510-8052-b4c04f4d4e32"
+	facts.BoardVendor = "LENOVO"
+	facts.BoardName = "21AHCTO1WW"
+	facts.Disks = []api.Disk{
+		{Name: "nvme0n1", Serial: "S64KNX0T123456", SizeBytes: 512110190592, Transport: "nvme"},
+		{Name: "sda", Model: "Ultra Fit", SizeBytes: 31457280000, Removable: true, Transport: "scsi"},
+		{Name: "sdb", Model: "PSSD T7", SizeBytes: 1000204886016, Transport: "usb"},
+	}
+	return facts
+}
+
+func TestMonitorReportsChangesOnce(t *testing.T) {
+	current := testFacts()
+	monitor := NewMonitor(slog.New(slog.NewTextHandler(io.Discard, nil)), filepath.Join(t.TempDir(), "hardware.json"),
+		WithCollector(func() (util.HardwareFacts, error) { return current, nil }))
+
+	// Without a baseline the current hardware is adopted.
+	if events, err := monitor.Check(); err != nil || len(events) != 0 {
+		t.Fatalf("expected baseline to be recorded silently, got %v, %v", events, err)
+	}
+	// Removable media and USB drives do not count as a hardware change.
+	current.Disks = current.Disks[:1]
+	if events, err := monitor.Check(); err != nil || len(events) != 0 || len(monitor.Changes()) != 0 {
+		t.Fatalf("expected no change after unplugging external drives, got %v, %v", events, err)
+	}
+
+	current.Disks = []api.Disk{{Name: "nvme0n1", Serial: "S64KNX0T999999", SizeBytes: 512110190592, Transport: "nvme"}}
+	current.SystemUUID = "00000000-0000-0000-0000-000000000001"
+	events, err := monitor.Check()
+	if err != nil {
+		t.Fatalf("check: %v", err)
+	}
+	if len(events) != 1 || events[0].Type != "hardware.changed" {
+		t.Fatalf("expected hardware.changed event, got %+v", events)
+	}
+	changes := monitor.Changes()
+	want := map[string]api.HardwareChange{
+		"disks":       {Previous: "S64KNX0T123456", Current: "S64KNX0T999999"},
+		"system_uuid": {Previous: "4c4c4544-0042-3510-8052-b4c04f4d4e32", Current: "00000000-0000-0000-0000-000000000001"},
+	}
+	if len(changes) != len(want) || changes["disks"] != want["disks"] || changes["system_uuid"] != want["system_uuid"] {
+		t.Fatalf("unexpected changes %+v", changes)
+	}
+
+	// A restart on the same changed hardware does not repeat the event, but
+	// the change stays outstanding.
+	restarted := NewMonitor(monitor.logger, monitor.path, WithCollector(monitor.collect))
+	if events, err := restarted.Check(); err != nil || len(events) != 0 || len(restarted.Changes()) != 2 {
+		t.Fatalf("expected the change to be reported once, got %v, %v, %v", events, restarted.Changes(), err)
+	}
+
+	if err := restarted.Record(current); err != nil {
+		t.Fatalf("record: %v", err)
+	}
+	if events, err := restarted.Check(); err != nil || len(events) != 0 || len(restarted.Changes()) != 0 {
+		t.Fatalf("expected re-enrollment to reset the baseline, got %v, %v", events, err)
+	}
+}
@@ -1,11 +1,13 @@
 package network
 
 import (
+	"errors"
 	"fmt"
 	"log/slog"
 	"os"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/evergreen-os/device-agent/internal/events"
@@ -78,6 +80,36 @@ func (m *Manager) Apply(policy api.NetworkPolicy) ([]api.Event, error) {
 	return eventsOut, nil
 }
 
+// Remove deletes every keyfile in the managed connections directory.
+func (m *Manager) Remove() ([]api.Event, error) {
+	entries, err := os.ReadDir(m.outputDir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("read network dir: %w", err)
+	}
+	var removed int
+	var errs []error
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".nmconnection") {
+			continue
+		}
+		full := filepath.Join(m.outputDir, entry.Name())
+		if _, err := util.RemoveFile(full); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		m.logger.Info("removed network profile", slog.String("path", full))
+		removed++
+	}
+	var eventsOut []api.Event
+	if removed > 0 {
+		eventsOut = append(eventsOut, events.NewEvent("network.profiles.removed", map[string]string{"count": strconv.Itoa(removed)}))
+	}
+	return eventsOut, errors.Join(errs...)
+}
+
 func sanitizeName(name string) string {
 	replacer := strings.NewReplacer(" ", "_", "/", "_", "\\", "_", ":", "_", "=", "_")
 	return replacer.Replace(name)
@@ -3,9 +3,13 @@ package policy
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
+	"maps"
 	"os"
+	"slices"
+	"strings"
 
 	"github.com/evergreen-os/device-agent/internal/apps"
 	"github.com/evergreen-os/device-agent/internal/browser"
@@ -31,12 +35,38 @@ type Manager struct {
 	network  *network.Manager
 	security *security.Manager
 
-	lastVersion string
+	hardware HardwareChanges
+
+	lastVersion     string
+	lastUnsupported string
+	lastBlocked     string
+}
+
+// ErrUnsupportedPolicy is returned for bundles with sections this build cannot enforce.
+var ErrUnsupportedPolicy = errors.New("policy contains unsupported sections")
+
+// ErrHardwareChanged is returned while a policy blocks enforcement because the
+// hardware differs from enrollment.
+var ErrHardwareChanged = errors.New("enforcement blocked: hardware changed since enrollment")
+
+// HardwareChanges reports fingerprint fields that differ from enrollment.
+type HardwareChanges interface {
+	Changes() map[string]api.HardwareChange
+}
+
+// Option customises a Manager.
+type Option func(*Manager)
+
+// WithHardwareChanges lets policies block enforcement after hardware changes.
+func WithHardwareChanges(hardware HardwareChanges) Option {
+	return func(m *Manager) {
+		m.hardware = hardware
+	}
 }
 
 // NewManager constructs a policy manager.
-func NewManager(logger *slog.Logger, cfg config.Config, verifier *Verifier, apps *apps.Manager, browser *browser.Manager, updates *updates.Manager, network *network.Manager, security *security.Manager) *Manager {
-	return &Manager{
+func NewManager(logger *slog.Logger, cfg config.Config, verifier *Verifier, apps *apps.Manager, browser *browser.Manager, updates *updates.Manager, network *network.Manager, security *security.Manager, opts ...Option) *Manager {
+	m := &Manager{
 		logger:   logger,
 		cfg:      cfg,
 		verifier: verifier,
@@ -47,6 +77,10 @@ func NewManager(logger *slog.Logger, cfg config.Config, verifier *Verifier, apps
 		network:  network,
 		security: security,
 	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
 }
 
 // Apply verifies and enforces a policy bundle.
@@ -56,6 +90,31 @@ func (m *Manager) Apply(ctx context.Context, envelope api.PolicyEnvelope) ([]api
 			return nil, fmt.Errorf("verify policy: %w", err)
 		}
 	}
+	if unknown := envelope.Policy.UnknownSections(); len(unknown) > 0 {
+		// Enforcing part of a bundle could leave the device in a state the
+		// administrator never intended, so refuse it as a whole.
+		var generated []api.Event
+		if m.lastUnsupported != envelope.Version {
+			m.lastUnsupported = envelope.Version
+			generated = append(generated, events.NewEvent("policy.unsupported", map[string]any{
+				"version":  envelope.Version,
+				"sections": unknown,
+			}))
+		}
+		return generated, fmt.Errorf("%w: %s", ErrUnsupportedPolicy, strings.Join(unknown, ", "))
+	}
+	if fields := m.blockingHardwareChanges(envelope.Policy); len(fields) > 0 {
+		var generated []api.Event
+		if m.lastBlocked != envelope.Version {
+			m.lastBlocked = envelope.Version
+			generated = append(generated, events.NewEvent("policy.blocked", map[string]any{
+				"version": envelope.Version,
+				"reason":  "hardware.changed",
+				"fields":  fields,
+			}))
+		}
+		return generated, fmt.Errorf("%w: %s", ErrHardwareChanged, strings.Join(fields, ", "))
+	}
 	if err := m.persist(envelope); err != nil {
 		return nil, err
 	}
@@ -100,6 +159,15 @@ func (m *Manager) Apply(ctx context.Context, envelope api.PolicyEnvelope) ([]api
 	return generated, nil
 }
 
+// blockingHardwareChanges returns the changed hardware fields when the policy
+// asks to block enforcement on hardware changes.
+func (m *Manager) blockingHardwareChanges(doc api.PolicyDocument) []string {
+	if m.hardware == nil || doc.Hardware.Action() != api.HardwareOnChangeBlock {
+		return nil
+	}
+	return slices.Sorted(maps.Keys(m.hardware.Changes()))
+}
+
 // CachedPolicy returns the last persisted policy.
 func (m *Manager) CachedPolicy() (api.PolicyEnvelope, error) {
 	data, err := os.ReadFile(m.cache)
@@ -113,6 +181,17 @@ func (m *Manager) CachedPolicy() (api.PolicyEnvelope, error) {
 	return env, nil
 }
 
+// Clear removes the cached policy and its ETag.
+func (m *Manager) Clear() error {
+	for _, path := range []string{m.cache, m.etagPath()} {
+		if _, err := util.RemoveFile(path); err != nil {
+			return fmt.Errorf("clear policy cache: %w", err)
+		}
+	}
+	m.lastVersion = ""
+	return nil
+}
+
 func (m *Manager) persist(envelope api.PolicyEnvelope) error {
 	data, err := json.MarshalIndent(envelope, "", "  ")
 	if err != nil {
@@ -131,6 +210,41 @@ func (m *Manager) persist(envelope api.PolicyEnvelope) error {
 	return nil
 }
 
+// ETag returns the HTTP entity tag stored alongside the cached policy.
+func (m *Manager) ETag() string {
+	data, err := os.ReadFile(m.etagPath())
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// SaveETag records the entity tag of the applied policy for conditional pulls.
+func (m *Manager) SaveETag(etag string) error {
+	path := m.etagPath()
+	if etag == "" {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("remove policy etag: %w", err)
+		}
+		return nil
+	}
+	if err := util.EnsureParentDir(path, 0o700); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(etag+"\n"), 0o600); err != nil {
+		return fmt.Errorf("write policy etag: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("rename policy etag: %w", err)
+	}
+	return nil
+}
+
+func (m *Manager) etagPath() string {
+	return m.cache + ".etag"
+}
+
 // LastVersion returns the last policy version applied.
 func (m *Manager) LastVersion() string {
 	return m.lastVersion
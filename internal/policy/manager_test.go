@@ -0,0 +1,86 @@
+package policy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/evergreen-os/device-agent/internal/config"
+	"github.com/evergreen-os/device-agent/pkg/api"
+)
+
+func TestManagerETagRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	cfg := config.Config{PolicyCachePath: filepath.Join(dir, "policy.json")}
+	manager := NewManager(nil, cfg, nil, nil, nil, nil, nil, nil)
+
+	if etag := manager.ETag(); etag != "" {
+		t.Fatalf("expected empty etag, got %q", etag)
+	}
+	if err := manager.SaveETag(`"v42"`); err != nil {
+		t.Fatalf("save etag: %v", err)
+	}
+	if etag := manager.ETag(); etag != `"v42"` {
+		t.Fatalf("unexpected etag %q", etag)
+	}
+	if err := manager.SaveETag(""); err != nil {
+		t.Fatalf("clear etag: %v", err)
+	}
+	if _, err := os.Stat(cfg.PolicyCachePath + ".etag"); !os.IsNotExist(err) {
+		t.Fatalf("expected etag file removed, got %v", err)
+	}
+}
+
+func TestManagerRefusesUnsupportedSections(t *testing.T) {
+	dir := t.TempDir()
+	cfg := config.Config{PolicyCachePath: filepath.Join(dir, "policy.json")}
+	manager := NewManager(nil, cfg, nil, nil, nil, nil, nil, nil)
+	envelope := api.PolicyEnvelope{
+		Version: "v9",
+		Policy:  api.PolicyDocument{Unknown: map[string]json.RawMessage{"kiosk": json.RawMessage(`{}`)}},
+	}
+
+	generated, err := manager.Apply(context.Background(), envelope)
+	if !errors.Is(err, ErrUnsupportedPolicy) {
+		t.Fatalf("expected unsupported policy error, got %v", err)
+	}
+	if len(generated) != 1 || generated[0].Type != "policy.unsupported" {
+		t.Fatalf("expected policy.unsupported event, got %+v", generated)
+	}
+	if _, err := os.Stat(cfg.PolicyCachePath); !os.IsNotExist(err) {
+		t.Fatalf("refused policy must not be cached, got %v", err)
+	}
+	generated, _ = manager.Apply(context.Background(), envelope)
+	if len(generated) != 0 {
+		t.Fatalf("expected refusal to be reported once per version, got %+v", generated)
+	}
+}
+
+type staticChanges map[string]api.HardwareChange
+
+func (c staticChanges) Changes() map[string]api.HardwareChange { return c }
+
+func TestManagerBlocksEnforcementAfterHardwareChange(t *testing.T) {
+	dir := t.TempDir()
+	cfg := config.Config{PolicyCachePath: filepath.Join(dir, "policy.json")}
+	changes := staticChanges{"system_uuid": {Previous: "a", Current: "b"}}
+	manager := NewManager(nil, cfg, nil, nil, nil, nil, nil, nil, WithHardwareChanges(changes))
+	envelope := api.PolicyEnvelope{
+		Version: "v3",
+		Policy:  api.PolicyDocument{Hardware: &api.HardwarePolicy{OnChange: api.HardwareOnChangeBlock}},
+	}
+
+	generated, err := manager.Apply(context.Background(), envelope)
+	if !errors.Is(err, ErrHardwareChanged) {
+		t.Fatalf("expected hardware changed error, got %v", err)
+	}
+	if len(generated) != 1 || generated[0].Type != "policy.blocked" {
+		t.Fatalf("expected policy.blocked event, got %+v", generated)
+	}
+	if generated, _ = manager.Apply(context.Background(), envelope); len(generated) != 0 {
+		t.Fatalf("expected the block to be reported once per version, got %+v", generated)
+	}
+}
@@ -0,0 +1,68 @@
+package secrets
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/evergreen-os/device-agent/internal/util"
+)
+
+const keySize = 32
+
+// KeyfileStore encrypts secrets with AES-256-GCM under a key kept in a local
+// file. The key sits on the same disk, so it only guards against casual
+// reads; it exists for tests and hosts without a TPM or systemd-creds.
+type KeyfileStore struct {
+	key []byte
+}
+
+// NewKeyfileStore loads the key at path, generating it on first use.
+func NewKeyfileStore(path string) (*KeyfileStore, error) {
+	key, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		key = make([]byte, keySize)
+		if _, err := rand.Read(key); err != nil {
+			return nil, fmt.Errorf("generate secrets key: %w", err)
+		}
+		if err := writeKeyFile(path, key); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("read secrets key: %w", err)
+	}
+	if len(key) != keySize {
+		return nil, fmt.Errorf("secrets key %s must be %d bytes, got %d", path, keySize, len(key))
+	}
+	return &KeyfileStore{key: key}, nil
+}
+
+// writeKeyFile bypasses util.WriteSecretFile, which would try to seal the key
+// with itself.
+func writeKeyFile(path string, key []byte) error {
+	if err := util.EnsureParentDir(path, 0o700); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, key, 0o600); err != nil {
+		return fmt.Errorf("write secrets key: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("rename secrets key: %w", err)
+	}
+	return nil
+}
+
+// Name implements util.SecretStore.
+func (s *KeyfileStore) Name() string { return "keyfile" }
+
+// Seal implements util.SecretStore.
+func (s *KeyfileStore) Seal(plaintext []byte) ([]byte, error) {
+	return sealAESGCM(s.key, plaintext)
+}
+
+// Unseal implements util.SecretStore.
+func (s *KeyfileStore) Unseal(sealed []byte) ([]byte, error) {
+	return openAESGCM(s.key, sealed)
+}
@@ -0,0 +1,82 @@
+// Package secrets implements the encryption-at-rest backends used by
+// util.WriteSecretFile and util.ReadSecretFile.
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"path/filepath"
+
+	"github.com/evergreen-os/device-agent/internal/config"
+	"github.com/evergreen-os/device-agent/internal/util"
+)
+
+// defaultPCRs binds TPM-sealed secrets to the Secure Boot state, which
+// survives OS updates.
+var defaultPCRs = []int{7}
+
+// New builds the store selected by the configuration. It returns nil for the
+// plaintext backend.
+func New(cfg config.Config) (util.SecretStore, error) {
+	switch cfg.Secrets.Backend {
+	case "", config.SecretsPlaintext:
+		return nil, nil
+	case config.SecretsKeyfile:
+		path := cfg.Secrets.KeyFile
+		if path == "" {
+			path = filepath.Join(filepath.Dir(cfg.DeviceTokenPath), "secrets.key")
+		}
+		return NewKeyfileStore(path)
+	case config.SecretsSystemdCreds:
+		return NewSystemdCredsStore(cfg.Secrets.SystemdCredsKey), nil
+	case config.SecretsTPM2:
+		pcrs := cfg.Secrets.PCRs
+		if len(pcrs) == 0 {
+			pcrs = defaultPCRs
+		}
+		return NewTPMStore(pcrs), nil
+	default:
+		return nil, fmt.Errorf("unknown secrets backend %q", cfg.Secrets.Backend)
+	}
+}
+
+// sealAESGCM encrypts plaintext with key and prepends the nonce.
+func sealAESGCM(key, plaintext []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("generate nonce: %w", err)
+	}
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// openAESGCM reverses sealAESGCM.
+func openAESGCM(key, sealed []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt: %w", err)
+	}
+	return plaintext, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("init cipher: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,107 @@
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/evergreen-os/device-agent/internal/config"
+	"github.com/evergreen-os/device-agent/internal/util"
+)
+
+func TestKeyfileStoreRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secrets.key")
+	store, err := NewKeyfileStore(path)
+	if err != nil {
+		t.Fatalf("new keyfile store: %v", err)
+	}
+	sealed, err := store.Seal([]byte("device-token"))
+	if err != nil {
+		t.Fatalf("seal: %v", err)
+	}
+	if bytes.Contains(sealed, []byte("device-token")) {
+		t.Fatalf("expected ciphertext, got %q", sealed)
+	}
+	reopened, err := NewKeyfileStore(path)
+	if err != nil {
+		t.Fatalf("reopen keyfile store: %v", err)
+	}
+	plaintext, err := reopened.Unseal(sealed)
+	if err != nil {
+		t.Fatalf("unseal: %v", err)
+	}
+	if string(plaintext) != "device-token" {
+		t.Fatalf("unexpected plaintext %q", plaintext)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat key: %v", err)
+	}
+	if perm := info.Mode().Perm(); perm != 0o600 {
+		t.Fatalf("expected key perm 0600, got %o", perm)
+	}
+}
+
+func TestKeyfileStoreRejectsTampering(t *testing.T) {
+	store, err := NewKeyfileStore(filepath.Join(t.TempDir(), "secrets.key"))
+	if err != nil {
+		t.Fatalf("new keyfile store: %v", err)
+	}
+	sealed, err := store.Seal([]byte("device-token"))
+	if err != nil {
+		t.Fatalf("seal: %v", err)
+	}
+	sealed[len(sealed)-1] ^= 0xff
+	if _, err := store.Unseal(sealed); err == nil {
+		t.Fatalf("expected tampered ciphertext to fail")
+	}
+}
+
+func TestSystemdCredsStoreInvocation(t *testing.T) {
+	var calls [][]string
+	store := NewSystemdCredsStore("tpm2")
+	store.run = func(_ context.Context, stdin []byte, args ...string) ([]byte, error) {
+		calls = append(calls, args)
+		return append([]byte(args[0]+":"), stdin...), nil
+	}
+	sealed, err := store.Seal([]byte("token"))
+	if err != nil {
+		t.Fatalf("seal: %v", err)
+	}
+	if string(sealed) != "encrypt:token" {
+		t.Fatalf("unexpected sealed output %q", sealed)
+	}
+	if _, err := store.Unseal(sealed); err != nil {
+		t.Fatalf("unseal: %v", err)
+	}
+	want := [][]string{
+		{"encrypt", "--name=evergreen-agent", "--with-key=tpm2", "-", "-"},
+		{"decrypt", "--name=evergreen-agent", "-", "-"},
+	}
+	if !reflect.DeepEqual(calls, want) {
+		t.Fatalf("unexpected systemd-creds calls %v", calls)
+	}
+}
+
+func TestNewSelectsBackend(t *testing.T) {
+	dir := t.TempDir()
+	cfg := config.Config{DeviceTokenPath: filepath.Join(dir, "device.json")}
+	store, err := New(cfg)
+	if err != nil || store != nil {
+		t.Fatalf("expected plaintext by default, got %v, %v", store, err)
+	}
+	cfg.Secrets.Backend = config.SecretsKeyfile
+	store, err = New(cfg)
+	if err != nil {
+		t.Fatalf("new keyfile store: %v", err)
+	}
+	if store.Name() != "keyfile" {
+		t.Fatalf("expected keyfile store, got %s", store.Name())
+	}
+	if ok, _ := util.FileExists(filepath.Join(dir, "secrets.key")); !ok {
+		t.Fatalf("expected the key next to the device token")
+	}
+}
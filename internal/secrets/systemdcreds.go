@@ -0,0 +1,65 @@
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// credentialName is embedded in every systemd credential so a blob cannot be
+// decrypted under a different name.
+const credentialName = "evergreen-agent"
+
+// SystemdCredsStore encrypts secrets with systemd-creds, which uses the TPM
+// and/or the host key in /var/lib/systemd/credential.secret.
+type SystemdCredsStore struct {
+	withKey string
+	run     func(ctx context.Context, stdin []byte, args ...string) ([]byte, error)
+}
+
+// NewSystemdCredsStore constructs a store. withKey is passed to --with-key
+// when set; systemd picks a suitable key otherwise.
+func NewSystemdCredsStore(withKey string) *SystemdCredsStore {
+	return &SystemdCredsStore{withKey: withKey, run: runSystemdCreds}
+}
+
+// Name implements util.SecretStore.
+func (s *SystemdCredsStore) Name() string { return "systemd-creds" }
+
+// Seal implements util.SecretStore.
+func (s *SystemdCredsStore) Seal(plaintext []byte) ([]byte, error) {
+	args := []string{"encrypt", "--name=" + credentialName}
+	if s.withKey != "" {
+		args = append(args, "--with-key="+s.withKey)
+	}
+	return s.exec(plaintext, append(args, "-", "-")...)
+}
+
+// Unseal implements util.SecretStore.
+func (s *SystemdCredsStore) Unseal(sealed []byte) ([]byte, error) {
+	return s.exec(sealed, "decrypt", "--name="+credentialName, "-", "-")
+}
+
+func (s *SystemdCredsStore) exec(stdin []byte, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	return s.run(ctx, stdin, args...)
+}
+
+func runSystemdCreds(ctx context.Context, stdin []byte, args ...string) ([]byte, error) {
+	if _, err := exec.LookPath("systemd-creds"); err != nil {
+		return nil, fmt.Errorf("systemd-creds not available: %w", err)
+	}
+	cmd := exec.CommandContext(ctx, "systemd-creds", args...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("systemd-creds %s: %w (%s)", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
@@ -0,0 +1,148 @@
+package secrets
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/google/go-tpm/legacy/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// srkTemplate is the TCG default RSA storage root key. The primary key is
+// derived from the owner seed, so it is recreated identically on every use.
+var srkTemplate = tpm2.Public{
+	Type:       tpm2.AlgRSA,
+	NameAlg:    tpm2.AlgSHA256,
+	Attributes: tpm2.FlagStorageDefault | tpm2.FlagNoDA,
+	RSAParameters: &tpm2.RSAParams{
+		Symmetric: &tpm2.SymScheme{Alg: tpm2.AlgAES, KeyBits: 128, Mode: tpm2.AlgCFB},
+		KeyBits:   2048,
+	},
+}
+
+// TPMStore seals a per-file data key to the TPM storage root key under a PCR
+// policy, so secrets only decrypt on this machine in the expected boot state.
+type TPMStore struct {
+	pcrs []int
+	open func() (io.ReadWriteCloser, error)
+	// mu serialises TPM sessions; /dev/tpm0 and the simulator do not support
+	// concurrent clients.
+	mu sync.Mutex
+}
+
+// tpmEnvelope is the on-disk format of a TPM-sealed secret.
+type tpmEnvelope struct {
+	PCRs []int `json:"pcrs"`
+	// Public and Private are the sealed data key object.
+	Public     []byte `json:"public"`
+	Private    []byte `json:"private"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// NewTPMStore seals secrets to the given SHA-256 PCRs of the system TPM.
+func NewTPMStore(pcrs []int) *TPMStore {
+	return NewTPMStoreWithChannel(pcrs, func() (io.ReadWriteCloser, error) { return tpm2.OpenTPM() })
+}
+
+// NewTPMStoreWithChannel uses open instead of the system TPM, e.g. to target a
+// simulator.
+func NewTPMStoreWithChannel(pcrs []int, open func() (io.ReadWriteCloser, error)) *TPMStore {
+	return &TPMStore{pcrs: pcrs, open: open}
+}
+
+// Name implements util.SecretStore.
+func (s *TPMStore) Name() string { return "tpm2" }
+
+// Seal implements util.SecretStore.
+func (s *TPMStore) Seal(plaintext []byte) ([]byte, error) {
+	key := make([]byte, keySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("generate data key: %w", err)
+	}
+	envelope := tpmEnvelope{PCRs: s.pcrs}
+	err := s.withSRK(func(rw io.ReadWriter, srk tpmutil.Handle) error {
+		return s.pcrPolicy(rw, tpm2.SessionTrial, s.pcrs, func(session tpmutil.Handle) error {
+			digest, err := tpm2.PolicyGetDigest(rw, session)
+			if err != nil {
+				return fmt.Errorf("policy digest: %w", err)
+			}
+			envelope.Private, envelope.Public, err = tpm2.Seal(rw, srk, "", "", digest, key)
+			if err != nil {
+				return fmt.Errorf("seal data key: %w", err)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	envelope.Ciphertext, err = sealAESGCM(key, plaintext)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(envelope)
+}
+
+// Unseal implements util.SecretStore.
+func (s *TPMStore) Unseal(data []byte) ([]byte, error) {
+	var envelope tpmEnvelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return nil, fmt.Errorf("decode tpm envelope: %w", err)
+	}
+	var key []byte
+	err := s.withSRK(func(rw io.ReadWriter, srk tpmutil.Handle) error {
+		item, _, err := tpm2.Load(rw, srk, "", envelope.Public, envelope.Private)
+		if err != nil {
+			return fmt.Errorf("load sealed data key: %w", err)
+		}
+		defer tpm2.FlushContext(rw, item)
+		return s.pcrPolicy(rw, tpm2.SessionPolicy, envelope.PCRs, func(session tpmutil.Handle) error {
+			key, err = tpm2.UnsealWithSession(rw, session, item, "")
+			if err != nil {
+				return fmt.Errorf("unseal data key (boot state changed?): %w", err)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return openAESGCM(key, envelope.Ciphertext)
+}
+
+// pcrPolicy starts a session of the given type, binds it to the current
+// values of pcrs and calls fn with it.
+func (s *TPMStore) pcrPolicy(rw io.ReadWriter, kind tpm2.SessionType, pcrs []int, fn func(tpmutil.Handle) error) error {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("generate session nonce: %w", err)
+	}
+	session, _, err := tpm2.StartAuthSession(rw, tpm2.HandleNull, tpm2.HandleNull, nonce, nil, kind, tpm2.AlgNull, tpm2.AlgSHA256)
+	if err != nil {
+		return fmt.Errorf("start session: %w", err)
+	}
+	defer tpm2.FlushContext(rw, session)
+	if err := tpm2.PolicyPCR(rw, session, nil, tpm2.PCRSelection{Hash: tpm2.AlgSHA256, PCRs: pcrs}); err != nil {
+		return fmt.Errorf("policy pcr: %w", err)
+	}
+	return fn(session)
+}
+
+func (s *TPMStore) withSRK(fn func(io.ReadWriter, tpmutil.Handle) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rw, err := s.open()
+	if err != nil {
+		return fmt.Errorf("open tpm: %w", err)
+	}
+	defer rw.Close()
+	srk, _, err := tpm2.CreatePrimary(rw, tpm2.HandleOwner, tpm2.PCRSelection{}, "", "", srkTemplate)
+	if err != nil {
+		return fmt.Errorf("create storage root key: %w", err)
+	}
+	defer tpm2.FlushContext(rw, srk)
+	return fn(rw, srk)
+}
@@ -0,0 +1,57 @@
+//go:build cgo
+
+package secrets
+
+import (
+	"io"
+	"testing"
+
+	"github.com/google/go-tpm-tools/simulator"
+	"github.com/google/go-tpm/legacy/tpm2"
+)
+
+// simulatedTPM keeps the simulator running across the store's sessions.
+type simulatedTPM struct {
+	*simulator.Simulator
+}
+
+func (simulatedTPM) Close() error { return nil }
+
+func newSimulatedStore(t *testing.T, pcrs []int) (*TPMStore, *simulator.Simulator) {
+	t.Helper()
+	sim, err := simulator.Get()
+	if err != nil {
+		t.Fatalf("start tpm simulator: %v", err)
+	}
+	t.Cleanup(func() { sim.Close() })
+	return NewTPMStoreWithChannel(pcrs, func() (io.ReadWriteCloser, error) { return simulatedTPM{sim}, nil }), sim
+}
+
+func TestTPMStoreRoundTrip(t *testing.T) {
+	store, _ := newSimulatedStore(t, defaultPCRs)
+	sealed, err := store.Seal([]byte("device-token"))
+	if err != nil {
+		t.Fatalf("seal: %v", err)
+	}
+	plaintext, err := store.Unseal(sealed)
+	if err != nil {
+		t.Fatalf("unseal: %v", err)
+	}
+	if string(plaintext) != "device-token" {
+		t.Fatalf("unexpected plaintext %q", plaintext)
+	}
+}
+
+func TestTPMStoreRefusesChangedPCRs(t *testing.T) {
+	store, sim := newSimulatedStore(t, []int{16})
+	sealed, err := store.Seal([]byte("device-token"))
+	if err != nil {
+		t.Fatalf("seal: %v", err)
+	}
+	if err := tpm2.PCRExtend(sim, 16, tpm2.AlgSHA256, make([]byte, 32), ""); err != nil {
+		t.Fatalf("extend pcr: %v", err)
+	}
+	if _, err := store.Unseal(sealed); err == nil {
+		t.Fatalf("expected unseal to fail after the PCR changed")
+	}
+}
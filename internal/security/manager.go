@@ -19,6 +19,7 @@ import (
 type Manager struct {
 	logger            *slog.Logger
 	usbGuardRulesPath string
+	sshConfigPath     string
 }
 
 // Option configures the Manager.
@@ -31,9 +32,20 @@ func WithUSBGuardRulesPath(path string) Option {
 	}
 }
 
+// WithSSHConfigPath overrides the default sshd drop-in path.
+func WithSSHConfigPath(path string) Option {
+	return func(m *Manager) {
+		m.sshConfigPath = path
+	}
+}
+
 // NewManager constructs a new Manager.
 func NewManager(logger *slog.Logger, opts ...Option) *Manager {
-	m := &Manager{logger: logger, usbGuardRulesPath: "/etc/usbguard/rules.conf"}
+	m := &Manager{
+		logger:            logger,
+		usbGuardRulesPath: "/etc/usbguard/rules.conf",
+		sshConfigPath:     "/etc/ssh/sshd_config.d/evergreen.conf",
+	}
 	for _, opt := range opts {
 		opt(m)
 	}
@@ -158,6 +170,33 @@ func (m *Manager) writeUSBGuardRules(rules []string) error {
 	return nil
 }
 
+// Remove deletes the sshd drop-in and USBGuard rules written by the agent.
+// USBGuard is stopped first so an empty rule set cannot block every device.
+func (m *Manager) Remove(ctx context.Context) ([]api.Event, error) {
+	var errs []error
+	if _, err := os.Stat(m.usbGuardRulesPath); err == nil {
+		if err := m.toggleService(ctx, "usbguard", false); err != nil {
+			m.logger.Warn("failed to stop usbguard", slog.String("error", err.Error()))
+		}
+	}
+	var removed []string
+	for _, path := range []string{m.sshConfigPath, m.usbGuardRulesPath} {
+		ok, err := util.RemoveFile(path)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if ok {
+			removed = append(removed, path)
+		}
+	}
+	var eventsOut []api.Event
+	if len(removed) > 0 {
+		eventsOut = append(eventsOut, events.NewEvent("security.config.removed", map[string]any{"paths": removed}))
+	}
+	return eventsOut, errors.Join(errs...)
+}
+
 func (m *Manager) removeUSBGuardRules() error {
 	if err := os.Remove(m.usbGuardRulesPath); err != nil && !errors.Is(err, os.ErrNotExist) {
 		return err
@@ -166,7 +205,7 @@ func (m *Manager) removeUSBGuardRules() error {
 }
 
 func (m *Manager) configureSSH(allowRoot bool) error {
-	path := "/etc/ssh/sshd_config.d/evergreen.conf"
+	path := m.sshConfigPath
 	if err := util.EnsureParentDir(path, 0o755); err != nil {
 		return err
 	}
@@ -7,6 +7,8 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/evergreen-os/device-agent/internal/updates"
@@ -29,7 +31,17 @@ type Collector struct {
 	logger  *slog.Logger
 	apps    AppLister
 	updates UpdateStatusProvider
-	lastErr string
+
+	lastErrMu sync.Mutex
+	lastErr   string
+
+	clockSkew atomic.Int64
+
+	hardwareMu      sync.Mutex
+	hardwareChanges map[string]api.HardwareChange
+
+	appUpdatesMu sync.Mutex
+	appUpdates   []api.AppUpdate
 }
 
 // NewCollector constructs a collector.
@@ -39,6 +51,8 @@ func NewCollector(logger *slog.Logger, apps AppLister, updates UpdateStatusProvi
 
 // SetLastError records the last operational error for reporting.
 func (c *Collector) SetLastError(err error) {
+	c.lastErrMu.Lock()
+	defer c.lastErrMu.Unlock()
 	if err == nil {
 		c.lastErr = ""
 		return
@@ -46,6 +60,25 @@ func (c *Collector) SetLastError(err error) {
 	c.lastErr = err.Error()
 }
 
+// SetClockSkew records the measured offset between the backend and local clocks.
+func (c *Collector) SetClockSkew(skew time.Duration) {
+	c.clockSkew.Store(int64(skew))
+}
+
+// SetHardwareChanges records fingerprint fields that differ from enrollment.
+func (c *Collector) SetHardwareChanges(changes map[string]api.HardwareChange) {
+	c.hardwareMu.Lock()
+	defer c.hardwareMu.Unlock()
+	c.hardwareChanges = changes
+}
+
+// SetAppUpdates records the Flatpak updates found by the last update check.
+func (c *Collector) SetAppUpdates(updates []api.AppUpdate) {
+	c.appUpdatesMu.Lock()
+	defer c.appUpdatesMu.Unlock()
+	c.appUpdates = updates
+}
+
 // Snapshot collects current device state.
 func (c *Collector) Snapshot(ctx context.Context) (api.DeviceState, error) {
 	installed, err := c.apps.ListInstalled(ctx)
@@ -53,10 +86,19 @@ func (c *Collector) Snapshot(ctx context.Context) (api.DeviceState, error) {
 		c.logger.Warn("failed to list apps", slog.String("error", err.Error()))
 	}
 	state := api.DeviceState{
-		Timestamp:     time.Now().UTC(),
-		InstalledApps: installed,
-		LastError:     c.lastErr,
+		Timestamp:        time.Now().UTC(),
+		InstalledApps:    installed,
+		ClockSkewSeconds: time.Duration(c.clockSkew.Load()).Seconds(),
 	}
+	c.lastErrMu.Lock()
+	state.LastError = c.lastErr
+	c.lastErrMu.Unlock()
+	c.hardwareMu.Lock()
+	state.HardwareChanges = c.hardwareChanges
+	c.hardwareMu.Unlock()
+	c.appUpdatesMu.Lock()
+	state.AppUpdates = c.appUpdates
+	c.appUpdatesMu.Unlock()
 	total, free, err := util.DiskUsage("/")
 	if err != nil {
 		c.logger.Warn("disk usage lookup failed", slog.String("error", err.Error()))
@@ -48,6 +48,33 @@ func (q *Queue) Replace(states []api.DeviceState) error {
 	return q.writeLocked(states)
 }
 
+// Clear deletes the queue file and any snapshots still in it.
+func (q *Queue) Clear() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, err := util.RemoveFile(q.path); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Discard removes the oldest n snapshots once they have been reported.
+func (q *Queue) Discard(n int) error {
+	if n <= 0 {
+		return nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	states, err := q.readLocked()
+	if err != nil {
+		return err
+	}
+	if n > len(states) {
+		n = len(states)
+	}
+	return q.writeLocked(states[n:])
+}
+
 func (q *Queue) readLocked() ([]api.DeviceState, error) {
 	data, err := os.ReadFile(q.path)
 	if err != nil {
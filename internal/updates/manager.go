@@ -25,8 +25,16 @@ type Manager struct {
 
 	now           func() time.Time
 	rebootCommand []string
+
+	maxClockSkew time.Duration
+	clockSkew    time.Duration
+	// clockUnknown is set until the offset has been measured at least once.
+	clockUnknown bool
 }
 
+// DefaultMaxClockSkew is the clock offset beyond which reboots are deferred.
+const DefaultMaxClockSkew = 5 * time.Minute
+
 const (
 	minutesPerDay  = 24 * 60
 	minutesPerWeek = 7 * minutesPerDay
@@ -65,11 +73,21 @@ func WithRebootCommand(cmd ...string) Option {
 	}
 }
 
+// WithMaxClockSkew overrides the clock offset tolerated before reboots are deferred.
+func WithMaxClockSkew(skew time.Duration) Option {
+	return func(m *Manager) {
+		if skew > 0 {
+			m.maxClockSkew = skew
+		}
+	}
+}
+
 func NewManager(logger *slog.Logger, opts ...Option) *Manager {
 	m := &Manager{
 		logger:        logger,
 		now:           time.Now,
 		rebootCommand: []string{"systemctl", "reboot"},
+		maxClockSkew:  DefaultMaxClockSkew,
 	}
 	for _, opt := range opts {
 		opt(m)
@@ -102,25 +120,64 @@ func (m *Manager) Apply(ctx context.Context, policy api.UpdatePolicy) (Result, e
 		}
 	}
 	if policy.RebootRequired && result.RebootRequired {
-		now := m.now()
-		if maintenanceAllowsNow(windows, now) {
-			if err := m.triggerReboot(ctx); err != nil {
-				result.Events = append(result.Events, events.NewEvent("update.reboot.failure", map[string]string{"error": err.Error()}))
-				return result, err
-			}
-			result.Events = append(result.Events, events.NewEvent("update.reboot.triggered", map[string]string{"time": now.Format(time.RFC3339)}))
-		} else {
-			if next, ok := nextMaintenanceWindow(windows, now); ok {
-				payload := map[string]string{"scheduled_for": next.Format(time.RFC3339)}
-				result.Events = append(result.Events, events.NewEvent("update.reboot.deferred", payload))
-			} else {
-				result.Events = append(result.Events, events.NewEvent("update.reboot.deferred", map[string]string{"reason": "no_window"}))
-			}
+		rebootEvents, err := m.enforceReboot(ctx, windows)
+		result.Events = append(result.Events, rebootEvents...)
+		if err != nil {
+			return result, err
 		}
 	}
 	return result, nil
 }
 
+// SetClockSkew records the measured offset between the backend and local
+// clocks. Maintenance windows cannot be trusted while it exceeds the limit.
+func (m *Manager) SetClockSkew(skew time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.clockSkew = skew
+	m.clockUnknown = false
+}
+
+// SetClockSkewUnknown defers reboots until SetClockSkew reports a measured
+// offset, for use before the backend has been reached.
+func (m *Manager) SetClockSkewUnknown() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.clockUnknown = true
+}
+
+func (m *Manager) clockUnreliable() (time.Duration, bool, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	skew := m.clockSkew
+	return skew, m.clockUnknown, skew.Abs() > m.maxClockSkew
+}
+
+func (m *Manager) enforceReboot(ctx context.Context, windows []maintenanceWindowSegment) ([]api.Event, error) {
+	skew, unknown, unreliable := m.clockUnreliable()
+	if unknown {
+		return []api.Event{events.NewEvent("update.reboot.deferred", map[string]string{"reason": "clock_unknown"})}, nil
+	}
+	if unreliable {
+		return []api.Event{events.NewEvent("update.reboot.deferred", map[string]string{
+			"reason":       "clock_skew",
+			"skew_seconds": strconv.FormatFloat(skew.Seconds(), 'f', 0, 64),
+		})}, nil
+	}
+	now := m.now()
+	if maintenanceAllowsNow(windows, now) {
+		if err := m.triggerReboot(ctx); err != nil {
+			return []api.Event{events.NewEvent("update.reboot.failure", map[string]string{"error": err.Error()})}, err
+		}
+		return []api.Event{events.NewEvent("update.reboot.triggered", map[string]string{"time": now.Format(time.RFC3339)})}, nil
+	}
+	if next, ok := nextMaintenanceWindow(windows, now); ok {
+		payload := map[string]string{"scheduled_for": next.Format(time.RFC3339)}
+		return []api.Event{events.NewEvent("update.reboot.deferred", payload)}, nil
+	}
+	return []api.Event{events.NewEvent("update.reboot.deferred", map[string]string{"reason": "no_window"})}, nil
+}
+
 // Status describes the rpm-ostree state.
 type Status struct {
 	Channel        string
@@ -306,6 +363,25 @@ func stringValue(m map[string]any, key string) string {
 	return ""
 }
 
+// Schedule is a parsed list of maintenance windows such as "Mon-Fri 22:00-05:00".
+// An empty schedule allows any time.
+type Schedule []maintenanceWindowSegment
+
+// ParseSchedule parses maintenance windows in the update policy syntax.
+func ParseSchedule(entries []string) (Schedule, error) {
+	return parseMaintenanceWindows(entries)
+}
+
+// Allows reports whether t falls inside a window.
+func (s Schedule) Allows(t time.Time) bool {
+	return maintenanceAllowsNow(s, t)
+}
+
+// Next returns the start of the next window after t.
+func (s Schedule) Next(t time.Time) (time.Time, bool) {
+	return nextMaintenanceWindow(s, t)
+}
+
 func parseMaintenanceWindows(entries []string) ([]maintenanceWindowSegment, error) {
 	var segments []maintenanceWindowSegment
 	for _, entry := range entries {
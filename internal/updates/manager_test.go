@@ -1,6 +1,9 @@
 package updates
 
 import (
+	"context"
+	"io"
+	"log/slog"
 	"testing"
 	"time"
 )
@@ -109,3 +112,45 @@ func TestNextMaintenanceWindow(t *testing.T) {
 		t.Fatalf("expected wrap to next day %s, got %s", expected, next)
 	}
 }
+
+func TestRebootDeferredWhileClockSkewed(t *testing.T) {
+	now := time.Date(2024, time.January, 1, 2, 30, 0, 0, time.UTC)
+	manager := NewManager(slog.New(slog.NewTextHandler(io.Discard, nil)), WithNowFunc(func() time.Time { return now }), WithRebootCommand("false"))
+	manager.SetClockSkew(-2 * time.Hour)
+
+	got, err := manager.enforceReboot(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("expected reboot to be deferred, got error: %v", err)
+	}
+	if len(got) != 1 || got[0].Type != "update.reboot.deferred" {
+		t.Fatalf("expected deferral event, got %+v", got)
+	}
+	payload := got[0].Payload.(map[string]string)
+	if payload["reason"] != "clock_skew" || payload["skew_seconds"] != "-7200" {
+		t.Fatalf("unexpected deferral payload: %v", payload)
+	}
+
+	manager.SetClockSkew(time.Minute)
+	if _, err := manager.enforceReboot(context.Background(), nil); err == nil {
+		t.Fatalf("expected reboot attempt once the clock is trusted")
+	}
+}
+
+func TestRebootDeferredUntilClockMeasured(t *testing.T) {
+	now := time.Date(2024, time.January, 1, 2, 30, 0, 0, time.UTC)
+	manager := NewManager(slog.New(slog.NewTextHandler(io.Discard, nil)), WithNowFunc(func() time.Time { return now }), WithRebootCommand("false"))
+	manager.SetClockSkewUnknown()
+
+	got, err := manager.enforceReboot(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("expected reboot to be deferred, got error: %v", err)
+	}
+	if len(got) != 1 || got[0].Payload.(map[string]string)["reason"] != "clock_unknown" {
+		t.Fatalf("expected a clock_unknown deferral, got %+v", got)
+	}
+
+	manager.SetClockSkew(0)
+	if _, err := manager.enforceReboot(context.Background(), nil); err == nil {
+		t.Fatalf("expected reboot attempt once the clock was measured")
+	}
+}
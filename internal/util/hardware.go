@@ -5,9 +5,13 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
 	"syscall"
+
+	"github.com/evergreen-os/device-agent/pkg/api"
 )
 
 // HardwareFacts represents immutable device information used during enrollment.
@@ -18,27 +22,75 @@ type HardwareFacts struct {
 	CPUCount     int    `json:"cpu_count"`
 	TotalRAM     uint64 `json:"total_ram_bytes"`
 	HasTPM       bool   `json:"has_tpm"`
+
+	// HardwareInventory holds the extended inventory reported for asset
+	// management.
+	api.HardwareInventory
 }
 
 // CollectHardwareFacts gathers best-effort hardware facts from the host.
 func CollectHardwareFacts() (HardwareFacts, error) {
-	serial := readFirstLine("/sys/class/dmi/id/product_serial")
-	model := readFirstLine("/sys/class/dmi/id/product_name")
-	cpuModel := cpuModelName()
-	cpuCount := runtime.NumCPU()
-	ram, err := totalRAM()
+	return CollectHardwareFactsFrom("/")
+}
+
+// CollectHardwareFactsFrom reads sysfs, procfs and /dev below root instead of
+// the host's, so a fixture tree can stand in for real hardware.
+func CollectHardwareFactsFrom(root string) (HardwareFacts, error) {
+	path := func(elem ...string) string {
+		return filepath.Join(append([]string{root}, elem...)...)
+	}
+	dmi := func(name string) string {
+		return readFirstLine(path("sys", "class", "dmi", "id", name))
+	}
+	ram, err := totalRAM(path("proc", "meminfo"))
 	if err != nil {
 		return HardwareFacts{}, fmt.Errorf("total ram: %w", err)
 	}
-	hasTPM := pathExists("/dev/tpm0") || pathExists("/dev/tpmrm0")
-	return HardwareFacts{
-		SerialNumber: serial,
-		Model:        model,
-		CPUModel:     cpuModel,
-		CPUCount:     cpuCount,
+	facts := HardwareFacts{
+		SerialNumber: dmi("product_serial"),
+		Model:        dmi("product_name"),
+		CPUModel:     cpuModelName(path("proc", "cpuinfo")),
+		CPUCount:     cpuCount(path("sys", "devices", "system", "cpu", "online")),
 		TotalRAM:     ram,
-		HasTPM:       hasTPM,
-	}, nil
+		HasTPM:       pathExists(path("dev", "tpm0")) || pathExists(path("dev", "tpmrm0")),
+	}
+	facts.HardwareInventory = api.HardwareInventory{
+		SystemUUID:   dmi("product_uuid"),
+		Vendor:       dmi("sys_vendor"),
+		BoardVendor:  dmi("board_vendor"),
+		BoardName:    dmi("board_name"),
+		BoardVersion: dmi("board_version"),
+		BIOSVendor:   dmi("bios_vendor"),
+		BIOSVersion:  dmi("bios_version"),
+		BIOSDate:     dmi("bios_date"),
+		ChassisType:  chassisType(dmi("chassis_type")),
+		NICs:         networkInterfaces(path("sys", "class", "net")),
+		Disks:        disks(path("sys", "block")),
+	}
+	facts.PCIDevices = pciDevices(path("sys", "bus", "pci", "devices"))
+	for _, dev := range facts.PCIDevices {
+		if strings.HasPrefix(dev.Class, pciClassDisplay) {
+			facts.GPUs = append(facts.GPUs, dev)
+		}
+	}
+	// ARM boards usually have no DMI tables; the device tree describes them.
+	deviceTree := path("proc", "device-tree")
+	if !pathExists(deviceTree) {
+		deviceTree = path("sys", "firmware", "devicetree", "base")
+	}
+	if facts.Model == "" {
+		facts.Model = readDeviceTreeString(filepath.Join(deviceTree, "model"))
+	}
+	if facts.SerialNumber == "" {
+		facts.SerialNumber = readDeviceTreeString(filepath.Join(deviceTree, "serial-number"))
+	}
+	if facts.CPUModel == "" {
+		facts.CPUModel = deviceTreeSoC(filepath.Join(deviceTree, "compatible"))
+	}
+	if facts.CPUModel == "" {
+		facts.CPUModel = runtime.GOARCH
+	}
+	return facts, nil
 }
 
 func readFirstLine(path string) string {
@@ -54,10 +106,10 @@ func readFirstLine(path string) string {
 	return ""
 }
 
-func cpuModelName() string {
-	file, err := os.Open("/proc/cpuinfo")
+func cpuModelName(path string) string {
+	file, err := os.Open(path)
 	if err != nil {
-		return runtime.GOARCH
+		return ""
 	}
 	defer file.Close()
 	scanner := bufio.NewScanner(file)
@@ -70,15 +122,57 @@ func cpuModelName() string {
 			}
 		}
 	}
-	return runtime.GOARCH
+	return ""
+}
+
+// cpuCount parses the online CPU list (e.g. "0-3,6"), falling back to the
+// CPUs available to this process.
+func cpuCount(path string) int {
+	online := readFirstLine(path)
+	count := 0
+	for _, span := range strings.Split(online, ",") {
+		first, last, isRange := strings.Cut(span, "-")
+		lo, err := strconv.Atoi(first)
+		if err != nil {
+			return runtime.NumCPU()
+		}
+		hi := lo
+		if isRange {
+			if hi, err = strconv.Atoi(last); err != nil || hi < lo {
+				return runtime.NumCPU()
+			}
+		}
+		count += hi - lo + 1
+	}
+	return count
 }
 
-func totalRAM() (uint64, error) {
-	var info syscall.Sysinfo_t
-	if err := syscall.Sysinfo(&info); err != nil {
+// totalRAM reads MemTotal from meminfo, falling back to sysinfo(2).
+func totalRAM(meminfo string) (uint64, error) {
+	file, err := os.Open(meminfo)
+	if err != nil {
+		var info syscall.Sysinfo_t
+		if err := syscall.Sysinfo(&info); err != nil {
+			return 0, err
+		}
+		return uint64(info.Totalram) * uint64(info.Unit), nil
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "MemTotal:" {
+			kb, err := strconv.ParseUint(fields[1], 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("parse MemTotal: %w", err)
+			}
+			return kb * 1024, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
 		return 0, err
 	}
-	return uint64(info.Totalram) * uint64(info.Unit), nil
+	return 0, fmt.Errorf("MemTotal missing from %s", meminfo)
 }
 
 func pathExists(path string) bool {
@@ -0,0 +1,166 @@
+package util
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/evergreen-os/device-agent/pkg/api"
+)
+
+// pciClassDisplay prefixes the class of VGA, 3D and other display
+// controllers.
+const pciClassDisplay = "0x03"
+
+// chassisTypes names the SMBIOS system enclosure types (DSP0134, 7.4.1).
+var chassisTypes = []string{
+	1: "Other", 2: "Unknown", 3: "Desktop", 4: "Low Profile Desktop",
+	5: "Pizza Box", 6: "Mini Tower", 7: "Tower", 8: "Portable", 9: "Laptop",
+	10: "Notebook", 11: "Hand Held", 12: "Docking Station", 13: "All in One",
+	14: "Sub Notebook", 15: "Space-saving", 16: "Lunch Box",
+	17: "Main Server Chassis", 18: "Expansion Chassis", 19: "SubChassis",
+	20: "Bus Expansion Chassis", 21: "Peripheral Chassis", 22: "RAID Chassis",
+	23: "Rack Mount Chassis", 24: "Sealed-case PC", 25: "Multi-system Chassis",
+	26: "Compact PCI", 27: "Advanced TCA", 28: "Blade", 29: "Blade Enclosure",
+	30: "Tablet", 31: "Convertible", 32: "Detachable", 33: "IoT Gateway",
+	34: "Embedded PC", 35: "Mini PC", 36: "Stick PC",
+}
+
+func chassisType(raw string) string {
+	if raw == "" {
+		return ""
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n <= 0 || n >= len(chassisTypes) {
+		return raw
+	}
+	return chassisTypes[n]
+}
+
+// networkInterfaces lists adapters backed by a device, skipping loopback,
+// bridges, tunnels and other virtual interfaces.
+func networkInterfaces(dir string) []api.NetworkInterface {
+	var nics []api.NetworkInterface
+	for _, name := range physicalDevices(dir) {
+		mac := readFirstLine(filepath.Join(dir, name, "address"))
+		if mac == "" || mac == "00:00:00:00:00:00" {
+			continue
+		}
+		nics = append(nics, api.NetworkInterface{Name: name, MAC: mac})
+	}
+	return nics
+}
+
+// disks lists block devices backed by hardware, skipping loop, zram and
+// device-mapper devices.
+func disks(dir string) []api.Disk {
+	var result []api.Disk
+	for _, name := range physicalDevices(dir) {
+		base := filepath.Join(dir, name)
+		sectors, _ := strconv.ParseUint(readFirstLine(filepath.Join(base, "size")), 10, 64)
+		result = append(result, api.Disk{
+			Name:  name,
+			Model: readFirstLine(filepath.Join(base, "device", "model")),
+			// NVMe and virtio expose the serial directly; SCSI disks only
+			// through VPD page 0x80, which needs root.
+			Serial:    readFirstLine(filepath.Join(base, "device", "serial")),
+			SizeBytes: sectors * 512,
+			Removable: readFirstLine(filepath.Join(base, "removable")) == "1",
+			Transport: diskTransport(base, name),
+		})
+	}
+	return result
+}
+
+// diskTransport tells internal disks from external ones. USB enclosures often
+// report removable=0, so the sysfs device path is checked for a USB
+// controller first.
+func diskTransport(base, name string) string {
+	if resolved, err := filepath.EvalSymlinks(base); err == nil {
+		if _, device, ok := strings.Cut(resolved, "/devices/"); ok {
+			for _, part := range strings.Split(device, "/") {
+				if strings.HasPrefix(part, "usb") {
+					return "usb"
+				}
+			}
+		}
+	}
+	switch {
+	case strings.HasPrefix(name, "nvme"):
+		return "nvme"
+	case strings.HasPrefix(name, "mmcblk"):
+		return "mmc"
+	case strings.HasPrefix(name, "vd"):
+		return "virtio"
+	case strings.HasPrefix(name, "sd"):
+		// libata reports every SATA disk with the SCSI vendor "ATA".
+		if readFirstLine(filepath.Join(base, "device", "vendor")) == "ATA" {
+			return "sata"
+		}
+		return "scsi"
+	}
+	return ""
+}
+
+// physicalDevices returns the sorted entries of a sysfs class directory that
+// have a backing device.
+func physicalDevices(dir string) []string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for _, entry := range entries {
+		if pathExists(filepath.Join(dir, entry.Name(), "device")) {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func pciDevices(dir string) []api.PCIDevice {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	var devices []api.PCIDevice
+	for _, entry := range entries {
+		base := filepath.Join(dir, entry.Name())
+		dev := api.PCIDevice{
+			Address: entry.Name(),
+			Vendor:  readFirstLine(filepath.Join(base, "vendor")),
+			Device:  readFirstLine(filepath.Join(base, "device")),
+			Class:   readFirstLine(filepath.Join(base, "class")),
+		}
+		if driver, err := os.Readlink(filepath.Join(base, "driver")); err == nil {
+			dev.Driver = filepath.Base(driver)
+		}
+		devices = append(devices, dev)
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].Address < devices[j].Address })
+	return devices
+}
+
+// readDeviceTreeString reads a NUL-terminated device tree property.
+func readDeviceTreeString(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(bytes.TrimRight(data, "\x00")))
+}
+
+// deviceTreeSoC returns the most generic compatible string, which names the
+// SoC (e.g. "brcm,bcm2711").
+func deviceTreeSoC(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	compatible := strings.Split(string(bytes.TrimRight(data, "\x00")), "\x00")
+	return strings.TrimSpace(compatible[len(compatible)-1])
+}
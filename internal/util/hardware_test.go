@@ -0,0 +1,127 @@
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/evergreen-os/device-agent/pkg/api"
+)
+
+func TestCollectHardwareFactsFromX86(t *testing.T) {
+	facts, err := CollectHardwareFactsFrom(filepath.Join("testdata", "x86"))
+	if err != nil {
+		t.Fatalf("collect: %v", err)
+	}
+	want := HardwareFacts{
+		SerialNumber: "PF3ABCDE",
+		Model:        "ThinkPad T14 Gen 3",
+		CPUModel:     "12th Gen Intel(R) Core(TM) i7-1260P",
+		CPUCount:     14,
+		TotalRAM:     32572908 * 1024,
+		HasTPM:       true,
+	}
+	want.HardwareInventory = api.HardwareInventory{
+		SystemUUID:   "4c4c4544-0042-3510-8052-b4c04f4d4e32",
+		Vendor:       "LENOVO",
+		BoardVendor:  "LENOVO",
+		BoardName:    "21AHCTO1WW",
+		BoardVersion: "SDK0T76463 WIN",
+		BIOSVendor:   "LENOVO",
+		BIOSVersion:  "R23ET70W (1.46 )",
+		BIOSDate:     "04/05/2024",
+		ChassisType:  "Notebook",
+		NICs: []api.NetworkInterface{
+			{Name: "enp0s31f6", MAC: "8c:16:45:ab:cd:ef"},
+			{Name: "wlp0s20f3", MAC: "a4:c3:f0:12:34:56"},
+		},
+		Disks: []api.Disk{
+			{Name: "nvme0n1", Model: "SAMSUNG MZVL2512HCJQ-00BL7", Serial: "S64KNX0T123456", SizeBytes: 1000215216 * 512, Transport: "nvme"},
+			{Name: "sda", Model: "Ultra Fit", SizeBytes: 61440000 * 512, Removable: true, Transport: "scsi"},
+			// A USB SSD enclosure that claims not to be removable.
+			{Name: "sdb", Model: "PSSD T7", SizeBytes: 1953525168 * 512, Transport: "scsi"},
+		},
+	}
+	if !reflect.DeepEqual(facts, want) {
+		t.Fatalf("unexpected facts:\n got %+v\nwant %+v", facts, want)
+	}
+}
+
+func TestCollectHardwareFactsFromDeviceTree(t *testing.T) {
+	facts, err := CollectHardwareFactsFrom(filepath.Join("testdata", "arm"))
+	if err != nil {
+		t.Fatalf("collect: %v", err)
+	}
+	if facts.Model != "Raspberry Pi 4 Model B Rev 1.5" || facts.SerialNumber != "10000000abcdef01" {
+		t.Fatalf("expected device tree model and serial, got %q %q", facts.Model, facts.SerialNumber)
+	}
+	if facts.CPUModel != "brcm,bcm2711" || facts.CPUCount != 4 {
+		t.Fatalf("expected SoC from device tree, got %q x%d", facts.CPUModel, facts.CPUCount)
+	}
+	if len(facts.Disks) != 1 || facts.Disks[0].Name != "mmcblk0" || facts.HasTPM {
+		t.Fatalf("unexpected devices %+v", facts)
+	}
+}
+
+func TestDiskTransport(t *testing.T) {
+	// Like PCI addresses, real sysfs device paths contain colons, so the
+	// links are built here.
+	dir := t.TempDir()
+	for name, device := range map[string]string{
+		"sda":     "devices/pci0000_00/0000_00_17.0/ata1/host0/target0_0_0/0_0_0_0/block/sda",
+		"sdb":     "devices/pci0000_00/0000_00_14.0/usb2/2-1/2-1_1.0/host6/target6_0_0/6_0_0_0/block/sdb",
+		"nvme0n1": "devices/pci0000_00/0000_00_06.0/0000_01_00.0/nvme/nvme0/nvme0n1",
+	} {
+		target := filepath.Join(dir, device)
+		if err := os.MkdirAll(filepath.Join(target, "device"), 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		if err := os.Symlink(target, filepath.Join(dir, name)); err != nil {
+			t.Fatalf("symlink: %v", err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "sda", "device", "vendor"), []byte("ATA     \n"), 0o644); err != nil {
+		t.Fatalf("write vendor: %v", err)
+	}
+	for name, want := range map[string]string{"sda": "sata", "sdb": "usb", "nvme0n1": "nvme"} {
+		if got := diskTransport(filepath.Join(dir, name), name); got != want {
+			t.Fatalf("diskTransport(%s) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestPCIDevices(t *testing.T) {
+	// PCI addresses contain colons, which module zips do not allow, so the
+	// tree is built here rather than checked into testdata.
+	dir := t.TempDir()
+	write := func(addr, vendor, device, class, driver string) {
+		base := filepath.Join(dir, "devices", addr)
+		if err := os.MkdirAll(base, 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		for name, value := range map[string]string{"vendor": vendor, "device": device, "class": class} {
+			if err := os.WriteFile(filepath.Join(base, name), []byte(value+"\n"), 0o644); err != nil {
+				t.Fatalf("write %s: %v", name, err)
+			}
+		}
+		if driver != "" {
+			if err := os.Symlink(filepath.Join("..", "..", "drivers", driver), filepath.Join(base, "driver")); err != nil {
+				t.Fatalf("symlink driver: %v", err)
+			}
+		}
+	}
+	write("0000:04:00.0", "0x144d", "0xa80a", "0x010802", "nvme")
+	write("0000:00:02.0", "0x8086", "0x46a6", "0x030000", "i915")
+	write("0000:00:14.3", "0x8086", "0x51f0", "0x028000", "")
+
+	got := pciDevices(filepath.Join(dir, "devices"))
+	want := []api.PCIDevice{
+		{Address: "0000:00:02.0", Vendor: "0x8086", Device: "0x46a6", Class: "0x030000", Driver: "i915"},
+		{Address: "0000:00:14.3", Vendor: "0x8086", Device: "0x51f0", Class: "0x028000"},
+		{Address: "0000:04:00.0", Vendor: "0x144d", Device: "0xa80a", Class: "0x010802", Driver: "nvme"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected pci devices:\n got %+v\nwant %+v", got, want)
+	}
+}
@@ -1,6 +1,7 @@
 package util
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -25,3 +26,18 @@ func EnsureParentDir(filePath string, perm os.FileMode) error {
 	}
 	return EnsureDir(dir, perm)
 }
+
+// RemoveFile deletes the file at path. A missing file is not an error, and the
+// return value reports whether a file was removed.
+func RemoveFile(path string) (bool, error) {
+	if path == "" {
+		return false, nil
+	}
+	if err := os.Remove(path); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		return false, fmt.Errorf("remove %s: %w", path, err)
+	}
+	return true, nil
+}
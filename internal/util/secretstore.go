@@ -0,0 +1,74 @@
+package util
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+)
+
+// SecretStore encrypts secret files at rest. Implementations must be safe for
+// concurrent use.
+type SecretStore interface {
+	// Name identifies the backend in the header of sealed files.
+	Name() string
+	// Seal encrypts plaintext for storage on disk.
+	Seal(plaintext []byte) ([]byte, error)
+	// Unseal reverses Seal.
+	Unseal(sealed []byte) ([]byte, error)
+}
+
+// sealedPrefix starts every file written through a SecretStore, followed by
+// the backend name and a newline. Files without it are plaintext.
+const sealedPrefix = "evergreen-sealed:"
+
+var (
+	secretStoreMu sync.RWMutex
+	secretStore   SecretStore
+)
+
+// SetSecretStore selects the store used by WriteSecretFile and ReadSecretFile.
+// A nil store keeps secrets as plaintext files.
+func SetSecretStore(store SecretStore) {
+	secretStoreMu.Lock()
+	defer secretStoreMu.Unlock()
+	secretStore = store
+}
+
+func currentSecretStore() SecretStore {
+	secretStoreMu.RLock()
+	defer secretStoreMu.RUnlock()
+	return secretStore
+}
+
+func sealSecret(store SecretStore, data []byte) ([]byte, error) {
+	if store == nil {
+		return data, nil
+	}
+	sealed, err := store.Seal(data)
+	if err != nil {
+		return nil, fmt.Errorf("seal secret with %s: %w", store.Name(), err)
+	}
+	header := sealedPrefix + store.Name() + "\n"
+	return append([]byte(header), sealed...), nil
+}
+
+// unsealSecret decodes a file written by sealSecret. plaintext reports whether
+// the file predates the secret store and should be migrated.
+func unsealSecret(store SecretStore, data []byte) (secret []byte, plaintext bool, err error) {
+	if !bytes.HasPrefix(data, []byte(sealedPrefix)) {
+		return data, true, nil
+	}
+	header, sealed, ok := bytes.Cut(data[len(sealedPrefix):], []byte("\n"))
+	if !ok {
+		return nil, false, fmt.Errorf("malformed sealed secret header")
+	}
+	backend := string(header)
+	if store == nil || store.Name() != backend {
+		return nil, false, fmt.Errorf("secret is sealed with %s but that backend is not configured", backend)
+	}
+	secret, err = store.Unseal(sealed)
+	if err != nil {
+		return nil, false, fmt.Errorf("unseal secret with %s: %w", backend, err)
+	}
+	return secret, false, nil
+}
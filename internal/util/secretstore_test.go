@@ -0,0 +1,134 @@
+package util
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// xorStore is a reversible stand-in for a real encryption backend.
+type xorStore struct{ name string }
+
+func (s xorStore) Name() string { return s.name }
+
+func (s xorStore) Seal(data []byte) ([]byte, error) { return xor(data), nil }
+
+func (s xorStore) Unseal(data []byte) ([]byte, error) { return xor(data), nil }
+
+func xor(data []byte) []byte {
+	out := make([]byte, len(data))
+	for i, b := range data {
+		out[i] = b ^ 0x5a
+	}
+	return out
+}
+
+func useSecretStore(t *testing.T, store SecretStore) {
+	t.Helper()
+	SetSecretStore(store)
+	t.Cleanup(func() { SetSecretStore(nil) })
+}
+
+func TestSecretStoreSealsFiles(t *testing.T) {
+	useSecretStore(t, xorStore{name: "xor"})
+	path := filepath.Join(t.TempDir(), "token")
+	if err := WriteSecretFile(path, []byte("super-secret-token")); err != nil {
+		t.Fatalf("write secret: %v", err)
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read raw: %v", err)
+	}
+	if !bytes.HasPrefix(raw, []byte("evergreen-sealed:xor\n")) || bytes.Contains(raw, []byte("super-secret-token")) {
+		t.Fatalf("expected sealed file, got %q", raw)
+	}
+	read, err := ReadSecretFile(path)
+	if err != nil {
+		t.Fatalf("read secret: %v", err)
+	}
+	if string(read) != "super-secret-token" {
+		t.Fatalf("unexpected secret content %q", read)
+	}
+}
+
+func TestSecretStoreMigratesPlaintext(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	if err := WriteSecretFile(path, []byte("legacy-token")); err != nil {
+		t.Fatalf("write plaintext secret: %v", err)
+	}
+	useSecretStore(t, xorStore{name: "xor"})
+	read, err := ReadSecretFile(path)
+	if err != nil {
+		t.Fatalf("read secret: %v", err)
+	}
+	if string(read) != "legacy-token" {
+		t.Fatalf("unexpected secret content %q", read)
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read raw: %v", err)
+	}
+	if !bytes.HasPrefix(raw, []byte("evergreen-sealed:xor\n")) {
+		t.Fatalf("expected plaintext secret to be sealed in place, got %q", raw)
+	}
+}
+
+func TestSecretStoreRejectsOtherBackend(t *testing.T) {
+	useSecretStore(t, xorStore{name: "xor"})
+	path := filepath.Join(t.TempDir(), "token")
+	if err := WriteSecretFile(path, []byte("token")); err != nil {
+		t.Fatalf("write secret: %v", err)
+	}
+	SetSecretStore(xorStore{name: "other"})
+	if _, err := ReadSecretFile(path); err == nil || !strings.Contains(err.Error(), "sealed with xor") {
+		t.Fatalf("expected backend mismatch error, got %v", err)
+	}
+	SetSecretStore(nil)
+	if _, err := ReadSecretFile(path); err == nil {
+		t.Fatalf("expected sealed secret to be unreadable without a store")
+	}
+}
+
+func TestSecretStoreMigratesConcurrentReads(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "token")
+	if err := WriteSecretFile(path, []byte("legacy-token")); err != nil {
+		t.Fatalf("write plaintext secret: %v", err)
+	}
+	useSecretStore(t, xorStore{name: "xor"})
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if read, err := ReadSecretFile(path); err != nil || string(read) != "legacy-token" {
+				errs <- fmt.Errorf("read %q: %v", read, err)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("expected only the secret to remain, got %v (%v)", entries, err)
+	}
+
+	// A migration that lost the race to a newer write leaves it in place.
+	if err := WriteSecretFile(path, []byte("new-token")); err != nil {
+		t.Fatalf("write secret: %v", err)
+	}
+	if err := migrateSecretFile(xorStore{name: "xor"}, path, []byte("legacy-token")); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	if read, err := ReadSecretFile(path); err != nil || string(read) != "new-token" {
+		t.Fatalf("expected the newer secret to survive, got %q (%v)", read, err)
+	}
+}
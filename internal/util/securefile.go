@@ -1,43 +1,116 @@
 package util
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"io/fs"
 	"os"
+	"path/filepath"
+	"sync"
 )
 
 const secretFilePerm = 0o600
 const secretDirPerm = 0o700
 
-// WriteSecretFile writes data to the provided path with restrictive permissions.
+// secretFileMu serialises secret writes so sealing a plaintext file during a
+// read cannot replace a newer write.
+var secretFileMu sync.Mutex
+
+// WriteSecretFile writes data to the provided path with restrictive
+// permissions, encrypted with the configured SecretStore.
 func WriteSecretFile(path string, data []byte) error {
 	if path == "" {
 		return errors.New("path cannot be empty")
 	}
-	if err := EnsureParentDir(path, secretDirPerm); err != nil {
+	data, err := sealSecret(currentSecretStore(), data)
+	if err != nil {
 		return err
 	}
-	tmpFile := path + ".tmp"
-	if err := os.WriteFile(tmpFile, data, secretFilePerm); err != nil {
-		return fmt.Errorf("write temp secret: %w", err)
-	}
-	if err := os.Chmod(tmpFile, secretFilePerm); err != nil {
-		return fmt.Errorf("chmod temp secret: %w", err)
+	return writeSecretFile(path, data)
+}
+
+func writeSecretFile(path string, data []byte) error {
+	tmp, err := writeSecretTemp(path, data)
+	if err != nil {
+		return err
 	}
-	if err := os.Rename(tmpFile, path); err != nil {
+	defer os.Remove(tmp)
+	secretFileMu.Lock()
+	defer secretFileMu.Unlock()
+	if err := os.Rename(tmp, path); err != nil {
 		return fmt.Errorf("rename secret: %w", err)
 	}
 	return nil
 }
 
-// ReadSecretFile reads data from a secret file.
+// writeSecretTemp writes data to a uniquely named temporary file next to path
+// so concurrent writers never share one.
+func writeSecretTemp(path string, data []byte) (string, error) {
+	if err := EnsureParentDir(path, secretDirPerm); err != nil {
+		return "", err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return "", fmt.Errorf("create temp secret: %w", err)
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), secretFilePerm)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", fmt.Errorf("write temp secret: %w", err)
+	}
+	return tmp.Name(), nil
+}
+
+// ReadSecretFile reads data from a secret file, decrypting it with the
+// configured SecretStore. Plaintext files written before a store was
+// configured are sealed in place.
 func ReadSecretFile(path string) ([]byte, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
-	return data, nil
+	store := currentSecretStore()
+	secret, plaintext, err := unsealSecret(store, data)
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", path, err)
+	}
+	if plaintext && store != nil {
+		if err := migrateSecretFile(store, path, data); err != nil {
+			return nil, fmt.Errorf("migrate plaintext secret %s: %w", path, err)
+		}
+	}
+	return secret, nil
+}
+
+// migrateSecretFile seals the plaintext file at path, unless another writer
+// replaced it since it was read.
+func migrateSecretFile(store SecretStore, path string, plaintext []byte) error {
+	sealed, err := sealSecret(store, plaintext)
+	if err != nil {
+		return err
+	}
+	tmp, err := writeSecretTemp(path, sealed)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	secretFileMu.Lock()
+	defer secretFileMu.Unlock()
+	current, err := os.ReadFile(path)
+	if err != nil || !bytes.Equal(current, plaintext) {
+		return nil
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("rename secret: %w", err)
+	}
+	return nil
 }
 
 // FileExists checks if a file exists.
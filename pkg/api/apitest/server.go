@@ -0,0 +1,823 @@
+// Package apitest provides an in-memory Evergreen backend for integration
+// tests. It implements the enroll (including one-time and device codes), AK
+// activation, certificate, policy, state, events, attest and unenroll endpoints
+// on top of httptest, signs policies with a throwaway Ed25519 key, records
+// every payload it receives and can be scripted to fail.
+package apitest
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/evergreen-os/device-agent/pkg/api"
+	"github.com/google/go-attestation/attest"
+)
+
+// Endpoint names a backend route that failures can be scripted for.
+type Endpoint string
+
+// Endpoints served by Server.
+const (
+	EndpointEnroll      Endpoint = "enroll"
+	EndpointToken       Endpoint = "token"
+	EndpointActivateAK  Endpoint = "ak_activate"
+	EndpointCertificate Endpoint = "certificate"
+	EndpointPolicy      Endpoint = "policy"
+	EndpointState       Endpoint = "state"
+	EndpointEvents      Endpoint = "events"
+	EndpointAttest      Endpoint = "attest"
+	EndpointUnenroll    Endpoint = "unenroll"
+)
+
+// Failure scripts a single non-successful response. A zero Status with a
+// non-zero Delay produces a slow but otherwise normal response.
+type Failure struct {
+	Status int
+	Delay  time.Duration
+	Body   string
+	// RetryAfter is sent as a Retry-After header, typically alongside 429.
+	RetryAfter time.Duration
+}
+
+// Server is a scriptable mock of the Evergreen backend.
+type Server struct {
+	*httptest.Server
+
+	signingKey ed25519.PrivateKey
+	publicKey  ed25519.PublicKey
+	caKey      *ecdsa.PrivateKey
+	caCert     *x509.Certificate
+
+	mu            sync.Mutex
+	nextDevice    int
+	nextToken     int
+	tokens        map[string]grant
+	refreshTokens map[string]string
+	refresh       *refreshSettings
+	approval      *approvalSettings
+	pending       map[string]*pendingDevice
+	policy        *api.PolicyEnvelope
+	etag          string
+	pollInterval  time.Duration
+	certLifetime  time.Duration
+	clockOffset   time.Duration
+	features      []string
+	agentVersion  string
+	agentCaps     []string
+	failures      map[Endpoint][]Failure
+	akSecrets     map[string][]byte
+	codes         map[string]bool
+	deviceCodes   map[string]string
+	released      map[string]bool
+
+	activatedAKs  []string
+	unenrollments []api.UnenrollRequest
+	enrollments   []api.EnrollDeviceRequest
+	states        []api.DeviceState
+	stateCalls    int
+	events        []api.Event
+	attestations  []api.AttestBootRequest
+	refreshes     int
+}
+
+// grant is an accepted bearer token. A zero expiry never expires.
+type grant struct {
+	deviceID string
+	expiry   time.Time
+}
+
+type approvalSettings struct {
+	pollInterval time.Duration
+}
+
+type pendingDevice struct {
+	request  api.EnrollDeviceRequest
+	approved bool
+}
+
+type refreshSettings struct {
+	accessLifetime time.Duration
+	rotate         bool
+}
+
+// NewServer starts a mock backend that is closed when the test finishes.
+func NewServer(t testing.TB) *Server {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("apitest: generate signing key: %v", err)
+	}
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("apitest: generate ca key: %v", err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "apitest device ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("apitest: create ca: %v", err)
+	}
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatalf("apitest: parse ca: %v", err)
+	}
+	s := &Server{
+		signingKey:    priv,
+		publicKey:     pub,
+		caKey:         caKey,
+		caCert:        caCert,
+		tokens:        map[string]grant{},
+		refreshTokens: map[string]string{},
+		pending:       map[string]*pendingDevice{},
+		certLifetime:  12 * time.Hour,
+		features:      []string{api.FeatureStateBatch, api.FeatureGzip},
+		failures:      map[Endpoint][]Failure{},
+		akSecrets:     map[string][]byte{},
+		codes:         map[string]bool{},
+		deviceCodes:   map[string]string{},
+		released:      map[string]bool{},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/v1/devices/enroll", s.handle(EndpointEnroll, false, s.enroll))
+	mux.HandleFunc("POST /api/v1/devices/enroll/device-code", s.handle(EndpointEnroll, false, s.deviceCode))
+	mux.HandleFunc("POST /api/v1/devices/enroll/poll", s.handle(EndpointEnroll, false, s.pollEnrollment))
+	mux.HandleFunc("POST /api/v1/devices/ak/activate", s.handle(EndpointActivateAK, true, s.activateAK))
+	mux.HandleFunc("POST /api/v1/devices/token", s.handle(EndpointToken, false, s.token))
+	mux.HandleFunc("POST /api/v1/devices/certificate", s.handle(EndpointCertificate, true, s.certificate))
+	mux.HandleFunc("GET /api/v1/devices/policy", s.handle(EndpointPolicy, true, s.pullPolicy))
+	mux.HandleFunc("POST /api/v1/devices/state", s.handle(EndpointState, true, s.reportState))
+	mux.HandleFunc("POST /api/v1/devices/state/batch", s.handle(EndpointState, true, s.reportStateBatch))
+	mux.HandleFunc("POST /api/v1/devices/events", s.handle(EndpointEvents, true, s.reportEvents))
+	mux.HandleFunc("POST /api/v1/devices/attest", s.handle(EndpointAttest, true, s.attest))
+	mux.HandleFunc("POST /api/v1/devices/unenroll", s.handle(EndpointUnenroll, true, s.unenroll))
+	s.Server = httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return s
+}
+
+// PublicKeyPEM returns the PEM encoded key that verifies served policies.
+func (s *Server) PublicKeyPEM() []byte {
+	der, err := x509.MarshalPKIXPublicKey(s.publicKey)
+	if err != nil {
+		panic(fmt.Sprintf("apitest: marshal public key: %v", err))
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+}
+
+// SetPolicy signs and publishes a policy. Devices holding the previous ETag
+// receive the new bundle on their next pull.
+func (s *Server) SetPolicy(version string, doc api.PolicyDocument) api.PolicyEnvelope {
+	payload, err := json.Marshal(doc)
+	if err != nil {
+		panic(fmt.Sprintf("apitest: marshal policy: %v", err))
+	}
+	envelope := api.PolicyEnvelope{
+		Version:   version,
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(s.signingKey, payload)),
+		Policy:    doc,
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.policy = &envelope
+	s.etag = strconv.Quote(version)
+	return envelope
+}
+
+// SetPollInterval makes policy responses suggest the given poll interval.
+func (s *Server) SetPollInterval(interval time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pollInterval = interval
+}
+
+// SetCertificateLifetime controls the validity of issued client certificates.
+func (s *Server) SetCertificateLifetime(lifetime time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.certLifetime = lifetime
+}
+
+// EnableRefreshTokens makes enrollment issue refresh credentials that are
+// exchanged for access tokens valid for accessLifetime. When rotate is set,
+// every exchange also replaces the refresh credential.
+func (s *Server) EnableRefreshTokens(accessLifetime time.Duration, rotate bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refresh = &refreshSettings{accessLifetime: accessLifetime, rotate: rotate}
+}
+
+// SetClockOffset shifts the Date header of every response, simulating a device
+// whose clock is off by -offset.
+func (s *Server) SetClockOffset(offset time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clockOffset = offset
+}
+
+// SetFeatures replaces the optional features advertised to agents. Endpoints
+// behind a feature that is not advertised answer 404.
+func (s *Server) SetFeatures(features ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.features = append([]string{}, features...)
+}
+
+// AgentVersion returns the agent version announced on the latest request.
+func (s *Server) AgentVersion() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.agentVersion
+}
+
+// AgentCapabilities returns the capabilities announced on the latest request.
+func (s *Server) AgentCapabilities() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.agentCaps...)
+}
+
+func (s *Server) hasFeature(feature string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Contains(s.features, feature)
+}
+
+// RequireApproval makes enrollment answer 202 with a poll token until Approve
+// is called. pollInterval is suggested to agents between polls.
+func (s *Server) RequireApproval(pollInterval time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.approval = &approvalSettings{pollInterval: pollInterval}
+}
+
+// PendingEnrollments returns how many devices are waiting for approval.
+func (s *Server) PendingEnrollments() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	count := 0
+	for _, pending := range s.pending {
+		if !pending.approved {
+			count++
+		}
+	}
+	return count
+}
+
+// Approve approves every pending enrollment.
+func (s *Server) Approve() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, pending := range s.pending {
+		pending.approved = true
+	}
+}
+
+// AddEnrollmentCode registers a one-time enrollment code. Enrollments that
+// carry an unknown or already used code are rejected with 403.
+func (s *Server) AddEnrollmentCode(code string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.codes[code] = true
+}
+
+// Decommission releases a device. Its authenticated calls other than unenroll
+// are answered with 410 Gone from now on.
+func (s *Server) Decommission(deviceID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.released[deviceID] = true
+}
+
+// Fail queues failures for an endpoint. Each request consumes one entry.
+func (s *Server) Fail(endpoint Endpoint, failures ...Failure) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures[endpoint] = append(s.failures[endpoint], failures...)
+}
+
+// RevokeTokens invalidates every issued device, access and refresh token.
+func (s *Server) RevokeTokens() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens = map[string]grant{}
+	s.refreshTokens = map[string]string{}
+}
+
+// ExpireAccessTokens invalidates issued access tokens but keeps refresh
+// credentials, simulating tokens that expired early.
+func (s *Server) ExpireAccessTokens() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for token, g := range s.tokens {
+		if !g.expiry.IsZero() {
+			delete(s.tokens, token)
+		}
+	}
+}
+
+// TokenRefreshes returns how many access tokens were issued.
+func (s *Server) TokenRefreshes() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.refreshes
+}
+
+// Enrollments returns the enrollment requests received so far.
+func (s *Server) Enrollments() []api.EnrollDeviceRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]api.EnrollDeviceRequest(nil), s.enrollments...)
+}
+
+// States returns every state snapshot received, in order.
+func (s *Server) States() []api.DeviceState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]api.DeviceState(nil), s.states...)
+}
+
+// StateRequests returns how many state uploads (single or batched) succeeded.
+func (s *Server) StateRequests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stateCalls
+}
+
+// Events returns every event received, in order.
+func (s *Server) Events() []api.Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]api.Event(nil), s.events...)
+}
+
+// ActivatedAKs returns the devices whose attestation key activation
+// succeeded, in order.
+func (s *Server) ActivatedAKs() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.activatedAKs...)
+}
+
+// Unenrollments returns the final and follow-up reports of released devices.
+func (s *Server) Unenrollments() []api.UnenrollRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]api.UnenrollRequest(nil), s.unenrollments...)
+}
+
+// Attestations returns the attestation uploads received so far.
+func (s *Server) Attestations() []api.AttestBootRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]api.AttestBootRequest(nil), s.attestations...)
+}
+
+type handlerFunc func(w http.ResponseWriter, r *http.Request, deviceID string)
+
+func (s *Server) handle(endpoint Endpoint, authenticated bool, next handlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		offset := s.clockOffset
+		features := strings.Join(s.features, ",")
+		if version := r.Header.Get("X-Evergreen-Agent-Version"); version != "" {
+			s.agentVersion = version
+			s.agentCaps = strings.Split(r.Header.Get("X-Evergreen-Agent-Capabilities"), ",")
+		}
+		s.mu.Unlock()
+		w.Header().Set("Date", time.Now().Add(offset).UTC().Format(http.TimeFormat))
+		w.Header().Set("X-Evergreen-Features", features)
+		if failure, ok := s.nextFailure(endpoint); ok {
+			if failure.Delay > 0 {
+				select {
+				case <-time.After(failure.Delay):
+				case <-r.Context().Done():
+					return
+				}
+			}
+			if failure.Status != 0 {
+				if failure.RetryAfter > 0 {
+					w.Header().Set("Retry-After", strconv.Itoa(int(failure.RetryAfter/time.Second)))
+				}
+				w.WriteHeader(failure.Status)
+				_, _ = io.WriteString(w, failure.Body)
+				return
+			}
+		}
+		var deviceID string
+		if authenticated {
+			token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			s.mu.Lock()
+			g, ok := s.tokens[token]
+			released := s.released[g.deviceID]
+			s.mu.Unlock()
+			if !ok || (!g.expiry.IsZero() && time.Now().After(g.expiry)) {
+				http.Error(w, "unknown device token", http.StatusUnauthorized)
+				return
+			}
+			if released && endpoint != EndpointUnenroll {
+				http.Error(w, "device decommissioned", http.StatusGone)
+				return
+			}
+			deviceID = g.deviceID
+		}
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			if !s.hasFeature(api.FeatureGzip) {
+				http.Error(w, "gzip request bodies not accepted", http.StatusUnsupportedMediaType)
+				return
+			}
+			body, err := gzip.NewReader(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			r.Body = body
+		}
+		next(w, r, deviceID)
+	}
+}
+
+func (s *Server) nextFailure(endpoint Endpoint) (Failure, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	queue := s.failures[endpoint]
+	if len(queue) == 0 {
+		return Failure{}, false
+	}
+	s.failures[endpoint] = queue[1:]
+	return queue[0], true
+}
+
+func (s *Server) enroll(w http.ResponseWriter, r *http.Request, _ string) {
+	var req api.EnrollDeviceRequest
+	if !decode(w, r, &req) {
+		return
+	}
+	s.mu.Lock()
+	if req.EnrollmentCode != "" {
+		if !s.codes[req.EnrollmentCode] {
+			s.mu.Unlock()
+			http.Error(w, "invalid enrollment code", http.StatusForbidden)
+			return
+		}
+		delete(s.codes, req.EnrollmentCode)
+	}
+	if req.DeviceCode != "" {
+		if _, ok := s.deviceCodes[req.DeviceCode]; !ok {
+			s.mu.Unlock()
+			http.Error(w, "invalid device code", http.StatusForbidden)
+			return
+		}
+		delete(s.deviceCodes, req.DeviceCode)
+	}
+	s.enrollments = append(s.enrollments, req)
+	// Device codes always wait for the operator to approve the user code.
+	if s.approval != nil || req.DeviceCode != "" {
+		s.nextToken++
+		pollToken := fmt.Sprintf("poll-%d", s.nextToken)
+		s.pending[pollToken] = &pendingDevice{request: req}
+		var interval time.Duration
+		if s.approval != nil {
+			interval = s.approval.pollInterval
+		}
+		s.mu.Unlock()
+		writePending(w, pollToken, interval)
+		return
+	}
+	s.mu.Unlock()
+	s.writeCredentials(w, req)
+}
+
+func (s *Server) deviceCode(w http.ResponseWriter, r *http.Request, _ string) {
+	var req api.DeviceCodeRequest
+	if !decode(w, r, &req) {
+		return
+	}
+	s.mu.Lock()
+	s.nextToken++
+	n := s.nextToken
+	deviceCode := fmt.Sprintf("device-code-%d", n)
+	userCode := fmt.Sprintf("USER-%04d", n)
+	s.deviceCodes[deviceCode] = userCode
+	s.mu.Unlock()
+	writeJSON(w, api.DeviceCodeResponse{
+		DeviceCode:              deviceCode,
+		UserCode:                userCode,
+		VerificationURI:         s.URL + "/activate",
+		VerificationURIComplete: s.URL + "/activate?user_code=" + userCode,
+		ExpiresIn:               600,
+	})
+}
+
+func (s *Server) pollEnrollment(w http.ResponseWriter, r *http.Request, _ string) {
+	var req api.PollEnrollmentRequest
+	if !decode(w, r, &req) {
+		return
+	}
+	s.mu.Lock()
+	pending, ok := s.pending[req.PollToken]
+	var interval time.Duration
+	if s.approval != nil {
+		interval = s.approval.pollInterval
+	}
+	if ok && pending.approved {
+		delete(s.pending, req.PollToken)
+	}
+	s.mu.Unlock()
+	switch {
+	case !ok:
+		http.Error(w, "unknown poll token", http.StatusUnauthorized)
+	case !pending.approved:
+		writePending(w, req.PollToken, interval)
+	default:
+		s.writeCredentials(w, pending.request)
+	}
+}
+
+func writePending(w http.ResponseWriter, pollToken string, interval time.Duration) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(w).Encode(api.EnrollDeviceResponse{PollToken: pollToken, PollInterval: int(interval / time.Second)})
+}
+
+func (s *Server) writeCredentials(w http.ResponseWriter, req api.EnrollDeviceRequest) {
+	s.mu.Lock()
+	s.nextDevice++
+	deviceID := fmt.Sprintf("device-%d", s.nextDevice)
+	token := fmt.Sprintf("token-%d", s.nextDevice)
+	s.tokens[token] = grant{deviceID: deviceID}
+	var policy api.PolicyEnvelope
+	if s.policy != nil {
+		policy = *s.policy
+	}
+	var refresh string
+	if s.refresh != nil {
+		refresh = s.newRefreshTokenLocked(deviceID)
+	}
+	s.mu.Unlock()
+
+	resp := api.EnrollDeviceResponse{DeviceID: deviceID, DeviceToken: token, RefreshToken: refresh, Policy: policy, Features: s.featureList()}
+	if req.CSR != "" {
+		cert, err := s.issueCertificate(req.CSR)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp.Certificate = cert
+	}
+	if req.TPM != nil {
+		challenge, secret, err := newAKChallenge(req.TPM)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.mu.Lock()
+		s.akSecrets[deviceID] = secret
+		s.mu.Unlock()
+		resp.AKChallenge = challenge
+	}
+	writeJSON(w, resp)
+}
+
+// newAKChallenge verifies the AK creation evidence and encrypts a random
+// secret that only the TPM holding both the EK and the AK can recover.
+func newAKChallenge(tpm *api.TPMEnrollment) (*api.AKChallenge, []byte, error) {
+	ek, err := x509.ParsePKIXPublicKey(tpm.EKPublic)
+	if err != nil {
+		return nil, nil, fmt.Errorf("parse endorsement key: %w", err)
+	}
+	params := attest.ActivationParameters{
+		TPMVersion: attest.TPMVersion20,
+		EK:         ek,
+		AK: attest.AttestationParameters{
+			Public:            tpm.AK.Public,
+			CreateData:        tpm.AK.CreateData,
+			CreateAttestation: tpm.AK.CreateAttestation,
+			CreateSignature:   tpm.AK.CreateSignature,
+		},
+	}
+	secret, credential, err := params.Generate()
+	if err != nil {
+		return nil, nil, fmt.Errorf("generate activation challenge: %w", err)
+	}
+	return &api.AKChallenge{Credential: credential.Credential, Secret: credential.Secret}, secret, nil
+}
+
+func (s *Server) activateAK(w http.ResponseWriter, r *http.Request, deviceID string) {
+	var req api.ActivateAKRequest
+	if !decode(w, r, &req) {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	want, ok := s.akSecrets[deviceID]
+	if !ok || req.DeviceID != deviceID || !bytes.Equal(want, req.Secret) {
+		http.Error(w, "attestation key activation failed", http.StatusForbidden)
+		return
+	}
+	delete(s.akSecrets, deviceID)
+	s.activatedAKs = append(s.activatedAKs, deviceID)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) token(w http.ResponseWriter, r *http.Request, _ string) {
+	var req api.RefreshTokenRequest
+	if !decode(w, r, &req) {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	deviceID, ok := s.refreshTokens[req.RefreshToken]
+	if !ok || s.refresh == nil || deviceID != req.DeviceID {
+		http.Error(w, "unknown refresh token", http.StatusUnauthorized)
+		return
+	}
+	s.nextToken++
+	s.refreshes++
+	access := fmt.Sprintf("access-%d", s.nextToken)
+	s.tokens[access] = grant{deviceID: deviceID, expiry: time.Now().Add(s.refresh.accessLifetime)}
+	resp := api.RefreshTokenResponse{AccessToken: access, ExpiresIn: int(s.refresh.accessLifetime / time.Second)}
+	if s.refresh.rotate {
+		delete(s.refreshTokens, req.RefreshToken)
+		resp.RefreshToken = s.newRefreshTokenLocked(deviceID)
+	}
+	writeJSON(w, resp)
+}
+
+func (s *Server) newRefreshTokenLocked(deviceID string) string {
+	s.nextToken++
+	refresh := fmt.Sprintf("refresh-%d", s.nextToken)
+	s.refreshTokens[refresh] = deviceID
+	return refresh
+}
+
+func (s *Server) certificate(w http.ResponseWriter, r *http.Request, _ string) {
+	var req api.RenewCertificateRequest
+	if !decode(w, r, &req) {
+		return
+	}
+	cert, err := s.issueCertificate(req.CSR)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, api.RenewCertificateResponse{Certificate: cert})
+}
+
+func (s *Server) pullPolicy(w http.ResponseWriter, r *http.Request, _ string) {
+	s.mu.Lock()
+	policy, etag, interval := s.policy, s.etag, s.pollInterval
+	s.mu.Unlock()
+	if interval > 0 {
+		w.Header().Set("X-Poll-Interval", strconv.Itoa(int(interval/time.Second)))
+	}
+	if policy == nil || r.Header.Get("If-None-Match") == etag || r.URL.Query().Get("current_version") == policy.Version {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("ETag", etag)
+	writeJSON(w, policy)
+}
+
+func (s *Server) reportState(w http.ResponseWriter, r *http.Request, _ string) {
+	var req api.ReportStateRequest
+	if !decode(w, r, &req) {
+		return
+	}
+	s.mu.Lock()
+	s.states = append(s.states, req.State)
+	s.stateCalls++
+	s.mu.Unlock()
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) featureList() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.features...)
+}
+
+func (s *Server) reportStateBatch(w http.ResponseWriter, r *http.Request, _ string) {
+	if !s.hasFeature(api.FeatureStateBatch) {
+		http.NotFound(w, r)
+		return
+	}
+	var req api.ReportStateBatchRequest
+	if !decode(w, r, &req) {
+		return
+	}
+	s.mu.Lock()
+	s.states = append(s.states, req.States...)
+	s.stateCalls++
+	s.mu.Unlock()
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) reportEvents(w http.ResponseWriter, r *http.Request, _ string) {
+	var req api.ReportEventsRequest
+	if !decode(w, r, &req) {
+		return
+	}
+	s.mu.Lock()
+	s.events = append(s.events, req.Events...)
+	s.mu.Unlock()
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) attest(w http.ResponseWriter, r *http.Request, _ string) {
+	var req api.AttestBootRequest
+	if !decode(w, r, &req) {
+		return
+	}
+	s.mu.Lock()
+	s.attestations = append(s.attestations, req)
+	s.mu.Unlock()
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) unenroll(w http.ResponseWriter, r *http.Request, deviceID string) {
+	var req api.UnenrollRequest
+	if !decode(w, r, &req) {
+		return
+	}
+	s.mu.Lock()
+	s.unenrollments = append(s.unenrollments, req)
+	// The token keeps working for follow-up reports to this endpoint; every
+	// other call answers 410.
+	s.released[deviceID] = true
+	s.mu.Unlock()
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) issueCertificate(csrPEM string) (string, error) {
+	block, _ := pem.Decode([]byte(csrPEM))
+	if block == nil {
+		return "", fmt.Errorf("csr is not PEM encoded")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return "", fmt.Errorf("parse csr: %w", err)
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return "", fmt.Errorf("csr signature: %w", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 62))
+	if err != nil {
+		return "", err
+	}
+	s.mu.Lock()
+	lifetime := s.certLifetime
+	s.mu.Unlock()
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      csr.Subject,
+		NotBefore:    now.Add(-time.Minute),
+		NotAfter:     now.Add(lifetime),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, s.caCert, csr.PublicKey, s.caKey)
+	if err != nil {
+		return "", fmt.Errorf("sign certificate: %w", err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})), nil
+}
+
+func decode(w http.ResponseWriter, r *http.Request, out any) bool {
+	if err := json.NewDecoder(r.Body).Decode(out); err != nil {
+		http.Error(w, fmt.Sprintf("decode request: %v", err), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(body)
+}
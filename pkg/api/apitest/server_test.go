@@ -0,0 +1,143 @@
+package apitest
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/evergreen-os/device-agent/internal/policy"
+	"github.com/evergreen-os/device-agent/pkg/api"
+)
+
+func enrollDevice(t *testing.T, server *Server, client *api.Client) api.EnrollDeviceResponse {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: pkix.Name{CommonName: "serial-1"}}, key)
+	if err != nil {
+		t.Fatalf("create csr: %v", err)
+	}
+	csr := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}))
+	resp, err := client.EnrollDevice(context.Background(), api.EnrollDeviceRequest{SerialNumber: "serial-1", CSR: csr})
+	if err != nil {
+		t.Fatalf("enroll: %v", err)
+	}
+	return resp
+}
+
+func TestServerEnrollAndSignedPolicy(t *testing.T) {
+	server := NewServer(t)
+	server.SetPollInterval(2 * time.Minute)
+	envelope := server.SetPolicy("v1", api.PolicyDocument{Updates: api.UpdatePolicy{Channel: "stable"}})
+
+	client, err := api.New(server.URL)
+	if err != nil {
+		t.Fatalf("new client: %v", err)
+	}
+	enrolled := enrollDevice(t, server, client)
+	if enrolled.DeviceID == "" || enrolled.DeviceToken == "" {
+		t.Fatalf("expected credentials, got %+v", enrolled)
+	}
+	if enrolled.Certificate == "" {
+		t.Fatalf("expected issued certificate for csr")
+	}
+	if enrolled.Policy.Version != "v1" {
+		t.Fatalf("expected initial policy, got %q", enrolled.Policy.Version)
+	}
+	if got := server.Enrollments(); len(got) != 1 || got[0].SerialNumber != "serial-1" {
+		t.Fatalf("unexpected recorded enrollments: %+v", got)
+	}
+
+	keyPath := filepath.Join(t.TempDir(), "policy.pem")
+	if err := os.WriteFile(keyPath, server.PublicKeyPEM(), 0o600); err != nil {
+		t.Fatalf("write key: %v", err)
+	}
+	verifier, err := policy.NewVerifier(keyPath)
+	if err != nil {
+		t.Fatalf("load verifier: %v", err)
+	}
+	if err := verifier.Verify(envelope); err != nil {
+		t.Fatalf("served policy failed verification: %v", err)
+	}
+
+	resp, err := client.PullPolicy(context.Background(), enrolled.DeviceToken, api.PullPolicyRequest{})
+	if err != nil {
+		t.Fatalf("pull policy: %v", err)
+	}
+	if resp.ETag == "" || resp.PollInterval != 2*time.Minute {
+		t.Fatalf("unexpected caching metadata: %+v", resp)
+	}
+	_, err = client.PullPolicy(context.Background(), enrolled.DeviceToken, api.PullPolicyRequest{ETag: resp.ETag})
+	if !errors.Is(err, api.ErrNotModified) {
+		t.Fatalf("expected not modified for matching etag, got %v", err)
+	}
+}
+
+func TestServerScriptedFailures(t *testing.T) {
+	server := NewServer(t)
+	client, err := api.New(server.URL)
+	if err != nil {
+		t.Fatalf("new client: %v", err)
+	}
+	enrolled := enrollDevice(t, server, client)
+	req := api.ReportEventsRequest{DeviceID: enrolled.DeviceID, Events: []api.Event{{Type: "test"}}}
+
+	server.Fail(EndpointEvents, Failure{Status: http.StatusTooManyRequests, RetryAfter: time.Second}, Failure{Status: http.StatusBadGateway})
+	if err := client.ReportEvents(context.Background(), enrolled.DeviceToken, req); err == nil {
+		t.Fatalf("expected scripted 429")
+	}
+	if err := client.ReportEvents(context.Background(), enrolled.DeviceToken, req); err == nil {
+		t.Fatalf("expected scripted 502")
+	}
+	if err := client.ReportEvents(context.Background(), enrolled.DeviceToken, req); err != nil {
+		t.Fatalf("expected success once failures are consumed: %v", err)
+	}
+	if got := server.Events(); len(got) != 1 {
+		t.Fatalf("expected one recorded event, got %d", len(got))
+	}
+
+	server.Fail(EndpointEvents, Failure{Delay: 300 * time.Millisecond})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := client.ReportEvents(ctx, enrolled.DeviceToken, req); err == nil {
+		t.Fatalf("expected slow response to exceed deadline")
+	}
+
+	server.RevokeTokens()
+	err = client.ReportEvents(context.Background(), enrolled.DeviceToken, req)
+	if !errors.Is(err, api.ErrUnauthorized) {
+		t.Fatalf("expected revoked token to be rejected, got %v", err)
+	}
+}
+
+func TestServerRecordsCompressedStateBatches(t *testing.T) {
+	server := NewServer(t)
+	client, err := api.New(server.URL, api.WithCompression(true))
+	if err != nil {
+		t.Fatalf("new client: %v", err)
+	}
+	enrolled := enrollDevice(t, server, client)
+	states := []api.DeviceState{{UpdateStatus: "idle"}, {UpdateStatus: "staged"}}
+	if err := client.ReportStateBatch(context.Background(), enrolled.DeviceToken, api.ReportStateBatchRequest{DeviceID: enrolled.DeviceID, States: states}); err != nil {
+		t.Fatalf("report state batch: %v", err)
+	}
+	got := server.States()
+	if len(got) != 2 || got[1].UpdateStatus != "staged" {
+		t.Fatalf("unexpected recorded states: %+v", got)
+	}
+	if server.StateRequests() != 1 {
+		t.Fatalf("expected one batched request, got %d", server.StateRequests())
+	}
+}
@@ -0,0 +1,33 @@
+package api
+
+import "encoding/json"
+
+// SplitBatches groups items into batches holding at most maxItems entries and
+// roughly maxBytes of JSON. Non-positive limits are ignored. An item larger
+// than maxBytes is sent on its own rather than dropped.
+func SplitBatches[T any](items []T, maxItems, maxBytes int) [][]T {
+	var batches [][]T
+	var current []T
+	size := 0
+	for _, item := range items {
+		itemSize := 0
+		if maxBytes > 0 {
+			if data, err := json.Marshal(item); err == nil {
+				itemSize = len(data) + 1
+			}
+		}
+		full := maxItems > 0 && len(current) >= maxItems
+		tooBig := maxBytes > 0 && len(current) > 0 && size+itemSize > maxBytes
+		if full || tooBig {
+			batches = append(batches, current)
+			current = nil
+			size = 0
+		}
+		current = append(current, item)
+		size += itemSize
+	}
+	if len(current) > 0 {
+		batches = append(batches, current)
+	}
+	return batches
+}
@@ -0,0 +1,37 @@
+package api
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSplitBatchesByCount(t *testing.T) {
+	batches := SplitBatches([]int{1, 2, 3, 4, 5}, 2, 0)
+	if len(batches) != 3 {
+		t.Fatalf("expected 3 batches, got %d", len(batches))
+	}
+	if len(batches[0]) != 2 || len(batches[2]) != 1 {
+		t.Fatalf("unexpected batch sizes: %v", batches)
+	}
+}
+
+func TestSplitBatchesByBytes(t *testing.T) {
+	large := strings.Repeat("x", 40)
+	items := []string{large, large, large, strings.Repeat("y", 200)}
+	batches := SplitBatches(items, 0, 100)
+	if len(batches) != 3 {
+		t.Fatalf("expected 3 batches, got %d: %v", len(batches), batches)
+	}
+	if len(batches[0]) != 2 {
+		t.Fatalf("expected first batch to hold two items, got %d", len(batches[0]))
+	}
+	if len(batches[2]) != 1 || batches[2][0] != items[3] {
+		t.Fatalf("expected oversized item in its own batch")
+	}
+}
+
+func TestSplitBatchesEmpty(t *testing.T) {
+	if batches := SplitBatches[int](nil, 10, 10); len(batches) != 0 {
+		t.Fatalf("expected no batches, got %v", batches)
+	}
+}
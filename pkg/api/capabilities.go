@@ -0,0 +1,155 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Headers used to negotiate capabilities with the backend.
+const (
+	headerAgentVersion      = "X-Evergreen-Agent-Version"
+	headerAgentCapabilities = "X-Evergreen-Agent-Capabilities"
+	headerServerFeatures    = "X-Evergreen-Features"
+)
+
+// Backend features the agent adapts to.
+const (
+	// FeatureStateBatch indicates POST /api/v1/devices/state/batch is available.
+	FeatureStateBatch = "state_batch"
+	// FeatureGzip indicates state and event uploads may be gzip encoded.
+	FeatureGzip = "gzip"
+)
+
+// PolicySections lists the top-level policy sections this build enforces.
+var PolicySections = []string{"apps", "updates", "browser", "network", "security", "hardware"}
+
+// AgentInfo identifies the agent build and what it understands.
+type AgentInfo struct {
+	Version      string   `json:"version"`
+	Commit       string   `json:"commit,omitempty"`
+	BuildDate    string   `json:"build_date,omitempty"`
+	Capabilities []string `json:"capabilities"`
+}
+
+// FeatureSet is the set of optional features advertised by the backend.
+type FeatureSet map[string]bool
+
+// Has reports whether the backend advertised the feature.
+func (f FeatureSet) Has(feature string) bool {
+	return f[feature]
+}
+
+// WithAgentInfo announces the agent version and capabilities on enrollment and
+// on every request.
+func WithAgentInfo(info AgentInfo) Option {
+	return func(client *Client) {
+		client.agentInfo = &info
+	}
+}
+
+// ServerFeatures returns the features advertised by the backend in its most
+// recent response. ok is false when the backend has not advertised any, in
+// which case callers should assume the full current API.
+func (c *Client) ServerFeatures() (features FeatureSet, ok bool) {
+	set := c.features.Load()
+	if set == nil {
+		return nil, false
+	}
+	return *set, true
+}
+
+func (c *Client) setAgentHeaders(req *http.Request) {
+	if c.agentInfo == nil {
+		return
+	}
+	req.Header.Set("User-Agent", "evergreen-agent/"+c.agentInfo.Version)
+	req.Header.Set(headerAgentVersion, c.agentInfo.Version)
+	req.Header.Set(headerAgentCapabilities, strings.Join(c.agentInfo.Capabilities, ","))
+}
+
+func (c *Client) observeFeatures(header http.Header) {
+	value, ok := header[http.CanonicalHeaderKey(headerServerFeatures)]
+	if !ok {
+		return
+	}
+	c.storeFeatures(strings.Split(strings.Join(value, ","), ","))
+}
+
+func (c *Client) storeFeatures(names []string) {
+	set := FeatureSet{}
+	for _, name := range names {
+		if name = strings.TrimSpace(name); name != "" {
+			set[name] = true
+		}
+	}
+	c.features.Store(&set)
+}
+
+// UnknownSections returns the top-level policy sections this build does not
+// understand, sorted by name.
+func (d PolicyDocument) UnknownSections() []string {
+	names := make([]string, 0, len(d.Unknown))
+	for name := range d.Unknown {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// UnmarshalJSON decodes a policy document, keeping sections this build does
+// not know about instead of silently discarding them.
+func (d *PolicyDocument) UnmarshalJSON(data []byte) error {
+	type plain PolicyDocument
+	var decoded plain
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	decoded.Unknown = nil
+	for name, value := range raw {
+		if slices.Contains(PolicySections, name) {
+			continue
+		}
+		if decoded.Unknown == nil {
+			decoded.Unknown = map[string]json.RawMessage{}
+		}
+		decoded.Unknown[name] = value
+	}
+	*d = PolicyDocument(decoded)
+	return nil
+}
+
+// MarshalJSON encodes known sections in declaration order followed by any
+// unknown sections sorted by name, so signatures over documents carrying
+// newer sections still verify.
+func (d PolicyDocument) MarshalJSON() ([]byte, error) {
+	type plain PolicyDocument
+	data, err := json.Marshal(plain(d))
+	if err != nil || len(d.Unknown) == 0 {
+		return data, err
+	}
+	var buf bytes.Buffer
+	buf.Write(data[:len(data)-1])
+	for _, name := range d.UnknownSections() {
+		key, err := json.Marshal(name)
+		if err != nil {
+			return nil, err
+		}
+		buf.WriteByte(',')
+		buf.Write(key)
+		buf.WriteByte(':')
+		if err := json.Compact(&buf, d.Unknown[name]); err != nil {
+			return nil, fmt.Errorf("encode policy section %s: %w", name, err)
+		}
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,85 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPolicyDocumentKeepsUnknownSections(t *testing.T) {
+	input := `{"apps":{"required":[{"id":"org.example.App"}]},"kiosk":{"url":"https://example.com"},"printers":[]}`
+	var doc PolicyDocument
+	if err := json.Unmarshal([]byte(input), &doc); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if got := strings.Join(doc.UnknownSections(), ","); got != "kiosk,printers" {
+		t.Fatalf("unexpected unknown sections %q", got)
+	}
+	if len(doc.Apps.Required) != 1 {
+		t.Fatalf("expected known sections to decode, got %+v", doc.Apps)
+	}
+	encoded, err := json.Marshal(doc)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	if !strings.HasSuffix(string(encoded), `,"kiosk":{"url":"https://example.com"},"printers":[]}`) {
+		t.Fatalf("expected unknown sections appended in order, got %s", encoded)
+	}
+
+	type plain PolicyDocument
+	known := PolicyDocument{Updates: UpdatePolicy{Channel: "stable"}}
+	withMethod, _ := json.Marshal(known)
+	without, _ := json.Marshal(plain(known))
+	if string(withMethod) != string(without) {
+		t.Fatalf("documents without unknown sections must encode unchanged:\n%s\n%s", withMethod, without)
+	}
+}
+
+func TestClientNegotiatesCapabilities(t *testing.T) {
+	var gotVersion, gotCaps, gotAgent string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotVersion = r.Header.Get("X-Evergreen-Agent-Version")
+		gotCaps = r.Header.Get("X-Evergreen-Agent-Capabilities")
+		if r.URL.Path == "/api/v1/devices/enroll" {
+			var req EnrollDeviceRequest
+			_ = json.NewDecoder(r.Body).Decode(&req)
+			if req.Agent != nil {
+				gotAgent = req.Agent.Version
+			}
+			_ = json.NewEncoder(w).Encode(EnrollDeviceResponse{DeviceID: "d", DeviceToken: "t", Features: []string{"kiosk"}})
+			return
+		}
+		w.Header().Set("X-Evergreen-Features", "state_batch, kiosk")
+		w.WriteHeader(http.StatusNotModified)
+	}))
+	defer server.Close()
+
+	client, err := New(server.URL, WithAgentInfo(AgentInfo{Version: "1.4.0", Capabilities: []string{"policy.apps", "gzip"}}))
+	if err != nil {
+		t.Fatalf("new client: %v", err)
+	}
+	if _, ok := client.ServerFeatures(); ok {
+		t.Fatalf("expected no features before the first response")
+	}
+	if _, err := client.EnrollDevice(context.Background(), EnrollDeviceRequest{}); err != nil {
+		t.Fatalf("enroll: %v", err)
+	}
+	if gotAgent != "1.4.0" {
+		t.Fatalf("expected agent info in enrollment body, got %q", gotAgent)
+	}
+	if features, _ := client.ServerFeatures(); features.Has(FeatureStateBatch) {
+		t.Fatalf("enrollment response did not advertise state batches")
+	}
+
+	_, _ = client.PullPolicy(context.Background(), "t", PullPolicyRequest{})
+	if gotVersion != "1.4.0" || gotCaps != "policy.apps,gzip" {
+		t.Fatalf("unexpected agent headers version=%q caps=%q", gotVersion, gotCaps)
+	}
+	features, ok := client.ServerFeatures()
+	if !ok || !features.Has(FeatureStateBatch) || !features.Has("kiosk") {
+		t.Fatalf("unexpected server features %v", features)
+	}
+}
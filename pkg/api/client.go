@@ -2,7 +2,9 @@ package api
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -10,6 +12,10 @@ import (
 	"net/http"
 	"net/url"
 	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -17,18 +23,40 @@ import (
 type Client struct {
 	baseURL    *url.URL
 	httpClient *http.Client
+	clientCert atomic.Pointer[tls.Certificate]
+	compress   bool
+
+	transportOpts TransportOptions
+
+	tokenMu     sync.RWMutex
+	tokenSource TokenSource
+
+	clockSkew    atomic.Int64
+	skewMeasured atomic.Bool
+
+	agentInfo *AgentInfo
+	features  atomic.Pointer[FeatureSet]
 }
 
 // Option allows customizing the client.
 type Option func(*Client)
 
-// WithHTTPClient sets a custom http.Client.
+// WithHTTPClient sets a custom http.Client. The provided client's transport is
+// used as-is, so certificates installed with SetClientCertificate are ignored.
 func WithHTTPClient(c *http.Client) Option {
 	return func(client *Client) {
 		client.httpClient = c
 	}
 }
 
+// WithCompression gzips state and event uploads once the backend advertises
+// the gzip feature.
+func WithCompression(enabled bool) Option {
+	return func(client *Client) {
+		client.compress = enabled
+	}
+}
+
 // New creates a new API client.
 func New(base string, opts ...Option) (*Client, error) {
 	if base == "" {
@@ -38,32 +66,141 @@ func New(base string, opts ...Option) (*Client, error) {
 	if err != nil {
 		return nil, fmt.Errorf("parse base url: %w", err)
 	}
-	c := &Client{
-		baseURL:    u,
-		httpClient: &http.Client{Timeout: 30 * time.Second},
-	}
+	c := &Client{baseURL: u}
 	for _, opt := range opts {
 		opt(c)
 	}
+	if c.httpClient == nil {
+		c.httpClient = &http.Client{Timeout: 30 * time.Second, Transport: c.newTransport()}
+	}
 	return c, nil
 }
 
+// SetClientCertificate installs the device certificate presented during mutual
+// TLS. Passing nil reverts to bearer-token-only authentication. Idle
+// connections are closed so the next request renegotiates with the new identity.
+func (c *Client) SetClientCertificate(cert *tls.Certificate) {
+	c.clientCert.Store(cert)
+	c.httpClient.CloseIdleConnections()
+}
+
+// SetTokenSource makes authenticated calls use access tokens from source
+// instead of the token passed by the caller. A request rejected with 401 is
+// retried once with a freshly refreshed token. Passing nil restores the
+// per-call tokens.
+func (c *Client) SetTokenSource(source TokenSource) {
+	c.tokenMu.Lock()
+	defer c.tokenMu.Unlock()
+	c.tokenSource = source
+}
+
+func (c *Client) currentTokenSource() TokenSource {
+	c.tokenMu.RLock()
+	defer c.tokenMu.RUnlock()
+	return c.tokenSource
+}
+
+func (c *Client) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	if cert := c.clientCert.Load(); cert != nil {
+		return cert, nil
+	}
+	// An empty certificate tells the TLS stack not to present one.
+	return &tls.Certificate{}, nil
+}
+
 // EnrollDeviceRequest contains hardware facts used for enrollment.
 type EnrollDeviceRequest struct {
-	SerialNumber string `json:"serial"`
-	Model        string `json:"model"`
-	CPUModel     string `json:"cpu_model"`
-	CPUCount     int    `json:"cpu_count"`
-	TotalRAM     uint64 `json:"total_ram_bytes"`
-	HasTPM       bool   `json:"has_tpm"`
-	PreSharedKey string `json:"pre_shared_key,omitempty"`
+	SerialNumber string     `json:"serial"`
+	Model        string     `json:"model"`
+	CPUModel     string     `json:"cpu_model"`
+	CPUCount     int        `json:"cpu_count"`
+	TotalRAM     uint64     `json:"total_ram_bytes"`
+	HasTPM       bool       `json:"has_tpm"`
+	PreSharedKey string     `json:"pre_shared_key,omitempty"`
+	CSR          string     `json:"csr,omitempty"`
+	Agent        *AgentInfo `json:"agent,omitempty"`
+	// TPM binds the enrollment to the device TPM when one is present.
+	TPM *TPMEnrollment `json:"tpm,omitempty"`
+	// EnrollmentCode is a one-time code typed in by provisioning staff.
+	EnrollmentCode string `json:"enrollment_code,omitempty"`
+	// DeviceCode redeems a device authorization obtained with
+	// RequestDeviceCode; the backend answers pending until it is approved.
+	DeviceCode string `json:"device_code,omitempty"`
+	// Hardware is the extended inventory beyond the summary fields above.
+	Hardware *HardwareInventory `json:"hardware,omitempty"`
+}
+
+// TPMEnrollment carries the endorsement key and attestation key parameters
+// needed by the backend to verify the AK lives on the same TPM as the EK.
+type TPMEnrollment struct {
+	// EKPublic is the PKIX DER encoded endorsement public key.
+	EKPublic []byte `json:"ek_public"`
+	// EKCertificate is the DER encoded EK certificate when the TPM provides one.
+	EKCertificate    []byte       `json:"ek_certificate,omitempty"`
+	EKCertificateURL string       `json:"ek_certificate_url,omitempty"`
+	AK               AKParameters `json:"ak"`
+}
+
+// AKParameters describes a TPM 2.0 attestation key and its creation evidence.
+type AKParameters struct {
+	Public            []byte `json:"public"`
+	CreateData        []byte `json:"create_data"`
+	CreateAttestation []byte `json:"create_attestation"`
+	CreateSignature   []byte `json:"create_signature"`
+}
+
+// AKChallenge is a credential activation challenge encrypted to the EK.
+type AKChallenge struct {
+	Credential []byte `json:"credential"`
+	Secret     []byte `json:"secret"`
+}
+
+// ActivateAKRequest proves possession of the AK by returning the decrypted
+// challenge secret.
+type ActivateAKRequest struct {
+	DeviceID string `json:"device_id"`
+	Secret   []byte `json:"secret"`
 }
 
 // EnrollDeviceResponse is returned after successful enrollment.
 type EnrollDeviceResponse struct {
-	DeviceID    string         `json:"device_id"`
-	DeviceToken string         `json:"device_token"`
-	Policy      PolicyEnvelope `json:"policy"`
+	DeviceID    string `json:"device_id"`
+	DeviceToken string `json:"device_token"`
+	Certificate string `json:"certificate,omitempty"`
+	// RefreshToken, when set, is exchanged for short-lived access tokens via
+	// RefreshToken instead of using DeviceToken directly.
+	RefreshToken string         `json:"refresh_token,omitempty"`
+	Policy       PolicyEnvelope `json:"policy"`
+	// Features lists optional backend features, mirroring X-Evergreen-Features.
+	Features []string `json:"features,omitempty"`
+	// PollToken is set, without credentials, when the backend answered 202
+	// because an administrator has to approve the device first.
+	PollToken string `json:"poll_token,omitempty"`
+	// PollInterval is the suggested delay in seconds between approval polls.
+	PollInterval int `json:"poll_interval,omitempty"`
+	// AKChallenge must be solved with ActivateAK before the AK is trusted.
+	AKChallenge *AKChallenge `json:"ak_challenge,omitempty"`
+}
+
+// Pending reports whether enrollment awaits administrator approval.
+func (r EnrollDeviceResponse) Pending() bool {
+	return r.PollToken != "" && r.DeviceToken == ""
+}
+
+// PollEnrollmentRequest asks whether a pending enrollment has been approved.
+type PollEnrollmentRequest struct {
+	PollToken string `json:"poll_token"`
+}
+
+// RenewCertificateRequest asks the backend to issue a fresh client certificate.
+type RenewCertificateRequest struct {
+	DeviceID string `json:"device_id"`
+	CSR      string `json:"csr"`
+}
+
+// RenewCertificateResponse carries the PEM encoded certificate chain.
+type RenewCertificateResponse struct {
+	Certificate string `json:"certificate"`
 }
 
 // PolicyEnvelope wraps a policy bundle with metadata.
@@ -81,16 +218,106 @@ type PolicyDocument struct {
 	Browser  BrowserPolicy  `json:"browser"`
 	Network  NetworkPolicy  `json:"network"`
 	Security SecurityPolicy `json:"security"`
+	// Hardware is optional so documents without it keep their canonical
+	// encoding and signatures.
+	Hardware *HardwarePolicy `json:"hardware,omitempty"`
+
+	// Unknown holds top-level sections this build does not understand.
+	Unknown map[string]json.RawMessage `json:"-"`
 }
 
 type AppsPolicy struct {
 	Required []AppDefinition `json:"required"`
-}
+	// Allowed and Blocked hold app ID patterns in path.Match syntax, e.g.
+	// "org.gnome.*". Blocked apps are uninstalled wherever they come from.
+	Allowed []string `json:"allowed,omitempty"`
+	Blocked []string `json:"blocked,omitempty"`
+	// Unmanaged decides what happens to installed apps that are neither
+	// required, allowed nor blocked. Defaults to AppsUnmanagedKeep.
+	Unmanaged string `json:"unmanaged,omitempty"`
+	// Remotes are reconciled before apps, so required apps can come from
+	// a private repository.
+	Remotes []FlatpakRemote `json:"remotes,omitempty"`
+	// Updates controls when apps are updated. Without it the agent leaves
+	// updates to the user and GNOME Software.
+	Updates *AppUpdatePolicy `json:"updates,omitempty"`
+	// MeteredMaxDownloadBytes is the largest install started while the
+	// connection is metered; larger ones wait for an unmetered connection.
+	// Defaults to 50 MB.
+	MeteredMaxDownloadBytes uint64 `json:"metered_max_download_bytes,omitempty"`
+	// Cleanup enables removal of runtimes no installed app uses.
+	Cleanup *AppCleanupPolicy `json:"cleanup,omitempty"`
+}
+
+// AppCleanupPolicy controls when unused Flatpak runtimes are removed.
+type AppCleanupPolicy struct {
+	// AfterRemoval cleans up whenever the agent uninstalls apps.
+	AfterRemoval bool `json:"after_removal,omitempty"`
+	// MinFreeBytes cleans up when free disk space drops below it.
+	MinFreeBytes uint64 `json:"min_free_bytes,omitempty"`
+}
+
+// AppUpdatePolicy controls Flatpak app updates.
+type AppUpdatePolicy struct {
+	Mode string `json:"mode"`
+	// MaintenanceWindows use the syntax of UpdatePolicy.Maintenance and
+	// apply to AppUpdatesWindow.
+	MaintenanceWindows []string `json:"maintenance_windows,omitempty"`
+	// Holds are app ID patterns kept at their installed version.
+	Holds []string `json:"holds,omitempty"`
+}
+
+// App update modes.
+const (
+	// AppUpdatesAuto updates apps as soon as updates are available.
+	AppUpdatesAuto = "auto"
+	// AppUpdatesManual leaves updates to the user.
+	AppUpdatesManual = "manual"
+	// AppUpdatesWindow updates apps during maintenance windows only.
+	AppUpdatesWindow = "window"
+)
+
+// FlatpakRemote describes a system-wide Flatpak remote.
+type FlatpakRemote struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+	// GPGKey is the ASCII-armored key the remote's summary is signed with.
+	GPGKey   string `json:"gpg_key,omitempty"`
+	Priority int    `json:"priority,omitempty"`
+	// Filter holds the contents of a flatpak remote filter file limiting
+	// which refs the remote offers.
+	Filter       string `json:"filter,omitempty"`
+	CollectionID string `json:"collection_id,omitempty"`
+	Disabled     bool   `json:"disabled,omitempty"`
+}
+
+// Handling of apps the policy does not mention.
+const (
+	AppsUnmanagedKeep   = "keep"
+	AppsUnmanagedReport = "report"
+	AppsUnmanagedRemove = "remove"
+)
 
 type AppDefinition struct {
 	ID     string `json:"id"`
 	Branch string `json:"branch"`
 	Source string `json:"source"`
+	// Commit pins the app to an OSTree commit, downgrading it if needed.
+	Commit string `json:"commit,omitempty"`
+	// Overrides restrict or extend the app's sandbox.
+	Overrides *SandboxOverrides `json:"overrides,omitempty"`
+}
+
+// SandboxOverrides are applied with flatpak override --system. List entries
+// prefixed with "!" revoke the permission, e.g. "!network" in Shares or
+// "!home" in Filesystems.
+type SandboxOverrides struct {
+	Filesystems []string          `json:"filesystems,omitempty"`
+	Shares      []string          `json:"shares,omitempty"`
+	Sockets     []string          `json:"sockets,omitempty"`
+	Devices     []string          `json:"devices,omitempty"`
+	Environment map[string]string `json:"environment,omitempty"`
+	TalkNames   []string          `json:"talk_names,omitempty"`
 }
 
 type UpdatePolicy struct {
@@ -142,9 +369,21 @@ type SecurityPolicy struct {
 	AllowRootLogin bool     `json:"allow_root_login"`
 }
 
-// PullPolicyRequest requests a new policy if changed.
+// PullPolicyRequest describes the policy the device already holds so the
+// backend (or an intermediate cache) can answer 304 Not Modified.
 type PullPolicyRequest struct {
 	CurrentVersion string `json:"current_version"`
+	ETag           string `json:"-"`
+}
+
+// PullPolicyResponse carries a policy bundle plus HTTP caching metadata.
+type PullPolicyResponse struct {
+	Envelope PolicyEnvelope
+	// ETag identifies the returned representation for If-None-Match.
+	ETag string
+	// PollInterval is the backend's suggested delay before the next pull, or
+	// zero when none was provided.
+	PollInterval time.Duration
 }
 
 // ReportStateRequest contains aggregated state information.
@@ -153,22 +392,58 @@ type ReportStateRequest struct {
 	State    DeviceState `json:"state"`
 }
 
-// DeviceState is reported to the backend.
-type DeviceState struct {
-	Timestamp      time.Time      `json:"timestamp"`
-	InstalledApps  []InstalledApp `json:"installed_apps"`
-	UpdateStatus   string         `json:"update_status"`
-	DiskTotalBytes uint64         `json:"disk_total_bytes"`
-	DiskFreeBytes  uint64         `json:"disk_free_bytes"`
-	BatteryPercent float64        `json:"battery_percent"`
-	LastError      string         `json:"last_error"`
+// ReportStateBatchRequest uploads several queued snapshots at once.
+type ReportStateBatchRequest struct {
+	DeviceID string        `json:"device_id"`
+	States   []DeviceState `json:"states"`
 }
 
-// InstalledApp describes an installed Flatpak.
+// DeviceState is reported to the backend.
+type DeviceState struct {
+	Timestamp        time.Time      `json:"timestamp"`
+	InstalledApps    []InstalledApp `json:"installed_apps"`
+	UpdateStatus     string         `json:"update_status"`
+	DiskTotalBytes   uint64         `json:"disk_total_bytes"`
+	DiskFreeBytes    uint64         `json:"disk_free_bytes"`
+	BatteryPercent   float64        `json:"battery_percent"`
+	LastError        string         `json:"last_error"`
+	ClockSkewSeconds float64        `json:"clock_skew_seconds"`
+	// HardwareChanges lists fingerprint fields that differ from enrollment.
+	HardwareChanges map[string]HardwareChange `json:"hardware_changes,omitempty"`
+	// AppUpdates lists Flatpak updates available but not yet installed.
+	AppUpdates []AppUpdate `json:"app_updates,omitempty"`
+}
+
+// InstalledApp describes an installed Flatpak app or runtime.
 type InstalledApp struct {
 	ID      string `json:"id"`
 	Version string `json:"version"`
 	Branch  string `json:"branch"`
+	Commit  string `json:"commit,omitempty"`
+	// Kind is "app" or "runtime".
+	Kind string `json:"kind,omitempty"`
+	Arch string `json:"arch,omitempty"`
+	// Origin names the remote the ref was installed from.
+	Origin string `json:"origin,omitempty"`
+	// Installation is "system", "user" or a custom installation name.
+	Installation       string `json:"installation,omitempty"`
+	InstalledSizeBytes uint64 `json:"installed_size_bytes,omitempty"`
+	// Runtime is the runtime ref an app runs on.
+	Runtime string `json:"runtime,omitempty"`
+	// EOL carries the remote's end-of-life reason, empty while supported.
+	EOL         string     `json:"eol,omitempty"`
+	LastUpdated *time.Time `json:"last_updated,omitempty"`
+}
+
+// AppUpdate describes an update available for an installed Flatpak.
+type AppUpdate struct {
+	ID     string `json:"id"`
+	Branch string `json:"branch"`
+	Commit string `json:"commit"`
+	// Held is set when policy keeps the app at its installed version.
+	Held bool `json:"held,omitempty"`
+	// Deferred is set while the update waits for an unmetered connection.
+	Deferred bool `json:"deferred,omitempty"`
 }
 
 // Event represents an event emitted by the agent.
@@ -185,6 +460,14 @@ type ReportEventsRequest struct {
 	Events   []Event `json:"events"`
 }
 
+// UnenrollRequest releases the device and carries its final report.
+type UnenrollRequest struct {
+	DeviceID string       `json:"device_id"`
+	Reason   string       `json:"reason"`
+	State    *DeviceState `json:"state,omitempty"`
+	Events   []Event      `json:"events,omitempty"`
+}
+
 // AttestBootRequest uploads TPM attestation evidence.
 type AttestBootRequest struct {
 	DeviceID string              `json:"device_id"`
@@ -209,6 +492,13 @@ type AttestationQuote struct {
 // ErrNotModified indicates the policy has not changed.
 var ErrNotModified = errors.New("policy not modified")
 
+// ErrUnauthorized indicates the backend rejected the device credentials.
+var ErrUnauthorized = errors.New("device credentials rejected")
+
+// ErrDecommissioned indicates the backend released the device (HTTP 410) and
+// it must remove its managed state.
+var ErrDecommissioned = errors.New("device decommissioned")
+
 func (c *Client) buildURL(parts ...string) string {
 	u := *c.baseURL
 	u.Path = path.Join(append([]string{c.baseURL.Path}, parts...)...)
@@ -216,74 +506,249 @@ func (c *Client) buildURL(parts ...string) string {
 }
 
 func (c *Client) doJSON(ctx context.Context, method, url string, body any, out any, headers http.Header) error {
-	var reader io.Reader
+	_, err := c.do(ctx, method, url, body, out, headers)
+	return err
+}
+
+// upload posts a state or event upload, gzipped when compression is enabled
+// and the backend accepts it.
+func (c *Client) upload(ctx context.Context, url string, body any, headers http.Header) error {
+	features, ok := c.ServerFeatures()
+	_, err := c.request(ctx, http.MethodPost, url, body, nil, headers, c.compress && ok && features.Has(FeatureGzip))
+	return err
+}
+
+// do performs a JSON request and returns the response headers, which are also
+// populated for 304 responses.
+func (c *Client) do(ctx context.Context, method, url string, body any, out any, headers http.Header) (http.Header, error) {
+	return c.request(ctx, method, url, body, out, headers, false)
+}
+
+func (c *Client) request(ctx context.Context, method, url string, body any, out any, headers http.Header, compress bool) (http.Header, error) {
+	var data []byte
+	compressed := false
 	if body != nil {
-		data, err := json.Marshal(body)
+		var err error
+		data, err = json.Marshal(body)
 		if err != nil {
-			return fmt.Errorf("marshal body: %w", err)
+			return nil, fmt.Errorf("marshal body: %w", err)
+		}
+		if compress {
+			if data, err = gzipBytes(data); err != nil {
+				return nil, fmt.Errorf("compress body: %w", err)
+			}
+			compressed = true
 		}
-		reader = bytes.NewReader(data)
-	}
-	req, err := http.NewRequestWithContext(ctx, method, url, reader)
-	if err != nil {
-		return fmt.Errorf("new request: %w", err)
 	}
-	req.Header.Set("Content-Type", "application/json")
-	for k, vals := range headers {
-		for _, v := range vals {
-			req.Header.Add(k, v)
+	source := c.currentTokenSource()
+	authenticated := headers.Get("Authorization") != ""
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, method, url, nil)
+		if err != nil {
+			return nil, fmt.Errorf("new request: %w", err)
 		}
+		if body != nil {
+			req.Body = io.NopCloser(bytes.NewReader(data))
+			req.ContentLength = int64(len(data))
+			req.Header.Set("Content-Type", "application/json")
+		}
+		if compressed {
+			req.Header.Set("Content-Encoding", "gzip")
+		}
+		c.setAgentHeaders(req)
+		for k, vals := range headers {
+			for _, v := range vals {
+				req.Header.Add(k, v)
+			}
+		}
+		if authenticated && source != nil {
+			token, err := source.Token(ctx)
+			if err != nil {
+				return nil, err
+			}
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		respHeaders, err := c.send(req, out)
+		if errors.Is(err, ErrUnauthorized) && authenticated && source != nil && attempt == 0 {
+			source.Invalidate()
+			continue
+		}
+		return respHeaders, err
 	}
+}
+
+func (c *Client) send(req *http.Request, out any) (http.Header, error) {
+	sent := time.Now()
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
-		return fmt.Errorf("perform request: %w", err)
+		return nil, fmt.Errorf("perform request: %w", err)
 	}
 	defer resp.Body.Close()
+	c.observeDate(resp.Header, sent, time.Now())
+	c.observeFeatures(resp.Header)
 	if resp.StatusCode == http.StatusNotModified {
-		return ErrNotModified
+		return resp.Header, ErrNotModified
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		data, _ := io.ReadAll(resp.Body)
+		return resp.Header, fmt.Errorf("api error %d: %s: %w", resp.StatusCode, string(data), ErrUnauthorized)
+	}
+	if resp.StatusCode == http.StatusGone {
+		data, _ := io.ReadAll(resp.Body)
+		return resp.Header, fmt.Errorf("api error %d: %s: %w", resp.StatusCode, string(data), ErrDecommissioned)
 	}
 	if resp.StatusCode >= 400 {
 		data, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("api error %d: %s", resp.StatusCode, string(data))
+		return resp.Header, fmt.Errorf("api error %d: %s", resp.StatusCode, string(data))
 	}
 	if out != nil {
 		decoder := json.NewDecoder(resp.Body)
 		if err := decoder.Decode(out); err != nil {
-			return fmt.Errorf("decode response: %w", err)
+			return resp.Header, fmt.Errorf("decode response: %w", err)
 		}
 	}
-	return nil
+	return resp.Header, nil
+}
+
+// ClockSkew reports how far the backend clock is ahead of the local clock, as
+// measured from the Date header of the most recent response. ok is false until
+// such a response has been received.
+func (c *Client) ClockSkew() (skew time.Duration, ok bool) {
+	return time.Duration(c.clockSkew.Load()), c.skewMeasured.Load()
+}
+
+// observeDate compares a response Date header against the midpoint of the
+// request's round trip. The header has one second resolution, which is far
+// below the skew we care about. Responses served from a proxy cache carry an
+// Age header and a Date from when they were generated, so they are ignored.
+func (c *Client) observeDate(header http.Header, sent, received time.Time) {
+	value := header.Get("Date")
+	if value == "" || header.Get("Age") != "" {
+		return
+	}
+	server, err := http.ParseTime(value)
+	if err != nil {
+		return
+	}
+	local := sent.Add(received.Sub(sent) / 2)
+	c.clockSkew.Store(int64(server.Sub(local)))
+	c.skewMeasured.Store(true)
+}
+
+// pollInterval parses the backend's X-Poll-Interval header (in seconds).
+func pollInterval(header http.Header) time.Duration {
+	value := header.Get("X-Poll-Interval")
+	if value == "" {
+		return 0
+	}
+	seconds, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil || seconds <= 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+func gzipBytes(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
 }
 
 // EnrollDevice performs the enrollment RPC.
 func (c *Client) EnrollDevice(ctx context.Context, req EnrollDeviceRequest) (EnrollDeviceResponse, error) {
+	if req.Agent == nil {
+		req.Agent = c.agentInfo
+	}
 	var resp EnrollDeviceResponse
 	url := c.buildURL("api", "v1", "devices", "enroll")
 	if err := c.doJSON(ctx, http.MethodPost, url, req, &resp, nil); err != nil {
 		return EnrollDeviceResponse{}, err
 	}
+	if resp.Features != nil {
+		c.storeFeatures(resp.Features)
+	}
+	return resp, nil
+}
+
+// PollEnrollment checks on a pending enrollment. The response is either still
+// pending or carries the issued credentials.
+func (c *Client) PollEnrollment(ctx context.Context, req PollEnrollmentRequest) (EnrollDeviceResponse, error) {
+	var resp EnrollDeviceResponse
+	url := c.buildURL("api", "v1", "devices", "enroll", "poll")
+	if err := c.doJSON(ctx, http.MethodPost, url, req, &resp, nil); err != nil {
+		return EnrollDeviceResponse{}, err
+	}
+	if resp.Features != nil {
+		c.storeFeatures(resp.Features)
+	}
 	return resp, nil
 }
 
-// PullPolicy retrieves the latest policy bundle.
-func (c *Client) PullPolicy(ctx context.Context, token, currentVersion string) (PolicyEnvelope, error) {
+// ActivateAK completes the attestation key credential activation challenge.
+func (c *Client) ActivateAK(ctx context.Context, token string, req ActivateAKRequest) error {
 	headers := http.Header{}
 	headers.Set("Authorization", "Bearer "+token)
-	url := c.buildURL("api", "v1", "devices", "policy")
-	var resp PolicyEnvelope
-	req := PullPolicyRequest{CurrentVersion: currentVersion}
+	url := c.buildURL("api", "v1", "devices", "ak", "activate")
+	return c.doJSON(ctx, http.MethodPost, url, req, nil, headers)
+}
+
+// RenewCertificate exchanges a CSR for a new device client certificate.
+func (c *Client) RenewCertificate(ctx context.Context, token string, req RenewCertificateRequest) (RenewCertificateResponse, error) {
+	headers := http.Header{}
+	headers.Set("Authorization", "Bearer "+token)
+	url := c.buildURL("api", "v1", "devices", "certificate")
+	var resp RenewCertificateResponse
 	if err := c.doJSON(ctx, http.MethodPost, url, req, &resp, headers); err != nil {
-		return PolicyEnvelope{}, err
+		return RenewCertificateResponse{}, err
 	}
 	return resp, nil
 }
 
+// PullPolicy retrieves the latest policy bundle with a conditional GET. It
+// returns ErrNotModified, together with any suggested poll interval, when the
+// cached policy is still current.
+func (c *Client) PullPolicy(ctx context.Context, token string, req PullPolicyRequest) (PullPolicyResponse, error) {
+	headers := http.Header{}
+	headers.Set("Authorization", "Bearer "+token)
+	if req.ETag != "" {
+		headers.Set("If-None-Match", req.ETag)
+	}
+	endpoint := c.buildURL("api", "v1", "devices", "policy")
+	if req.CurrentVersion != "" {
+		endpoint += "?" + url.Values{"current_version": {req.CurrentVersion}}.Encode()
+	}
+	var envelope PolicyEnvelope
+	respHeaders, err := c.do(ctx, http.MethodGet, endpoint, nil, &envelope, headers)
+	if err != nil {
+		return PullPolicyResponse{PollInterval: pollInterval(respHeaders)}, err
+	}
+	return PullPolicyResponse{
+		Envelope:     envelope,
+		ETag:         respHeaders.Get("ETag"),
+		PollInterval: pollInterval(respHeaders),
+	}, nil
+}
+
 // ReportState sends device state to the backend.
 func (c *Client) ReportState(ctx context.Context, token string, req ReportStateRequest) error {
 	headers := http.Header{}
 	headers.Set("Authorization", "Bearer "+token)
 	url := c.buildURL("api", "v1", "devices", "state")
-	return c.doJSON(ctx, http.MethodPost, url, req, nil, headers)
+	return c.upload(ctx, url, req, headers)
+}
+
+// ReportStateBatch sends several queued state snapshots in one request.
+func (c *Client) ReportStateBatch(ctx context.Context, token string, req ReportStateBatchRequest) error {
+	headers := http.Header{}
+	headers.Set("Authorization", "Bearer "+token)
+	url := c.buildURL("api", "v1", "devices", "state", "batch")
+	return c.upload(ctx, url, req, headers)
 }
 
 // ReportEvents sends queued events.
@@ -291,6 +756,14 @@ func (c *Client) ReportEvents(ctx context.Context, token string, req ReportEvent
 	headers := http.Header{}
 	headers.Set("Authorization", "Bearer "+token)
 	url := c.buildURL("api", "v1", "devices", "events")
+	return c.upload(ctx, url, req, headers)
+}
+
+// Unenroll notifies the backend that the device removed its managed state.
+func (c *Client) Unenroll(ctx context.Context, token string, req UnenrollRequest) error {
+	headers := http.Header{}
+	headers.Set("Authorization", "Bearer "+token)
+	url := c.buildURL("api", "v1", "devices", "unenroll")
 	return c.doJSON(ctx, http.MethodPost, url, req, nil, headers)
 }
 
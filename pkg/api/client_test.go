@@ -1,10 +1,22 @@
 package api
 
 import (
+	"compress/gzip"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"testing"
+	"time"
 )
 
 func TestNewClientBuildURL(t *testing.T) {
@@ -50,3 +62,222 @@ func TestAttestBoot(t *testing.T) {
 		t.Fatalf("unexpected path %s", gotPath)
 	}
 }
+
+func TestClientPresentsDeviceCertificate(t *testing.T) {
+	var presented int
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		presented = len(r.TLS.PeerCertificates)
+		w.WriteHeader(http.StatusOK)
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	server.StartTLS()
+	defer server.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(server.Certificate())
+	client, err := New(server.URL, WithTransportOptions(TransportOptions{RootCAs: pool}))
+	if err != nil {
+		t.Fatalf("new client: %v", err)
+	}
+
+	req := ReportEventsRequest{DeviceID: "device"}
+	if err := client.ReportEvents(context.Background(), "token", req); err != nil {
+		t.Fatalf("report events without certificate: %v", err)
+	}
+	if presented != 0 {
+		t.Fatalf("expected no client certificate, got %d", presented)
+	}
+
+	cert := selfSignedCertificate(t)
+	client.SetClientCertificate(&cert)
+	if err := client.ReportEvents(context.Background(), "token", req); err != nil {
+		t.Fatalf("report events with certificate: %v", err)
+	}
+	if presented != 1 {
+		t.Fatalf("expected device certificate to be presented, got %d", presented)
+	}
+}
+
+func selfSignedCertificate(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "device"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestReportStateBatchCompressed(t *testing.T) {
+	var got ReportStateBatchRequest
+	encodings := map[string]string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Evergreen-Features", "state_batch,gzip")
+		encodings[r.URL.Path] = r.Header.Get("Content-Encoding")
+		if r.URL.Path == "/api/v1/devices/token" {
+			_, _ = w.Write([]byte(`{"access_token":"access"}`))
+		}
+		if r.URL.Path != "/api/v1/devices/state/batch" || r.Header.Get("Content-Encoding") != "gzip" {
+			return
+		}
+		reader, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Errorf("open gzip body: %v", err)
+			return
+		}
+		if err := json.NewDecoder(reader).Decode(&got); err != nil {
+			t.Errorf("decode body: %v", err)
+		}
+	}))
+	defer server.Close()
+
+	client, err := New(server.URL, WithCompression(true))
+	if err != nil {
+		t.Fatalf("new client: %v", err)
+	}
+	// Until the backend advertises gzip, and for anything but uploads,
+	// bodies are sent as they are.
+	if err := client.ReportEvents(context.Background(), "token", ReportEventsRequest{DeviceID: "device"}); err != nil {
+		t.Fatalf("report events: %v", err)
+	}
+	if _, err := client.RefreshToken(context.Background(), RefreshTokenRequest{RefreshToken: "refresh"}); err != nil {
+		t.Fatalf("refresh token: %v", err)
+	}
+	req := ReportStateBatchRequest{DeviceID: "device", States: []DeviceState{{UpdateStatus: "idle"}, {UpdateStatus: "staged"}}}
+	if err := client.ReportStateBatch(context.Background(), "token", req); err != nil {
+		t.Fatalf("report state batch: %v", err)
+	}
+	want := map[string]string{
+		"/api/v1/devices/events":      "",
+		"/api/v1/devices/token":       "",
+		"/api/v1/devices/state/batch": "gzip",
+	}
+	if !reflect.DeepEqual(encodings, want) {
+		t.Fatalf("unexpected content encodings %v", encodings)
+	}
+	if len(got.States) != 2 || got.States[1].UpdateStatus != "staged" {
+		t.Fatalf("unexpected batch payload: %+v", got)
+	}
+}
+
+func TestUnauthorizedIsDistinct(t *testing.T) {
+	status := http.StatusUnauthorized
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	client, err := New(server.URL)
+	if err != nil {
+		t.Fatalf("new client: %v", err)
+	}
+	err = client.ReportEvents(context.Background(), "revoked", ReportEventsRequest{})
+	if !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("expected ErrUnauthorized, got %v", err)
+	}
+	status = http.StatusInternalServerError
+	err = client.ReportEvents(context.Background(), "token", ReportEventsRequest{})
+	if err == nil || errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("expected generic error for 500, got %v", err)
+	}
+}
+
+func TestPullPolicyConditionalGet(t *testing.T) {
+	var method, ifNoneMatch, version string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method = r.Method
+		ifNoneMatch = r.Header.Get("If-None-Match")
+		version = r.URL.Query().Get("current_version")
+		w.Header().Set("X-Poll-Interval", "120")
+		if ifNoneMatch == `"v2"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v2"`)
+		_ = json.NewEncoder(w).Encode(PolicyEnvelope{Version: "v2"})
+	}))
+	defer server.Close()
+
+	client, err := New(server.URL)
+	if err != nil {
+		t.Fatalf("new client: %v", err)
+	}
+	resp, err := client.PullPolicy(context.Background(), "token", PullPolicyRequest{CurrentVersion: "v1"})
+	if err != nil {
+		t.Fatalf("pull policy: %v", err)
+	}
+	if method != http.MethodGet || version != "v1" || ifNoneMatch != "" {
+		t.Fatalf("unexpected request: method=%s version=%s if-none-match=%s", method, version, ifNoneMatch)
+	}
+	if resp.Envelope.Version != "v2" || resp.ETag != `"v2"` {
+		t.Fatalf("unexpected response: %+v", resp)
+	}
+	if resp.PollInterval != 2*time.Minute {
+		t.Fatalf("expected poll interval of 2m, got %v", resp.PollInterval)
+	}
+
+	resp, err = client.PullPolicy(context.Background(), "token", PullPolicyRequest{CurrentVersion: "v2", ETag: resp.ETag})
+	if !errors.Is(err, ErrNotModified) {
+		t.Fatalf("expected ErrNotModified, got %v", err)
+	}
+	if resp.PollInterval != 2*time.Minute {
+		t.Fatalf("expected poll interval on 304, got %v", resp.PollInterval)
+	}
+}
+
+func TestClientTracksClockSkew(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Date", time.Now().Add(-90*time.Minute).UTC().Format(http.TimeFormat))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	client, err := New(server.URL)
+	if err != nil {
+		t.Fatalf("new client: %v", err)
+	}
+	if _, ok := client.ClockSkew(); ok {
+		t.Fatalf("expected no skew before the first response")
+	}
+	if err := client.ReportEvents(context.Background(), "token", ReportEventsRequest{}); err != nil {
+		t.Fatalf("report events: %v", err)
+	}
+	skew, ok := client.ClockSkew()
+	if !ok {
+		t.Fatalf("expected skew to be measured")
+	}
+	if diff := skew + 90*time.Minute; diff < -2*time.Second || diff > 2*time.Second {
+		t.Fatalf("expected skew near -90m, got %v", skew)
+	}
+}
+
+func TestClientIgnoresCachedResponseDates(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// A proxy cache answering with a copy generated an hour ago.
+		w.Header().Set("Date", time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat))
+		w.Header().Set("Age", "3600")
+		w.WriteHeader(http.StatusNotModified)
+	}))
+	defer server.Close()
+
+	client, err := New(server.URL)
+	if err != nil {
+		t.Fatalf("new client: %v", err)
+	}
+	if _, err := client.PullPolicy(context.Background(), "token", PullPolicyRequest{ETag: `"v1"`}); !errors.Is(err, ErrNotModified) {
+		t.Fatalf("expected not modified, got %v", err)
+	}
+	if skew, ok := client.ClockSkew(); ok {
+		t.Fatalf("expected a cached response not to measure skew, got %v", skew)
+	}
+}
@@ -0,0 +1,39 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+// DeviceCodeRequest starts an interactive device-code enrollment.
+type DeviceCodeRequest struct {
+	SerialNumber string `json:"serial"`
+}
+
+// DeviceCodeResponse tells the operator where to approve the device. The
+// DeviceCode is then redeemed through EnrollDevice.
+type DeviceCodeResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete,omitempty"`
+	// ExpiresIn is the lifetime of the codes in seconds.
+	ExpiresIn int `json:"expires_in"`
+	// Interval is the suggested delay in seconds between approval polls.
+	Interval int `json:"interval,omitempty"`
+}
+
+// RequestDeviceCode obtains a device code and the user code an operator
+// enters on another machine to approve the enrollment.
+func (c *Client) RequestDeviceCode(ctx context.Context, req DeviceCodeRequest) (DeviceCodeResponse, error) {
+	var resp DeviceCodeResponse
+	url := c.buildURL("api", "v1", "devices", "enroll", "device-code")
+	if err := c.doJSON(ctx, http.MethodPost, url, req, &resp, nil); err != nil {
+		return DeviceCodeResponse{}, err
+	}
+	if resp.DeviceCode == "" || resp.UserCode == "" {
+		return DeviceCodeResponse{}, errors.New("device code response missing codes")
+	}
+	return resp, nil
+}
@@ -0,0 +1,75 @@
+package api
+
+// HardwareInventory describes the device hardware for asset management.
+type HardwareInventory struct {
+	SystemUUID   string `json:"system_uuid,omitempty"`
+	Vendor       string `json:"vendor,omitempty"`
+	BoardVendor  string `json:"board_vendor,omitempty"`
+	BoardName    string `json:"board_name,omitempty"`
+	BoardVersion string `json:"board_version,omitempty"`
+	BIOSVendor   string `json:"bios_vendor,omitempty"`
+	BIOSVersion  string `json:"bios_version,omitempty"`
+	BIOSDate     string `json:"bios_date,omitempty"`
+	// ChassisType is the SMBIOS enclosure type name, e.g. "Notebook".
+	ChassisType string             `json:"chassis_type,omitempty"`
+	NICs        []NetworkInterface `json:"nics,omitempty"`
+	Disks       []Disk             `json:"disks,omitempty"`
+	GPUs        []PCIDevice        `json:"gpus,omitempty"`
+	PCIDevices  []PCIDevice        `json:"pci_devices,omitempty"`
+}
+
+// NetworkInterface is a physical network adapter.
+type NetworkInterface struct {
+	Name string `json:"name"`
+	MAC  string `json:"mac"`
+}
+
+// Disk is a physical block device.
+type Disk struct {
+	Name      string `json:"name"`
+	Model     string `json:"model,omitempty"`
+	Serial    string `json:"serial,omitempty"`
+	SizeBytes uint64 `json:"size_bytes"`
+	Removable bool   `json:"removable,omitempty"`
+	// Transport is how the disk is attached: nvme, sata, mmc, virtio, usb or
+	// scsi.
+	Transport string `json:"transport,omitempty"`
+}
+
+// PCIDevice identifies a PCI function by its hex vendor, device and class IDs.
+type PCIDevice struct {
+	Address string `json:"address"`
+	Vendor  string `json:"vendor"`
+	Device  string `json:"device"`
+	Class   string `json:"class"`
+	Driver  string `json:"driver,omitempty"`
+}
+
+// HardwareChange is a hardware fingerprint field that differs from the value
+// recorded at enrollment.
+type HardwareChange struct {
+	Previous string `json:"previous"`
+	Current  string `json:"current"`
+}
+
+// Responses to a hardware change.
+const (
+	HardwareOnChangeAlert    = "alert"
+	HardwareOnChangeBlock    = "block"
+	HardwareOnChangeReenroll = "reenroll"
+)
+
+// HardwarePolicy decides how the agent reacts when the hardware no longer
+// matches the fingerprint recorded at enrollment.
+type HardwarePolicy struct {
+	// OnChange is alert (the default), block or reenroll.
+	OnChange string `json:"on_change"`
+}
+
+// Action returns the effective OnChange response.
+func (p *HardwarePolicy) Action() string {
+	if p == nil || p.OnChange == "" {
+		return HardwareOnChangeAlert
+	}
+	return p.OnChange
+}
@@ -0,0 +1,129 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// tokenExpiryLeeway refreshes access tokens slightly before they expire so
+// in-flight requests do not race the deadline.
+const tokenExpiryLeeway = 30 * time.Second
+
+// defaultAccessTokenLifetime applies when a token response gives no
+// expires_in.
+const defaultAccessTokenLifetime = 15 * time.Minute
+
+// TokenSource supplies bearer tokens for authenticated device calls.
+type TokenSource interface {
+	// Token returns a valid access token, refreshing it if necessary.
+	Token(ctx context.Context) (string, error)
+	// Invalidate discards the cached access token after the backend rejected it.
+	Invalidate()
+}
+
+// RefreshTokenRequest exchanges a refresh credential for an access token.
+type RefreshTokenRequest struct {
+	DeviceID     string `json:"device_id"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// RefreshTokenResponse carries a short-lived access token. RefreshToken is set
+// when the backend rotated the refresh credential.
+type RefreshTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+}
+
+// RefreshToken exchanges a refresh credential for a short-lived access token.
+func (c *Client) RefreshToken(ctx context.Context, req RefreshTokenRequest) (RefreshTokenResponse, error) {
+	var resp RefreshTokenResponse
+	url := c.buildURL("api", "v1", "devices", "token")
+	if err := c.doJSON(ctx, http.MethodPost, url, req, &resp, nil); err != nil {
+		return RefreshTokenResponse{}, err
+	}
+	if resp.AccessToken == "" {
+		return RefreshTokenResponse{}, errors.New("token response missing access token")
+	}
+	return resp, nil
+}
+
+// RefreshTokenSource caches short-lived access tokens obtained with a refresh
+// credential and renews them on expiry or after Invalidate.
+type RefreshTokenSource struct {
+	client   *Client
+	deviceID string
+	onRotate func(refreshToken string) error
+	now      func() time.Time
+
+	mu      sync.Mutex
+	refresh string
+	access  string
+	expiry  time.Time
+	// unsaved is set while onRotate has not accepted the current refresh
+	// credential.
+	unsaved bool
+}
+
+// NewRefreshTokenSource constructs a token source for the device. onRotate,
+// when non-nil, is called with every new refresh credential so it can be
+// persisted before the old one stops working. A failing onRotate does not fail
+// the request, since the backend has already rotated the credential; it is
+// called again on the next Token call.
+func NewRefreshTokenSource(client *Client, deviceID, refreshToken string, onRotate func(string) error) *RefreshTokenSource {
+	return &RefreshTokenSource{
+		client:   client,
+		deviceID: deviceID,
+		onRotate: onRotate,
+		now:      time.Now,
+		refresh:  refreshToken,
+	}
+}
+
+// Token implements TokenSource.
+func (s *RefreshTokenSource) Token(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer s.saveRefresh()
+	if s.access != "" && s.now().Before(s.expiry.Add(-tokenExpiryLeeway)) {
+		return s.access, nil
+	}
+	resp, err := s.client.RefreshToken(ctx, RefreshTokenRequest{DeviceID: s.deviceID, RefreshToken: s.refresh})
+	if err != nil {
+		return "", fmt.Errorf("refresh access token: %w", err)
+	}
+	lifetime := time.Duration(resp.ExpiresIn) * time.Second
+	if lifetime <= 0 {
+		lifetime = defaultAccessTokenLifetime
+	}
+	s.access = resp.AccessToken
+	s.expiry = s.now().Add(lifetime)
+	if resp.RefreshToken != "" && resp.RefreshToken != s.refresh {
+		s.refresh = resp.RefreshToken
+		s.unsaved = true
+	}
+	return s.access, nil
+}
+
+// saveRefresh hands an unsaved refresh credential to onRotate. s.mu must be
+// held.
+func (s *RefreshTokenSource) saveRefresh() {
+	if !s.unsaved || s.onRotate == nil {
+		return
+	}
+	if err := s.onRotate(s.refresh); err == nil {
+		s.unsaved = false
+	}
+}
+
+// Invalidate implements TokenSource.
+func (s *RefreshTokenSource) Invalidate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.access = ""
+	s.expiry = time.Time{}
+}
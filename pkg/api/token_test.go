@@ -0,0 +1,139 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRefreshTokenSourceRefreshesOnExpiryAndRejection(t *testing.T) {
+	var (
+		mu        sync.Mutex
+		issued    int
+		valid     = map[string]bool{}
+		refreshed []string
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.URL.Path {
+		case "/api/v1/devices/token":
+			var req RefreshTokenRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				t.Errorf("decode token request: %v", err)
+			}
+			refreshed = append(refreshed, req.RefreshToken)
+			issued++
+			access := fmt.Sprintf("access-%d", issued)
+			valid[access] = true
+			_ = json.NewEncoder(w).Encode(RefreshTokenResponse{
+				AccessToken:  access,
+				ExpiresIn:    300,
+				RefreshToken: fmt.Sprintf("refresh-%d", issued),
+			})
+		case "/api/v1/devices/events":
+			token := r.Header.Get("Authorization")[len("Bearer "):]
+			if !valid[token] {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		}
+	}))
+	defer server.Close()
+
+	client, err := New(server.URL)
+	if err != nil {
+		t.Fatalf("new client: %v", err)
+	}
+	var rotated []string
+	source := NewRefreshTokenSource(client, "device-1", "refresh-0", func(refresh string) error {
+		rotated = append(rotated, refresh)
+		return nil
+	})
+	now := time.Now()
+	source.now = func() time.Time { return now }
+	client.SetTokenSource(source)
+
+	report := func() error {
+		return client.ReportEvents(context.Background(), "ignored", ReportEventsRequest{DeviceID: "device-1"})
+	}
+	if err := report(); err != nil {
+		t.Fatalf("first report: %v", err)
+	}
+	if err := report(); err != nil {
+		t.Fatalf("cached token report: %v", err)
+	}
+	if issued != 1 {
+		t.Fatalf("expected cached access token to be reused, got %d exchanges", issued)
+	}
+
+	now = now.Add(5 * time.Minute)
+	if err := report(); err != nil {
+		t.Fatalf("report after expiry: %v", err)
+	}
+	if issued != 2 {
+		t.Fatalf("expected refresh on expiry, got %d exchanges", issued)
+	}
+
+	mu.Lock()
+	valid = map[string]bool{}
+	mu.Unlock()
+	if err := report(); err != nil {
+		t.Fatalf("report after rejection: %v", err)
+	}
+	if issued != 3 {
+		t.Fatalf("expected refresh after 401, got %d exchanges", issued)
+	}
+
+	want := []string{"refresh-0", "refresh-1", "refresh-2"}
+	if fmt.Sprint(refreshed) != fmt.Sprint(want) {
+		t.Fatalf("expected rotated refresh tokens to be used, got %v", refreshed)
+	}
+	if len(rotated) != 3 || rotated[2] != "refresh-3" {
+		t.Fatalf("expected every rotation to be reported, got %v", rotated)
+	}
+}
+
+func TestRefreshTokenSourceKeepsTokensWhenPersistingFails(t *testing.T) {
+	var issued int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		issued++
+		// No expires_in: the default lifetime applies.
+		_ = json.NewEncoder(w).Encode(RefreshTokenResponse{AccessToken: "access", RefreshToken: "refresh-1"})
+	}))
+	defer server.Close()
+
+	client, err := New(server.URL)
+	if err != nil {
+		t.Fatalf("new client: %v", err)
+	}
+	var saved []string
+	fail := true
+	source := NewRefreshTokenSource(client, "device-1", "refresh-0", func(refresh string) error {
+		saved = append(saved, refresh)
+		if fail {
+			fail = false
+			return errors.New("disk full")
+		}
+		return nil
+	})
+	for i := 0; i < 3; i++ {
+		token, err := source.Token(context.Background())
+		if err != nil || token != "access" {
+			t.Fatalf("token %d: got %q (%v)", i, token, err)
+		}
+	}
+	if issued != 1 {
+		t.Fatalf("expected the access token to be cached, got %d exchanges", issued)
+	}
+	if fmt.Sprint(saved) != fmt.Sprint([]string{"refresh-1", "refresh-1"}) {
+		t.Fatalf("expected the failed save to be retried once, got %v", saved)
+	}
+}
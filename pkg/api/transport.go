@@ -0,0 +1,139 @@
+package api
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// TransportOptions hardens the connection to the backend.
+type TransportOptions struct {
+	// Proxy forces all requests through the given proxy. When nil the
+	// standard HTTPS_PROXY/NO_PROXY environment variables apply.
+	Proxy *url.URL
+	// Direct connects without any proxy, ignoring the environment.
+	Direct bool
+	// RootCAs verifies the backend instead of the system trust store when
+	// set; start from x509.SystemCertPool to extend the system roots.
+	RootCAs *x509.CertPool
+	// PinnedSPKI lists SHA-256 digests of acceptable backend public keys. Any
+	// certificate in a chain verified against the trust store may match.
+	PinnedSPKI [][]byte
+	// MinVersion is the lowest TLS version accepted. Defaults to TLS 1.2.
+	MinVersion uint16
+}
+
+// WithTransportOptions configures proxying, trust roots, key pinning and the
+// minimum TLS version for every backend call.
+func WithTransportOptions(opts TransportOptions) Option {
+	return func(client *Client) {
+		client.transportOpts = opts
+	}
+}
+
+func (c *Client) newTransport() *http.Transport {
+	opts := c.transportOpts
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	switch {
+	case opts.Direct:
+		transport.Proxy = nil
+	case opts.Proxy != nil:
+		transport.Proxy = http.ProxyURL(opts.Proxy)
+	}
+	minVersion := opts.MinVersion
+	if minVersion == 0 {
+		minVersion = tls.VersionTLS12
+	}
+	tlsConfig := &tls.Config{
+		GetClientCertificate: c.getClientCertificate,
+		RootCAs:              opts.RootCAs,
+		MinVersion:           minVersion,
+	}
+	if len(opts.PinnedSPKI) > 0 {
+		pins := opts.PinnedSPKI
+		tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+			return verifyPins(state.VerifiedChains, pins)
+		}
+	}
+	transport.TLSClientConfig = tlsConfig
+	return transport
+}
+
+// verifyPins checks the chains built during verification rather than the
+// certificates the server sent, which may include unrelated extras.
+func verifyPins(chains [][]*x509.Certificate, pins [][]byte) error {
+	for _, chain := range chains {
+		for _, cert := range chain {
+			digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			for _, pin := range pins {
+				if bytes.Equal(digest[:], pin) {
+					return nil
+				}
+			}
+		}
+	}
+	return errors.New("backend certificate does not match any pinned public key")
+}
+
+// ParseSPKIPin decodes a SHA-256 SPKI pin given as base64 (optionally prefixed
+// with "sha256/") or hex.
+func ParseSPKIPin(value string) ([]byte, error) {
+	trimmed := strings.TrimPrefix(strings.TrimSpace(value), "sha256/")
+	if decoded, err := base64.StdEncoding.DecodeString(trimmed); err == nil && len(decoded) == sha256.Size {
+		return decoded, nil
+	}
+	if decoded, err := hex.DecodeString(trimmed); err == nil && len(decoded) == sha256.Size {
+		return decoded, nil
+	}
+	return nil, fmt.Errorf("invalid sha256 pin %q", value)
+}
+
+var (
+	pacComment   = regexp.MustCompile(`(?s)/\*.*?\*/|//[^\n]*`)
+	pacReturn    = regexp.MustCompile(`\breturn\b`)
+	pacLiteral   = regexp.MustCompile(`\breturn\s*["']([^"']*)["']`)
+	pacCondition = regexp.MustCompile(`\b(if|else|switch)\b|\?`)
+	pacDirective = regexp.MustCompile(`(?i)^(PROXY|HTTPS)\s+([A-Za-z0-9.\-\[\]:]+)$`)
+)
+
+// StaticProxyFromPAC reads the proxy from a proxy auto-config script that
+// returns a single unconditional directive, such as
+// `return "PROXY proxy.example:3128";`. The script is not evaluated, so
+// scripts with conditions, several return statements or fallback lists are
+// rejected. A script returning DIRECT yields a nil URL, which callers must
+// treat as a direct connection rather than as no proxy configured.
+func StaticProxyFromPAC(script []byte) (*url.URL, error) {
+	if !bytes.Contains(script, []byte("FindProxyForURL")) {
+		return nil, errors.New("pac file does not define FindProxyForURL")
+	}
+	code := pacComment.ReplaceAll(script, nil)
+	literals := pacLiteral.FindAllSubmatch(code, -1)
+	if len(pacReturn.FindAll(code, -1)) != 1 || len(literals) != 1 {
+		return nil, errors.New("pac file must return exactly one static directive")
+	}
+	if pacCondition.Match(pacLiteral.ReplaceAll(code, nil)) {
+		return nil, errors.New("pac file must not contain conditions")
+	}
+	directive := strings.TrimSpace(string(literals[0][1]))
+	if strings.EqualFold(directive, "DIRECT") {
+		return nil, nil
+	}
+	match := pacDirective.FindStringSubmatch(directive)
+	if match == nil {
+		return nil, fmt.Errorf("unsupported pac directive %q", directive)
+	}
+	scheme := "http"
+	if strings.EqualFold(match[1], "HTTPS") {
+		scheme = "https"
+	}
+	return &url.URL{Scheme: scheme, Host: match[2]}, nil
+}
@@ -0,0 +1,180 @@
+package api
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTransportEnforcesSPKIPins(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	pool := x509.NewCertPool()
+	pool.AddCert(server.Certificate())
+	digest := sha256.Sum256(server.Certificate().RawSubjectPublicKeyInfo)
+
+	pin, err := ParseSPKIPin("sha256/" + base64.StdEncoding.EncodeToString(digest[:]))
+	if err != nil {
+		t.Fatalf("parse pin: %v", err)
+	}
+	client, err := New(server.URL, WithTransportOptions(TransportOptions{RootCAs: pool, PinnedSPKI: [][]byte{pin}}))
+	if err != nil {
+		t.Fatalf("new client: %v", err)
+	}
+	if err := client.ReportEvents(context.Background(), "token", ReportEventsRequest{}); err != nil {
+		t.Fatalf("expected pinned request to succeed: %v", err)
+	}
+
+	wrong := sha256.Sum256([]byte("other key"))
+	client, err = New(server.URL, WithTransportOptions(TransportOptions{RootCAs: pool, PinnedSPKI: [][]byte{wrong[:]}}))
+	if err != nil {
+		t.Fatalf("new client: %v", err)
+	}
+	if err := client.ReportEvents(context.Background(), "token", ReportEventsRequest{}); err == nil {
+		t.Fatalf("expected pin mismatch to fail")
+	}
+}
+
+func TestTransportPinsIgnoreUnverifiedCertificates(t *testing.T) {
+	caKey, caCert := newTestCertificate(t, "Trusted CA", nil, nil)
+	leafKey, leafCert := newTestCertificate(t, "backend", caCert, caKey)
+	_, pinned := newTestCertificate(t, "Pinned backend", nil, nil)
+
+	// The server chain carries the publicly known pinned certificate, which
+	// plays no part in verifying the leaf.
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{{
+		Certificate: [][]byte{leafCert.Raw, pinned.Raw},
+		PrivateKey:  leafKey,
+	}}}
+	server.StartTLS()
+	defer server.Close()
+	pool := x509.NewCertPool()
+	pool.AddCert(caCert)
+	digest := sha256.Sum256(pinned.RawSubjectPublicKeyInfo)
+
+	client, err := New(server.URL, WithTransportOptions(TransportOptions{RootCAs: pool, PinnedSPKI: [][]byte{digest[:]}}))
+	if err != nil {
+		t.Fatalf("new client: %v", err)
+	}
+	if err := client.ReportEvents(context.Background(), "token", ReportEventsRequest{}); err == nil {
+		t.Fatalf("expected a pin outside the verified chain to be rejected")
+	}
+}
+
+// newTestCertificate issues a certificate for 127.0.0.1 signed by parent, or
+// a self-signed CA when parent is nil.
+func newTestCertificate(t *testing.T, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*ecdsa.PrivateKey, *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+		parent, parentKey = template, key
+	} else {
+		template.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		template.KeyUsage = x509.KeyUsageDigitalSignature
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parse certificate: %v", err)
+	}
+	return key, cert
+}
+
+func TestTransportMinimumTLSVersion(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	server.TLS = &tls.Config{MaxVersion: tls.VersionTLS12}
+	server.StartTLS()
+	defer server.Close()
+	pool := x509.NewCertPool()
+	pool.AddCert(server.Certificate())
+
+	client, err := New(server.URL, WithTransportOptions(TransportOptions{RootCAs: pool, MinVersion: tls.VersionTLS13}))
+	if err != nil {
+		t.Fatalf("new client: %v", err)
+	}
+	if err := client.ReportEvents(context.Background(), "token", ReportEventsRequest{}); err == nil {
+		t.Fatalf("expected TLS 1.2 server to be rejected")
+	}
+}
+
+func TestTransportDirectIgnoresProxyEnvironment(t *testing.T) {
+	t.Setenv("HTTPS_PROXY", "http://proxy.school.example:3128")
+	for _, opts := range []TransportOptions{{}, {Direct: true}} {
+		client, err := New("https://backend.example", WithTransportOptions(opts))
+		if err != nil {
+			t.Fatalf("new client: %v", err)
+		}
+		transport := client.newTransport()
+		if got := transport.Proxy != nil; got == opts.Direct {
+			t.Fatalf("direct=%t: unexpected proxy function set=%t", opts.Direct, got)
+		}
+	}
+}
+
+func TestStaticProxyFromPAC(t *testing.T) {
+	script := []byte(`// use an HTTPS proxy only off-site
+	function FindProxyForURL(url, host) {
+		/* every request goes through the school proxy */
+		return "PROXY proxy.school.example:3128";
+	}`)
+	proxy, err := StaticProxyFromPAC(script)
+	if err != nil {
+		t.Fatalf("parse pac: %v", err)
+	}
+	if proxy == nil || proxy.String() != "http://proxy.school.example:3128" {
+		t.Fatalf("unexpected proxy %v", proxy)
+	}
+	direct, err := StaticProxyFromPAC([]byte(`function FindProxyForURL(url, host) { return "DIRECT"; }`))
+	if err != nil || direct != nil {
+		t.Fatalf("expected direct connection, got %v (%v)", direct, err)
+	}
+	for _, script := range []string{
+		"not a pac file",
+		`function FindProxyForURL(url, host) {
+			if (isPlainHostName(host)) { return "DIRECT"; }
+			return "PROXY proxy.school.example:3128";
+		}`,
+		`function FindProxyForURL(url, host) { return isInNet(host, "10.0.0.0", "255.0.0.0") ? "DIRECT" : "PROXY p:3128"; }`,
+		`function FindProxyForURL(url, host) { return "PROXY a:3128; PROXY b:3128"; }`,
+		`function FindProxyForURL(url, host) { return "SOCKS socks.example:1080"; }`,
+	} {
+		if _, err := StaticProxyFromPAC([]byte(script)); err == nil {
+			t.Fatalf("expected %q to be rejected", script)
+		}
+	}
+}